@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"net/http"
 	"net/http/httptest"
@@ -455,3 +456,144 @@ func TestConfigurationValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestPricingRules_LongContextBoundary(t *testing.T) {
+	resetGlobalState()
+	modelPricing["long-ctx"] = ModelPricing{
+		Model:  "long-ctx",
+		Input:  1.0,
+		Output: 4.0,
+		Rules: []PricingRule{
+			{MinPromptTokens: 200000, Input: 2.0, Output: 8.0},
+		},
+	}
+
+	tests := []struct {
+		name         string
+		promptTokens int
+		expectedCost float64
+	}{
+		{"Below threshold", 199999, 199999*1.0/1000000 + 1000*4.0/1000000},
+		{"At threshold", 200000, 200000*2.0/1000000 + 1000*8.0/1000000},
+		{"Above threshold", 200001, 200001*2.0/1000000 + 1000*8.0/1000000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cost := calculateCost(tt.promptTokens, 1000, "long-ctx")
+			if math.Abs(cost-tt.expectedCost) > 1e-9 {
+				t.Errorf("Expected cost %f, got %f", tt.expectedCost, cost)
+			}
+		})
+	}
+}
+
+func TestPricingRules_ServiceTiers(t *testing.T) {
+	resetGlobalState()
+	modelPricing["tiered"] = ModelPricing{
+		Model:  "tiered",
+		Input:  2.0,
+		Output: 8.0,
+		Rules: []PricingRule{
+			{ServiceTier: "batch", Input: 1.0, Output: 4.0},
+			{ServiceTier: "priority", Input: 3.5, Output: 14.0},
+			{MinPromptTokens: 1000, Input: 4.0, Output: 16.0},
+			{ServiceTier: "priority", MinPromptTokens: 1000, Input: 7.0, Output: 28.0},
+		},
+	}
+
+	tests := []struct {
+		tier          string
+		promptTokens  int
+		expectedInput float64
+	}{
+		{"", 999, 2.0},
+		{"auto", 999, 2.0},
+		{"default", 999, 2.0},
+		{"batch", 999, 1.0},
+		{"BATCH", 999, 1.0},
+		{"flex", 999, 2.0},      // No rule for this tier
+		{"", 1000, 4.0},         // Long-context rule
+		{"batch", 1000, 1.0},    // Tier rule wins over tier-less threshold rule
+		{"priority", 999, 3.5},  // Threshold not reached
+		{"priority", 1000, 7.0}, // Tier and threshold both match
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s_%d", tt.tier, tt.promptTokens), func(t *testing.T) {
+			cost := calculateCostForTier(tt.promptTokens, 0, "tiered", tt.tier)
+			expected := float64(tt.promptTokens) * tt.expectedInput / 1000000
+			if math.Abs(cost-expected) > 1e-9 {
+				t.Errorf("Expected cost %f, got %f", expected, cost)
+			}
+		})
+	}
+}
+
+func TestLoadModelPricing_RuleColumns(t *testing.T) {
+	filename := "test_pricing_rules.csv"
+	defer os.Remove(filename)
+
+	content := `model,version,input,cached_input,output,service_tier,min_prompt_tokens
+gpt-4o,gpt-4o-2024-08-06,2.5,1.25,10.0,,
+gpt-4o,gpt-4o-2024-08-06,1.25,,5.0,batch,
+gpt-4o,gpt-4o-2024-08-06,5.0,2.5,20.0,,128000
+gpt-4o,gpt-4o-2024-08-06,9.0,,9.0,,invalid
+`
+	if err := createTestCSV(filename, content); err != nil {
+		t.Fatalf("Failed to create test CSV: %v", err)
+	}
+
+	modelPricing = make(map[string]ModelPricing)
+	if err := loadModelPricing(filename); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(modelPricing) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(modelPricing))
+	}
+
+	pricing := modelPricing["gpt-4o"]
+	if pricing.Input != 2.5 || pricing.Output != 10.0 {
+		t.Errorf("Unexpected base rates: %+v", pricing)
+	}
+	if len(pricing.Rules) != 2 {
+		t.Fatalf("Expected 2 rules (invalid threshold skipped), got %d", len(pricing.Rules))
+	}
+	if pricing.Rules[0].ServiceTier != "batch" || pricing.Rules[1].MinPromptTokens != 128000 {
+		t.Errorf("Unexpected rules: %+v", pricing.Rules)
+	}
+	if len(modelPricing["gpt-4o-2024-08-06"].Rules) != 2 {
+		t.Error("Version entry should carry the same rules")
+	}
+}
+
+func TestLoadModelPricing_FileBeforeEmbedded(t *testing.T) {
+	filename := "test_pricing_override.csv"
+	defer os.Remove(filename)
+
+	content := `model,version,input,cached_input,output
+gpt-4o,gpt-4o-2024-08-06,1.0,,2.0
+`
+	if err := createTestCSV(filename, content); err != nil {
+		t.Fatalf("Failed to create test CSV: %v", err)
+	}
+
+	// The pricing file replaces the embedded copy
+	modelPricing = make(map[string]ModelPricing)
+	if err := loadModelPricing(filename); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(modelPricing) != 2 || modelPricing["gpt-4o"].Input != 1.0 {
+		t.Errorf("Expected the file's pricing only, got %d models: %+v", len(modelPricing), modelPricing["gpt-4o"])
+	}
+
+	// The embedded copy is used when the file cannot be opened
+	modelPricing = make(map[string]ModelPricing)
+	if err := loadModelPricing("does_not_exist.csv"); err != nil {
+		t.Fatalf("Expected the embedded pricing, got %v", err)
+	}
+	if len(modelPricing) <= 2 {
+		t.Errorf("Expected the embedded pricing, got %d models", len(modelPricing))
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminToken protects the /admin API, which is disabled while it is empty.
+var adminToken string
+
+// AuditEntry records one change made through the admin API.
+type AuditEntry struct {
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	Target  string                 `json:"target,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Remote  string                 `json:"remote,omitempty"`
+}
+
+// AuditTrail is an append-only JSON Lines file of admin actions.
+type AuditTrail struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var auditTrail *AuditTrail
+
+func openAuditTrail(path string) (*AuditTrail, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit trail: %w", err)
+	}
+	return &AuditTrail{file: file}, nil
+}
+
+func (a *AuditTrail) Append(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.file.Write(append(data, '\n'))
+	return err
+}
+
+func (a *AuditTrail) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// audit logs an admin action and appends it to the audit trail, if one is configured.
+func audit(c *gin.Context, action, target string, details map[string]interface{}) {
+	log.Printf("Admin: %s %s %v (from %s)", action, target, details, c.ClientIP())
+	if auditTrail == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:    time.Now().UTC(),
+		Action:  action,
+		Target:  target,
+		Details: details,
+		Remote:  c.ClientIP(),
+	}
+	if err := auditTrail.Append(entry); err != nil {
+		log.Printf("Warning: cannot write audit entry: %v", err)
+	}
+}
+
+// adminAuth requires the configured admin token as bearer token.
+func adminAuth(c *gin.Context) {
+	if adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{
+			Error: "Admin API is disabled. Set admin_token to enable it.",
+		})
+		return
+	}
+	token, ok := bearerToken(c)
+	if !ok {
+		c.Abort()
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		log.Printf("Admin request rejected: invalid token (from %s)", c.ClientIP())
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{
+			Error: "Invalid admin token.",
+		})
+		return
+	}
+	c.Next()
+}
+
+// registerAdminRoutes mounts the admin API under /admin.
+func registerAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/admin", adminAuth)
+	{
+		admin.GET("/budget", adminGetBudget)
+		admin.PUT("/budget", adminSetBudget)
+		admin.POST("/budget/reset", adminResetBudget)
+		admin.GET("/reservations", adminListReservations)
+		admin.GET("/budgets", adminGetBudgetTree)
+		admin.PUT("/budgets/*path", adminSetNodeBudget)
+		admin.POST("/budgets/*path", adminResetNodeBudget)
+		admin.GET("/keys", adminListKeys)
+		admin.PUT("/keys/:id/budget", adminSetKeyBudget)
+		admin.POST("/keys/:id/topup", adminTopUpKey)
+		admin.POST("/keys/:id/reset", adminResetKey)
+		admin.POST("/keys/:id/freeze", adminFreezeKey)
+		admin.POST("/keys/:id/unfreeze", adminUnfreezeKey)
+		admin.PUT("/keys/:id/moderation", adminSetKeyModeration)
+		admin.PUT("/keys/:id/rate-limit", adminSetKeyRateLimit)
+		admin.PUT("/keys/:id/concurrency", adminSetKeyConcurrency)
+		admin.PUT("/keys/:id/priority", adminSetKeyPriority)
+		admin.PUT("/keys/:id/project", adminSetKeyProject)
+		admin.PUT("/keys/:id/models", adminSetKeyModels)
+		admin.GET("/queue", adminGetQueue)
+		admin.GET("/cache", adminGetCache)
+		admin.DELETE("/cache", adminPurgeCache)
+	}
+}
+
+// budgetStatus describes the global quota. Must hold mu.
+func budgetStatus() gin.H {
+	return gin.H{
+		"limit_usd":       costLimitUSD,
+		"spent_usd":       totalCost,
+		"reserved_usd":    reservedCost,
+		"remaining_usd":   costLimitUSD - totalCost - reservedCost,
+		"batch_limit_usd": batchCostLimit(),
+		"model_caps":      modelCapStatus(time.Now()),
+		"tag_budgets":     tagBudgetStatus(),
+		"reservations":    len(reservations),
+	}
+}
+
+func adminGetBudget(c *gin.Context) {
+	mu.Lock()
+	defer mu.Unlock()
+	c.JSON(http.StatusOK, budgetStatus())
+}
+
+// bindAmount reads a JSON body with a single USD amount field. On failure the
+// 400 response has already been written.
+func bindAmount(c *gin.Context, field string) (float64, bool) {
+	var body map[string]*float64
+	if err := c.ShouldBindJSON(&body); err != nil || body[field] == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Expected JSON body with numeric field %q.", field),
+		})
+		return 0, false
+	}
+	amount := *body[field]
+	if math.IsNaN(amount) || math.IsInf(amount, 0) || amount < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Field %q must be a non-negative amount in USD.", field),
+		})
+		return 0, false
+	}
+	return amount, true
+}
+
+func adminSetBudget(c *gin.Context) {
+	limit, ok := bindAmount(c, "limit_usd")
+	if !ok {
+		return
+	}
+
+	mu.Lock()
+	previous := costLimitUSD
+	costLimitUSD = limit
+	status := budgetStatus()
+	mu.Unlock()
+
+	audit(c, "budget.set", "global", map[string]interface{}{"previous_usd": previous, "limit_usd": limit})
+	c.JSON(http.StatusOK, status)
+}
+
+func adminResetBudget(c *gin.Context) {
+	mu.Lock()
+	previous := totalCost
+	totalCost = 0
+	startBudgetPeriod("global", time.Now())
+	status := budgetStatus()
+	mu.Unlock()
+
+	audit(c, "budget.reset", "global", map[string]interface{}{"previous_spent_usd": previous})
+	c.JSON(http.StatusOK, status)
+}
+
+// adminGetBudgetTree shows the budget tree with each key under its project.
+func adminGetBudgetTree(c *gin.Context) {
+	var keys []ProxyKey
+	if keyStore != nil {
+		var err error
+		if keys, err = keyStore.List(); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.JSON(http.StatusOK, budgetTree(keys))
+}
+
+// adminSetNodeBudget sets the budget of a team or project from
+// {"budget_usd": n}; 0 removes it.
+func adminSetNodeBudget(c *gin.Context) {
+	path, err := normalizeBudgetPath(c.Param("path"))
+	if err == nil && path == "" {
+		err = errors.New("the organisation's budget is set with PUT /admin/budget")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	budget, ok := bindAmount(c, "budget_usd")
+	if !ok {
+		return
+	}
+
+	mu.Lock()
+	previous := nodeBudgets[path]
+	if budget > 0 {
+		nodeBudgets[path] = budget
+	} else {
+		delete(nodeBudgets, path)
+	}
+	node := &BudgetNode{Name: path[strings.LastIndex(path, "/")+1:], Path: path, BudgetUSD: budget, SpentUSD: nodeSpend[path], ReservedUSD: nodeReservedCost(path)}
+	mu.Unlock()
+
+	audit(c, "budget.node", path, map[string]interface{}{"previous_usd": previous, "budget_usd": budget})
+	c.JSON(http.StatusOK, node)
+}
+
+// adminResetNodeBudget resets the spend of a team or project to zero, on
+// POST /admin/budgets/{path}/reset. The nodes above and below it keep theirs.
+func adminResetNodeBudget(c *gin.Context) {
+	nodePath, found := strings.CutSuffix(c.Param("path"), "/reset")
+	if !found {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Not found."})
+		return
+	}
+	path, err := normalizeBudgetPath(nodePath)
+	if err == nil && path == "" {
+		err = errors.New("the organisation's spend is reset with POST /admin/budget/reset")
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	mu.Lock()
+	previous := nodeSpend[path]
+	delete(nodeSpend, path)
+	node := &BudgetNode{Name: path[strings.LastIndex(path, "/")+1:], Path: path, BudgetUSD: nodeBudgets[path], ReservedUSD: nodeReservedCost(path)}
+	mu.Unlock()
+
+	// Persist the reset so that restarting does not restore the old spend
+	recordUsage(LedgerEntry{Time: now, Type: ledgerEntryReset, Project: path})
+	audit(c, "budget.node.reset", path, map[string]interface{}{"previous_spent_usd": previous})
+	c.JSON(http.StatusOK, node)
+}
+
+func adminListReservations(c *gin.Context) {
+	mu.Lock()
+	defer mu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"reservations": listReservations()})
+}
+
+// keyStatus describes a key with its current spend. Must hold mu.
+func keyStatus(k ProxyKey) gin.H {
+	return gin.H{
+		"id":           k.ID,
+		"name":         k.Name,
+		"prefix":       k.Prefix,
+		"budget_usd":   k.BudgetUSD,
+		"spent_usd":    keySpend[k.ID],
+		"reserved_usd": keyReservedCost(k.ID),
+		"created_at":   k.CreatedAt,
+		"revoked_at":   k.RevokedAt,
+		"frozen_at":    k.FrozenAt,
+		"moderation":   moderationRequired(&k),
+		"rate_limit":   k.RateLimit,
+		"concurrency":  clientConcurrency(&k),
+		"priority":     keyPriority(&k),
+		"project":      k.Project,
+		"models":       k.Models,
+	}
+}
+
+// requireKeyStore rejects key management requests when proxy keys are disabled.
+func requireKeyStore(c *gin.Context) bool {
+	if keyStore == nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Error: "Proxy keys are not enabled. Set keys_file to enable them.",
+		})
+		return false
+	}
+	return true
+}
+
+func adminListKeys(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	keys, err := keyStore.List()
+	if err != nil {
+		log.Printf("Admin: cannot list keys: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Cannot read keys file."})
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]gin.H, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, keyStatus(k))
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": list})
+}
+
+// respondKey writes the outcome of a key store change and audits it on success.
+func respondKey(c *gin.Context, action string, key ProxyKey, err error, details map[string]interface{}) {
+	if errors.Is(err, errKeyNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	audit(c, action, key.ID, details)
+	mu.Lock()
+	defer mu.Unlock()
+	c.JSON(http.StatusOK, keyStatus(key))
+}
+
+func adminSetKeyBudget(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	budget, ok := bindAmount(c, "budget_usd")
+	if !ok {
+		return
+	}
+	key, err := keyStore.SetBudget(c.Param("id"), budget)
+	respondKey(c, "key.budget", key, err, map[string]interface{}{"budget_usd": budget})
+}
+
+func adminTopUpKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	amount, ok := bindAmount(c, "amount_usd")
+	if !ok {
+		return
+	}
+	key, err := keyStore.TopUp(c.Param("id"), amount)
+	respondKey(c, "key.topup", key, err, map[string]interface{}{"amount_usd": amount, "budget_usd": key.BudgetUSD})
+}
+
+func adminResetKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	key, err := keyStore.Get(c.Param("id"))
+	if err != nil {
+		respondKey(c, "key.reset", key, err, nil)
+		return
+	}
+
+	now := time.Now().UTC()
+	mu.Lock()
+	previous := keySpend[key.ID]
+	keySpend[key.ID] = 0
+	startBudgetPeriod("key:"+key.ID, now)
+	mu.Unlock()
+
+	// Persist the reset so that restarting does not restore the old spend
+	recordUsage(LedgerEntry{Time: now, Type: ledgerEntryReset, KeyID: key.ID})
+	respondKey(c, "key.reset", key, nil, map[string]interface{}{"previous_spent_usd": previous})
+}
+
+func adminFreezeKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	key, err := keyStore.Freeze(c.Param("id"))
+	respondKey(c, "key.freeze", key, err, nil)
+}
+
+func adminUnfreezeKey(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	key, err := keyStore.Unfreeze(c.Param("id"))
+	respondKey(c, "key.unfreeze", key, err, nil)
+}
+
+// adminSetKeyModeration sets the moderation policy of a key from
+// {"moderation": true|false}; null makes the key follow the moderation setting.
+func adminSetKeyModeration(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	var body map[string]json.RawMessage
+	var moderation *bool
+	err := c.ShouldBindJSON(&body)
+	if err == nil {
+		raw, found := body["moderation"]
+		if !found {
+			err = errors.New("missing field")
+		} else {
+			err = json.Unmarshal(raw, &moderation)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: `Expected JSON body with field "moderation": true, false or null.`,
+		})
+		return
+	}
+	key, err := keyStore.SetModeration(c.Param("id"), moderation)
+	respondKey(c, "key.moderation", key, err, map[string]interface{}{"moderation": moderation})
+}
+
+// adminSetKeyRateLimit sets the limits of a key from {"rpm": n, "tpm": n};
+// a missing or zero field removes that limit.
+func adminSetKeyRateLimit(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	var limit RateLimit
+	if err := c.ShouldBindJSON(&limit); err != nil || limit.RPM < 0 || limit.TPM < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: `Expected JSON body with non-negative integer fields "rpm" and "tpm".`,
+		})
+		return
+	}
+	key, err := keyStore.SetRateLimit(c.Param("id"), limit)
+	respondKey(c, "key.rate_limit", key, err, map[string]interface{}{"rpm": limit.RPM, "tpm": limit.TPM})
+}
+
+// adminSetKeyConcurrency sets how many requests of a key may be in flight from
+// {"max_concurrent": n}; 0 follows the key_max_concurrent setting.
+func adminSetKeyConcurrency(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	var body struct {
+		MaxConcurrent *int `json:"max_concurrent"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.MaxConcurrent == nil || *body.MaxConcurrent < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: `Expected JSON body with non-negative integer field "max_concurrent".`,
+		})
+		return
+	}
+	key, err := keyStore.SetMaxConcurrent(c.Param("id"), *body.MaxConcurrent)
+	respondKey(c, "key.concurrency", key, err, map[string]interface{}{"max_concurrent": *body.MaxConcurrent})
+}
+
+// adminSetKeyProject moves a key in the budget tree from
+// {"project": "team/project"}; "" charges it to the organisation only.
+func adminSetKeyProject(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	var body struct {
+		Project *string `json:"project"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Project == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: `Expected JSON body with string field "project".`,
+		})
+		return
+	}
+	key, err := keyStore.SetProject(c.Param("id"), *body.Project)
+	respondKey(c, "key.project", key, err, map[string]interface{}{"project": key.Project})
+}
+
+// adminSetKeyModels sets the model patterns a key may use from
+// {"models": ["gpt-4o-mini*"]}; an empty list or null allows every model.
+func adminSetKeyModels(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	var body map[string]json.RawMessage
+	var models []string
+	err := c.ShouldBindJSON(&body)
+	if err == nil {
+		raw, found := body["models"]
+		if !found {
+			err = errors.New("missing field")
+		} else {
+			err = json.Unmarshal(raw, &models)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: `Expected JSON body with field "models": a list of model patterns or null.`,
+		})
+		return
+	}
+	key, err := keyStore.SetModels(c.Param("id"), models)
+	respondKey(c, "key.models", key, err, map[string]interface{}{"models": models})
+}
+
+// adminSetKeyPriority sets the lane of a key's requests from
+// {"priority": "interactive"|"batch"}; null makes them interactive.
+func adminSetKeyPriority(c *gin.Context) {
+	if !requireKeyStore(c) {
+		return
+	}
+	var body map[string]json.RawMessage
+	var priority *string
+	err := c.ShouldBindJSON(&body)
+	if err == nil {
+		raw, found := body["priority"]
+		if !found {
+			err = errors.New("missing field")
+		} else if err = json.Unmarshal(raw, &priority); err == nil && priority != nil && !validPriority(*priority) {
+			err = errors.New("unknown priority")
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: `Expected JSON body with field "priority": "interactive", "batch" or null.`,
+		})
+		return
+	}
+	value := ""
+	if priority != nil {
+		value = *priority
+	}
+	key, err := keyStore.SetPriority(c.Param("id"), value)
+	respondKey(c, "key.priority", key, err, map[string]interface{}{"priority": priority})
+}
+
+func adminGetQueue(c *gin.Context) {
+	mu.Lock()
+	defer mu.Unlock()
+	c.JSON(http.StatusOK, queueStatus())
+}
+
+func adminGetCache(c *gin.Context) {
+	if responseCache == nil {
+		c.JSON(http.StatusOK, gin.H{"backend": "off"})
+		return
+	}
+	c.JSON(http.StatusOK, responseCache.Status())
+}
+
+func adminPurgeCache(c *gin.Context) {
+	if responseCache == nil {
+		c.JSON(http.StatusOK, gin.H{"purged": 0})
+		return
+	}
+	purged := responseCache.Purge()
+	audit(c, "cache.purge", "cache", map[string]interface{}{"purged": purged})
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupTestAdmin(t *testing.T) {
+	t.Helper()
+	adminToken = "admin-secret"
+	t.Cleanup(func() {
+		adminToken = ""
+		auditTrail = nil
+	})
+}
+
+func adminRequest(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	resetGlobalState()
+	router := setupTestRouter()
+
+	// Disabled without a token
+	w := adminRequest(router, "GET", "/admin/budget", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 with admin API disabled, got %d", w.Code)
+	}
+
+	setupTestAdmin(t)
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/budget", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for wrong token, got %d", w.Code)
+	}
+
+	w = adminRequest(router, "GET", "/admin/budget", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminGlobalBudget(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	trail, err := openAuditTrail(auditFile)
+	if err != nil {
+		t.Fatalf("Failed to open audit trail: %v", err)
+	}
+	defer trail.Close()
+	auditTrail = trail
+	router := setupTestRouter()
+
+	totalCost = 1.5
+
+	w := adminRequest(router, "PUT", "/admin/budget", `{"limit_usd": 5}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if costLimitUSD != 5 {
+		t.Errorf("Expected limit 5, got %f", costLimitUSD)
+	}
+
+	w = adminRequest(router, "PUT", "/admin/budget", `{"limit_usd": -1}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for negative limit, got %d", w.Code)
+	}
+	w = adminRequest(router, "PUT", "/admin/budget", `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for missing limit, got %d", w.Code)
+	}
+
+	w = adminRequest(router, "POST", "/admin/budget/reset", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var status map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if totalCost != 0 || status["remaining_usd"] != 5.0 {
+		t.Errorf("Expected reset spend, got total=%f status=%v", totalCost, status)
+	}
+
+	data, _ := os.ReadFile(auditFile)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"budget.set"`) || !strings.Contains(lines[1], `"previous_spent_usd":1.5`) {
+		t.Errorf("Unexpected audit trail:\n%s", data)
+	}
+}
+
+func TestAdminKeyManagement(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	mockOpenAI(t, ChatResponse{Model: "gpt-4o", Usage: Usage{PromptTokens: 10, CompletionTokens: 5}})
+
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	ledger = l
+	defer func() {
+		ledger = nil
+		l.Close()
+	}()
+	router := setupTestRouter()
+
+	secret, key, _ := store.Create("alice", 1.0)
+	keySpend[key.ID] = 0.75
+
+	w := adminRequest(router, "POST", "/admin/keys/"+key.ID+"/topup", `{"amount_usd": 0.5}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if k, _ := store.Get(key.ID); k.BudgetUSD != 1.5 {
+		t.Errorf("Expected budget 1.5 after top-up, got %f", k.BudgetUSD)
+	}
+
+	w = adminRequest(router, "PUT", "/admin/keys/alice/budget", `{"budget_usd": 3}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var status map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status["budget_usd"] != 3.0 || status["spent_usd"] != 0.75 {
+		t.Errorf("Unexpected key status: %v", status)
+	}
+
+	w = adminRequest(router, "POST", "/admin/keys/key_missing/freeze", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown key, got %d", w.Code)
+	}
+
+	// Frozen keys are rejected until unfrozen
+	if w = adminRequest(router, "POST", "/admin/keys/"+key.ID+"/freeze", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = postChat(router, secret); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for frozen key, got %d", w.Code)
+	}
+	if w = adminRequest(router, "POST", "/admin/keys/"+key.ID+"/freeze", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 when freezing twice, got %d", w.Code)
+	}
+	if w = adminRequest(router, "POST", "/admin/keys/"+key.ID+"/unfreeze", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if w = postChat(router, secret); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 after unfreeze, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A reset is persisted in the ledger
+	if w = adminRequest(router, "POST", "/admin/keys/"+key.ID+"/reset", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if keySpend[key.ID] != 0 {
+		t.Errorf("Expected key spend reset, got %f", keySpend[key.ID])
+	}
+	entries, _ := readLedger(ledgerFile)
+	keySpend = make(map[string]float64)
+	keySpend[key.ID] = 0.75
+	restoreKeySpend(entries)
+	if keySpend[key.ID] != 0 {
+		t.Errorf("Expected restored spend 0 after reset, got %f", keySpend[key.ID])
+	}
+
+	w = adminRequest(router, "GET", "/admin/keys", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"name":"alice"`) {
+		t.Errorf("Unexpected key list: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminReservations(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	router := setupTestRouter()
+
+	// A request in flight holds a reservation that the admin API reports
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		json.NewEncoder(w).Encode(ChatResponse{Model: "gpt-4o", Usage: Usage{PromptTokens: 10, CompletionTokens: 5}})
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() {
+		openAIBaseURL = previous
+		server.Close()
+	}()
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- postChat(router, "sk-test")
+	}()
+	<-started
+
+	w := adminRequest(router, "GET", "/admin/reservations", "")
+	var body struct {
+		Reservations []Reservation `json:"reservations"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if len(body.Reservations) != 1 || body.Reservations[0].Model != "gpt-4o" || body.Reservations[0].CostUSD <= 0 {
+		t.Errorf("Expected one reservation, got %s", w.Body.String())
+	}
+
+	close(release)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reservations) != 0 || reservedCost != 0 {
+		t.Errorf("Expected reservation to be settled, got %d reservations, $%f", len(reservations), reservedCost)
+	}
+}
+
+func TestAdminNoKeyStore(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	router := setupTestRouter()
+
+	w := adminRequest(router, "POST", "/admin/keys/key_x/topup", `{"amount_usd": 1}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 without key store, got %d", w.Code)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxAudioUpload limits the size of audio uploads held in memory.
+const maxAudioUpload = 32 << 20
+
+// fallbackAudioBytesPerSecond estimates the duration of files whose headers
+// cannot be read, assuming 128 kbit/s.
+const fallbackAudioBytesPerSecond = 16000
+
+// SpeechRequest holds the fields of a speech request the proxy needs to price
+// it. The request body is forwarded to OpenAI unchanged.
+type SpeechRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+// AudioUsage is reported by transcription models, either as seconds of audio
+// or as tokens.
+type AudioUsage struct {
+	Type         string  `json:"type"`
+	Seconds      float64 `json:"seconds"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+}
+
+func audioTranscriptionsProxy(c *gin.Context) {
+	proxyAudioUpload(c, "/v1/audio/transcriptions")
+}
+
+func audioTranslationsProxy(c *gin.Context) {
+	proxyAudioUpload(c, "/v1/audio/translations")
+}
+
+// proxyAudioUpload forwards a multipart audio upload unchanged, pricing it by
+// the duration read from the file headers and settling with the usage
+// reported by OpenAI. Models without a per-second price are rejected rather
+// than let through uncharged.
+func proxyAudioUpload(c *gin.Context, path string) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxAudioUpload))
+	if err == nil {
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		err = c.Request.ParseMultipartForm(maxAudioUpload)
+	}
+	var audio []byte
+	if err == nil {
+		audio, err = readFormFile(c, "file")
+	}
+	model := c.PostForm("model")
+	if err != nil || model == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Expected multipart form with file and model.",
+		})
+		return
+	}
+
+	if !checkModel(c, proxyKey, model) {
+		return
+	}
+	pricing, _ := getPricingForModel(model)
+	if pricing.PerSecond == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("No audio price for model %s.", model),
+		})
+		return
+	}
+
+	seconds, format, err := audioDuration(audio)
+	if err != nil {
+		seconds = float64(len(audio)) / fallbackAudioBytesPerSecond
+		log.Printf("Cannot read audio duration (%v), estimating %.1fs from file size", err, seconds)
+	} else if logEnabled("debug") {
+		log.Printf("Audio upload: format=%s, duration=%.1fs", format, seconds)
+	}
+
+	reservation, ok := reserveRequest(c, proxyKey, model, 0, seconds*pricing.PerSecond)
+	if !ok {
+		return
+	}
+
+	respBody, contentType, err := sendOpenAI(path, c.GetHeader("Content-Type"), body, upstreamKey)
+	if err != nil {
+		failRequest(c, reservation, 0, err)
+		return
+	}
+
+	// JSON responses report the duration that was billed; text formats do not
+	var response map[string]json.RawMessage
+	isJSON := strings.HasPrefix(contentType, "application/json") && json.Unmarshal(respBody, &response) == nil
+	var usage AudioUsage
+	if isJSON {
+		json.Unmarshal(response["usage"], &usage)
+		var duration float64
+		if usage.Type == "duration" && usage.Seconds > 0 {
+			seconds = usage.Seconds
+		} else if json.Unmarshal(response["duration"], &duration) == nil && duration > 0 {
+			seconds = duration
+		}
+	}
+
+	proxyUsage := chargeRequest(c, reservation, usage.InputTokens, usage.OutputTokens, transcriptionCost(pricing, usage, seconds), "")
+	proxyUsage.AudioSeconds = seconds
+
+	if !isJSON {
+		c.Data(http.StatusOK, contentType, respBody)
+		return
+	}
+	response["proxy_usage"], _ = json.Marshal(proxyUsage)
+	c.JSON(http.StatusOK, response)
+}
+
+// transcriptionCost prices a transcription by the usage OpenAI reported:
+// token-billed models at the input and output rates of their pricing row, the
+// others by the second.
+func transcriptionCost(pricing ModelPricing, usage AudioUsage, seconds float64) float64 {
+	if usage.Type == "tokens" && (pricing.Input > 0 || pricing.Output > 0) {
+		return float64(usage.InputTokens)*(pricing.Input/1000000.0) + float64(usage.OutputTokens)*(pricing.Output/1000000.0)
+	}
+	return seconds * pricing.PerSecond
+}
+
+func readFormFile(c *gin.Context, field string) ([]byte, error) {
+	header, err := c.FormFile(field)
+	if err != nil {
+		return nil, err
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// audioSpeechProxy prices text-to-speech by the characters of the input, which
+// is known exactly before the request is sent. Models without a per-character
+// price are rejected.
+func audioSpeechProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var reqData SpeechRequest
+	if err == nil {
+		err = json.Unmarshal(body, &reqData)
+	}
+	if err != nil || reqData.Model == "" || reqData.Input == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+
+	if !checkModel(c, proxyKey, reqData.Model) {
+		return
+	}
+
+	pricing, _ := getPricingForModel(reqData.Model)
+	if pricing.PerMChars == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("No audio price for model %s.", reqData.Model),
+		})
+		return
+	}
+	characters := utf8.RuneCountInString(reqData.Input)
+	cost := float64(characters) * (pricing.PerMChars / 1000000.0)
+
+	reservation, ok := reserveRequest(c, proxyKey, reqData.Model, 0, cost)
+	if !ok {
+		return
+	}
+
+	respBody, contentType, err := sendOpenAI("/v1/audio/speech", "application/json", body, upstreamKey)
+	if err != nil {
+		failRequest(c, reservation, 0, err)
+		return
+	}
+
+	// The audio is returned as is; the cost is reported in the quota headers
+	chargeRequest(c, reservation, 0, 0, cost, "")
+	c.Data(http.StatusOK, contentType, respBody)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func setupAudioPricing(t *testing.T) {
+	t.Helper()
+	problems, err := parsePricingCSV(`model,version,input,cached_input,output,per_second,per_1m_characters
+whisper-1,whisper-1,,,,0.0001,
+gpt-4o-transcribe,gpt-4o-transcribe,6.0,,10.0,0.0001,
+tts-1,tts-1,,,,,15.0
+`, modelPricing)
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("Failed to parse audio pricing: %v %v", err, problems)
+	}
+	generateAllowedPrefixes()
+}
+
+func postAudioUpload(router http.Handler, path, model string, audio []byte, fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("model", model)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	part, _ := form.CreateFormFile("file", "audio.wav")
+	part.Write(audio)
+	form.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAudioTranscriptions(t *testing.T) {
+	resetGlobalState()
+	setupAudioPricing(t)
+	got := mockOpenAIRaw(t, `{"text":"Hello","usage":{"type":"duration","seconds":61}}`)
+	router := setupTestRouter()
+
+	audio := testWAV(8000, 60)
+	w := postAudioUpload(router, "/v1/audio/transcriptions", "whisper-1", audio, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got.URL.Path != "/v1/audio/transcriptions" || !strings.HasPrefix(got.Header.Get("Content-Type"), "multipart/form-data") {
+		t.Errorf("Unexpected upstream request: %s %s", got.URL.Path, got.Header.Get("Content-Type"))
+	}
+
+	// The duration reported by OpenAI is charged: 61s at $0.0001 per second
+	var response struct {
+		Text       string     `json:"text"`
+		ProxyUsage ProxyUsage `json:"proxy_usage"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Text != "Hello" || response.ProxyUsage.AudioSeconds != 61 || response.ProxyUsage.CostUSD != 0.0061 {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestAudioTranscriptions_TokenUsage(t *testing.T) {
+	resetGlobalState()
+	setupAudioPricing(t)
+	mockOpenAIRaw(t, `{"text":"Hello","usage":{"type":"tokens","input_tokens":1000,"output_tokens":200,"total_tokens":1200}}`)
+	router := setupTestRouter()
+
+	w := postAudioUpload(router, "/v1/audio/transcriptions", "gpt-4o-transcribe", testWAV(8000, 60), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	// Token-billed: 1000 input tokens at $6 and 200 output tokens at $10 per 1M,
+	// not 60s at $0.0001 per second
+	if w.Header().Get("X-Request-Cost-USD") != "0.008000" {
+		t.Errorf("Unexpected X-Request-Cost-USD: %q", w.Header().Get("X-Request-Cost-USD"))
+	}
+}
+
+func TestAudio_UnpricedModel(t *testing.T) {
+	resetGlobalState()
+	setupAudioPricing(t)
+	api := newMockOpenAIRoutes(t)
+	router := setupTestRouter()
+
+	// gpt-4o-mini-tts is allowed by the gpt-4o-mini prefix but has no audio price
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/audio/speech", strings.NewReader(`{"model":"gpt-4o-mini-tts","input":"Hello","voice":"alloy"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "No audio price") {
+		t.Errorf("Expected status 400 for unpriced speech, got %d: %s", w.Code, w.Body.String())
+	}
+	w = postAudioUpload(router, "/v1/audio/transcriptions", "gpt-4o-mini", testWAV(8000, 1), nil)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "No audio price") {
+		t.Errorf("Expected status 400 for unpriced transcription, got %d: %s", w.Code, w.Body.String())
+	}
+	if n := api.count("POST /v1/audio/speech") + api.count("POST /v1/audio/transcriptions"); n != 0 {
+		t.Errorf("Expected no upstream calls, got %d", n)
+	}
+}
+
+func TestAudioTranslations_TextFormat(t *testing.T) {
+	resetGlobalState()
+	setupAudioPricing(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("Hello"))
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() {
+		openAIBaseURL = previous
+		server.Close()
+	}()
+	router := setupTestRouter()
+
+	w := postAudioUpload(router, "/v1/audio/translations", "whisper-1", testWAV(8000, 30), map[string]string{"response_format": "text"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	// Text responses are passed through and charged by the duration from the file
+	if w.Body.String() != "Hello" {
+		t.Errorf("Expected text response, got %q", w.Body.String())
+	}
+	if w.Header().Get("X-Request-Cost-USD") != "0.003000" {
+		t.Errorf("Unexpected X-Request-Cost-USD: %q", w.Header().Get("X-Request-Cost-USD"))
+	}
+}
+
+func TestAudioTranscriptions_Rejected(t *testing.T) {
+	resetGlobalState()
+	setupAudioPricing(t)
+	router := setupTestRouter()
+
+	// 10 minutes at $0.0001 per second exceed the quota
+	costLimitUSD = 0.05
+	w := postAudioUpload(router, "/v1/audio/transcriptions", "whisper-1", testWAV(8000, 600), nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = postAudioUpload(router, "/v1/audio/transcriptions", "", testWAV(8000, 1), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without model, got %d", w.Code)
+	}
+}
+
+func TestAudioSpeech(t *testing.T) {
+	resetGlobalState()
+	setupAudioPricing(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"voice":"alloy"`) {
+			t.Errorf("Expected request to be forwarded unchanged, got %s", body)
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte{0xFF, 0xFB, 0x90, 0x00})
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() {
+		openAIBaseURL = previous
+		server.Close()
+	}()
+	router := setupTestRouter()
+
+	input := strings.Repeat("Zażółć ", 1000) // characters, not bytes, are counted
+	data, _ := json.Marshal(map[string]string{"model": "tts-1", "input": input, "voice": "alloy"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/audio/speech", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "audio/mpeg" || w.Body.Len() != 4 {
+		t.Errorf("Expected audio to be passed through, got %s", w.Header().Get("Content-Type"))
+	}
+	// 7000 characters at $15 per 1M
+	if w.Header().Get("X-Request-Cost-USD") != "0.105000" {
+		t.Errorf("Unexpected X-Request-Cost-USD: %q", w.Header().Get("X-Request-Cost-USD"))
+	}
+}
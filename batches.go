@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchUpload limits the size of batch input files held in memory; OpenAI
+// accepts up to 200 MB.
+const maxBatchUpload = 200 << 20
+
+// batchTier is the service tier batches are priced at.
+const batchTier = "batch"
+
+// batchDiscount applies to models without batch rows in the pricing file.
+const batchDiscount = 0.5
+
+// batchPollInterval is how often pending batches are checked for completion.
+const batchPollInterval = time.Minute
+
+// BatchEstimate is the estimated cost of a batch input file.
+type BatchEstimate struct {
+	Model            string  `json:"model"`
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// pendingBatch is a submitted batch whose reservation awaits settlement.
+type pendingBatch struct {
+	ID          string
+	Reservation *Reservation
+	UpstreamKey string // used to poll the batch when no client does
+}
+
+// Batch state, guarded by mu.
+var (
+	batchFileEstimates = make(map[string]BatchEstimate) // by uploaded file ID
+	pendingBatches     = make(map[string]*pendingBatch) // by batch ID
+
+	// Proxy keys share the upstream OpenAI key, so the proxy records which
+	// key created each file and batch and hides them from other keys
+	fileOwners  = make(map[string]string) // key ID by file ID
+	batchOwners = make(map[string]string) // key ID by batch ID
+)
+
+// batchRequestLine is a line of a batch input file.
+type batchRequestLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// batchResponseLine is a line of a batch output file.
+type batchResponseLine struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int `json:"status_code"`
+		Body       struct {
+			Model string     `json:"model"`
+			Usage batchUsage `json:"usage"`
+		} `json:"body"`
+	} `json:"response"`
+}
+
+// batchUsage covers the usage of every batch endpoint: chat completions,
+// completions and embeddings report prompt and completion tokens, the
+// Responses API input and output tokens.
+type batchUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"prompt_tokens_details"`
+	InputTokens        int `json:"input_tokens"`
+	OutputTokens       int `json:"output_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+}
+
+// batchStatus holds the fields of a batch object the proxy needs.
+type batchStatus struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	OutputFileID string `json:"output_file_id"`
+	ErrorFileID  string `json:"error_file_id"`
+}
+
+// ownsResource reports whether a client may use a file or batch. Proxy keys
+// reach only what they created through the proxy; clients with their own
+// OpenAI key reach their own organization. Must hold mu.
+func ownsResource(owners map[string]string, id string, key *ProxyKey) bool {
+	return key == nil || owners[id] == key.ID
+}
+
+// checkOwner writes a 404, as OpenAI does for unknown IDs, when the client
+// may not use a file or batch.
+func checkOwner(c *gin.Context, owners map[string]string, kind, id string, key *ProxyKey) bool {
+	mu.Lock()
+	owned := ownsResource(owners, id, key)
+	mu.Unlock()
+	if !owned {
+		c.JSON(http.StatusNotFound, ErrorResponse{
+			Error: fmt.Sprintf("No such %s: %s.", kind, id),
+		})
+	}
+	return owned
+}
+
+// recordBatchFiles gives the output and error files of a batch to the key that
+// created it. Must hold mu.
+func recordBatchFiles(status batchStatus) {
+	owner, found := batchOwners[status.ID]
+	if !found {
+		return
+	}
+	for _, fileID := range []string{status.OutputFileID, status.ErrorFileID} {
+		if fileID != "" {
+			fileOwners[fileID] = owner
+		}
+	}
+}
+
+// batchCost prices tokens at the model's batch rates, or at the standard rates
+// with the batch discount when the pricing file has no batch rows for it.
+func batchCost(promptTokens, cachedTokens, completionTokens int, model string) float64 {
+	pricing, _ := getPricingForModel(model)
+	for _, rule := range pricing.Rules {
+		if rule.ServiceTier == batchTier {
+			return calculateCostWithCache(promptTokens, cachedTokens, completionTokens, model, batchTier)
+		}
+	}
+	return calculateCostWithCache(promptTokens, cachedTokens, completionTokens, model, "") * batchDiscount
+}
+
+// estimateBatchRequest estimates the tokens of one request of a batch. The
+// completion is bounded by the request's output limit; without one only the
+// prompt is estimated, as for synchronous requests.
+func estimateBatchRequest(url string, body json.RawMessage) (model string, promptTokens, completionTokens int, err error) {
+	var common struct {
+		Model               string `json:"model"`
+		MaxTokens           *int   `json:"max_tokens"`
+		MaxCompletionTokens *int   `json:"max_completion_tokens"`
+		MaxOutputTokens     *int   `json:"max_output_tokens"`
+		N                   *int   `json:"n"`
+	}
+	if err := json.Unmarshal(body, &common); err != nil || common.Model == "" {
+		return "", 0, 0, fmt.Errorf("body must be a JSON object with a model")
+	}
+	model = common.Model
+
+	maxOutput := 0
+	for _, limit := range []*int{common.MaxTokens, common.MaxCompletionTokens, common.MaxOutputTokens, common.N} {
+		if limit != nil && *limit < 0 {
+			return "", 0, 0, fmt.Errorf("token limits and n must not be negative")
+		}
+	}
+	for _, limit := range []*int{common.MaxTokens, common.MaxCompletionTokens, common.MaxOutputTokens} {
+		if limit != nil {
+			maxOutput = *limit
+		}
+	}
+	choices := 1
+	if common.N != nil && *common.N > 1 {
+		choices = *common.N
+	}
+
+	switch url {
+	case "/v1/chat/completions":
+		var reqData ChatRequest
+		if json.Unmarshal(body, &reqData) == nil {
+			promptTokens = countChatTokens(reqData)
+		} else {
+			// Messages with content parts are counted by their JSON
+			promptTokens = countTokens(string(body), model)
+		}
+		completionTokens = saturatingMul(maxOutput, choices)
+	case "/v1/completions":
+		var reqData CompletionRequest
+		json.Unmarshal(body, &reqData)
+		if promptTokens, err = countEmbeddingInputTokens(reqData.Prompt, model); err != nil {
+			return "", 0, 0, err
+		}
+		if common.MaxTokens == nil {
+			maxOutput = defaultCompletionMaxTokens
+		}
+		completionTokens = saturatingMul(maxOutput, saturatingMul(completionCandidates(reqData), completionPrompts(reqData.Prompt)))
+	case "/v1/embeddings":
+		var reqData EmbeddingRequest
+		json.Unmarshal(body, &reqData)
+		if promptTokens, err = countEmbeddingInputTokens(reqData.Input, model); err != nil {
+			return "", 0, 0, err
+		}
+	case "/v1/responses":
+		var reqData ResponsesRequest
+		json.Unmarshal(body, &reqData)
+		if promptTokens, err = countResponsesInputTokens(reqData); err != nil {
+			return "", 0, 0, err
+		}
+		completionTokens = maxOutput
+	default:
+		return "", 0, 0, fmt.Errorf("unsupported url %q", url)
+	}
+	return model, promptTokens, completionTokens, nil
+}
+
+// estimateBatchFile estimates the cost of a batch input file. All requests of
+// a batch use the same model.
+func estimateBatchFile(data []byte) (BatchEstimate, error) {
+	var estimate BatchEstimate
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchUpload)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var request batchRequestLine
+		if err := json.Unmarshal(line, &request); err != nil {
+			return estimate, fmt.Errorf("line %d: invalid JSON: %v", lineNum, err)
+		}
+		model, promptTokens, completionTokens, err := estimateBatchRequest(request.URL, request.Body)
+		if err != nil {
+			return estimate, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if estimate.Model == "" {
+			estimate.Model = model
+		} else if model != estimate.Model {
+			return estimate, fmt.Errorf("line %d: model %s differs from %s; a batch uses one model", lineNum, model, estimate.Model)
+		}
+
+		estimate.Requests++
+		estimate.PromptTokens += promptTokens
+		estimate.CompletionTokens += completionTokens
+		estimate.CostUSD += batchCost(promptTokens, 0, completionTokens, model)
+	}
+	if err := scanner.Err(); err != nil {
+		return estimate, err
+	}
+	if estimate.Requests == 0 {
+		return estimate, fmt.Errorf("file has no requests")
+	}
+	return estimate, nil
+}
+
+// filesUpload forwards a file upload unchanged. Batch input files are estimated
+// first, so that the batch can be admitted when it is created.
+func filesUpload(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchUpload))
+	if err == nil {
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		err = c.Request.ParseMultipartForm(maxBatchUpload)
+	}
+	var data []byte
+	if err == nil {
+		data, err = readFormFile(c, "file")
+	}
+	purpose := c.PostForm("purpose")
+	if err != nil || purpose == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Expected multipart form with file and purpose.",
+		})
+		return
+	}
+
+	var estimate BatchEstimate
+	if purpose == "batch" {
+		if estimate, err = estimateBatchFile(data); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Invalid batch file: %v.", err),
+			})
+			return
+		}
+		if !checkModel(c, proxyKey, estimate.Model) {
+			return
+		}
+	}
+
+	respBody, err := postOpenAI("/v1/files", c.GetHeader("Content-Type"), body, upstreamKey)
+	var response map[string]json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error: fmt.Sprintf("OpenAI API call error: %s", err.Error()),
+		})
+		return
+	}
+
+	var fileID string
+	json.Unmarshal(response["id"], &fileID)
+	if proxyKey != nil {
+		mu.Lock()
+		fileOwners[fileID] = proxyKey.ID
+		mu.Unlock()
+		recordUsage(LedgerEntry{Time: time.Now().UTC(), Type: ledgerEntryFile, KeyID: proxyKey.ID, FileID: fileID})
+	}
+	if purpose == "batch" {
+		mu.Lock()
+		batchFileEstimates[fileID] = estimate
+		mu.Unlock()
+		logInfof("Batch file uploaded: id=%s, model=%s, requests=%d, estimated_cost=$%.6f", fileID, estimate.Model, estimate.Requests, estimate.CostUSD)
+		response["proxy_estimate"], _ = json.Marshal(estimate)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// fileContent passes through the content of a file, such as a batch's output.
+func fileContent(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authenticateRequest(c)
+	if !ok || !checkOwner(c, fileOwners, "file", c.Param("id"), proxyKey) {
+		return
+	}
+
+	respBody, contentType, err := getOpenAI("/v1/files/"+c.Param("id")+"/content", upstreamKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error: fmt.Sprintf("OpenAI API call error: %s", err.Error()),
+		})
+		return
+	}
+	c.Data(http.StatusOK, contentType, respBody)
+}
+
+// batchesCreate reserves the estimated cost of the input file and submits the
+// batch. The reservation is held until the batch ends.
+func batchesCreate(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var reqData struct {
+		InputFileID string `json:"input_file_id"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &reqData)
+	}
+	if err != nil || reqData.InputFileID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+
+	if !checkOwner(c, fileOwners, "file", reqData.InputFileID, proxyKey) {
+		return
+	}
+	mu.Lock()
+	estimate, found := batchFileEstimates[reqData.InputFileID]
+	mu.Unlock()
+	if !found {
+		// Uploaded without the proxy: estimate from the file's content
+		data, _, err := getOpenAI("/v1/files/"+reqData.InputFileID+"/content", upstreamKey)
+		if err == nil {
+			estimate, err = estimateBatchFile(data)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Cannot estimate batch input file %s: %v.", reqData.InputFileID, err),
+			})
+			return
+		}
+		if !checkModel(c, proxyKey, estimate.Model) {
+			return
+		}
+	}
+
+	// OpenAI limits batch tokens separately, so only the request counts here
+	reservation, ok := reserve(c, proxyKey, estimate.Model, estimate.PromptTokens, estimate.CostUSD, false)
+	if !ok {
+		return
+	}
+
+	respBody, err := postOpenAI("/v1/batches", "application/json", body, upstreamKey)
+	var response map[string]json.RawMessage
+	var batch batchStatus
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err == nil {
+		err = json.Unmarshal(respBody, &batch)
+	}
+	if err != nil {
+		failRequest(c, reservation, estimate.PromptTokens, err)
+		return
+	}
+
+	mu.Lock()
+	reservation.BatchID = batch.ID
+	pendingBatches[batch.ID] = &pendingBatch{ID: batch.ID, Reservation: reservation, UpstreamKey: upstreamKey}
+	if proxyKey != nil {
+		batchOwners[batch.ID] = proxyKey.ID
+	}
+	mu.Unlock()
+	// Batches run for up to a day, so the reservation is kept in the ledger
+	// until the batch is settled
+	recordUsage(LedgerEntry{
+		Time:             time.Now().UTC(),
+		Type:             ledgerEntryBatch,
+		KeyID:            reservation.KeyID,
+		Project:          reservation.Project,
+		Tags:             reservation.Tags,
+		User:             reservation.User,
+		Model:            estimate.Model,
+		PromptTokens:     estimate.PromptTokens,
+		CompletionTokens: estimate.CompletionTokens,
+		BatchID:          batch.ID,
+		ReservedUSD:      estimate.CostUSD,
+	})
+	logInfof("Batch submitted: id=%s, model=%s, requests=%d, reserved=$%.6f", batch.ID, estimate.Model, estimate.Requests, estimate.CostUSD)
+
+	response["proxy_estimate"], _ = json.Marshal(estimate)
+	c.JSON(http.StatusOK, response)
+}
+
+func batchesRetrieve(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authenticateRequest(c)
+	if !ok || !checkOwner(c, batchOwners, "batch", c.Param("id"), proxyKey) {
+		return
+	}
+	respBody, _, err := getOpenAI("/v1/batches/"+c.Param("id"), upstreamKey)
+	respondBatch(c, respBody, upstreamKey, err)
+}
+
+func batchesCancel(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authenticateRequest(c)
+	if !ok || !checkOwner(c, batchOwners, "batch", c.Param("id"), proxyKey) {
+		return
+	}
+	respBody, err := postOpenAI("/v1/batches/"+c.Param("id")+"/cancel", "application/json", nil, upstreamKey)
+	respondBatch(c, respBody, upstreamKey, err)
+}
+
+// respondBatch passes a batch object through, settling the batch if it has
+// ended. The settled usage is added to the response.
+func respondBatch(c *gin.Context, respBody []byte, upstreamKey string, err error) {
+	var response map[string]json.RawMessage
+	var batch batchStatus
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err == nil {
+		err = json.Unmarshal(respBody, &batch)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error: fmt.Sprintf("OpenAI API call error: %s", err.Error()),
+		})
+		return
+	}
+
+	mu.Lock()
+	recordBatchFiles(batch)
+	mu.Unlock()
+	proxyUsage, err := settleBatch(batch, upstreamKey)
+	if err != nil {
+		log.Printf("Cannot settle batch %s: %v", batch.ID, err)
+	}
+	if proxyUsage != nil {
+		c.Set(contextRequestCost, proxyUsage.CostUSD)
+		response["proxy_usage"], _ = json.Marshal(proxyUsage)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// batchEnded reports whether a batch reached a final status.
+func batchEnded(status string) bool {
+	switch status {
+	case "completed", "failed", "expired", "cancelled":
+		return true
+	}
+	return false
+}
+
+// settleBatch replaces the reservation of an ended batch with the cost of the
+// requests in its output file; expired and cancelled batches are charged for
+// the requests that completed. upstreamKey reads the output of batches restored
+// without a key. It returns nil for batches that are still running, were not
+// submitted through the proxy or were already settled.
+func settleBatch(status batchStatus, upstreamKey string) (*ProxyUsage, error) {
+	if !batchEnded(status.Status) {
+		return nil, nil
+	}
+
+	// Claim the batch so that it is settled once
+	mu.Lock()
+	batch, found := pendingBatches[status.ID]
+	delete(pendingBatches, status.ID)
+	mu.Unlock()
+	if !found {
+		return nil, nil
+	}
+	if batch.UpstreamKey == "" {
+		batch.UpstreamKey = upstreamKey
+	}
+
+	if status.OutputFileID == "" {
+		logInfof("Batch %s %s without output, reservation released", batch.ID, status.Status)
+		return settleUsage(batch.Reservation, 0, 0, 0, batchTier), nil
+	}
+
+	data, _, err := getOpenAI("/v1/files/"+status.OutputFileID+"/content", batch.UpstreamKey)
+	if err != nil {
+		mu.Lock()
+		pendingBatches[batch.ID] = batch
+		mu.Unlock()
+		return nil, err
+	}
+
+	var promptTokens, cachedTokens, completionTokens int
+	cost := 0.0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchUpload)
+	for scanner.Scan() {
+		var line batchResponseLine
+		if json.Unmarshal(scanner.Bytes(), &line) != nil || line.Response == nil {
+			continue
+		}
+		model := line.Response.Body.Model
+		if model == "" {
+			model = batch.Reservation.Model
+		}
+		usage := line.Response.Body.Usage
+		prompt := usage.PromptTokens + usage.InputTokens
+		cached := usage.PromptTokensDetails.CachedTokens + usage.InputTokensDetails.CachedTokens
+		completion := usage.CompletionTokens + usage.OutputTokens
+
+		promptTokens += prompt
+		cachedTokens += cached
+		completionTokens += completion
+		cost += batchCost(prompt, cached, completion, model)
+	}
+
+	logInfof("Batch %s %s: reserved=$%.6f, cost=$%.6f", batch.ID, status.Status, batch.Reservation.CostUSD, cost)
+	proxyUsage := settleUsage(batch.Reservation, promptTokens, completionTokens, cost, batchTier)
+	proxyUsage.CachedTokens = cachedTokens
+	return proxyUsage, nil
+}
+
+// pollBatches settles pending batches that ended without a client retrieving
+// them through the proxy.
+func pollBatches() {
+	mu.Lock()
+	pending := make([]pendingBatch, 0, len(pendingBatches))
+	for _, batch := range pendingBatches {
+		pending = append(pending, *batch)
+	}
+	mu.Unlock()
+
+	for _, batch := range pending {
+		if batch.UpstreamKey == "" {
+			continue // restored for a client's own OpenAI key, which is not kept
+		}
+		respBody, _, err := getOpenAI("/v1/batches/"+batch.ID, batch.UpstreamKey)
+		var status batchStatus
+		if err == nil {
+			err = json.Unmarshal(respBody, &status)
+		}
+		if err == nil {
+			mu.Lock()
+			recordBatchFiles(status)
+			mu.Unlock()
+			_, err = settleBatch(status, batch.UpstreamKey)
+		}
+		if err != nil {
+			log.Printf("Cannot check batch %s: %v", batch.ID, err)
+		}
+	}
+}
+
+// restoreBatchState rebuilds the owners of files and batches and the
+// reservations of batches still running from a ledger entry at startup, so
+// that batches submitted before a restart are settled. Batches of clients with
+// their own OpenAI key are settled when the client next retrieves them.
+func restoreBatchState(entry LedgerEntry) {
+	switch {
+	case entry.Type == ledgerEntryFile:
+		fileOwners[entry.FileID] = entry.KeyID
+	case entry.Type == ledgerEntryBatch:
+		nextReservationID++
+		r := &Reservation{
+			ID:        nextReservationID,
+			KeyID:     entry.KeyID,
+			Model:     entry.Model,
+			CostUSD:   entry.ReservedUSD,
+			StartedAt: entry.Time,
+			Project:   entry.Project,
+			Tags:      entry.Tags,
+			User:      entry.User,
+			BatchID:   entry.BatchID,
+		}
+		batch := &pendingBatch{ID: entry.BatchID, Reservation: r}
+		if entry.KeyID != "" {
+			batchOwners[entry.BatchID] = entry.KeyID
+			batch.UpstreamKey = upstreamAPIKey
+			if keyStore != nil {
+				if key, err := keyStore.Get(entry.KeyID); err == nil {
+					r.keyName, r.keyBudget, r.keyCreated = key.Name, key.BudgetUSD, key.CreatedAt
+				}
+			}
+		}
+		reservations[r.ID] = r
+		reservedCost += r.CostUSD
+		pendingBatches[entry.BatchID] = batch
+	case entry.Type == "" && entry.BatchID != "":
+		if batch, found := pendingBatches[entry.BatchID]; found {
+			releaseReservation(batch.Reservation)
+			delete(pendingBatches, entry.BatchID)
+		}
+	}
+}
+
+// runBatchPoller calls pollBatches every batchPollInterval.
+func runBatchPoller() {
+	for range time.Tick(batchPollInterval) {
+		pollBatches()
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockOpenAIRoutes serves canned responses by method and path and records the
+// requests it receives.
+type mockOpenAIRoutes struct {
+	mu        sync.Mutex
+	responses map[string]string // "METHOD /path" -> response body
+	requests  []string
+}
+
+func newMockOpenAIRoutes(t *testing.T) *mockOpenAIRoutes {
+	t.Helper()
+	api := &mockOpenAIRoutes{responses: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		route := r.Method + " " + r.URL.Path
+		api.requests = append(api.requests, route)
+		body, ok := api.responses[route]
+		if !ok {
+			http.Error(w, `{"error":{"message":"not found"}}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	t.Cleanup(func() {
+		openAIBaseURL = previous
+		server.Close()
+	})
+	return api
+}
+
+func (api *mockOpenAIRoutes) set(route, body string) {
+	api.mu.Lock()
+	api.responses[route] = body
+	api.mu.Unlock()
+}
+
+func (api *mockOpenAIRoutes) count(route string) int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	n := 0
+	for _, r := range api.requests {
+		if r == route {
+			n++
+		}
+	}
+	return n
+}
+
+func resetBatchState() {
+	batchFileEstimates = make(map[string]BatchEstimate)
+	pendingBatches = make(map[string]*pendingBatch)
+	fileOwners = make(map[string]string)
+	batchOwners = make(map[string]string)
+	reservations = make(map[int64]*Reservation)
+	reservedCost = 0
+}
+
+func testBatchFile(requests int, maxTokens int) string {
+	var b strings.Builder
+	for i := 0; i < requests; i++ {
+		fmt.Fprintf(&b, `{"custom_id":"r%d","method":"POST","url":"/v1/chat/completions","body":{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}],"max_tokens":%d}}`+"\n", i, maxTokens)
+	}
+	return b.String()
+}
+
+func uploadBatchFile(router http.Handler, content string) *httptest.ResponseRecorder {
+	return uploadBatchFileWithKey(router, "sk-test", content)
+}
+
+func uploadBatchFileWithKey(router http.Handler, apiKey, content string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", "batch")
+	part, _ := form.CreateFormFile("file", "batch.jsonl")
+	part.Write([]byte(content))
+	form.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func batchRequest(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	return batchRequestWithKey(router, "sk-test", method, path, body)
+}
+
+func batchRequestWithKey(router http.Handler, apiKey, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestBatchCost(t *testing.T) {
+	resetGlobalState()
+	modelPricing["gpt-4o"] = ModelPricing{Model: "gpt-4o", Input: 2.5, Output: 10.0,
+		Rules: []PricingRule{{ServiceTier: "batch", Input: 1.0, Output: 4.0}}}
+
+	// Batch rows in the pricing file win over the discount
+	if cost := batchCost(1000000, 0, 1000000, "gpt-4o"); cost != 5.0 {
+		t.Errorf("Expected batch rates, got %f", cost)
+	}
+	// Other models get half the standard rates
+	if cost := batchCost(1000000, 0, 1000000, "gpt-4o-mini"); math.Abs(cost-0.375) > 1e-9 {
+		t.Errorf("Expected discounted standard rates, got %f", cost)
+	}
+}
+
+func TestEstimateBatchFile(t *testing.T) {
+	resetGlobalState()
+	estimate, err := estimateBatchFile([]byte(testBatchFile(3, 100) + "\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	promptTokens := calculateTokensFromMessages([]ChatMessage{{Role: "user", Content: "Hello"}}, "gpt-4o")
+	if estimate.Model != "gpt-4o" || estimate.Requests != 3 || estimate.PromptTokens != 3*promptTokens || estimate.CompletionTokens != 300 {
+		t.Errorf("Unexpected estimate: %+v", estimate)
+	}
+	if expected := batchCost(3*promptTokens, 0, 300, "gpt-4o"); math.Abs(estimate.CostUSD-expected) > 1e-12 {
+		t.Errorf("Expected cost %f, got %f", expected, estimate.CostUSD)
+	}
+
+	// Embeddings have no completion
+	estimate, err = estimateBatchFile([]byte(`{"custom_id":"e","method":"POST","url":"/v1/embeddings","body":{"model":"gpt-4o","input":["a","b"]}}`))
+	if err != nil || estimate.PromptTokens != 2 || estimate.CompletionTokens != 0 {
+		t.Errorf("Unexpected embeddings estimate: %+v (%v)", estimate, err)
+	}
+
+	// Overflowing limits saturate instead of turning negative
+	estimate, err = estimateBatchFile([]byte(`{"custom_id":"a","url":"/v1/chat/completions","body":{"model":"gpt-4o","messages":[],"max_tokens":4611686018427387904,"n":4}}`))
+	if err != nil || estimate.CompletionTokens != math.MaxInt || estimate.CostUSD <= 0 {
+		t.Errorf("Expected a saturated estimate, got %+v (%v)", estimate, err)
+	}
+
+	for name, content := range map[string]string{
+		"empty":       "\n",
+		"invalid":     "{not json}\n",
+		"no model":    `{"custom_id":"a","url":"/v1/chat/completions","body":{"messages":[]}}`,
+		"mixed model": testBatchFile(1, 10) + strings.Replace(testBatchFile(1, 10), "gpt-4o", "gpt-4o-mini", 1),
+		"bad url":     `{"custom_id":"a","url":"/v1/audio/speech","body":{"model":"tts-1"}}`,
+		"negative":    testBatchFile(1, -1000),
+		"negative n":  `{"custom_id":"a","url":"/v1/chat/completions","body":{"model":"gpt-4o","messages":[],"max_tokens":10,"n":-2}}`,
+	} {
+		if _, err := estimateBatchFile([]byte(content)); err == nil {
+			t.Errorf("Expected error for %s file", name)
+		}
+	}
+}
+
+func TestBatchLifecycle(t *testing.T) {
+	resetGlobalState()
+	resetBatchState()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/files", `{"id":"file-in","object":"file","purpose":"batch"}`)
+	api.set("POST /v1/batches", `{"id":"batch_1","object":"batch","status":"validating","input_file_id":"file-in"}`)
+	api.set("GET /v1/batches/batch_1", `{"id":"batch_1","object":"batch","status":"in_progress"}`)
+	router := setupTestRouter()
+
+	w := uploadBatchFile(router, testBatchFile(10, 1000))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var upload struct {
+		ID            string        `json:"id"`
+		ProxyEstimate BatchEstimate `json:"proxy_estimate"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &upload)
+	if upload.ID != "file-in" || upload.ProxyEstimate.Requests != 10 {
+		t.Errorf("Unexpected upload response: %s", w.Body.String())
+	}
+
+	// The estimate is reserved at submission
+	w = batchRequest(router, "POST", "/v1/batches", `{"input_file_id":"file-in","endpoint":"/v1/chat/completions","completion_window":"24h"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(reservations) != 1 || reservedCost != upload.ProxyEstimate.CostUSD {
+		t.Errorf("Expected reservation of %f, got %f", upload.ProxyEstimate.CostUSD, reservedCost)
+	}
+
+	// Nothing is settled while the batch runs
+	w = batchRequest(router, "GET", "/v1/batches/batch_1", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "proxy_usage") || len(reservations) != 1 {
+		t.Errorf("Expected running batch to keep its reservation: %s", w.Body.String())
+	}
+
+	// Completion settles from the output file at half the standard rates
+	api.set("GET /v1/batches/batch_1", `{"id":"batch_1","object":"batch","status":"completed","output_file_id":"file-out"}`)
+	api.set("GET /v1/files/file-out/content",
+		`{"id":"r1","custom_id":"r0","response":{"status_code":200,"body":{"model":"gpt-4o-2024-08-06","usage":{"prompt_tokens":1000,"completion_tokens":500,"prompt_tokens_details":{"cached_tokens":0}}}},"error":null}`+"\n"+
+			`{"id":"r2","custom_id":"r1","response":null,"error":{"code":"server_error"}}`+"\n")
+	w = batchRequest(router, "GET", "/v1/batches/batch_1", "")
+	var retrieved struct {
+		Status     string     `json:"status"`
+		ProxyUsage ProxyUsage `json:"proxy_usage"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &retrieved)
+	expected := 0.00375 // (1000 x $2.5 + 500 x $10) / 1M / 2
+	if retrieved.Status != "completed" || retrieved.ProxyUsage.CostUSD != expected || retrieved.ProxyUsage.ServiceTier != "batch" {
+		t.Errorf("Unexpected settled batch: %s", w.Body.String())
+	}
+	if totalCost != expected || len(reservations) != 0 || reservedCost != 0 {
+		t.Errorf("Expected total cost %f and no reservations, got %f and %d", expected, totalCost, len(reservations))
+	}
+	if w.Header().Get("X-Request-Cost-USD") != "0.003750" {
+		t.Errorf("Unexpected X-Request-Cost-USD: %q", w.Header().Get("X-Request-Cost-USD"))
+	}
+
+	// A batch is settled once
+	batchRequest(router, "GET", "/v1/batches/batch_1", "")
+	if totalCost != expected || api.count("GET /v1/files/file-out/content") != 1 {
+		t.Errorf("Expected batch to be settled once, total cost %f", totalCost)
+	}
+}
+
+func TestBatchCreate_Rejected(t *testing.T) {
+	resetGlobalState()
+	resetBatchState()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/batches", `{"id":"batch_1","status":"validating"}`)
+	router := setupTestRouter()
+
+	// Files uploaded without the proxy are estimated from their content:
+	// 1000 requests x 1000 tokens at $5 per 1M is $5
+	api.set("GET /v1/files/file-big/content", testBatchFile(1000, 1000))
+	w := batchRequest(router, "POST", "/v1/batches", `{"input_file_id":"file-big","endpoint":"/v1/chat/completions"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d: %s", w.Code, w.Body.String())
+	}
+	if api.count("POST /v1/batches") != 0 || len(reservations) != 0 {
+		t.Error("Expected rejected batch not to be submitted")
+	}
+
+	w = batchRequest(router, "POST", "/v1/batches", `{"input_file_id":"file-missing","endpoint":"/v1/chat/completions"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown file, got %d", w.Code)
+	}
+}
+
+func TestBatchCancelAndPoll(t *testing.T) {
+	resetGlobalState()
+	resetBatchState()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/batches", `{"id":"batch_1","status":"validating"}`)
+	api.set("POST /v1/batches/batch_1/cancel", `{"id":"batch_1","status":"cancelling"}`)
+	api.set("GET /v1/files/file-in/content", testBatchFile(2, 100))
+	router := setupTestRouter()
+
+	batchRequest(router, "POST", "/v1/batches", `{"input_file_id":"file-in","endpoint":"/v1/chat/completions"}`)
+	w := batchRequest(router, "POST", "/v1/batches/batch_1/cancel", "")
+	if w.Code != http.StatusOK || len(reservations) != 1 {
+		t.Fatalf("Expected cancelling batch to keep its reservation, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The poller settles batches no client retrieves; cancelled without output
+	// releases the reservation
+	api.set("GET /v1/batches/batch_1", `{"id":"batch_1","status":"cancelled","output_file_id":null}`)
+	pollBatches()
+	if len(reservations) != 0 || len(pendingBatches) != 0 || totalCost != 0 {
+		t.Errorf("Expected reservation to be released, got %d reservations, total %f", len(reservations), totalCost)
+	}
+}
+
+func TestBatchOwnership(t *testing.T) {
+	resetGlobalState()
+	resetBatchState()
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/files", `{"id":"file-in","object":"file","purpose":"batch"}`)
+	api.set("POST /v1/batches", `{"id":"batch_1","object":"batch","status":"validating"}`)
+	api.set("GET /v1/batches/batch_1", `{"id":"batch_1","object":"batch","status":"failed","error_file_id":"file-err"}`)
+	api.set("POST /v1/batches/batch_1/cancel", `{"id":"batch_1","status":"cancelling"}`)
+	api.set("GET /v1/files/file-in/content", testBatchFile(2, 100))
+	api.set("GET /v1/files/file-err/content", `{"custom_id":"r0","error":{"code":"invalid_request"}}`)
+	api.set("GET /v1/files/file-other/content", testBatchFile(2, 100))
+	router := setupTestRouter()
+	owner, _, _ := store.Create("owner", 0)
+	other, _, _ := store.Create("other", 0)
+
+	if w := uploadBatchFileWithKey(router, owner, testBatchFile(2, 100)); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	create := `{"input_file_id":"file-in","endpoint":"/v1/chat/completions","completion_window":"24h"}`
+	if w := batchRequestWithKey(router, other, "POST", "/v1/batches", create); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another key's input file to be hidden, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := batchRequestWithKey(router, owner, "POST", "/v1/batches", create); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Other keys cannot see, cancel or download what the owner created
+	for _, request := range []struct{ method, path string }{
+		{"GET", "/v1/batches/batch_1"},
+		{"POST", "/v1/batches/batch_1/cancel"},
+		{"GET", "/v1/files/file-in/content"},
+		{"GET", "/v1/files/file-other/content"}, // not created through the proxy
+	} {
+		if w := batchRequestWithKey(router, other, request.method, request.path, ""); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s %s, got %d: %s", request.method, request.path, w.Code, w.Body.String())
+		}
+	}
+	if api.count("POST /v1/batches/batch_1/cancel") != 0 || len(reservations) != 1 {
+		t.Error("Expected the batch not to be cancelled by another key")
+	}
+
+	// The owner gets the batch and the files it produced
+	if w := batchRequestWithKey(router, owner, "GET", "/v1/batches/batch_1", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := batchRequestWithKey(router, owner, "GET", "/v1/files/file-err/content", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the owner to download the error file, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := batchRequestWithKey(router, other, "GET", "/v1/files/file-err/content", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the error file to be hidden from another key, got %d", w.Code)
+	}
+}
+
+func TestBatchRestoredAfterRestart(t *testing.T) {
+	resetGlobalState()
+	resetBatchState()
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	ledger = l
+	defer func() {
+		ledger = nil
+		l.Close()
+	}()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/files", `{"id":"file-in","object":"file","purpose":"batch"}`)
+	api.set("POST /v1/batches", `{"id":"batch_1","object":"batch","status":"validating"}`)
+	router := setupTestRouter()
+	secret, key, _ := store.Create("owner", 0)
+
+	uploadBatchFileWithKey(router, secret, testBatchFile(10, 1000))
+	w := batchRequestWithKey(router, secret, "POST", "/v1/batches", `{"input_file_id":"file-in","endpoint":"/v1/chat/completions","completion_window":"24h"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	reserved := reservedCost
+
+	// A restart loses the in-memory state, which is rebuilt from the ledger
+	restart := func() {
+		resetGlobalState()
+		resetBatchState()
+		keySpend = make(map[string]float64)
+		entries, err := readLedger(ledgerFile)
+		if err != nil {
+			t.Fatalf("Failed to read ledger: %v", err)
+		}
+		restoreKeySpend(entries)
+	}
+	restart()
+	if len(reservations) != 1 || reservedCost != reserved || pendingBatches["batch_1"] == nil {
+		t.Fatalf("Expected the batch reservation of %f restored, got %d reservations of %f", reserved, len(reservations), reservedCost)
+	}
+	if pendingBatches["batch_1"].UpstreamKey != "sk-upstream" || batchOwners["batch_1"] != key.ID || fileOwners["file-in"] != key.ID {
+		t.Error("Expected the batch and file owners restored")
+	}
+
+	// The poller settles the restored batch against the key
+	api.set("GET /v1/batches/batch_1", `{"id":"batch_1","object":"batch","status":"completed","output_file_id":"file-out"}`)
+	api.set("GET /v1/files/file-out/content",
+		`{"custom_id":"r0","response":{"status_code":200,"body":{"model":"gpt-4o","usage":{"prompt_tokens":1000,"completion_tokens":500}}}}`+"\n")
+	pollBatches()
+	expected := 0.00375 // (1000 x $2.5 + 500 x $10) / 1M / 2
+	if len(reservations) != 0 || totalCost != expected || keySpend[key.ID] != expected {
+		t.Errorf("Expected the batch charged %f, got total %f, key %f, %d reservations", expected, totalCost, keySpend[key.ID], len(reservations))
+	}
+
+	// Once settled, the batch is not restored again
+	restart()
+	if len(reservations) != 0 || len(pendingBatches) != 0 || keySpend[key.ID] != expected {
+		t.Errorf("Expected no pending batch after settlement, got %d reservations and key spend %f", len(reservations), keySpend[key.ID])
+	}
+}
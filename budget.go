@@ -0,0 +1,280 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reservation holds the estimated cost of an in-flight request against the
+// global quota and its key's budget until the actual cost is known.
+type Reservation struct {
+	ID        int64     `json:"id"`
+	KeyID     string    `json:"key_id,omitempty"`
+	Model     string    `json:"model"`
+	CostUSD   float64   `json:"cost_usd"`
+	StartedAt time.Time `json:"started_at"`
+	Priority  string    `json:"priority,omitempty"`
+	Project   string    `json:"project,omitempty"`
+
+	Tags    map[string]string `json:"tags,omitempty"`
+	User    string            `json:"user,omitempty"`     // OpenAI's user field
+	BatchID string            `json:"batch_id,omitempty"` // batch the reservation is held for
+
+	rateLimited bool // tokens are settled against the token rate limits
+	rateTokens  int  // tokens taken from the token rate limits at admission
+
+	// The key's budget at admission, for threshold notifications
+	keyName    string
+	keyBudget  float64
+	keyCreated time.Time
+}
+
+// In-flight reservations, guarded by mu.
+var (
+	reservations      = make(map[int64]*Reservation)
+	reservedCost      = 0.0
+	nextReservationID int64
+)
+
+func keyReservedCost(keyID string) float64 {
+	reserved := 0.0
+	for _, r := range reservations {
+		if r.KeyID == keyID {
+			reserved += r.CostUSD
+		}
+	}
+	return reserved
+}
+
+// listReservations returns the in-flight reservations, oldest first. Must hold mu.
+func listReservations() []Reservation {
+	list := make([]Reservation, 0, len(reservations))
+	for _, r := range reservations {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// budgetError rejects a request with 429; its message is shown to the client.
+type budgetError string
+
+func (e budgetError) Error() string { return string(e) }
+
+// reserveBudget admits a request whose prompt is estimated to cost estimate and
+// reserves that amount. Spend and other in-flight reservations count against
+// the global quota, the key budget and the budgets of its project and tags;
+// batch requests may not spend the headroom kept for interactive ones. Must
+// hold mu; the caller writes the rejection with writeBudgetError after
+// releasing it.
+func reserveBudget(key *ProxyKey, model, priority string, tags map[string]string, promptTokens int, estimate float64) (*Reservation, error) {
+	keyID := ""
+	if key != nil {
+		keyID = key.ID
+	}
+
+	if key != nil && key.BudgetUSD > 0 && keySpend[keyID] >= key.BudgetUSD {
+		log.Printf("Request blocked: key budget exceeded, key=%s, spent=$%.6f, budget=$%.6f", keyID, keySpend[keyID], key.BudgetUSD)
+		return nil, budgetError("Key cost limit exceeded.")
+	}
+
+	if totalCost+reservedCost+estimate >= costLimitUSD {
+		log.Printf("Request blocked: prompt would exceed quota, prompt_tokens=%d, prompt_cost=$%.6f, current_cost=$%.6f, reserved=$%.6f, limit=$%.6f",
+			promptTokens, estimate, totalCost, reservedCost, costLimitUSD)
+		return nil, budgetError("Request would exceed global cost limit.")
+	}
+
+	if key != nil && key.Project != "" {
+		if err := checkNodeBudgets(key.Project, estimate); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkTagBudgets(tags, estimate); err != nil {
+		return nil, err
+	}
+
+	if err := checkModelSpendCaps(model, estimate, time.Now()); err != nil {
+		return nil, err
+	}
+
+	if priority == priorityBatch && interactiveHeadroomPercent > 0 && totalCost+reservedCost+estimate >= batchCostLimit() {
+		log.Printf("Request shed: batch prompt would exceed the batch share of the quota, prompt_cost=$%.6f, current_cost=$%.6f, reserved=$%.6f, batch_limit=$%.6f",
+			estimate, totalCost, reservedCost, batchCostLimit())
+		return nil, budgetError("Request would exceed the cost limit for batch traffic.")
+	}
+
+	if key != nil && key.BudgetUSD > 0 {
+		keyReserved := keyReservedCost(keyID)
+		if keySpend[keyID]+keyReserved+estimate >= key.BudgetUSD {
+			log.Printf("Request blocked: prompt would exceed key budget, key=%s, prompt_cost=$%.6f, spent=$%.6f, reserved=$%.6f, budget=$%.6f",
+				keyID, estimate, keySpend[keyID], keyReserved, key.BudgetUSD)
+			return nil, budgetError("Request would exceed key cost limit.")
+		}
+	}
+
+	nextReservationID++
+	r := &Reservation{
+		ID:        nextReservationID,
+		KeyID:     keyID,
+		Model:     model,
+		CostUSD:   estimate,
+		StartedAt: time.Now().UTC(),
+		Priority:  priority,
+		Tags:      tags,
+	}
+	if key != nil {
+		r.Project = key.Project
+		r.keyName, r.keyBudget, r.keyCreated = key.Name, key.BudgetUSD, key.CreatedAt
+	}
+	reservations[r.ID] = r
+	reservedCost += estimate
+	return r, nil
+}
+
+func writeBudgetError(c *gin.Context, err error) {
+	c.JSON(http.StatusTooManyRequests, ErrorResponse{
+		Error: err.Error(),
+	})
+}
+
+// releaseReservation drops a reservation without charging it. Must hold mu.
+func releaseReservation(r *Reservation) {
+	if _, ok := reservations[r.ID]; !ok {
+		return
+	}
+	delete(reservations, r.ID)
+	reservedCost -= r.CostUSD
+	if len(reservations) == 0 {
+		reservedCost = 0 // avoid drift from floating point rounding
+	}
+}
+
+// settleReservation replaces a reservation with the actual cost of the request. Must hold mu.
+func settleReservation(r *Reservation, cost float64) {
+	releaseReservation(r)
+	totalCost += cost
+	if r.KeyID != "" {
+		keySpend[r.KeyID] += cost
+	}
+	chargeNodes(r.Project, cost)
+	chargeTags(r.Tags, cost)
+	now := time.Now()
+	chargeModelSpendCaps(r.Model, cost, now, now)
+}
+
+// Context keys set by proxy handlers for the quota headers
+const (
+	contextProxyKey    = "proxyKey"    // *ProxyKey the request was made with
+	contextRequestCost = "requestCost" // float64 charged for the request
+)
+
+// quotaStatus returns the limit and remaining amount that apply to requests
+// made with key: its budget or a budget above it in the budget tree when that
+// is tighter than the global quota. Must hold mu.
+func quotaStatus(key *ProxyKey) (limit, remaining float64) {
+	limit = costLimitUSD
+	remaining = costLimitUSD - totalCost - reservedCost
+	if key != nil {
+		if nodeLimit, nodeRemaining, ok := nodeQuotaStatus(key.Project); ok && nodeRemaining < remaining {
+			limit, remaining = nodeLimit, nodeRemaining
+		}
+	}
+	if key != nil && key.BudgetUSD > 0 {
+		keyRemaining := key.BudgetUSD - keySpend[key.ID] - keyReservedCost(key.ID)
+		if keyRemaining < remaining {
+			limit, remaining = key.BudgetUSD, keyRemaining
+		}
+	}
+	return limit, math.Max(remaining, 0)
+}
+
+// quotaHeaderWriter adds the quota headers just before the response is written,
+// so that they reflect the cost of the request.
+type quotaHeaderWriter struct {
+	gin.ResponseWriter
+	c    *gin.Context
+	done bool
+}
+
+func (w *quotaHeaderWriter) setHeaders() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.setQuotaValues()
+}
+
+func (w *quotaHeaderWriter) setQuotaValues() {
+	var key *ProxyKey
+	if value, ok := w.c.Get(contextProxyKey); ok {
+		key = value.(*ProxyKey)
+	}
+	cost := w.c.GetFloat64(contextRequestCost)
+
+	mu.Lock()
+	limit, remaining := quotaStatus(key)
+	mu.Unlock()
+
+	header := w.Header()
+	header.Set("X-Quota-Limit-USD", formatUSD(limit))
+	header.Set("X-Quota-Remaining-USD", formatUSD(remaining))
+	// Quotas are only reset through the admin API or by restarting the proxy
+	header.Set("X-Quota-Reset", "never")
+	header.Set("X-Request-Cost-USD", formatUSD(cost))
+}
+
+// declareQuotaTrailers announces that a streamed response repeats the quota
+// headers as trailers, once its cost is known. Must be called before the
+// response is written.
+func declareQuotaTrailers(c *gin.Context) {
+	if _, ok := c.Writer.(*quotaHeaderWriter); ok {
+		c.Writer.Header().Set("Trailer", "X-Quota-Remaining-USD, X-Request-Cost-USD")
+	}
+}
+
+// writeQuotaTrailers sets the trailers declared by declareQuotaTrailers after
+// the request has been charged.
+func writeQuotaTrailers(c *gin.Context) {
+	if w, ok := c.Writer.(*quotaHeaderWriter); ok {
+		w.setQuotaValues()
+	}
+}
+
+func (w *quotaHeaderWriter) WriteHeaderNow() {
+	w.setHeaders()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *quotaHeaderWriter) Write(data []byte) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *quotaHeaderWriter) WriteString(s string) (int, error) {
+	w.setHeaders()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *quotaHeaderWriter) Flush() {
+	w.setHeaders()
+	w.ResponseWriter.Flush()
+}
+
+// quotaHeaders reports the remaining quota and the cost of the request in
+// response headers, including on rejected requests. Handlers must not hold mu
+// while writing the response.
+func quotaHeaders(c *gin.Context) {
+	c.Writer = &quotaHeaderWriter{ResponseWriter: c.Writer, c: c}
+	c.Next()
+}
+
+func formatUSD(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 6, 64)
+}
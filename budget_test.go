@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func headerUSD(t *testing.T, header http.Header, name string) float64 {
+	t.Helper()
+	value, err := strconv.ParseFloat(header.Get(name), 64)
+	if err != nil {
+		t.Fatalf("Expected numeric %s header, got %q", name, header.Get(name))
+	}
+	return value
+}
+
+func TestQuotaHeaders(t *testing.T) {
+	resetGlobalState()
+	mockOpenAI(t, ChatResponse{Model: "gpt-4o", Usage: Usage{PromptTokens: 1000, CompletionTokens: 500}})
+	router := setupTestRouter()
+	totalCost = 0.5
+
+	w := postChat(router, "sk-test")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 1000 * $2.5/1M + 500 * $10/1M
+	cost := 0.0075
+	if got := headerUSD(t, w.Header(), "X-Request-Cost-USD"); got != cost {
+		t.Errorf("Expected request cost %f, got %f", cost, got)
+	}
+	if got := headerUSD(t, w.Header(), "X-Quota-Limit-USD"); got != 2.0 {
+		t.Errorf("Expected limit 2.0, got %f", got)
+	}
+	if got := headerUSD(t, w.Header(), "X-Quota-Remaining-USD"); got != 2.0-0.5-cost {
+		t.Errorf("Expected remaining %f, got %f", 2.0-0.5-cost, got)
+	}
+	if w.Header().Get("X-Quota-Reset") != "never" {
+		t.Errorf("Unexpected X-Quota-Reset: %q", w.Header().Get("X-Quota-Reset"))
+	}
+
+	// Rejected requests report the exhausted quota too
+	totalCost = 2.0
+	w = postChat(router, "sk-test")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+	if got := headerUSD(t, w.Header(), "X-Quota-Remaining-USD"); got != 0 {
+		t.Errorf("Expected remaining 0, got %f", got)
+	}
+	if got := headerUSD(t, w.Header(), "X-Request-Cost-USD"); got != 0 {
+		t.Errorf("Expected request cost 0, got %f", got)
+	}
+}
+
+func TestQuotaHeaders_KeyBudget(t *testing.T) {
+	resetGlobalState()
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	mockOpenAI(t, ChatResponse{Model: "gpt-4o", Usage: Usage{PromptTokens: 1000, CompletionTokens: 500}})
+	router := setupTestRouter()
+
+	secret, key, _ := store.Create("alice", 0.1)
+	keySpend[key.ID] = 0.05
+
+	w := postChat(router, secret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	// The key budget is tighter than the global quota
+	if got := headerUSD(t, w.Header(), "X-Quota-Limit-USD"); got != 0.1 {
+		t.Errorf("Expected key limit 0.1, got %f", got)
+	}
+	if got := headerUSD(t, w.Header(), "X-Quota-Remaining-USD"); got != 0.0425 {
+		t.Errorf("Expected remaining 0.0425, got %f", got)
+	}
+}
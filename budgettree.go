@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The budget tree has the global quota at its root (the organisation), teams
+// and projects below it as paths such as "platform/search", and keys as
+// leaves. A request made with a key in a project is charged to the key and to
+// every node above it, and is admitted only if each of them has headroom.
+
+// Node budgets by path, guarded by mu. Nodes without a budget only add up the
+// spend below them.
+var nodeBudgets = make(map[string]float64)
+
+// nodeSpend holds the spend of each node including everything below it,
+// restored from the ledger at startup. Guarded by mu.
+var nodeSpend = make(map[string]float64)
+
+// normalizeBudgetPath cleans a path such as "platform/search/"; "" is the root.
+func normalizeBudgetPath(path string) (string, error) {
+	path = strings.Trim(strings.TrimSpace(path), "/")
+	if path == "" {
+		return "", nil
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.TrimSpace(segment)
+		if segments[i] == "" || strings.ContainsAny(segments[i], "=,") {
+			return "", fmt.Errorf("invalid budget path %q: expected names separated by /, e.g. team/project", path)
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// budgetAncestors returns a node and the nodes above it, outermost first,
+// e.g. "platform" and "platform/search" for "platform/search".
+func budgetAncestors(path string) []string {
+	if path == "" {
+		return nil
+	}
+	segments := strings.Split(path, "/")
+	ancestors := make([]string, len(segments))
+	for i := range segments {
+		ancestors[i] = strings.Join(segments[:i+1], "/")
+	}
+	return ancestors
+}
+
+// underBudgetPath reports whether project is node or below it.
+func underBudgetPath(project, node string) bool {
+	return project == node || strings.HasPrefix(project, node+"/")
+}
+
+// nodeReservedCost sums the reservations of requests charged to a node. Must
+// hold mu.
+func nodeReservedCost(path string) float64 {
+	reserved := 0.0
+	for _, r := range reservations {
+		if r.Project != "" && underBudgetPath(r.Project, path) {
+			reserved += r.CostUSD
+		}
+	}
+	return reserved
+}
+
+// checkNodeBudgets rejects a request of a project estimated to cost estimate
+// if any node above it lacks the headroom. Must hold mu.
+func checkNodeBudgets(project string, estimate float64) error {
+	for _, path := range budgetAncestors(project) {
+		budget := nodeBudgets[path]
+		if budget <= 0 {
+			continue
+		}
+		if nodeSpend[path] >= budget {
+			log.Printf("Request blocked: budget of %s exceeded, spent=$%.6f, budget=$%.6f", path, nodeSpend[path], budget)
+			return budgetError(fmt.Sprintf("Cost limit of %s exceeded.", path))
+		}
+		reserved := nodeReservedCost(path)
+		if nodeSpend[path]+reserved+estimate >= budget {
+			log.Printf("Request blocked: prompt would exceed budget of %s, prompt_cost=$%.6f, spent=$%.6f, reserved=$%.6f, budget=$%.6f",
+				path, estimate, nodeSpend[path], reserved, budget)
+			return budgetError(fmt.Sprintf("Request would exceed cost limit of %s.", path))
+		}
+	}
+	return nil
+}
+
+// chargeNodes adds the cost of a request to its project and every node above
+// it. Must hold mu.
+func chargeNodes(project string, cost float64) {
+	for _, path := range budgetAncestors(project) {
+		nodeSpend[path] += cost
+	}
+}
+
+// nodeQuotaStatus returns the tightest node budget above a project, for the
+// quota headers. Must hold mu.
+func nodeQuotaStatus(project string) (limit, remaining float64, ok bool) {
+	for _, path := range budgetAncestors(project) {
+		budget := nodeBudgets[path]
+		if budget <= 0 {
+			continue
+		}
+		nodeRemaining := budget - nodeSpend[path] - nodeReservedCost(path)
+		if !ok || nodeRemaining < remaining {
+			limit, remaining, ok = budget, nodeRemaining, true
+		}
+	}
+	return limit, remaining, ok
+}
+
+// BudgetNode is a node of the budget tree with the spend rolled up from below.
+type BudgetNode struct {
+	Name        string        `json:"name"`
+	Path        string        `json:"path"`
+	BudgetUSD   float64       `json:"budget_usd"` // 0 means no budget of its own
+	SpentUSD    float64       `json:"spent_usd"`
+	ReservedUSD float64       `json:"reserved_usd"`
+	Children    []*BudgetNode `json:"children,omitempty"`
+	Keys        []BudgetKey   `json:"keys,omitempty"`
+}
+
+// BudgetKey is a key in the budget tree.
+type BudgetKey struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	BudgetUSD   float64 `json:"budget_usd"`
+	SpentUSD    float64 `json:"spent_usd"`
+	ReservedUSD float64 `json:"reserved_usd"`
+}
+
+// budgetTree builds the tree of every node with a budget, spend or keys, with
+// keys placed under their projects. Must hold mu.
+func budgetTree(keys []ProxyKey) *BudgetNode {
+	root := &BudgetNode{Name: "organisation", BudgetUSD: costLimitUSD, SpentUSD: totalCost, ReservedUSD: reservedCost}
+	nodes := map[string]*BudgetNode{"": root}
+	var node func(path string) *BudgetNode
+	node = func(path string) *BudgetNode {
+		if n, ok := nodes[path]; ok {
+			return n
+		}
+		parent, name := "", path
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			parent, name = path[:i], path[i+1:]
+		}
+		n := &BudgetNode{
+			Name:        name,
+			Path:        path,
+			BudgetUSD:   nodeBudgets[path],
+			SpentUSD:    nodeSpend[path],
+			ReservedUSD: nodeReservedCost(path),
+		}
+		nodes[path] = n
+		p := node(parent)
+		p.Children = append(p.Children, n)
+		return n
+	}
+
+	for path := range nodeBudgets {
+		node(path)
+	}
+	for path := range nodeSpend {
+		node(path)
+	}
+	for _, k := range keys {
+		if k.Revoked() {
+			continue
+		}
+		n := node(k.Project)
+		n.Keys = append(n.Keys, BudgetKey{
+			ID:          k.ID,
+			Name:        k.Name,
+			BudgetUSD:   k.BudgetUSD,
+			SpentUSD:    keySpend[k.ID],
+			ReservedUSD: keyReservedCost(k.ID),
+		})
+	}
+	for _, n := range nodes {
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+	}
+	return root
+}
+
+// parseNodeBudgets parses comma-separated path=USD entries, e.g.
+// "platform=100,platform/search=40".
+func parseNodeBudgets(value string) (map[string]float64, error) {
+	budgets := make(map[string]float64)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, amount, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be path=USD", entry)
+		}
+		path, err := normalizeBudgetPath(path)
+		if err != nil {
+			return nil, err
+		}
+		if path == "" {
+			return nil, fmt.Errorf("entry %q: the organisation's budget is the quota setting", entry)
+		}
+		budget, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if err != nil || math.IsNaN(budget) || math.IsInf(budget, 0) || budget < 0 {
+			return nil, fmt.Errorf("entry %q: budget must be a non-negative amount in USD", entry)
+		}
+		budgets[path] = budget
+	}
+	return budgets, nil
+}
+
+// formatNodeBudgets is the inverse of parseNodeBudgets, sorted by path.
+func formatNodeBudgets(budgets map[string]float64) []string {
+	entries := make([]string, 0, len(budgets))
+	for path, budget := range budgets {
+		entries = append(entries, path+"="+strconv.FormatFloat(budget, 'f', -1, 64))
+	}
+	sort.Strings(entries)
+	return entries
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetBudgetTree(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		nodeBudgets = make(map[string]float64)
+		nodeSpend = make(map[string]float64)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestBudgetPaths(t *testing.T) {
+	if path, err := normalizeBudgetPath(" /platform/ search/"); err != nil || path != "platform/search" {
+		t.Errorf("Expected platform/search, got %q: %v", path, err)
+	}
+	for _, path := range []string{"platform//search", "a=b", "x,y"} {
+		if _, err := normalizeBudgetPath(path); err == nil {
+			t.Errorf("Expected error for %q", path)
+		}
+	}
+	if ancestors := budgetAncestors("platform/search/indexer"); strings.Join(ancestors, " ") != "platform platform/search platform/search/indexer" {
+		t.Errorf("Unexpected ancestors: %v", ancestors)
+	}
+	if underBudgetPath("platform-tools", "platform") || !underBudgetPath("platform/search", "platform") {
+		t.Error("Expected paths to match by segments")
+	}
+
+	budgets, err := parseNodeBudgets("platform=100, platform/search/=40,research=0")
+	if err != nil || len(budgets) != 3 || budgets["platform/search"] != 40 {
+		t.Errorf("Unexpected budgets %v: %v", budgets, err)
+	}
+	if entries := formatNodeBudgets(budgets); strings.Join(entries, ",") != "platform/search=40,platform=100,research=0" {
+		t.Errorf("Unexpected format: %v", entries)
+	}
+	for _, value := range []string{"platform", "=5", "platform=-1", "platform=lots"} {
+		if _, err := parseNodeBudgets(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestBudgetTree_Admission(t *testing.T) {
+	resetGlobalState()
+	resetBudgetTree(t)
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	searchSecret, search, _ := store.Create("indexer", 0)
+	store.SetProject(search.ID, "platform/search")
+	toolsSecret, tools, _ := store.Create("tools", 0)
+	store.SetProject(tools.ID, "platform/tools")
+	nodeBudgets["platform"] = 1
+	nodeBudgets["platform/search"] = 0.5
+
+	// Charged to the key and every node above it
+	if w := postChat(router, searchSecret); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	mu.Lock()
+	spent := []float64{nodeSpend["platform"], nodeSpend["platform/search"], nodeSpend["platform/tools"], keySpend[search.ID]}
+	mu.Unlock()
+	if spent[0] != spent[1] || spent[1] != spent[3] || spent[0] == 0 || spent[2] != 0 {
+		t.Errorf("Expected the cost at every level above the key, got %v", spent)
+	}
+
+	// The project's budget rejects its keys only
+	mu.Lock()
+	nodeSpend["platform/search"] = 0.5
+	mu.Unlock()
+	w := postChat(router, searchSecret)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "platform/search") {
+		t.Errorf("Expected project budget rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postChat(router, toolsSecret); w.Code != http.StatusOK {
+		t.Errorf("Expected sibling project to pass, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The team's budget rejects every project below it
+	mu.Lock()
+	nodeSpend["platform"] = 1
+	mu.Unlock()
+	if w := postChat(router, toolsSecret); w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "Cost limit of platform exceeded") {
+		t.Errorf("Expected team budget rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(reservations) != 0 {
+		t.Errorf("Expected rejected requests to leave no reservation, got %d", len(reservations))
+	}
+}
+
+func TestBudgetTree_RestoredFromLedger(t *testing.T) {
+	resetBudgetTree(t)
+	keySpend = make(map[string]float64)
+	t.Cleanup(func() { keySpend = make(map[string]float64) })
+
+	now := time.Now().UTC()
+	restoreKeySpend([]LedgerEntry{
+		{Time: now, KeyID: "key_1", Project: "platform/search", CostUSD: 1},
+		{Time: now, KeyID: "key_2", Project: "platform", CostUSD: 2},
+		{Time: now, Type: ledgerEntryReset, KeyID: "key_1"},
+	})
+	// Resetting a key's spend does not undo what its project spent
+	if nodeSpend["platform"] != 3 || nodeSpend["platform/search"] != 1 || keySpend["key_1"] != 0 {
+		t.Errorf("Unexpected spend: nodes %v, keys %v", nodeSpend, keySpend)
+	}
+}
+
+func TestAdminBudgetTree(t *testing.T) {
+	resetGlobalState()
+	resetBudgetTree(t)
+	setupTestAdmin(t)
+	store := setupTestKeyStore(t)
+	router := setupTestRouter()
+	_, key, _ := store.Create("indexer", 2)
+
+	w := adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/project", `{"project": "platform/search"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"project":"platform/search"`) {
+		t.Errorf("Expected key project, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/project", `{"project": "a//b"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid path, got %d", w.Code)
+	}
+	w = adminRequest(router, "PUT", "/admin/budgets/platform", `{"budget_usd": 50}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"budget_usd":50`) {
+		t.Errorf("Expected node budget, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = adminRequest(router, "PUT", "/admin/budgets/", `{"budget_usd": 50}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for the root, got %d", w.Code)
+	}
+
+	mu.Lock()
+	chargeNodes("platform/search", 0.25)
+	mu.Unlock()
+	w = adminRequest(router, "GET", "/admin/budgets", "")
+	var root BudgetNode
+	if err := json.Unmarshal(w.Body.Bytes(), &root); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if root.Name != "organisation" || root.BudgetUSD != costLimitUSD || len(root.Children) != 1 {
+		t.Fatalf("Unexpected root: %+v", root)
+	}
+	platform := root.Children[0]
+	if platform.Path != "platform" || platform.BudgetUSD != 50 || platform.SpentUSD != 0.25 || len(platform.Children) != 1 {
+		t.Fatalf("Unexpected team node: %+v", platform)
+	}
+	search := platform.Children[0]
+	if search.Name != "search" || search.SpentUSD != 0.25 || len(search.Keys) != 1 || search.Keys[0].BudgetUSD != 2 {
+		t.Errorf("Unexpected project node: %+v", search)
+	}
+}
+
+func TestAdminResetNodeBudget(t *testing.T) {
+	resetGlobalState()
+	resetBudgetTree(t)
+	setupTestAdmin(t)
+	router := setupTestRouter()
+
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	ledger = l
+	defer func() {
+		ledger = nil
+		l.Close()
+	}()
+
+	now := time.Now().UTC()
+	charges := []LedgerEntry{
+		{Time: now, KeyID: "key_1", Project: "platform/search", CostUSD: 1},
+		{Time: now, KeyID: "key_2", Project: "platform", CostUSD: 2},
+	}
+	for _, entry := range charges {
+		ledger.Append(entry)
+	}
+	mu.Lock()
+	nodeBudgets["platform"] = 5
+	restoreKeySpend(charges)
+	mu.Unlock()
+
+	w := adminRequest(router, "POST", "/admin/budgets/platform/reset", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"spent_usd":0`) {
+		t.Errorf("Expected node reset, got %d: %s", w.Code, w.Body.String())
+	}
+	// The nodes below keep their spend
+	if nodeSpend["platform"] != 0 || nodeSpend["platform/search"] != 1 {
+		t.Errorf("Unexpected spend after reset: %v", nodeSpend)
+	}
+	if w = adminRequest(router, "POST", "/admin/budgets/reset", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for the root, got %d", w.Code)
+	}
+	if w = adminRequest(router, "POST", "/admin/budgets/platform", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 without /reset, got %d", w.Code)
+	}
+
+	// Spend after the reset counts again, and a restart honours the reset
+	ledger.Append(LedgerEntry{Time: now, KeyID: "key_2", Project: "platform", CostUSD: 0.5})
+	entries, err := readLedger(ledgerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeSpend = make(map[string]float64)
+	keySpend = make(map[string]float64)
+	t.Cleanup(func() { keySpend = make(map[string]float64) })
+	restoreKeySpend(entries)
+	if nodeSpend["platform"] != 0.5 || nodeSpend["platform/search"] != 1 || keySpend["key_2"] != 2.5 {
+		t.Errorf("Unexpected spend after restart: nodes %v, keys %v", nodeSpend, keySpend)
+	}
+}
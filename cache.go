@@ -0,0 +1,379 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The response cache serves repeated deterministic chat requests (temperature
+// 0) without calling OpenAI. Entries are keyed by a hash of the canonical
+// request, which includes the model, and hits are not charged.
+
+const (
+	cacheMemory = "memory"
+	cacheDisk   = "disk"
+)
+
+// Header reporting whether a response came from the cache: hit, miss or
+// bypass. Clients skip the cache with Cache-Control: no-cache or no-store.
+const cacheHeader = "X-Proxy-Cache"
+
+// CacheEntry is a cached response and what it cost when it was fetched.
+type CacheEntry struct {
+	Key              string          `json:"key"`
+	StoredAt         time.Time       `json:"stored_at"`
+	Response         json.RawMessage `json:"response"`
+	PromptTokens     int             `json:"prompt_tokens"`
+	CompletionTokens int             `json:"completion_tokens"`
+	CostUSD          float64         `json:"cost_usd"`
+	ServiceTier      string          `json:"service_tier,omitempty"`
+}
+
+func (e *CacheEntry) size() int64 {
+	return int64(len(e.Response))
+}
+
+// ResponseCache stores entries for ttl, evicting the least recently stored
+// ones beyond maxBytes of responses.
+type ResponseCache struct {
+	backend  string
+	dir      string // disk backend only
+	ttl      time.Duration
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // memory backend: values are *CacheEntry
+	order   *list.List               // oldest first
+	bytes   int64
+
+	hits, misses int
+	savedUSD     float64
+}
+
+var responseCache *ResponseCache
+
+// newResponseCache creates a cache with the memory or disk backend.
+func newResponseCache(backend, dir string, ttl time.Duration, maxBytes int64) (*ResponseCache, error) {
+	c := &ResponseCache{
+		backend:  backend,
+		dir:      dir,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+	if backend == cacheDisk {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("cannot create cache directory: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// cacheKey hashes a request; encoding/json writes struct fields in a fixed
+// order, so equal requests have equal keys.
+func cacheKey(path string, request interface{}) (string, error) {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(path+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *ResponseCache) expired(e *CacheEntry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(e.StoredAt) >= c.ttl
+}
+
+// Get returns the live entry for key and counts the lookup.
+func (c *ResponseCache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entry *CacheEntry
+	if c.backend == cacheDisk {
+		entry = c.readFile(key)
+	} else if el, ok := c.entries[key]; ok {
+		entry = el.Value.(*CacheEntry)
+	}
+	if entry != nil && c.expired(entry, time.Now()) {
+		c.remove(key)
+		entry = nil
+	}
+	if entry == nil {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.savedUSD += entry.CostUSD
+	return entry, true
+}
+
+// Put stores an entry, evicting the oldest ones to stay within maxBytes.
+// Entries larger than maxBytes are not stored.
+func (c *ResponseCache) Put(entry *CacheEntry) {
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.backend == cacheDisk {
+		if err := c.writeFile(entry); err != nil {
+			log.Printf("Warning: cannot write cache entry: %v", err)
+		}
+		c.evictFiles()
+		return
+	}
+	c.remove(entry.Key)
+	c.entries[entry.Key] = c.order.PushBack(entry)
+	c.bytes += entry.size()
+	now := time.Now()
+	for el := c.order.Front(); el != nil && c.maxBytes > 0 && c.bytes > c.maxBytes; el = c.order.Front() {
+		c.remove(el.Value.(*CacheEntry).Key)
+	}
+	for el := c.order.Front(); el != nil && c.expired(el.Value.(*CacheEntry), now); el = c.order.Front() {
+		c.remove(el.Value.(*CacheEntry).Key)
+	}
+}
+
+// Purge drops every entry and returns how many there were.
+func (c *ResponseCache) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.backend == cacheDisk {
+		files := c.files()
+		for _, f := range files {
+			os.Remove(f.path)
+		}
+		return len(files)
+	}
+	n := len(c.entries)
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+	return n
+}
+
+// Status describes the cache and its counters.
+func (c *ResponseCache) Status() gin.H {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, bytes := len(c.entries), c.bytes
+	if c.backend == cacheDisk {
+		files := c.files()
+		entries, bytes = len(files), 0
+		for _, f := range files {
+			bytes += f.size
+		}
+	}
+	return gin.H{
+		"backend":   c.backend,
+		"ttl":       c.ttl.String(),
+		"max_bytes": c.maxBytes,
+		"entries":   entries,
+		"bytes":     bytes,
+		"hits":      c.hits,
+		"misses":    c.misses,
+		"saved_usd": c.savedUSD,
+	}
+}
+
+// remove drops an entry. Must hold c.mu.
+func (c *ResponseCache) remove(key string) {
+	if c.backend == cacheDisk {
+		os.Remove(c.path(key))
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.bytes -= el.Value.(*CacheEntry).size()
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *ResponseCache) readFile(key string) *CacheEntry {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	var entry CacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key {
+		return nil
+	}
+	return &entry
+}
+
+// writeFile writes an entry to a temporary file and renames it into place,
+// so readers never see a partial entry.
+func (c *ResponseCache) writeFile(entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, "."+entry.Key+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path(entry.Key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+type cacheFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// files lists the entries on disk, oldest first.
+func (c *ResponseCache) files() []cacheFile {
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil
+	}
+	var files []cacheFile
+	for _, d := range dirEntries {
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") || !strings.HasSuffix(d.Name(), ".json") {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, cacheFile{path: filepath.Join(c.dir, d.Name()), size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files
+}
+
+// evictFiles removes expired entries and the oldest ones beyond maxBytes.
+// Must hold c.mu.
+func (c *ResponseCache) evictFiles() {
+	files := c.files()
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	now := time.Now()
+	for _, f := range files {
+		if !(c.maxBytes > 0 && total > c.maxBytes) && !(c.ttl > 0 && now.Sub(f.modTime) >= c.ttl) {
+			break
+		}
+		os.Remove(f.path)
+		total -= f.size
+	}
+}
+
+// cacheable reports whether a chat request may be answered from the cache:
+// the cache is enabled, the request is deterministic and the client did not
+// opt out. It sets the cache header for requests that bypass the cache.
+func cacheable(c *gin.Context, reqData ChatRequest) bool {
+	if responseCache == nil {
+		return false
+	}
+	control := strings.ToLower(c.GetHeader("Cache-Control"))
+	if reqData.Temperature == nil || *reqData.Temperature != 0 ||
+		strings.Contains(control, "no-cache") || strings.Contains(control, "no-store") {
+		c.Header(cacheHeader, "bypass")
+		return false
+	}
+	return true
+}
+
+// serveCached answers a request from the cache. The hit is recorded in the
+// ledger without a cost, and ProxyUsage reports the amount saved.
+func serveCached(c *gin.Context, key *ProxyKey, model string, entry *CacheEntry) {
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(entry.Response, &response); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Cannot read cached response."})
+		return
+	}
+	usage, _ := json.Marshal(&ProxyUsage{
+		PromptTokens:     entry.PromptTokens,
+		CompletionTokens: entry.CompletionTokens,
+		ServiceTier:      normalizeServiceTier(entry.ServiceTier),
+		SavedUSD:         entry.CostUSD,
+	})
+	response["proxy_usage"] = usage
+
+	keyID, project := "", ""
+	if key != nil {
+		keyID, project = key.ID, key.Project
+	}
+	recordUsage(LedgerEntry{
+		Time:             time.Now().UTC(),
+		Type:             ledgerEntryCacheHit,
+		KeyID:            keyID,
+		Project:          project,
+		Tags:             requestTags(c),
+		User:             c.GetString(contextUser),
+		Model:            model,
+		PromptTokens:     entry.PromptTokens,
+		CompletionTokens: entry.CompletionTokens,
+		SavedUSD:         entry.CostUSD,
+	})
+	logInfof("Cache hit: model=%s, saved=$%.6f", model, entry.CostUSD)
+
+	c.Header(cacheHeader, "hit")
+	c.Header("Age", fmt.Sprintf("%d", int(time.Since(entry.StoredAt).Seconds())))
+	c.JSON(http.StatusOK, response)
+}
+
+// storeCached caches a response, before its ProxyUsage is set, with what it
+// cost.
+func storeCached(key string, response interface{}, promptTokens, completionTokens int, cost float64, serviceTier string) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Warning: cannot encode response for the cache: %v", err)
+		return
+	}
+	responseCache.Put(&CacheEntry{
+		Key:              key,
+		StoredAt:         time.Now().UTC(),
+		Response:         body,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		CostUSD:          cost,
+		ServiceTier:      serviceTier,
+	})
+}
+
+// parseCacheBackend validates the cache setting; "" or "off" disables it.
+func parseCacheBackend(value string) (string, error) {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "", "off":
+		return "", nil
+	case cacheMemory, cacheDisk:
+		return value, nil
+	}
+	return "", fmt.Errorf("must be off, memory or disk, got %q", value)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupTestCache(t *testing.T, backend string) *ResponseCache {
+	t.Helper()
+	cache, err := newResponseCache(backend, filepath.Join(t.TempDir(), "cache"), time.Hour, 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	responseCache = cache
+	t.Cleanup(func() { responseCache = nil })
+	return cache
+}
+
+// postCachedChat sends a deterministic chat request with extra headers.
+func postCachedChat(router http.Handler, model string, headers map[string]string) *httptest.ResponseRecorder {
+	body := `{"model":"` + model + `","messages":[{"role":"user","content":"Hello"}],"temperature":0}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestResponseCache_ChatCompletions(t *testing.T) {
+	resetGlobalState()
+	setupTestCache(t, cacheMemory)
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	ledger = l
+	defer func() {
+		ledger = nil
+		l.Close()
+	}()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	w := postCachedChat(router, "gpt-4o", nil)
+	if w.Code != http.StatusOK || w.Header().Get(cacheHeader) != "miss" {
+		t.Fatalf("Expected a miss, got %d %q: %s", w.Code, w.Header().Get(cacheHeader), w.Body.String())
+	}
+	spent := totalCost
+
+	// The same request is served from the cache without a charge
+	w = postCachedChat(router, "gpt-4o", nil)
+	var response ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || w.Header().Get(cacheHeader) != "hit" || response.Choices[0].Message.Content != "Hi" {
+		t.Fatalf("Expected a hit, got %d %q: %s", w.Code, w.Header().Get(cacheHeader), w.Body.String())
+	}
+	if usage := response.ProxyUsage; usage.CostUSD != 0 || usage.SavedUSD != spent || usage.PromptTokens != 10 {
+		t.Errorf("Expected no cost and the saved amount, got %+v", usage)
+	}
+	if api.count("POST /v1/chat/completions") != 1 || totalCost != spent {
+		t.Errorf("Expected one upstream call and no charge, got %d calls and $%f", api.count("POST /v1/chat/completions"), totalCost)
+	}
+
+	// Other models and non-deterministic requests are not served from it
+	if w := postCachedChat(router, "gpt-4o-mini", nil); w.Header().Get(cacheHeader) != "miss" {
+		t.Errorf("Expected a miss for another model, got %q", w.Header().Get(cacheHeader))
+	}
+	if w := postCachedChat(router, "gpt-4o", map[string]string{"Cache-Control": "no-cache"}); w.Header().Get(cacheHeader) != "bypass" {
+		t.Errorf("Expected no-cache to bypass, got %q", w.Header().Get(cacheHeader))
+	}
+	if w := postChat(router, "sk-test"); w.Header().Get(cacheHeader) != "bypass" {
+		t.Errorf("Expected a request without temperature 0 to bypass, got %q", w.Header().Get(cacheHeader))
+	}
+
+	entries, _ := readLedger(ledgerFile)
+	hits := 0
+	for _, e := range entries {
+		if e.Type == ledgerEntryCacheHit {
+			hits++
+			if e.CostUSD != 0 || e.SavedUSD != spent || e.Model != "gpt-4o" {
+				t.Errorf("Unexpected cache hit entry: %+v", e)
+			}
+		}
+	}
+	if hits != 1 || len(entries) != 5 {
+		t.Errorf("Expected 4 charged requests and 1 cache hit in the ledger, got %d entries with %d hits", len(entries), hits)
+	}
+}
+
+func TestResponseCache_Eviction(t *testing.T) {
+	for _, backend := range []string{cacheMemory, cacheDisk} {
+		t.Run(backend, func(t *testing.T) {
+			cache := setupTestCache(t, backend)
+			cache.maxBytes = 250
+			now := time.Now().UTC()
+			response := json.RawMessage(`{"id":"` + strings.Repeat("x", 90) + `"}`)
+
+			cache.Put(&CacheEntry{Key: "expired", StoredAt: now.Add(-2 * time.Hour), Response: response, CostUSD: 1})
+			if _, ok := cache.Get("expired"); ok {
+				t.Error("Expected an expired entry to be missed")
+			}
+
+			cache.Put(&CacheEntry{Key: "a", StoredAt: now, Response: response, CostUSD: 1})
+			if backend == cacheDisk {
+				// Entries on disk are evicted by modification time
+				os.Chtimes(cache.path("a"), now.Add(-time.Minute), now.Add(-time.Minute))
+			}
+			cache.Put(&CacheEntry{Key: "b", StoredAt: now, Response: response, CostUSD: 1})
+			cache.Put(&CacheEntry{Key: "c", StoredAt: now, Response: response, CostUSD: 1})
+			if _, ok := cache.Get("a"); ok {
+				t.Error("Expected the oldest entry evicted beyond the size limit")
+			}
+			if entry, ok := cache.Get("c"); !ok || string(entry.Response) != string(response) {
+				t.Errorf("Expected the newest entry, got %v", entry)
+			}
+			cache.Put(&CacheEntry{Key: "large", StoredAt: now, Response: json.RawMessage(strings.Repeat(" ", 300))})
+			if _, ok := cache.Get("large"); ok {
+				t.Error("Expected an entry over the size limit not to be stored")
+			}
+
+			status := cache.Status()
+			if status["hits"] != 1 || status["misses"] != 3 || status["saved_usd"] != 1.0 {
+				t.Errorf("Unexpected status: %v", status)
+			}
+			if purged := cache.Purge(); purged == 0 {
+				t.Error("Expected entries to be purged")
+			}
+			if _, ok := cache.Get("c"); ok {
+				t.Error("Expected no entries after a purge")
+			}
+		})
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	router := setupTestRouter()
+
+	if w := adminRequest(router, "GET", "/admin/cache", ""); !strings.Contains(w.Body.String(), `"backend":"off"`) {
+		t.Errorf("Expected the cache off, got %s", w.Body.String())
+	}
+	cache := setupTestCache(t, cacheMemory)
+	cache.Put(&CacheEntry{Key: "a", StoredAt: time.Now(), Response: json.RawMessage(`{}`)})
+	w := adminRequest(router, "DELETE", "/admin/cache", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"purged":1`) {
+		t.Errorf("Expected one entry purged, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(router, "GET", "/admin/cache", ""); !strings.Contains(w.Body.String(), `"entries":0`) {
+		t.Errorf("Expected an empty cache, got %s", w.Body.String())
+	}
+}
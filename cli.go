@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errUsage is returned by commands invoked with missing or unknown arguments.
+var errUsage = errors.New("invalid usage")
+
+// commands are the administrative subcommands that run offline instead of
+// starting the server.
+var commands = map[string]func(args []string, w io.Writer) error{
+	"config":   runConfigCommand,
+	"pricing":  runPricingCommand,
+	"estimate": runEstimateCommand,
+	"usage":    runUsageCommand,
+	"keys":     runKeysCommand,
+}
+
+func printCommandsUsage(w io.Writer, name string) {
+	fmt.Fprintf(w, "Usage: %s [serve] [options]\n", name)
+	fmt.Fprintf(w, "       %s config print [options]\n", name)
+	fmt.Fprintf(w, "       %s pricing validate [options] <file>\n", name)
+	fmt.Fprintf(w, "       %s pricing show [options] [-model m]\n", name)
+	fmt.Fprintf(w, "       %s estimate [options] -model m -file prompt.json [-max-tokens n]\n", name)
+	fmt.Fprintf(w, "       %s usage report [options] [-by model|key|day] [-since YYYY-MM-DD]\n", name)
+	fmt.Fprintf(w, "       %s keys create|revoke|list [options]\n", name)
+}
+
+// commandConfig parses the configuration flags shared by all commands plus
+// the command's own flags, which register registers on fs.
+func commandConfig(name string, args []string, register func(fs *flag.FlagSet)) (*Config, *flag.FlagSet, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	if register != nil {
+		register(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if flags.help {
+		fs.Usage()
+		return nil, nil, flag.ErrHelp
+	}
+
+	cfg, err := loadConfig(fs, flags, os.Getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Keep command output free of routine server logs
+	logLevel = "warn"
+	return cfg, fs, nil
+}
+
+func runConfigCommand(args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("%w: config print [options]", errUsage)
+	}
+
+	cfg, _, err := commandConfig("config print", args[1:], nil)
+	if err != nil {
+		return err
+	}
+	return printConfig(w, cfg)
+}
+
+func runPricingCommand(args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: pricing validate|show", errUsage)
+	}
+
+	switch args[0] {
+	case "validate":
+		_, fs, err := commandConfig("pricing validate", args[1:], nil)
+		if err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("%w: pricing validate [options] <file>", errUsage)
+		}
+		return validatePricingFile(fs.Arg(0), w)
+
+	case "show":
+		var model string
+		cfg, _, err := commandConfig("pricing show", args[1:], func(fs *flag.FlagSet) {
+			fs.StringVar(&model, "model", "", "Show only the pricing used for this model")
+		})
+		if err != nil {
+			return err
+		}
+		if err := loadModelPricing(cfg.PricingFile); err != nil {
+			return err
+		}
+		return showPricing(w, model)
+
+	default:
+		return fmt.Errorf("%w: unknown pricing command %q", errUsage, args[0])
+	}
+}
+
+func validatePricingFile(filename string, w io.Writer) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open pricing file: %w", err)
+	}
+
+	models := make(map[string]ModelPricing)
+	problems, err := parsePricingCSV(string(data), models)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(w, "%s: %s\n", filename, problem)
+	}
+
+	rules := 0
+	for name, pricing := range models {
+		if name == pricing.Model {
+			rules += len(pricing.Rules)
+		}
+	}
+	fmt.Fprintf(w, "%s: %d entries, %d pricing rules\n", filename, len(models), rules)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %d problem(s) found", filename, len(problems))
+	}
+	return nil
+}
+
+func showPricing(w io.Writer, model string) error {
+	var models []ModelPricing
+	if model != "" {
+		pricing, found := getPricingForModel(model)
+		if !found {
+			return fmt.Errorf("no pricing for model %s", model)
+		}
+		models = append(models, pricing)
+	} else {
+		for name, pricing := range modelPricing {
+			// Version aliases share the entry of their model
+			if name == pricing.Model {
+				models = append(models, pricing)
+			}
+		}
+		sort.Slice(models, func(i, j int) bool { return models[i].Model < models[j].Model })
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODEL\tVERSION\tTIER\tMIN PROMPT\tINPUT\tCACHED INPUT\tOUTPUT")
+	for _, pricing := range models {
+		fmt.Fprintf(tw, "%s\t%s\t-\t-\t%g\t%g\t%g\n", pricing.Model, pricing.Version, pricing.Input, pricing.CachedInput, pricing.Output)
+		for _, rule := range pricing.Rules {
+			tier := rule.ServiceTier
+			if tier == "" {
+				tier = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%g\t%g\t%g\n", pricing.Model, pricing.Version, tier, rule.MinPromptTokens, rule.Input, rule.CachedInput, rule.Output)
+		}
+	}
+	fmt.Fprintln(tw, "\nPrices in USD per 1M tokens.")
+
+	var images []ModelPricing
+	for _, pricing := range models {
+		if len(pricing.ImagePrices) > 0 {
+			images = append(images, pricing)
+		}
+	}
+	if len(images) > 0 {
+		fmt.Fprintln(tw, "\nMODEL\tSIZE\tQUALITY\tPER IMAGE")
+		for _, pricing := range images {
+			for _, price := range pricing.ImagePrices {
+				quality := price.Quality
+				if quality == "" {
+					quality = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%g\n", pricing.Model, price.Size, quality, price.PerImage)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func runEstimateCommand(args []string, w io.Writer) error {
+	var (
+		model       string
+		file        string
+		maxTokens   int
+		serviceTier string
+	)
+	cfg, _, err := commandConfig("estimate", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&model, "model", "", "Model to price (defaults to the model in the file)")
+		fs.StringVar(&file, "file", "", "Chat request JSON or array of messages")
+		fs.IntVar(&maxTokens, "max-tokens", 0, "Completion tokens per choice to include in the estimate (defaults to max_completion_tokens or max_tokens in the file)")
+		fs.StringVar(&serviceTier, "service-tier", "", "Service tier to price (defaults to service_tier in the file)")
+	})
+	if err != nil {
+		return err
+	}
+	if file == "" {
+		return fmt.Errorf("%w: estimate -file prompt.json [-model m]", errUsage)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("cannot read prompt file: %w", err)
+	}
+	var reqData ChatRequest
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "[") {
+		err = json.Unmarshal(data, &reqData.Messages)
+	} else {
+		err = json.Unmarshal(data, &reqData)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid chat request: %w", file, err)
+	}
+
+	if model != "" {
+		reqData.Model = model
+	}
+	if reqData.Model == "" {
+		return errors.New("no model given: use -model or set \"model\" in the file")
+	}
+	// The worst case is the one admission reserves: the output limit for
+	// each of the n choices
+	if maxTokens != 0 {
+		reqData.MaxCompletion = &maxTokens
+	}
+	maxTokens = maxCompletionTokens(reqData)
+	if serviceTier == "" {
+		serviceTier = reqData.ServiceTier
+	}
+
+	if err := loadModelPricing(cfg.PricingFile); err != nil {
+		return err
+	}
+
+	encodingsDir = cfg.EncodingsDir
+	promptTokens := countChatTokens(reqData)
+	promptCost := calculateCostForTier(promptTokens, 0, reqData.Model, serviceTier)
+	pricing, found := getPricingForModel(reqData.Model)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Model:\t%s\n", reqData.Model)
+	if !found {
+		fmt.Fprintf(tw, "Pricing:\tnot found, using default rates\n")
+	} else if pricing.Model != reqData.Model {
+		fmt.Fprintf(tw, "Pricing:\t%s\n", pricing.Model)
+	}
+	if serviceTier != "" {
+		fmt.Fprintf(tw, "Service tier:\t%s\n", serviceTier)
+	}
+	fmt.Fprintf(tw, "Messages:\t%d\n", len(reqData.Messages))
+	fmt.Fprintf(tw, "Prompt tokens:\t%d\n", promptTokens)
+	fmt.Fprintf(tw, "Prompt cost:\t$%.6f\n", promptCost)
+	if maxTokens > 0 {
+		maxCost := calculateCostForTier(promptTokens, maxTokens, reqData.Model, serviceTier)
+		fmt.Fprintf(tw, "Max completion tokens:\t%d\n", maxTokens)
+		fmt.Fprintf(tw, "Max total cost:\t$%.6f\n", maxCost)
+	}
+	return tw.Flush()
+}
+
+func runUsageCommand(args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] != "report" {
+		return fmt.Errorf("%w: usage report [options]", errUsage)
+	}
+
+	var by, since, until, tag string
+	cfg, _, err := commandConfig("usage report", args[1:], func(fs *flag.FlagSet) {
+		fs.StringVar(&by, "by", "model", "Group by model, key, project, user, day or tag:<name>")
+		fs.StringVar(&tag, "tag", "", "Only include usage with this tag, e.g. env=staging")
+		fs.StringVar(&since, "since", "", "Only include usage on or after this date (YYYY-MM-DD, UTC)")
+		fs.StringVar(&until, "until", "", "Only include usage before this date (YYYY-MM-DD, UTC)")
+	})
+	if err != nil {
+		return err
+	}
+	if cfg.LedgerFile == "" {
+		return errors.New("no ledger configured: set ledger_file, LEDGER_FILE or -ledger")
+	}
+
+	var from, to time.Time
+	if since != "" {
+		if from, err = time.Parse("2006-01-02", since); err != nil {
+			return fmt.Errorf("invalid -since date %q: expected YYYY-MM-DD", since)
+		}
+	}
+	if until != "" {
+		if to, err = time.Parse("2006-01-02", until); err != nil {
+			return fmt.Errorf("invalid -until date %q: expected YYYY-MM-DD", until)
+		}
+	}
+
+	var filter map[string]string
+	if tag != "" {
+		if filter, err = parseTags(tag); err != nil {
+			return fmt.Errorf("invalid -tag value: %w", err)
+		}
+	}
+
+	entries, err := readLedger(cfg.LedgerFile)
+	if err != nil {
+		return err
+	}
+	if len(filter) > 0 {
+		tagged := entries[:0]
+		for _, e := range entries {
+			if hasTags(e.Tags, filter) {
+				tagged = append(tagged, e)
+			}
+		}
+		entries = tagged
+	}
+
+	keyNames := make(map[string]string)
+	if by == "key" && cfg.KeysFile != "" {
+		store, err := loadKeyStore(cfg.KeysFile)
+		if err != nil {
+			return err
+		}
+		keys, err := store.List()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			keyNames[k.ID] = k.Name
+		}
+	}
+
+	var groupOf func(e LedgerEntry) string
+	switch by {
+	case "model":
+		groupOf = func(e LedgerEntry) string { return e.Model }
+	case "key":
+		groupOf = func(e LedgerEntry) string {
+			if e.KeyID == "" {
+				return "(client key)"
+			}
+			if name := keyNames[e.KeyID]; name != "" {
+				return e.KeyID + " (" + name + ")"
+			}
+			return e.KeyID
+		}
+	case "project":
+		groupOf = func(e LedgerEntry) string {
+			if e.Project == "" {
+				return "(no project)"
+			}
+			return e.Project
+		}
+	case "user":
+		groupOf = func(e LedgerEntry) string {
+			if e.User == "" {
+				return "(no user)"
+			}
+			return e.User
+		}
+	case "day":
+		groupOf = func(e LedgerEntry) string { return e.Time.UTC().Format("2006-01-02") }
+	default:
+		name, ok := strings.CutPrefix(by, "tag:")
+		if !ok || !tagNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid -by value %q: expected model, key, project, user, day or tag:<name>", by)
+		}
+		groupOf = func(e LedgerEntry) string {
+			if value, ok := e.Tags[name]; ok {
+				return value
+			}
+			return "(no " + name + ")"
+		}
+	}
+
+	return writeUsageReport(w, entries, groupOf, from, to)
+}
+
+type usageTotals struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	CostUSD          float64
+}
+
+func (t *usageTotals) add(e LedgerEntry) {
+	t.Requests++
+	t.PromptTokens += e.PromptTokens
+	t.CompletionTokens += e.CompletionTokens
+	t.CostUSD += e.CostUSD
+}
+
+func writeUsageReport(w io.Writer, entries []LedgerEntry, groupOf func(LedgerEntry) string, from, to time.Time) error {
+	groups := make(map[string]*usageTotals)
+	var total usageTotals
+	for _, e := range entries {
+		if e.Type != "" {
+			continue
+		}
+		if !from.IsZero() && e.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !e.Time.Before(to) {
+			continue
+		}
+		group := groupOf(e)
+		if groups[group] == nil {
+			groups[group] = &usageTotals{}
+		}
+		groups[group].add(e)
+		total.add(e)
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "GROUP\tREQUESTS\tPROMPT TOKENS\tCOMPLETION TOKENS\tCOST USD\t")
+	for _, name := range names {
+		g := groups[name]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.6f\t\n", name, g.Requests, g.PromptTokens, g.CompletionTokens, g.CostUSD)
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%d\t%.6f\t\n", total.Requests, total.PromptTokens, total.CompletionTokens, total.CostUSD)
+	return tw.Flush()
+}
+
+func runKeysCommand(args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: keys create|revoke|list", errUsage)
+	}
+
+	var (
+		name    string
+		budget  float64
+		project string
+		models  string
+	)
+	register := func(fs *flag.FlagSet) {
+		if args[0] == "create" {
+			fs.StringVar(&name, "name", "", "Name of the key owner")
+			fs.Float64Var(&budget, "budget", 0, "Cost limit of the key in USD (0 = global quota only)")
+			fs.StringVar(&project, "project", "", "Team or project of the key in the budget tree, e.g. platform/search")
+			fs.StringVar(&models, "models", "", "Comma-separated models the key may use, e.g. gpt-4o-mini* (default: every allowed model)")
+		}
+	}
+	cfg, fs, err := commandConfig("keys "+args[0], args[1:], register)
+	if err != nil {
+		return err
+	}
+	if cfg.KeysFile == "" {
+		return errors.New("no keys file configured: set keys_file, KEYS_FILE or -keys")
+	}
+	store, err := loadKeyStore(cfg.KeysFile)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		if project, err = normalizeBudgetPath(project); err != nil {
+			return err
+		}
+		var patterns []string
+		for _, pattern := range strings.Split(models, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				if err := validModelPattern(pattern); err != nil {
+					return err
+				}
+				patterns = append(patterns, pattern)
+			}
+		}
+		secret, key, err := store.Create(name, budget)
+		if err != nil {
+			return err
+		}
+		if project != "" {
+			if key, err = store.SetProject(key.ID, project); err != nil {
+				return err
+			}
+		}
+		if len(patterns) > 0 {
+			if key, err = store.SetModels(key.ID, patterns); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "Created key %s for %s\n", key.ID, key.Name)
+		fmt.Fprintf(w, "Secret (shown only once): %s\n", secret)
+		return nil
+
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("%w: keys revoke [options] <id|name>", errUsage)
+		}
+		key, err := store.Revoke(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Revoked key %s (%s)\n", key.ID, key.Name)
+		return nil
+
+	case "list":
+		keys, err := store.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tBUDGET USD\tPROJECT\tCREATED\tSTATUS")
+		for _, k := range keys {
+			status := "active"
+			if k.Revoked() {
+				status = "revoked " + k.RevokedAt.Format(time.RFC3339)
+			} else if k.Frozen() {
+				status = "frozen " + k.FrozenAt.Format(time.RFC3339)
+			}
+			budget := "-"
+			if k.BudgetUSD > 0 {
+				budget = fmt.Sprintf("%.2f", k.BudgetUSD)
+			}
+			project := "-"
+			if k.Project != "" {
+				project = k.Project
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s...\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, budget, project, k.CreatedAt.Format(time.RFC3339), status)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("%w: unknown keys command %q", errUsage, args[0])
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPricingValidateCommand(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid.csv")
+	createTestCSV(valid, `model,version,input,cached_input,output,service_tier,min_prompt_tokens
+gpt-4o,gpt-4o-2024-08-06,2.5,1.25,10.0,,
+gpt-4o,gpt-4o-2024-08-06,1.25,,5.0,batch,
+`)
+	var out bytes.Buffer
+	if err := runPricingCommand([]string{"validate", valid}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "2 entries, 1 pricing rules") {
+		t.Errorf("Unexpected output: %s", out.String())
+	}
+
+	invalid := filepath.Join(dir, "invalid.csv")
+	createTestCSV(invalid, `model,version,input,cached_input,output
+gpt-4o,gpt-4o-2024-08-06,2.5,1.25,10.0
+gpt-4o-mini,gpt-4o-mini-2024-07-18,abc,0.075,0.6
+`)
+	out.Reset()
+	err := runPricingCommand([]string{"validate", invalid}, &out)
+	if err == nil || !strings.Contains(err.Error(), "1 problem(s) found") {
+		t.Errorf("Expected validation failure, got %v", err)
+	}
+	if !strings.Contains(out.String(), "line 3: invalid input price for model gpt-4o-mini") {
+		t.Errorf("Expected problem with line number, got: %s", out.String())
+	}
+
+	if err := runPricingCommand([]string{"validate"}, &out); !errors.Is(err, errUsage) {
+		t.Errorf("Expected usage error without file, got %v", err)
+	}
+}
+
+func TestPricingShowCommand(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pricing.csv")
+	createTestCSV(filename, `model,version,input,cached_input,output,service_tier,min_prompt_tokens
+gpt-4o,gpt-4o-2024-08-06,2.5,1.25,10.0,,
+gpt-4o,gpt-4o-2024-08-06,1.25,,5.0,batch,
+o3,o3-2025-04-16,2.0,0.5,8.0,,
+`)
+	modelPricing = make(map[string]ModelPricing)
+	defer resetGlobalState()
+
+	var out bytes.Buffer
+	if err := runPricingCommand([]string{"show", "-pricing", filename}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	// header, gpt-4o base, gpt-4o batch, o3 base, blank, footer
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 lines, got %d:\n%s", len(lines), out.String())
+	}
+	if !strings.HasPrefix(lines[2], "gpt-4o") || !strings.Contains(lines[2], "batch") {
+		t.Errorf("Expected batch rule line, got %q", lines[2])
+	}
+
+	out.Reset()
+	if err := runPricingCommand([]string{"show", "-pricing", filename, "-model", "o3-2025-04-16"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Contains(out.String(), "gpt-4o") || !strings.Contains(out.String(), "o3") {
+		t.Errorf("Expected only o3 pricing, got:\n%s", out.String())
+	}
+}
+
+func TestEstimateCommand(t *testing.T) {
+	withBpeLoader(t, &byteBpeLoader{})
+	dir := t.TempDir()
+	pricingFile := filepath.Join(dir, "pricing.csv")
+	createTestCSV(pricingFile, `model,version,input,cached_input,output
+gpt-4o,gpt-4o-2024-08-06,2.5,1.25,10.0
+`)
+	promptFile := filepath.Join(dir, "prompt.json")
+	os.WriteFile(promptFile, []byte(`{"model":"gpt-4o","max_tokens":100,"messages":[{"role":"user","content":"Hello there"}]}`), 0644)
+	defer resetGlobalState()
+
+	var out bytes.Buffer
+	if err := runEstimateCommand([]string{"-pricing", pricingFile, "-file", promptFile}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	messages := []ChatMessage{{Role: "user", Content: "Hello there"}}
+	promptTokens := calculateTokensFromMessages(messages, "gpt-4o")
+	for _, expected := range []string{
+		"Model:",
+		"Prompt tokens:",
+		"Max completion tokens:  100",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+	if !regexp.MustCompile(`Prompt tokens:\s+` + strconv.Itoa(promptTokens) + `\n`).MatchString(out.String()) {
+		t.Errorf("Expected prompt token count %d in output:\n%s", promptTokens, out.String())
+	}
+
+	// The worst case covers max_completion_tokens for each of the n choices
+	choicesFile := filepath.Join(dir, "choices.json")
+	os.WriteFile(choicesFile, []byte(`{"model":"gpt-4o","max_tokens":100,"max_completion_tokens":50,"n":3,"messages":[{"role":"user","content":"Hello there"}]}`), 0644)
+	out.Reset()
+	if err := runEstimateCommand([]string{"-pricing", pricingFile, "-file", choicesFile}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Max completion tokens:  150") {
+		t.Errorf("Expected 3 choices of 50 tokens, got:\n%s", out.String())
+	}
+	out.Reset()
+	if err := runEstimateCommand([]string{"-pricing", pricingFile, "-file", choicesFile, "-max-tokens", "10"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Max completion tokens:  30") {
+		t.Errorf("Expected the flag to replace the limit of each choice, got:\n%s", out.String())
+	}
+
+	// A bare array of messages needs the model from the flag
+	arrayFile := filepath.Join(dir, "messages.json")
+	os.WriteFile(arrayFile, []byte(`[{"role":"user","content":"Hi"}]`), 0644)
+	if err := runEstimateCommand([]string{"-pricing", pricingFile, "-file", arrayFile}, &out); err == nil {
+		t.Error("Expected error without model")
+	}
+	if err := runEstimateCommand([]string{"-pricing", pricingFile, "-file", arrayFile, "-model", "gpt-4o"}, &out); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Without the rank files tokens are approximated
+	withBpeLoader(t, &byteBpeLoader{err: errors.New("no such file")})
+	if err := runEstimateCommand([]string{"-pricing", pricingFile, "-file", promptFile}, &out); err != nil {
+		t.Errorf("Unexpected error without rank files: %v", err)
+	}
+}
+
+func TestKeysCommands(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "keys.json")
+
+	var out bytes.Buffer
+	if err := runKeysCommand([]string{"create", "-keys", keysFile, "-name", "alice", "-budget", "5", "-project", "platform/search/", "-models", "gpt-4o-mini*, gpt-4.1-mini*"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	secret := regexp.MustCompile(proxyKeyPrefix + `[0-9a-f]+`).FindString(out.String())
+	if secret == "" {
+		t.Fatalf("Expected secret in output, got: %s", out.String())
+	}
+
+	// Only a hash of the secret is stored
+	data, _ := os.ReadFile(keysFile)
+	if strings.Contains(string(data), secret) {
+		t.Error("Keys file must not contain the secret")
+	}
+	if !strings.Contains(string(data), `"models": [`) {
+		t.Errorf("Expected the key's models in the keys file, got: %s", data)
+	}
+
+	if err := runKeysCommand([]string{"create", "-keys", keysFile, "-name", "alice"}, &out); err == nil {
+		t.Error("Expected error for duplicate active key name")
+	}
+
+	out.Reset()
+	if err := runKeysCommand([]string{"revoke", "-keys", keysFile, "alice"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "Revoked key key_") {
+		t.Errorf("Unexpected output: %s", out.String())
+	}
+
+	out.Reset()
+	if err := runKeysCommand([]string{"list", "-keys", keysFile}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), "alice") || !strings.Contains(out.String(), "revoked") || !strings.Contains(out.String(), "5.00") ||
+		!strings.Contains(out.String(), "platform/search ") {
+		t.Errorf("Unexpected list output:\n%s", out.String())
+	}
+
+	if err := runKeysCommand([]string{"list"}, &out); err == nil || !strings.Contains(err.Error(), "no keys file configured") {
+		t.Errorf("Expected missing keys file error, got %v", err)
+	}
+}
+
+func TestUsageReportCommand(t *testing.T) {
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	day1 := time.Date(2025, 7, 1, 10, 0, 0, 0, time.UTC)
+	day2 := time.Date(2025, 7, 2, 10, 0, 0, 0, time.UTC)
+	entries := []LedgerEntry{
+		{Time: day1, Model: "gpt-4o", PromptTokens: 100, CompletionTokens: 50, CostUSD: 0.5},
+		{Time: day1, KeyID: "key_1", Model: "gpt-4o-mini", PromptTokens: 10, CompletionTokens: 5, CostUSD: 0.25,
+			Tags: map[string]string{"env": "staging", "feature": "autocomplete"}},
+		{Time: day2, KeyID: "key_1", Project: "platform/search", Model: "gpt-4o", PromptTokens: 200, CompletionTokens: 100, CostUSD: 1.0,
+			Tags: map[string]string{"env": "production", "feature": "autocomplete"}, User: "user-42"},
+	}
+	for _, e := range entries {
+		if err := l.Append(e); err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+	}
+	l.Close()
+
+	var out bytes.Buffer
+	if err := runUsageCommand([]string{"report", "-ledger", ledgerFile}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report := out.String()
+	if !strings.Contains(report, "gpt-4o-mini") || !strings.Contains(report, "1.750000") {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+
+	out.Reset()
+	if err := runUsageCommand([]string{"report", "-ledger", ledgerFile, "-by", "key", "-since", "2025-07-02"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report = out.String()
+	if strings.Contains(report, "(client key)") || !strings.Contains(report, "key_1") || !strings.Contains(report, "1.000000") {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+
+	out.Reset()
+	if err := runUsageCommand([]string{"report", "-ledger", ledgerFile, "-by", "project"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report = out.String()
+	if !strings.Contains(report, "platform/search") || !strings.Contains(report, "(no project)") {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+
+	out.Reset()
+	if err := runUsageCommand([]string{"report", "-ledger", ledgerFile, "-by", "tag:env", "-tag", "feature=autocomplete"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	report = out.String()
+	if !strings.Contains(report, "staging") || !strings.Contains(report, "production") || strings.Contains(report, "(no env)") || !strings.Contains(report, "1.250000") {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+
+	out.Reset()
+	if err := runUsageCommand([]string{"report", "-ledger", ledgerFile, "-by", "user"}, &out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if report = out.String(); !strings.Contains(report, "user-42") || !strings.Contains(report, "(no user)") {
+		t.Errorf("Unexpected report:\n%s", report)
+	}
+
+	for _, args := range [][]string{{"-by", "tag:"}, {"-tag", "env"}} {
+		if err := runUsageCommand(append([]string{"report", "-ledger", ledgerFile}, args...), &out); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+
+	if err := runUsageCommand([]string{"report", "-ledger", ledgerFile, "-by", "team"}, &out); err == nil {
+		t.Error("Expected error for invalid grouping")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultCompletionMaxTokens is the max_tokens OpenAI applies to legacy
+// completions when the request sets none.
+const defaultCompletionMaxTokens = 16
+
+// CompletionRequest holds the fields of a legacy completions request the proxy
+// needs. The request body is forwarded to OpenAI unchanged.
+type CompletionRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	MaxTokens   *int            `json:"max_tokens,omitempty"`
+	N           *int            `json:"n,omitempty"`
+	BestOf      *int            `json:"best_of,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+	ServiceTier string          `json:"service_tier,omitempty"`
+	User        string          `json:"user,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string `json:"text"`
+	Index        int    `json:"index"`
+	FinishReason string `json:"finish_reason"`
+}
+
+// completionPrompts returns the number of prompts in a request: the prompt is
+// a string, an array of strings, an array of token IDs or an array of such
+// arrays, and every prompt gets its own completions.
+func completionPrompts(prompt json.RawMessage) int {
+	var items []json.RawMessage
+	if json.Unmarshal(prompt, &items) != nil || len(items) == 0 {
+		return 1
+	}
+	var token int
+	if json.Unmarshal(items[0], &token) == nil {
+		return 1
+	}
+	return len(items)
+}
+
+// completionCandidates returns how many completions are generated per prompt:
+// best_of are generated server-side and n of them returned.
+func completionCandidates(reqData CompletionRequest) int {
+	candidates := 1
+	if reqData.N != nil && *reqData.N > candidates {
+		candidates = *reqData.N
+	}
+	if reqData.BestOf != nil && *reqData.BestOf > candidates {
+		candidates = *reqData.BestOf
+	}
+	return candidates
+}
+
+func completionsProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var reqData CompletionRequest
+	if err == nil {
+		err = json.Unmarshal(body, &reqData)
+	}
+	if err != nil || len(reqData.Prompt) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+
+	if !checkModel(c, proxyKey, reqData.Model) {
+		return
+	}
+	setRequestUser(c, reqData.User)
+
+	// Prompts take the same forms as embeddings input
+	promptTokens, err := countEmbeddingInputTokens(reqData.Prompt, reqData.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Invalid prompt: %v.", err),
+		})
+		return
+	}
+
+	if !checkNonNegative(c,
+		intField{"max_tokens", reqData.MaxTokens},
+		intField{"n", reqData.N},
+		intField{"best_of", reqData.BestOf},
+	) {
+		return
+	}
+
+	// Every prompt may generate max_tokens for each of its candidates
+	maxTokens := defaultCompletionMaxTokens
+	if reqData.MaxTokens != nil {
+		maxTokens = *reqData.MaxTokens
+	}
+	generated := saturatingMul(completionCandidates(reqData), completionPrompts(reqData.Prompt))
+	estimatedCompletion := saturatingMul(maxTokens, generated)
+	estimate := calculateCostForTier(promptTokens, estimatedCompletion, reqData.Model, reqData.ServiceTier)
+
+	reservation, ok := reserveRequest(c, proxyKey, reqData.Model, promptTokens, estimate)
+	if !ok {
+		return
+	}
+
+	if reqData.Stream {
+		streamCompletion(c, reservation, reqData, body, upstreamKey, promptTokens, generated)
+		return
+	}
+
+	respBody, err := postOpenAI("/v1/completions", "application/json", body, upstreamKey)
+	// Decoded loosely so that fields unknown to the proxy are passed through
+	var response map[string]json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err != nil {
+		failRequest(c, reservation, promptTokens, err)
+		return
+	}
+
+	var usage *Usage
+	json.Unmarshal(response["usage"], &usage)
+	var choices []CompletionChoice
+	json.Unmarshal(response["choices"], &choices)
+	texts := make([]string, len(choices))
+	for i, choice := range choices {
+		texts[i] = choice.Text
+	}
+	var serviceTier string
+	json.Unmarshal(response["service_tier"], &serviceTier)
+
+	proxyUsage := chargeCompletion(c, reservation, reqData, promptTokens, usage, texts, generated, serviceTier)
+	response["proxy_usage"], _ = json.Marshal(proxyUsage)
+	c.JSON(http.StatusOK, response)
+}
+
+// streamCompletion relays a streamed completion and charges it from the usage
+// chunk sent with stream_options.include_usage, or from the streamed text. The
+// cost is sent in trailers.
+func streamCompletion(c *gin.Context, reservation *Reservation, reqData CompletionRequest, body []byte, upstreamKey string, promptTokens, generated int) {
+	resp, err := openOpenAIStream(c.Request.Context(), "/v1/completions", body, upstreamKey)
+	if err != nil {
+		failRequest(c, reservation, promptTokens, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var (
+		usage       *Usage
+		serviceTier string
+		texts       = make(map[int]*strings.Builder)
+	)
+	relayStream(c, resp, reqData.Model, func(data []byte) {
+		var chunk struct {
+			Choices     []CompletionChoice `json:"choices"`
+			Usage       *Usage             `json:"usage"`
+			ServiceTier string             `json:"service_tier"`
+		}
+		if json.Unmarshal(data, &chunk) != nil {
+			return // [DONE]
+		}
+		for _, choice := range chunk.Choices {
+			if texts[choice.Index] == nil {
+				texts[choice.Index] = &strings.Builder{}
+			}
+			texts[choice.Index].WriteString(choice.Text)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		if chunk.ServiceTier != "" {
+			serviceTier = chunk.ServiceTier
+		}
+	})
+
+	choiceTexts := make([]string, 0, len(texts))
+	for _, text := range texts {
+		choiceTexts = append(choiceTexts, text.String())
+	}
+	chargeCompletion(c, reservation, reqData, promptTokens, usage, choiceTexts, generated, serviceTier)
+	writeQuotaTrailers(c)
+}
+
+// chargeCompletion charges a completion from its usage, or from the counted
+// text of the returned choices when OpenAI reported none.
+func chargeCompletion(c *gin.Context, reservation *Reservation, reqData CompletionRequest, promptTokens int, usage *Usage, texts []string, generated int, serviceTier string) *ProxyUsage {
+	completionTokens := 0
+	if usage != nil {
+		if usage.PromptTokens > 0 {
+			promptTokens = usage.PromptTokens
+		}
+		completionTokens = usage.CompletionTokens
+	}
+
+	if completionTokens == 0 {
+		for _, text := range texts {
+			completionTokens += countTokens(text, reqData.Model)
+		}
+		// Candidates discarded by best_of are billed but not returned
+		if returned := len(texts); returned > 0 && generated > returned {
+			completionTokens = completionTokens * generated / returned
+		}
+	}
+
+	// The response reports the tier that actually served the request
+	if serviceTier == "" {
+		serviceTier = reqData.ServiceTier
+	}
+
+	cost := calculateCostForTier(promptTokens, completionTokens, reqData.Model, serviceTier)
+	return chargeRequest(c, reservation, promptTokens, completionTokens, cost, serviceTier)
+}
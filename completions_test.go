@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postCompletions(router http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCompletionPrompts(t *testing.T) {
+	tests := []struct {
+		prompt   string
+		expected int
+	}{
+		{`"Say hello"`, 1},
+		{`["Say hello", "Say goodbye"]`, 2},
+		{`[9906, 1917]`, 1},
+		{`[[9906], [1917], [0]]`, 3},
+	}
+	for _, tt := range tests {
+		if prompts := completionPrompts(json.RawMessage(tt.prompt)); prompts != tt.expected {
+			t.Errorf("Expected %d prompts for %s, got %d", tt.expected, tt.prompt, prompts)
+		}
+	}
+}
+
+func TestCompletionsProxy(t *testing.T) {
+	resetGlobalState()
+	got := mockOpenAIRaw(t, `{"id":"cmpl-1","object":"text_completion","choices":[{"text":"Hello!","index":0,"finish_reason":"stop","logprobs":null}],
+		"usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}`)
+	router := setupTestRouter()
+
+	w := postCompletions(router, `{"model":"gpt-4o","prompt":["Say hello","Say goodbye"],"max_tokens":50,"echo":false}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body, _ := io.ReadAll(got.Body)
+	if got.URL.Path != "/v1/completions" || !strings.Contains(string(body), `"echo":false`) {
+		t.Errorf("Expected request to be forwarded unchanged, got %s %s", got.URL.Path, body)
+	}
+
+	var response struct {
+		Choices    []map[string]interface{} `json:"choices"`
+		ProxyUsage ProxyUsage               `json:"proxy_usage"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if len(response.Choices) != 1 || response.Choices[0]["text"] != "Hello!" {
+		t.Errorf("Response not passed through: %s", w.Body.String())
+	}
+	if _, ok := response.Choices[0]["logprobs"]; !ok {
+		t.Error("Expected unknown fields to be passed through")
+	}
+
+	// 1000 input tokens at $2.5 and 500 output tokens at $10 per 1M
+	if response.ProxyUsage.CostUSD != 0.0075 || totalCost != 0.0075 {
+		t.Errorf("Expected cost 0.0075, got %f (total %f)", response.ProxyUsage.CostUSD, totalCost)
+	}
+}
+
+func TestCompletionsProxy_BestOfEstimate(t *testing.T) {
+	resetGlobalState()
+	router := setupTestRouter()
+
+	// 2 prompts x best_of 5 x 1000 tokens at $10 per 1M is $0.10
+	costLimitUSD = 0.09
+	w := postCompletions(router, `{"model":"gpt-4o","prompt":["a","b"],"max_tokens":1000,"n":2,"best_of":5}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// With best_of 4 the estimate fits
+	mockOpenAIRaw(t, `{"choices":[{"text":"x"}],"usage":{"prompt_tokens":2,"completion_tokens":100}}`)
+	w = postCompletions(router, `{"model":"gpt-4o","prompt":["a","b"],"max_tokens":1000,"n":2,"best_of":4}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestCompletionsProxy_CountsWithoutUsage(t *testing.T) {
+	resetGlobalState()
+	mockOpenAIRaw(t, `{"choices":[{"text":"Hello world","index":0},{"text":"Hello world","index":1}]}`)
+	router := setupTestRouter()
+
+	w := postCompletions(router, `{"model":"gpt-4o","prompt":"Say hello","n":2,"best_of":4}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The 2 candidates discarded by best_of are billed like the returned ones
+	completionTokens := 4 * countTokens("Hello world", "gpt-4o")
+	expected := calculateCost(countTokens("Say hello", "gpt-4o"), completionTokens, "gpt-4o")
+	if totalCost != expected {
+		t.Errorf("Expected total cost %f, got %f", expected, totalCost)
+	}
+}
+
+func TestCompletionsProxy_InvalidRequests(t *testing.T) {
+	resetGlobalState()
+	router := setupTestRouter()
+
+	for _, body := range []string{
+		`{"model":"gpt-4o"}`,
+		`{"model":"gpt-4o","prompt":{"text":"Hello"}}`,
+		`{"model":"unknown-model","prompt":"Hello"}`,
+		`{"model":"gpt-4o","prompt":"Hello","max_tokens":-1000}`,
+		`{"model":"gpt-4o","prompt":"Hello","best_of":-2}`,
+	} {
+		if w := postCompletions(router, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
+
+// streamCompletionChunks serves chunks as a streamed completion.
+func streamCompletionChunks(t *testing.T, chunks ...string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	t.Cleanup(func() {
+		openAIBaseURL = previous
+		server.Close()
+	})
+}
+
+func TestCompletionsProxy_Streaming(t *testing.T) {
+	resetGlobalState()
+	streamCompletionChunks(t,
+		`{"id":"cmpl-1","object":"text_completion","choices":[{"text":"Hello","index":0,"finish_reason":null}],"model":"gpt-4o"}`,
+		`{"id":"cmpl-1","object":"text_completion","choices":[{"text":" world","index":0,"finish_reason":"stop"}],"model":"gpt-4o"}`,
+		`{"id":"cmpl-1","object":"text_completion","choices":[],"model":"gpt-4o","usage":{"prompt_tokens":1000,"completion_tokens":500,"total_tokens":1500}}`,
+	)
+	router := setupTestRouter()
+
+	w := postCompletions(router, `{"model":"gpt-4o","prompt":"Say hello","stream":true,"stream_options":{"include_usage":true}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/event-stream" || strings.Count(w.Body.String(), "data: ") != 4 {
+		t.Errorf("Expected chunks to be relayed, got:\n%s", w.Body.String())
+	}
+
+	// 1000 prompt tokens at $2.5 and 500 completion tokens at $10 per 1M
+	if expected := 0.0075; totalCost != expected {
+		t.Errorf("Expected total cost %f, got %f", expected, totalCost)
+	}
+	if cost := w.Result().Trailer.Get("X-Request-Cost-USD"); cost != "0.007500" {
+		t.Errorf("Unexpected X-Request-Cost-USD trailer: %q", cost)
+	}
+}
+
+func TestCompletionsProxy_StreamWithoutUsage(t *testing.T) {
+	resetGlobalState()
+	streamCompletionChunks(t,
+		`{"choices":[{"text":"Hello","index":0},{"text":"Hi","index":1}]}`,
+		`{"choices":[{"text":" world","index":0},{"text":" there","index":1}]}`,
+	)
+	router := setupTestRouter()
+
+	w := postCompletions(router, `{"model":"gpt-4o","prompt":"Say hello","stream":true,"n":2,"best_of":4}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Without usage each streamed choice is counted, and the candidates
+	// discarded by best_of are billed like the returned ones
+	completionTokens := 2 * (countTokens("Hello world", "gpt-4o") + countTokens("Hi there", "gpt-4o"))
+	expected := calculateCost(countTokens("Say hello", "gpt-4o"), completionTokens, "gpt-4o")
+	if totalCost != expected {
+		t.Errorf("Expected total cost %f, got %f", expected, totalCost)
+	}
+	if len(reservations) != 0 {
+		t.Errorf("Expected reservation to be settled, got %d", len(reservations))
+	}
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the proxy after merging defaults, the
+// configuration file, environment variables and command-line flags.
+type Config struct {
+	Port             string
+	Quota            float64
+	PricingFile      string
+	LogLevel         string
+	AllowedOrigins   []string
+	KeysFile         string
+	LedgerFile       string
+	OpenAIAPIKey     string
+	AdminToken       string
+	AuditFile        string
+	ModelsUpstream   bool
+	Moderation       bool
+	EncodingsDir     string
+	RateLimit        RateLimit
+	ModelRateLimits  map[string]RateLimit
+	MaxConcurrent    int
+	KeyMaxConcurrent int
+	MaxQueueWait     time.Duration
+	MaxQueueDepth    int
+
+	InteractiveSlots           int
+	InteractiveHeadroomPercent float64
+
+	WebhookURL       string
+	BudgetThresholds []float64
+
+	NodeBudgets map[string]float64
+
+	ModelSpendCaps  []ModelSpendCap
+	ModelAllowlists map[string][]string
+
+	TagSchema    map[string][]string
+	RequiredTags []string
+	TagBudgets   map[string]float64
+
+	Cache      string
+	CacheDir   string
+	CacheTTL   time.Duration
+	CacheMaxMB int
+
+	IdempotencyWindow time.Duration
+	IdempotencyMaxMB  int
+
+	// sources records where each setting came from, keyed by setting key
+	sources map[string]string
+}
+
+const (
+	defaultPricingFile = "config/model_pricing.csv"
+	defaultCacheDir    = "data/cache"
+	defaultCacheTTL    = 24 * time.Hour
+	defaultCacheMaxMB  = 100
+)
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:              "8123",
+		Quota:             2.0,
+		PricingFile:       defaultPricingFile,
+		LogLevel:          "info",
+		MaxQueueWait:      defaultMaxQueueWait,
+		MaxQueueDepth:     defaultMaxQueueDepth,
+		BudgetThresholds:  defaultBudgetThresholds,
+		CacheDir:          defaultCacheDir,
+		CacheTTL:          defaultCacheTTL,
+		CacheMaxMB:        defaultCacheMaxMB,
+		IdempotencyWindow: defaultIdempotencyWindow,
+		IdempotencyMaxMB:  defaultIdempotencyMaxMB,
+		sources:           make(map[string]string),
+	}
+}
+
+// configSetting describes one setting and how it is named in each source.
+type configSetting struct {
+	key    string // key in the configuration file
+	env    string // environment variable
+	flag   string // command-line flag, empty for settings that must not appear in process lists
+	usage  string
+	secret bool // masked by printConfig
+	set    func(cfg *Config, value string) error
+	get    func(cfg *Config) interface{}
+}
+
+var configSettings = []configSetting{
+	{
+		key: "port", env: "PORT", flag: "port",
+		usage: "Port to run server on",
+		set: func(cfg *Config, value string) error {
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("must be a port number between 1 and 65535, got %q", value)
+			}
+			cfg.Port = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.Port },
+	},
+	{
+		key: "quota", env: "QUOTA", flag: "quota",
+		usage: "Global cost limit in USD",
+		set: func(cfg *Config, value string) error {
+			quota, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(quota) || math.IsInf(quota, 0) || quota < 0 {
+				return fmt.Errorf("must be a non-negative amount in USD, got %q", value)
+			}
+			cfg.Quota = quota
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.Quota },
+	},
+	{
+		key: "pricing_file", env: "PRICING_FILE", flag: "pricing",
+		usage: "Path to CSV file with model pricing",
+		set: func(cfg *Config, value string) error {
+			if value == "" {
+				return errors.New("must not be empty")
+			}
+			cfg.PricingFile = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.PricingFile },
+	},
+	{
+		key: "log_level", env: "LOG_LEVEL", flag: "log-level",
+		usage: "Log level: debug, info, warn or error",
+		set: func(cfg *Config, value string) error {
+			level := strings.ToLower(value)
+			if _, ok := logLevels[level]; !ok {
+				return fmt.Errorf("must be one of debug, info, warn, error, got %q", value)
+			}
+			cfg.LogLevel = level
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.LogLevel },
+	},
+	{
+		key: "allowed_origins", env: "ALLOWED_ORIGINS", flag: "allowed-origins",
+		usage: "Comma-separated list of origins allowed to make browser (CORS) requests",
+		set: func(cfg *Config, value string) error {
+			origins, err := parseAllowedOrigins(value)
+			if err != nil {
+				return err
+			}
+			cfg.AllowedOrigins = origins
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.AllowedOrigins },
+	},
+	{
+		key: "keys_file", env: "KEYS_FILE", flag: "keys",
+		usage: "Path to JSON file with proxy-issued API keys (disabled if empty)",
+		set: func(cfg *Config, value string) error {
+			cfg.KeysFile = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.KeysFile },
+	},
+	{
+		key: "ledger_file", env: "LEDGER_FILE", flag: "ledger",
+		usage: "Path to JSON Lines usage ledger (disabled if empty)",
+		set: func(cfg *Config, value string) error {
+			cfg.LedgerFile = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.LedgerFile },
+	},
+	{
+		key: "openai_api_key", env: "OPENAI_API_KEY",
+		usage:  "OpenAI API key used upstream for requests authenticated with proxy keys",
+		secret: true,
+		set: func(cfg *Config, value string) error {
+			cfg.OpenAIAPIKey = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.OpenAIAPIKey },
+	},
+	{
+		key: "admin_token", env: "ADMIN_TOKEN",
+		usage:  "Bearer token for the /admin API (disabled if empty)",
+		secret: true,
+		set: func(cfg *Config, value string) error {
+			cfg.AdminToken = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.AdminToken },
+	},
+	{
+		key: "audit_file", env: "AUDIT_FILE", flag: "audit",
+		usage: "Path to JSON Lines audit trail of admin actions (disabled if empty)",
+		set: func(cfg *Config, value string) error {
+			cfg.AuditFile = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.AuditFile },
+	},
+	{
+		key: "models_upstream", env: "MODELS_UPSTREAM", flag: "models-upstream",
+		usage: "Merge OpenAI's model list into GET /v1/models (true or false)",
+		set: func(cfg *Config, value string) error {
+			merge, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("must be true or false, got %q", value)
+			}
+			cfg.ModelsUpstream = merge
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.ModelsUpstream },
+	},
+	{
+		key: "moderation", env: "MODERATION", flag: "moderation",
+		usage: "Check chat prompts with the moderation API before forwarding them (true or false)",
+		set: func(cfg *Config, value string) error {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("must be true or false, got %q", value)
+			}
+			cfg.Moderation = enabled
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.Moderation },
+	},
+	{
+		key: "encodings_dir", env: "ENCODINGS_DIR", flag: "encodings",
+		usage: "Directory with BPE rank files (*.tiktoken) to use instead of the bundled ones",
+		set: func(cfg *Config, value string) error {
+			cfg.EncodingsDir = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.EncodingsDir },
+	},
+	{
+		key: "rate_limit_rpm", env: "RATE_LIMIT_RPM", flag: "rpm",
+		usage: "Requests per minute allowed across all clients (0 = no limit)",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.RateLimit.RPM)
+		},
+		get: func(cfg *Config) interface{} { return cfg.RateLimit.RPM },
+	},
+	{
+		key: "rate_limit_tpm", env: "RATE_LIMIT_TPM", flag: "tpm",
+		usage: "Tokens per minute allowed across all clients (0 = no limit)",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.RateLimit.TPM)
+		},
+		get: func(cfg *Config) interface{} { return cfg.RateLimit.TPM },
+	},
+	{
+		key: "model_rate_limits", env: "MODEL_RATE_LIMITS", flag: "model-rate-limits",
+		usage: "Comma-separated per-model limits as model=RPM/TPM, e.g. gpt-4o=500/30000",
+		set: func(cfg *Config, value string) error {
+			limits, err := parseModelRateLimits(value)
+			if err != nil {
+				return err
+			}
+			cfg.ModelRateLimits = limits
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return formatModelRateLimits(cfg.ModelRateLimits) },
+	},
+	{
+		key: "max_concurrent", env: "MAX_CONCURRENT", flag: "max-concurrent",
+		usage: "Requests in flight upstream across all clients before requests queue (0 = no limit)",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.MaxConcurrent)
+		},
+		get: func(cfg *Config) interface{} { return cfg.MaxConcurrent },
+	},
+	{
+		key: "key_max_concurrent", env: "KEY_MAX_CONCURRENT", flag: "key-max-concurrent",
+		usage: "Requests in flight per client before its requests queue (0 = no limit)",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.KeyMaxConcurrent)
+		},
+		get: func(cfg *Config) interface{} { return cfg.KeyMaxConcurrent },
+	},
+	{
+		key: "max_queue_wait", env: "MAX_QUEUE_WAIT", flag: "max-queue-wait",
+		usage: "How long a request may wait for a slot, e.g. 30s (0 rejects instead of queueing)",
+		set: func(cfg *Config, value string) error {
+			wait, err := time.ParseDuration(value)
+			if err != nil || wait < 0 {
+				return fmt.Errorf("must be a non-negative duration such as 30s, got %q", value)
+			}
+			cfg.MaxQueueWait = wait
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.MaxQueueWait.String() },
+	},
+	{
+		key: "max_queue_depth", env: "MAX_QUEUE_DEPTH", flag: "max-queue-depth",
+		usage: "Requests that may wait for a slot at once (0 = no limit)",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.MaxQueueDepth)
+		},
+		get: func(cfg *Config) interface{} { return cfg.MaxQueueDepth },
+	},
+	{
+		key: "interactive_slots", env: "INTERACTIVE_SLOTS", flag: "interactive-slots",
+		usage: "Slots of max_concurrent kept for interactive requests",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.InteractiveSlots)
+		},
+		get: func(cfg *Config) interface{} { return cfg.InteractiveSlots },
+	},
+	{
+		key: "interactive_headroom_percent", env: "INTERACTIVE_HEADROOM_PERCENT", flag: "interactive-headroom",
+		usage: "Percentage of the quota batch requests may not spend, e.g. 20",
+		set: func(cfg *Config, value string) error {
+			percent, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(percent) || percent < 0 || percent > 100 {
+				return fmt.Errorf("must be a percentage between 0 and 100, got %q", value)
+			}
+			cfg.InteractiveHeadroomPercent = percent
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.InteractiveHeadroomPercent },
+	},
+	{
+		key: "webhook_url", env: "WEBHOOK_URL",
+		usage:  "URL notified with a JSON POST when spend reaches a budget threshold (disabled if empty)",
+		secret: true,
+		set: func(cfg *Config, value string) error {
+			if value != "" {
+				if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return fmt.Errorf("must be an http or https URL, got %q", value)
+				}
+			}
+			cfg.WebhookURL = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.WebhookURL },
+	},
+	{
+		key: "budget_thresholds", env: "BUDGET_THRESHOLDS", flag: "budget-thresholds",
+		usage: "Comma-separated percentages of a budget that trigger a webhook notification",
+		set: func(cfg *Config, value string) error {
+			thresholds, err := parseBudgetThresholds(value)
+			if err != nil {
+				return err
+			}
+			cfg.BudgetThresholds = thresholds
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.BudgetThresholds },
+	},
+	{
+		key: "budgets", env: "BUDGETS", flag: "budgets",
+		usage: "Comma-separated budgets of teams and projects as path=USD, e.g. platform=100,platform/search=40",
+		set: func(cfg *Config, value string) error {
+			budgets, err := parseNodeBudgets(value)
+			if err != nil {
+				return err
+			}
+			cfg.NodeBudgets = budgets
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return formatNodeBudgets(cfg.NodeBudgets) },
+	},
+	{
+		key: "model_spend_caps", env: "MODEL_SPEND_CAPS", flag: "model-spend-caps",
+		usage: "Comma-separated caps on the spend of all clients on a model as model=USD/period (day, week or month), e.g. o3-pro*=5/day",
+		set: func(cfg *Config, value string) error {
+			caps, err := parseModelSpendCaps(value)
+			if err != nil {
+				return err
+			}
+			cfg.ModelSpendCaps = caps
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return formatModelSpendCaps(cfg.ModelSpendCaps) },
+	},
+	{
+		key: "model_allowlists", env: "MODEL_ALLOWLISTS", flag: "model-allowlists",
+		usage: "Comma-separated models allowed below a team or project as path=model|model, e.g. interns=gpt-4o-mini*",
+		set: func(cfg *Config, value string) error {
+			allowlists, err := parseNodeModels(value)
+			if err != nil {
+				return err
+			}
+			cfg.ModelAllowlists = allowlists
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return formatNodeModels(cfg.ModelAllowlists) },
+	},
+	{
+		key: "tag_schema", env: "TAG_SCHEMA", flag: "tag-schema",
+		usage: "Comma-separated tags clients may send as name=value|value, or name=* for any value (default: any tag)",
+		set: func(cfg *Config, value string) error {
+			schema, err := parseTagSchema(value)
+			if err != nil {
+				return err
+			}
+			cfg.TagSchema = schema
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return formatTagSchema(cfg.TagSchema) },
+	},
+	{
+		key: "required_tags", env: "REQUIRED_TAGS", flag: "required-tags",
+		usage: "Comma-separated tags every charged request must carry",
+		set: func(cfg *Config, value string) error {
+			names, err := parseTagNames(value)
+			if err != nil {
+				return err
+			}
+			cfg.RequiredTags = names
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.RequiredTags },
+	},
+	{
+		key: "tag_budgets", env: "TAG_BUDGETS", flag: "tag-budgets",
+		usage: "Comma-separated budgets of tags as name:value=USD, e.g. env:staging=20",
+		set: func(cfg *Config, value string) error {
+			budgets, err := parseTagBudgets(value)
+			if err != nil {
+				return err
+			}
+			cfg.TagBudgets = budgets
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return formatTagBudgets(cfg.TagBudgets) },
+	},
+	{
+		key: "cache", env: "CACHE", flag: "cache",
+		usage: "Cache deterministic chat responses: off, memory or disk",
+		set: func(cfg *Config, value string) error {
+			backend, err := parseCacheBackend(value)
+			if err != nil {
+				return err
+			}
+			cfg.Cache = backend
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.Cache },
+	},
+	{
+		key: "cache_dir", env: "CACHE_DIR", flag: "cache-dir",
+		usage: "Directory of the disk cache",
+		set: func(cfg *Config, value string) error {
+			cfg.CacheDir = value
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.CacheDir },
+	},
+	{
+		key: "cache_ttl", env: "CACHE_TTL", flag: "cache-ttl",
+		usage: "How long cached responses are served, e.g. 24h (0 = until evicted)",
+		set: func(cfg *Config, value string) error {
+			ttl, err := time.ParseDuration(value)
+			if err != nil || ttl < 0 {
+				return fmt.Errorf("must be a non-negative duration such as 24h, got %q", value)
+			}
+			cfg.CacheTTL = ttl
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.CacheTTL.String() },
+	},
+	{
+		key: "cache_max_mb", env: "CACHE_MAX_MB", flag: "cache-max-mb",
+		usage: "Size of the cached responses in MB before the oldest are evicted (0 = no limit)",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.CacheMaxMB)
+		},
+		get: func(cfg *Config) interface{} { return cfg.CacheMaxMB },
+	},
+	{
+		key: "idempotency_window", env: "IDEMPOTENCY_WINDOW", flag: "idempotency-window",
+		usage: "How long responses are replayed for a repeated Idempotency-Key, e.g. 24h (0 = ignore the header)",
+		set: func(cfg *Config, value string) error {
+			window, err := time.ParseDuration(value)
+			if err != nil || window < 0 {
+				return fmt.Errorf("must be a non-negative duration such as 24h, got %q", value)
+			}
+			cfg.IdempotencyWindow = window
+			return nil
+		},
+		get: func(cfg *Config) interface{} { return cfg.IdempotencyWindow.String() },
+	},
+	{
+		key: "idempotency_max_mb", env: "IDEMPOTENCY_MAX_MB", flag: "idempotency-max-mb",
+		usage: "Size of the responses stored for Idempotency-Key replays in MB before the oldest are evicted (0 = no limit)",
+		set: func(cfg *Config, value string) error {
+			return parseRateLimitValue(value, &cfg.IdempotencyMaxMB)
+		},
+		get: func(cfg *Config) interface{} { return cfg.IdempotencyMaxMB },
+	},
+}
+
+// parseRateLimitValue parses a non-negative limit, where 0 means no limit.
+func parseRateLimitValue(value string, target *int) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("must be a non-negative integer, got %q", value)
+	}
+	*target = n
+	return nil
+}
+
+func parseAllowedOrigins(value string) ([]string, error) {
+	origins := []string{}
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+				return nil, fmt.Errorf("origin %q must be \"*\" or scheme://host[:port]", origin)
+			}
+			origin = strings.TrimSuffix(origin, "/")
+		}
+		origins = append(origins, origin)
+	}
+	return origins, nil
+}
+
+// configFlags holds the flag values registered by registerConfigFlags.
+type configFlags struct {
+	configFile string
+	values     map[string]*string
+	help       bool
+}
+
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	defaults := defaultConfig()
+	flags := &configFlags{values: make(map[string]*string)}
+
+	fs.StringVar(&flags.configFile, "config", "", "Path to YAML configuration file (env CONFIG_FILE)")
+	for _, s := range configSettings {
+		if s.flag == "" {
+			continue
+		}
+		flags.values[s.flag] = fs.String(s.flag, formatSettingValue(s.get(defaults)), fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	fs.BoolVar(&flags.help, "help", false, "Show help")
+	fs.BoolVar(&flags.help, "h", false, "Show help (short)")
+
+	return flags
+}
+
+func formatSettingValue(value interface{}) string {
+	switch v := value.(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// loadConfig merges the configuration sources with the precedence
+// flags > environment variables > configuration file > defaults.
+// fs must already be parsed. All problems are reported together.
+func loadConfig(fs *flag.FlagSet, flags *configFlags, getenv func(string) string) (*Config, error) {
+	cfg := defaultConfig()
+	for _, s := range configSettings {
+		cfg.sources[s.key] = "default"
+	}
+
+	var errs []error
+
+	configFile := getenv("CONFIG_FILE")
+	if flags.configFile != "" {
+		configFile = flags.configFile
+	}
+	if configFile != "" {
+		if err := applyConfigFile(cfg, configFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, s := range configSettings {
+		value, ok := lookupEnv(getenv, s.env)
+		if !ok {
+			continue
+		}
+		if err := s.set(cfg, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (env %s): %w", s.key, s.env, err))
+			continue
+		}
+		cfg.sources[s.key] = "env " + s.env
+	}
+
+	setFlags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	for _, s := range configSettings {
+		if s.flag == "" || !setFlags[s.flag] {
+			continue
+		}
+		if err := s.set(cfg, *flags.values[s.flag]); err != nil {
+			errs = append(errs, fmt.Errorf("%s (flag -%s): %w", s.key, s.flag, err))
+			continue
+		}
+		cfg.sources[s.key] = "flag -" + s.flag
+	}
+
+	if cfg.PricingFile != defaultPricingFile {
+		if _, err := os.Stat(cfg.PricingFile); err != nil {
+			errs = append(errs, fmt.Errorf("pricing_file (%s): %w", cfg.sources["pricing_file"], err))
+		}
+	}
+
+	if cfg.InteractiveSlots > 0 && cfg.InteractiveSlots >= cfg.MaxConcurrent {
+		errs = append(errs, fmt.Errorf("interactive_slots (%s): must be less than max_concurrent (%d), or batch requests could never run",
+			cfg.sources["interactive_slots"], cfg.MaxConcurrent))
+	}
+
+	for _, name := range cfg.RequiredTags {
+		if _, ok := cfg.TagSchema[name]; len(cfg.TagSchema) > 0 && !ok {
+			errs = append(errs, fmt.Errorf("required_tags (%s): tag %s is not in tag_schema", cfg.sources["required_tags"], name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return cfg, nil
+}
+
+func lookupEnv(getenv func(string) string, name string) (string, bool) {
+	value := strings.TrimSpace(getenv(name))
+	return value, value != ""
+}
+
+// applyConfigFile reads a YAML mapping of setting keys to values.
+func applyConfigFile(cfg *Config, filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil // empty file
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of settings", filename, root.Line)
+	}
+
+	var errs []error
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		keyNode, valueNode := root.Content[i], root.Content[i+1]
+
+		var setting *configSetting
+		for j := range configSettings {
+			if configSettings[j].key == keyNode.Value {
+				setting = &configSettings[j]
+				break
+			}
+		}
+		if setting == nil {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown setting %q", filename, keyNode.Line, keyNode.Value))
+			continue
+		}
+
+		var value string
+		switch valueNode.Kind {
+		case yaml.ScalarNode:
+			value = valueNode.Value
+		case yaml.SequenceNode:
+			items := make([]string, 0, len(valueNode.Content))
+			for _, item := range valueNode.Content {
+				items = append(items, item.Value)
+			}
+			value = strings.Join(items, ",")
+		default:
+			errs = append(errs, fmt.Errorf("%s:%d: %s: expected a value or a list", filename, valueNode.Line, setting.key))
+			continue
+		}
+
+		if err := setting.set(cfg, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %w", filename, valueNode.Line, setting.key, err))
+			continue
+		}
+		cfg.sources[setting.key] = "file " + filename
+	}
+
+	return errors.Join(errs...)
+}
+
+// printConfig writes the effective configuration as YAML, annotating each
+// setting with the source it came from.
+func printConfig(w io.Writer, cfg *Config) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range configSettings {
+		current := s.get(cfg)
+		if s.secret && current != "" {
+			current = "********"
+		}
+		var value yaml.Node
+		if err := value.Encode(current); err != nil {
+			return err
+		}
+		if value.Kind == yaml.SequenceNode {
+			value.Style = yaml.FlowStyle
+		}
+		value.LineComment = cfg.sources[s.key]
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.key}, &value)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// logLevel is the configured minimum level for messages logged via logInfof.
+var logLevel = "info"
+
+func logEnabled(level string) bool {
+	return logLevels[level] >= logLevels[logLevel]
+}
+
+// logInfof logs routine per-request information, suppressed at warn and error levels.
+func logInfof(format string, args ...interface{}) {
+	if logEnabled("info") {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func parseTestConfig(t *testing.T, args []string, env map[string]string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	return loadConfig(fs, flags, func(name string) string { return env[name] })
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	cfg, err := parseTestConfig(t, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.Port != "8123" || cfg.Quota != 2.0 || cfg.PricingFile != defaultPricingFile || cfg.LogLevel != "info" {
+		t.Errorf("Unexpected defaults: %+v", cfg)
+	}
+	if len(cfg.AllowedOrigins) != 0 {
+		t.Errorf("Expected no allowed origins, got %v", cfg.AllowedOrigins)
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	filename := "test_config.yaml"
+	defer os.Remove(filename)
+	content := `port: 9000
+quota: 5
+log_level: warn
+allowed_origins:
+  - http://localhost:3000
+  - https://example.com
+`
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	env := map[string]string{
+		"CONFIG_FILE": filename,
+		"QUOTA":       "7.5",
+		"LOG_LEVEL":   "error",
+	}
+	cfg, err := parseTestConfig(t, []string{"-log-level", "debug"}, env)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cfg.Port != "9000" {
+		t.Errorf("Expected port from file, got %s", cfg.Port)
+	}
+	if cfg.Quota != 7.5 {
+		t.Errorf("Expected quota from env, got %f", cfg.Quota)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("Expected log level from flag, got %s", cfg.LogLevel)
+	}
+	if len(cfg.AllowedOrigins) != 2 || cfg.AllowedOrigins[1] != "https://example.com" {
+		t.Errorf("Unexpected allowed origins: %v", cfg.AllowedOrigins)
+	}
+
+	expectedSources := map[string]string{
+		"port":         "file " + filename,
+		"quota":        "env QUOTA",
+		"log_level":    "flag -log-level",
+		"pricing_file": "default",
+	}
+	for key, source := range expectedSources {
+		if cfg.sources[key] != source {
+			t.Errorf("Expected source %q for %s, got %q", source, key, cfg.sources[key])
+		}
+	}
+}
+
+func TestLoadConfig_ValidationErrors(t *testing.T) {
+	filename := "test_invalid_config.yaml"
+	defer os.Remove(filename)
+	content := `qouta: 1
+port: abc
+`
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	env := map[string]string{
+		"QUOTA":             "-1",
+		"ALLOWED_ORIGINS":   "localhost:3000",
+		"INTERACTIVE_SLOTS": "4",
+	}
+	_, err := parseTestConfig(t, []string{"-config", filename, "-log-level", "verbose", "-pricing", "missing.csv", "-interactive-headroom", "150"}, env)
+	if err == nil {
+		t.Fatal("Expected validation error")
+	}
+
+	expected := []string{
+		filename + `:1: unknown setting "qouta"`,
+		filename + ":2: port: must be a port number",
+		"quota (env QUOTA): must be a non-negative amount",
+		"allowed_origins (env ALLOWED_ORIGINS): origin \"localhost:3000\"",
+		"log_level (flag -log-level): must be one of debug, info, warn, error",
+		"pricing_file (flag -pricing):",
+		"interactive_headroom_percent (flag -interactive-headroom): must be a percentage",
+		"interactive_slots (env INTERACTIVE_SLOTS): must be less than max_concurrent",
+	}
+	for _, msg := range expected {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected error to contain %q, got:\n%v", msg, err)
+		}
+	}
+}
+
+func TestLoadConfig_MissingFile(t *testing.T) {
+	_, err := parseTestConfig(t, []string{"-config", "does_not_exist.yaml"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot read config file") {
+		t.Errorf("Expected missing file error, got %v", err)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	cfg, err := parseTestConfig(t, []string{"-quota", "3.5"}, map[string]string{"ALLOWED_ORIGINS": "*"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := printConfig(&buf, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	output := buf.String()
+	for _, line := range []string{
+		`port: "8123" # default`,
+		"quota: 3.5 # flag -quota",
+		"allowed_origins: ['*'] # env ALLOWED_ORIGINS",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(corsMiddleware([]string{"http://localhost:3000"}))
+	r.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	tests := []struct {
+		name          string
+		method        string
+		origin        string
+		expectedCode  int
+		expectedAllow string
+	}{
+		{"Allowed origin", "GET", "http://localhost:3000", http.StatusOK, "http://localhost:3000"},
+		{"Other origin", "GET", "http://evil.example", http.StatusOK, ""},
+		{"No origin", "GET", "", http.StatusOK, ""},
+		{"Preflight", "OPTIONS", "http://localhost:3000", http.StatusNoContent, "http://localhost:3000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, "/health", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("Expected status %d, got %d", tt.expectedCode, w.Code)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.expectedAllow {
+				t.Errorf("Expected Access-Control-Allow-Origin %q, got %q", tt.expectedAllow, got)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Tags(t *testing.T) {
+	cfg, err := parseTestConfig(t, []string{"-tag-budgets", "env:staging=20"}, map[string]string{
+		"TAG_SCHEMA":    "project,env=staging|production",
+		"REQUIRED_TAGS": "project",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(cfg.TagSchema) != 2 || cfg.RequiredTags[0] != "project" || cfg.TagBudgets["env:staging"] != 20 {
+		t.Errorf("Unexpected tag settings: %v, %v, %v", cfg.TagSchema, cfg.RequiredTags, cfg.TagBudgets)
+	}
+
+	_, err = parseTestConfig(t, []string{"-required-tags", "team"}, map[string]string{"TAG_SCHEMA": "project"})
+	if err == nil || !strings.Contains(err.Error(), "required_tags (flag -required-tags): tag team is not in tag_schema") {
+		t.Errorf("Expected required tag outside the schema to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Audio duration detection from file headers, used to estimate the cost of
+// transcriptions before the file is sent upstream. Only headers are parsed;
+// nothing is decoded.
+
+var errUnknownAudioFormat = errors.New("unknown audio format")
+
+// audioDuration returns the duration in seconds of an uploaded audio file and
+// the name of its format.
+func audioDuration(data []byte) (float64, string, error) {
+	var (
+		seconds float64
+		format  string
+		err     error
+	)
+	switch {
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		format = "wav"
+		seconds, err = wavDuration(data)
+	case len(data) >= 4 && string(data[0:4]) == "fLaC":
+		format = "flac"
+		seconds, err = flacDuration(data)
+	case len(data) >= 4 && string(data[0:4]) == "OggS":
+		format = "ogg"
+		seconds, err = oggDuration(data)
+	case len(data) >= 4 && bytes.Equal(data[0:4], []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		format = "webm"
+		seconds, err = matroskaDuration(data)
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		format = "mp4"
+		seconds, err = mp4Duration(data)
+	case len(data) >= 3 && (string(data[0:3]) == "ID3" || (data[0] == 0xFF && data[1]&0xE0 == 0xE0)):
+		format = "mp3"
+		seconds, err = mp3Duration(data)
+	default:
+		return 0, "", errUnknownAudioFormat
+	}
+	if err == nil && (seconds <= 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0)) {
+		err = errors.New("no duration in header")
+	}
+	if err != nil {
+		return 0, format, fmt.Errorf("%s: %w", format, err)
+	}
+	return seconds, format, nil
+}
+
+func wavDuration(data []byte) (float64, error) {
+	var byteRate uint32
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := binary.LittleEndian.Uint32(data[pos+4 : pos+8])
+		body := pos + 8
+		switch id {
+		case "fmt ":
+			if body+12 > len(data) {
+				return 0, errors.New("truncated fmt chunk")
+			}
+			byteRate = binary.LittleEndian.Uint32(data[body+8 : body+12])
+		case "data":
+			if byteRate == 0 {
+				return 0, errors.New("data chunk before fmt chunk")
+			}
+			// Streaming writers leave the size unset
+			if size == 0 || size == math.MaxUint32 || int64(body)+int64(size) > int64(len(data)) {
+				size = uint32(len(data) - body)
+			}
+			return float64(size) / float64(byteRate), nil
+		}
+		pos = body + int(size) + int(size&1) // chunks are padded to even sizes
+	}
+	return 0, errors.New("no data chunk")
+}
+
+func flacDuration(data []byte) (float64, error) {
+	// The first metadata block is always STREAMINFO
+	if len(data) < 8+18 || data[4]&0x7F != 0 {
+		return 0, errors.New("missing STREAMINFO")
+	}
+	info := data[8:]
+	sampleRate := uint32(info[10])<<12 | uint32(info[11])<<4 | uint32(info[12])>>4
+	totalSamples := uint64(info[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(info[14:18]))
+	if sampleRate == 0 {
+		return 0, errors.New("invalid sample rate")
+	}
+	return float64(totalSamples) / float64(sampleRate), nil
+}
+
+// oggDuration reads the granule position of the last page; its unit is the
+// sample rate of the Vorbis stream, or 48 kHz for Opus.
+func oggDuration(data []byte) (float64, error) {
+	if len(data) < 28 {
+		return 0, errors.New("truncated page")
+	}
+	segments := int(data[26])
+	packet := 27 + segments
+	if packet+19 > len(data) {
+		return 0, errors.New("truncated page")
+	}
+
+	var rate float64
+	var preSkip uint64
+	switch {
+	case bytes.HasPrefix(data[packet:], []byte("OpusHead")):
+		rate = 48000
+		preSkip = uint64(binary.LittleEndian.Uint16(data[packet+10 : packet+12]))
+	case bytes.HasPrefix(data[packet:], []byte("\x01vorbis")):
+		rate = float64(binary.LittleEndian.Uint32(data[packet+12 : packet+16]))
+	default:
+		return 0, errors.New("unsupported codec")
+	}
+	if rate == 0 {
+		return 0, errors.New("invalid sample rate")
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || last+14 > len(data) {
+		return 0, errors.New("truncated page")
+	}
+	granule := binary.LittleEndian.Uint64(data[last+6 : last+14])
+	if granule == math.MaxUint64 || granule < preSkip {
+		return 0, errors.New("no granule position")
+	}
+	return float64(granule-preSkip) / rate, nil
+}
+
+// mp4Duration reads the duration of the movie header (moov/mvhd) box.
+func mp4Duration(data []byte) (float64, error) {
+	moov, ok := findMP4Box(data, "moov")
+	if !ok {
+		return 0, errors.New("no moov box")
+	}
+	mvhd, ok := findMP4Box(moov, "mvhd")
+	if !ok || len(mvhd) < 20 {
+		return 0, errors.New("no mvhd box")
+	}
+
+	var timescale uint32
+	var duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0, errors.New("truncated mvhd box")
+		}
+		timescale = binary.BigEndian.Uint32(mvhd[20:24])
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale = binary.BigEndian.Uint32(mvhd[12:16])
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	if timescale == 0 {
+		return 0, errors.New("invalid timescale")
+	}
+	return float64(duration) / float64(timescale), nil
+}
+
+// findMP4Box returns the content of the first box of the given type among the
+// boxes in data.
+func findMP4Box(data []byte, boxType string) ([]byte, bool) {
+	for pos := 0; pos+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[pos : pos+4]))
+		header := uint64(8)
+		switch size {
+		case 0: // box extends to the end of the file
+			size = uint64(len(data) - pos)
+		case 1: // 64-bit size follows the type
+			if pos+16 > len(data) {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(data[pos+8 : pos+16])
+			header = 16
+		}
+		// Boxes running past the end are cut short; sizing before adding keeps
+		// a crafted 64-bit size from wrapping around
+		if remaining := uint64(len(data) - pos); size > remaining {
+			size = remaining
+		}
+		if size < header {
+			return nil, false
+		}
+		end := pos + int(size)
+		if string(data[pos+4:pos+8]) == boxType {
+			return data[pos+int(header) : end], true
+		}
+		pos = end
+	}
+	return nil, false
+}
+
+// Matroska (WebM) element IDs
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+)
+
+// matroskaDuration reads Segment/Info/Duration. Recordings made by browsers
+// often have no duration, which is reported as an error.
+func matroskaDuration(data []byte) (float64, error) {
+	segment, ok := findEBMLElement(data, ebmlSegment)
+	if !ok {
+		return 0, errors.New("no segment")
+	}
+	info, ok := findEBMLElement(segment, ebmlInfo)
+	if !ok {
+		return 0, errors.New("no segment info")
+	}
+
+	scale := 1000000.0 // nanoseconds per timecode unit
+	if raw, ok := findEBMLElement(info, ebmlTimecodeScale); ok && len(raw) > 0 && len(raw) <= 8 {
+		var v uint64
+		for _, b := range raw {
+			v = v<<8 | uint64(b)
+		}
+		scale = float64(v)
+	}
+
+	raw, ok := findEBMLElement(info, ebmlDuration)
+	if !ok {
+		return 0, errors.New("no duration")
+	}
+	var duration float64
+	switch len(raw) {
+	case 4:
+		duration = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+	case 8:
+		duration = math.Float64frombits(binary.BigEndian.Uint64(raw))
+	default:
+		return 0, errors.New("invalid duration")
+	}
+	return duration * scale / 1e9, nil
+}
+
+// findEBMLElement returns the content of the first element with the given ID
+// among the elements in data. Elements of unknown size extend to the end.
+func findEBMLElement(data []byte, id uint64) ([]byte, bool) {
+	for pos := 0; pos < len(data); {
+		elementID, n := readEBMLVint(data[pos:], true)
+		if n == 0 {
+			return nil, false
+		}
+		pos += n
+		size, m := readEBMLVint(data[pos:], false)
+		if m == 0 {
+			return nil, false
+		}
+		pos += m
+
+		end := len(data)
+		if size != 1<<(7*uint(m))-1 && uint64(pos)+size < uint64(len(data)) {
+			end = pos + int(size)
+		}
+		if elementID == id {
+			return data[pos:end], true
+		}
+		pos = end
+	}
+	return nil, false
+}
+
+// readEBMLVint reads a variable-length integer. IDs keep their length marker
+// bit; sizes do not. It returns the number of bytes read, 0 if invalid.
+func readEBMLVint(data []byte, keepMarker bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || length > len(data) {
+		return 0, 0
+	}
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> uint(length))
+	}
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, length
+}
+
+// MPEG audio tables for Layer III
+var (
+	mp3BitratesV1 = [15]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	mp3BitratesV2 = [15]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+	mp3Rates      = map[byte][3]int{3: {44100, 48000, 32000}, 2: {22050, 24000, 16000}, 0: {11025, 12000, 8000}}
+)
+
+// mp3Duration uses the frame count of a Xing/Info or VBRI header when present,
+// and otherwise assumes a constant bitrate.
+func mp3Duration(data []byte) (float64, error) {
+	start := 0
+	if len(data) >= 10 && string(data[0:3]) == "ID3" {
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		start = 10 + size
+		if data[5]&0x10 != 0 { // footer present
+			start += 10
+		}
+	}
+
+	// Find the first frame header
+	for ; start+4 <= len(data); start++ {
+		if data[start] == 0xFF && data[start+1]&0xE0 == 0xE0 {
+			break
+		}
+	}
+	if start+4 > len(data) {
+		return 0, errors.New("no frame header")
+	}
+	header := data[start : start+4]
+
+	version := (header[1] >> 3) & 0x03 // 3 = MPEG 1, 2 = MPEG 2, 0 = MPEG 2.5
+	layer := (header[1] >> 1) & 0x03   // 1 = Layer III
+	bitrateIndex := header[2] >> 4
+	rateIndex := (header[2] >> 2) & 0x03
+	mono := header[3]>>6 == 3
+	rates, ok := mp3Rates[version]
+	if !ok || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return 0, errors.New("unsupported frame header")
+	}
+	sampleRate := rates[rateIndex]
+
+	bitrate := mp3BitratesV1[bitrateIndex]
+	samplesPerFrame := 1152
+	sideInfo := 32
+	if mono {
+		sideInfo = 17
+	}
+	if version != 3 {
+		bitrate = mp3BitratesV2[bitrateIndex]
+		samplesPerFrame = 576
+		sideInfo = 17
+		if mono {
+			sideInfo = 9
+		}
+	}
+
+	// Variable bitrate files carry the number of frames in their first frame
+	var frames uint32
+	if xing := start + 4 + sideInfo; xing+12 <= len(data) {
+		tag := string(data[xing : xing+4])
+		if (tag == "Xing" || tag == "Info") && binary.BigEndian.Uint32(data[xing+4:xing+8])&1 != 0 {
+			frames = binary.BigEndian.Uint32(data[xing+8 : xing+12])
+		}
+	}
+	if vbri := start + 4 + 32; frames == 0 && vbri+18 <= len(data) && string(data[vbri:vbri+4]) == "VBRI" {
+		frames = binary.BigEndian.Uint32(data[vbri+14 : vbri+18])
+	}
+	if frames > 0 {
+		return float64(frames) * float64(samplesPerFrame) / float64(sampleRate), nil
+	}
+
+	audioBytes := len(data) - start
+	if len(data) >= 128 && string(data[len(data)-128:len(data)-125]) == "TAG" {
+		audioBytes -= 128 // ID3v1 tag
+	}
+	return float64(audioBytes) * 8 / float64(bitrate*1000), nil
+}
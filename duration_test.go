@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// Minimal files with just enough header for duration detection
+
+func testWAV(sampleRate, seconds int) []byte {
+	var b bytes.Buffer
+	dataSize := sampleRate * 2 * seconds // 16-bit mono
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(36+dataSize))
+	b.WriteString("WAVEfmt ")
+	for _, field := range []interface{}{
+		uint32(16), uint16(1), uint16(1), uint32(sampleRate), uint32(sampleRate * 2), uint16(2), uint16(16),
+	} {
+		binary.Write(&b, binary.LittleEndian, field)
+	}
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(dataSize))
+	b.Write(make([]byte, dataSize))
+	return b.Bytes()
+}
+
+func testFLAC() []byte {
+	// STREAMINFO: 44100 Hz, 2 channels, 16 bits, 441000 samples
+	info := make([]byte, 34)
+	info[10], info[11], info[12], info[13] = 0x0A, 0xC4, 0x42, 0xF0
+	binary.BigEndian.PutUint32(info[14:18], 441000)
+	return append([]byte{'f', 'L', 'a', 'C', 0x80, 0, 0, 34}, info...)
+}
+
+func testMP3CBR() []byte {
+	// ID3v2 tag, then 128 kbit/s MPEG 1 Layer III frames: 16000 bytes per second
+	tag := []byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, 10}
+	tag = append(tag, make([]byte, 10)...)
+	audio := make([]byte, 16000)
+	copy(audio, []byte{0xFF, 0xFB, 0x90, 0x00})
+	return append(tag, audio...)
+}
+
+func testMP3Xing(frames uint32) []byte {
+	data := []byte{0xFF, 0xFB, 0x90, 0x00}
+	data = append(data, make([]byte, 32)...) // side information
+	data = append(data, 'X', 'i', 'n', 'g', 0, 0, 0, 1)
+	data = binary.BigEndian.AppendUint32(data, frames)
+	return append(data, make([]byte, 400)...)
+}
+
+func testMP4() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 0, 0, 16})
+	b.WriteString("ftypM4A ")
+	b.Write([]byte{0, 0, 0, 0})
+	b.Write([]byte{0, 0, 0, 8})
+	b.WriteString("free")
+	// moov containing mvhd version 0: timescale 1000, duration 5500
+	b.Write([]byte{0, 0, 0, 36})
+	b.WriteString("moov")
+	b.Write([]byte{0, 0, 0, 28})
+	b.WriteString("mvhd")
+	binary.Write(&b, binary.BigEndian, []uint32{0, 0, 0, 1000, 5500})
+	return b.Bytes()
+}
+
+func testOggOpus(seconds int) []byte {
+	page := func(granule uint64, packet []byte) []byte {
+		p := []byte("OggS")
+		p = append(p, 0, 2)
+		p = binary.LittleEndian.AppendUint64(p, granule)
+		p = append(p, make([]byte, 12)...) // serial, sequence, checksum
+		p = append(p, 1, byte(len(packet)))
+		return append(p, packet...)
+	}
+	head := []byte("OpusHead")
+	head = append(head, 1, 1)
+	head = binary.LittleEndian.AppendUint16(head, 312) // pre-skip
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = append(head, 0, 0, 0)
+
+	data := page(0, head)
+	data = append(data, page(0, make([]byte, 100))...)
+	return append(data, page(uint64(seconds*48000+312), make([]byte, 100))...)
+}
+
+func testWebM(durationMs float64) []byte {
+	data := []byte{0x1A, 0x45, 0xDF, 0xA3, 0x80}                                                // empty EBML header
+	data = append(data, 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF) // segment of unknown size
+	info := []byte{0x2A, 0xD7, 0xB1, 0x83, 0x0F, 0x42, 0x40}                                    // 1 ms timecode scale
+	info = append(info, 0x44, 0x89, 0x88)
+	info = binary.BigEndian.AppendUint64(info, math.Float64bits(durationMs))
+	data = append(data, 0x15, 0x49, 0xA9, 0x66, 0x80|byte(len(info)))
+	return append(data, info...)
+}
+
+func TestAudioDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		format   string
+		expected float64
+	}{
+		{"wav", testWAV(16000, 2), "wav", 2},
+		{"flac", testFLAC(), "flac", 10},
+		{"mp3 constant bitrate", testMP3CBR(), "mp3", 1},
+		{"mp3 xing", testMP3Xing(100), "mp3", 100 * 1152 / 44100.0},
+		{"mp4", testMP4(), "mp4", 5.5},
+		{"ogg opus", testOggOpus(3), "ogg", 3},
+		{"webm", testWebM(2500), "webm", 2.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seconds, format, err := audioDuration(tt.data)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if format != tt.format || math.Abs(seconds-tt.expected) > 1e-9 {
+				t.Errorf("Expected %s %.3fs, got %s %.3fs", tt.format, tt.expected, format, seconds)
+			}
+		})
+	}
+}
+
+func TestAudioDuration_Invalid(t *testing.T) {
+	if _, _, err := audioDuration([]byte("not audio at all")); !errors.Is(err, errUnknownAudioFormat) {
+		t.Errorf("Expected unknown format error, got %v", err)
+	}
+
+	// Truncated headers are errors, not panics
+	for _, data := range [][]byte{
+		testWAV(16000, 1)[:30],
+		testFLAC()[:12],
+		testMP4()[:20],
+		testOggOpus(1)[:30],
+		testWebM(1000)[:20],
+		{0xFF, 0xFB},
+	} {
+		if seconds, format, err := audioDuration(data); err == nil {
+			t.Errorf("Expected error for truncated %s file, got %.3fs", format, seconds)
+		}
+	}
+}
+
+func TestAudioDuration_OversizedMP4Box(t *testing.T) {
+	// 64-bit box sizes that would wrap around when added to the offset must
+	// not move the box walk backwards or slice out of range
+	for _, largesize := range []uint64{math.MaxUint64 - 7, math.MaxUint64, 1 << 63} {
+		data := testMP4()[:24] // ftyp and free boxes
+		data = append(data, 0, 0, 0, 1)
+		data = append(data, "skip"...)
+		data = binary.BigEndian.AppendUint64(data, largesize)
+		data = append(data, make([]byte, 16)...)
+
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := audioDuration(data)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("Expected error for box size %d", largesize)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Box walk did not finish for box size %d", largesize)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EmbeddingRequest holds the fields of an embeddings request the proxy needs.
+// The request body is forwarded to OpenAI unchanged.
+type EmbeddingRequest struct {
+	Model string          `json:"model"`
+	Input json.RawMessage `json:"input"`
+	User  string          `json:"user,omitempty"`
+}
+
+type EmbeddingUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type EmbeddingResponse struct {
+	Object     string          `json:"object"`
+	Data       json.RawMessage `json:"data"` // passed through without decoding the vectors
+	Model      string          `json:"model"`
+	Usage      EmbeddingUsage  `json:"usage"`
+	ProxyUsage *ProxyUsage     `json:"proxy_usage,omitempty"`
+}
+
+// countEmbeddingInputTokens counts the tokens of an embeddings input, which is
+// a string, an array of strings, an array of token IDs or an array of such arrays.
+func countEmbeddingInputTokens(input json.RawMessage, model string) (int, error) {
+	var text string
+	if err := json.Unmarshal(input, &text); err == nil {
+		return countTokens(text, model), nil
+	}
+
+	var texts []string
+	if err := json.Unmarshal(input, &texts); err == nil {
+		total := 0
+		for _, t := range texts {
+			total += countTokens(t, model)
+		}
+		return total, nil
+	}
+
+	var tokens []int
+	if err := json.Unmarshal(input, &tokens); err == nil {
+		return len(tokens), nil
+	}
+
+	var tokenArrays [][]int
+	if err := json.Unmarshal(input, &tokenArrays); err == nil {
+		total := 0
+		for _, t := range tokenArrays {
+			total += len(t)
+		}
+		return total, nil
+	}
+
+	return 0, errors.New("input must be a string, an array of strings or an array of token arrays")
+}
+
+func embeddingsProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var reqData EmbeddingRequest
+	if err == nil {
+		err = json.Unmarshal(body, &reqData)
+	}
+	if err != nil || len(reqData.Input) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+
+	if !checkModel(c, proxyKey, reqData.Model) {
+		return
+	}
+	setRequestUser(c, reqData.User)
+
+	promptTokens, err := countEmbeddingInputTokens(reqData.Input, reqData.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Invalid embeddings input: %v.", err),
+		})
+		return
+	}
+	// Embeddings have no output tokens, so the estimate is the full cost
+	promptCost := calculateCost(promptTokens, 0, reqData.Model)
+
+	reservation, ok := reserveRequest(c, proxyKey, reqData.Model, promptTokens, promptCost)
+	if !ok {
+		return
+	}
+
+	respBody, err := postOpenAI("/v1/embeddings", "application/json", body, upstreamKey)
+	var response EmbeddingResponse
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err != nil {
+		failRequest(c, reservation, promptTokens, err)
+		return
+	}
+
+	if response.Usage.PromptTokens > 0 {
+		promptTokens = response.Usage.PromptTokens
+	}
+	cost := calculateCost(promptTokens, 0, reqData.Model)
+	response.ProxyUsage = chargeRequest(c, reservation, promptTokens, 0, cost, "")
+
+	c.JSON(http.StatusOK, response)
+}
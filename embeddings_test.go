@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func setupEmbeddingPricing() {
+	modelPricing["text-embedding-3-small"] = ModelPricing{
+		Model: "text-embedding-3-small",
+		Input: 0.02,
+	}
+	generateAllowedPrefixes()
+}
+
+func postEmbeddings(router http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/embeddings", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCountEmbeddingInputTokens(t *testing.T) {
+	model := "text-embedding-3-small"
+	hello := countTokens("Hello world", model)
+
+	tests := []struct {
+		name     string
+		input    string
+		expected int
+	}{
+		{"string", `"Hello world"`, hello},
+		{"array of strings", `["Hello world", "Hello world"]`, 2 * hello},
+		{"token array", `[9906, 1917, 0]`, 3},
+		{"array of token arrays", `[[9906, 1917], [0]]`, 3},
+		{"empty array", `[]`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := countEmbeddingInputTokens(json.RawMessage(tt.input), model)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tokens != tt.expected {
+				t.Errorf("Expected %d tokens, got %d", tt.expected, tokens)
+			}
+		})
+	}
+
+	if _, err := countEmbeddingInputTokens(json.RawMessage(`{"text": "Hello"}`), model); err == nil {
+		t.Error("Expected error for object input")
+	}
+}
+
+func TestEmbeddingsProxy(t *testing.T) {
+	resetGlobalState()
+	setupEmbeddingPricing()
+
+	var gotBody map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/embeddings" {
+			t.Errorf("Unexpected upstream path %s", r.URL.Path)
+		}
+		data, _ := io.ReadAll(r.Body)
+		json.Unmarshal(data, &gotBody)
+		w.Write([]byte(`{"object":"list","data":[{"object":"embedding","index":0,"embedding":[0.0023064255,-0.009327292]}],"model":"text-embedding-3-small","usage":{"prompt_tokens":500000,"total_tokens":500000}}`))
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() {
+		openAIBaseURL = previous
+		server.Close()
+	}()
+	router := setupTestRouter()
+
+	w := postEmbeddings(router, `{"model":"text-embedding-3-small","input":"Hello world","dimensions":256}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Fields the proxy does not know are forwarded unchanged
+	if gotBody["dimensions"] != 256.0 {
+		t.Errorf("Expected dimensions to be forwarded, got %v", gotBody)
+	}
+
+	var response EmbeddingResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if string(response.Data) != `[{"object":"embedding","index":0,"embedding":[0.0023064255,-0.009327292]}]` {
+		t.Errorf("Embedding data changed: %s", response.Data)
+	}
+	// 500k tokens at $0.02 per 1M tokens
+	if response.ProxyUsage == nil || response.ProxyUsage.PromptTokens != 500000 || response.ProxyUsage.CostUSD != 0.01 {
+		t.Errorf("Unexpected proxy usage: %+v", response.ProxyUsage)
+	}
+	if totalCost != 0.01 {
+		t.Errorf("Expected total cost 0.01, got %f", totalCost)
+	}
+	if w.Header().Get("X-Request-Cost-USD") != "0.010000" {
+		t.Errorf("Unexpected X-Request-Cost-USD: %q", w.Header().Get("X-Request-Cost-USD"))
+	}
+}
+
+func TestEmbeddingsProxy_Rejected(t *testing.T) {
+	resetGlobalState()
+	setupEmbeddingPricing()
+	router := setupTestRouter()
+
+	w := postEmbeddings(router, `{"model":"unknown-embedder","input":"Hello"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unknown model, got %d", w.Code)
+	}
+
+	w = postEmbeddings(router, `{"model":"text-embedding-3-small","input":{"text":"Hello"}}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid input, got %d", w.Code)
+	}
+
+	w = postEmbeddings(router, `{"model":"text-embedding-3-small"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without input, got %d", w.Code)
+	}
+
+	// 100k tokens at $0.02 per 1M tokens exceed a tiny quota
+	costLimitUSD = 0.001
+	tokens := make([]int, 100000)
+	data, _ := json.Marshal(map[string]interface{}{"model": "text-embedding-3-small", "input": tokens})
+	w = postEmbeddings(router, string(data))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Idempotency keys make client retries safe: the first successful response to
+// a request with an Idempotency-Key header is stored for idempotencyWindow and
+// replayed for requests repeating the key, so OpenAI is called and the request
+// charged only once. A duplicate arriving while the first is in flight waits
+// for its result. Stored responses are capped at idempotencyMaxBytes, the
+// oldest evicted first; streamed responses are not stored.
+
+const (
+	idempotencyHeader        = "Idempotency-Key"
+	replayedHeader           = "Idempotent-Replayed"
+	maxIdempotencyKey        = 255
+	defaultIdempotencyWindow = 24 * time.Hour
+	defaultIdempotencyMaxMB  = 50
+)
+
+var (
+	idempotencyWindow   = defaultIdempotencyWindow
+	idempotencyMaxBytes = int64(defaultIdempotencyMaxMB) << 20
+)
+
+// idempotentResult is the stored outcome of a request, or its pending state.
+type idempotentResult struct {
+	requestHash string
+	done        chan struct{} // closed when the first request finishes
+	completed   bool
+	expires     time.Time
+	status      int
+	header      http.Header
+	body        []byte
+	element     *list.Element // in idempotentOrder once stored
+}
+
+// Results by scope, and the IDs of stored ones oldest first with the size of
+// their bodies. Guarded by idempotencyMu.
+var (
+	idempotencyMu      sync.Mutex
+	idempotentRequests = make(map[string]*idempotentResult)
+	idempotentOrder    = list.New()
+	idempotentBytes    int64
+)
+
+// idempotentWriter records the response while writing it to the client.
+// Streamed responses and ones larger than idempotencyMaxBytes are not
+// recorded.
+type idempotentWriter struct {
+	gin.ResponseWriter
+	body    bytes.Buffer
+	skipped bool
+}
+
+func (w *idempotentWriter) record(data []byte) {
+	if w.skipped {
+		return
+	}
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") ||
+		(idempotencyMaxBytes > 0 && int64(w.body.Len()+len(data)) > idempotencyMaxBytes) {
+		w.skipped = true
+		w.body = bytes.Buffer{}
+		return
+	}
+	w.body.Write(data)
+}
+
+func (w *idempotentWriter) Write(data []byte) (int, error) {
+	w.record(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotentWriter) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotent replays the stored response for a repeated Idempotency-Key. Keys
+// are scoped to the client's bearer token and the endpoint; reusing a key for
+// a different request body is rejected with 422. Only 2xx responses are
+// stored, so a failed request can be retried with the same key; so can one
+// whose response was not stored.
+func idempotent(c *gin.Context) {
+	key := c.GetHeader(idempotencyHeader)
+	if key == "" || idempotencyWindow <= 0 {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Idempotency-Key must be at most 255 characters.",
+		})
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Cannot read request body."})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	scope := sha256.Sum256([]byte(c.GetHeader("Authorization") + "\n" + c.Request.URL.Path + "\n" + key))
+	id := hex.EncodeToString(scope[:])
+	requestSum := sha256.Sum256(body)
+	requestHash := hex.EncodeToString(requestSum[:])
+
+	for {
+		idempotencyMu.Lock()
+		now := time.Now()
+		sweepIdempotentResults(now)
+		result, found := idempotentRequests[id]
+		if !found {
+			result = &idempotentResult{requestHash: requestHash, done: make(chan struct{})}
+			idempotentRequests[id] = result
+			idempotencyMu.Unlock()
+			runIdempotent(c, id, result)
+			return
+		}
+		idempotencyMu.Unlock()
+
+		if result.requestHash != requestHash {
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, ErrorResponse{
+				Error: "Idempotency-Key was already used for a different request.",
+			})
+			return
+		}
+		select {
+		case <-result.done:
+		case <-c.Request.Context().Done():
+			c.Abort()
+			return
+		}
+		if result.completed {
+			replayIdempotent(c, result)
+			return
+		}
+		// The first request failed and was forgotten; try again
+	}
+}
+
+// runIdempotent handles the first request with a key and stores its response
+// if it succeeded, evicting the oldest stored responses beyond
+// idempotencyMaxBytes. A handler that panicked has not written its response
+// yet (gin.Recovery writes the 500 later), so nothing is stored for it.
+func runIdempotent(c *gin.Context, id string, result *idempotentResult) {
+	writer := &idempotentWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	returned := false
+	defer func() {
+		idempotencyMu.Lock()
+		defer idempotencyMu.Unlock()
+		status := writer.Status()
+		if !returned || !writer.Written() || status < 200 || status >= 300 || writer.skipped {
+			delete(idempotentRequests, id)
+			close(result.done)
+			return
+		}
+		result.completed = true
+		result.expires = time.Now().Add(idempotencyWindow)
+		result.status = status
+		result.header = writer.Header().Clone()
+		result.body = writer.body.Bytes()
+		result.element = idempotentOrder.PushBack(id)
+		idempotentBytes += int64(len(result.body))
+		for el := idempotentOrder.Front(); el != nil && idempotencyMaxBytes > 0 && idempotentBytes > idempotencyMaxBytes; el = idempotentOrder.Front() {
+			forgetIdempotentResult(el.Value.(string))
+		}
+		close(result.done)
+	}()
+	c.Next()
+	returned = true
+}
+
+func replayIdempotent(c *gin.Context, result *idempotentResult) {
+	for name, values := range result.header {
+		switch name {
+		case "Content-Length", "Date", "Trailer":
+			continue
+		}
+		c.Writer.Header()[name] = values
+	}
+	c.Header(replayedHeader, "true")
+	c.Status(result.status)
+	c.Writer.Write(result.body)
+	c.Abort()
+}
+
+// forgetIdempotentResult removes a stored response. Must hold idempotencyMu.
+func forgetIdempotentResult(id string) {
+	if result, ok := idempotentRequests[id]; ok && result.element != nil {
+		idempotentOrder.Remove(result.element)
+		idempotentBytes -= int64(len(result.body))
+	}
+	delete(idempotentRequests, id)
+}
+
+// sweepIdempotentResults forgets stored responses past their window; they are
+// stored in the order they expire. Must hold idempotencyMu.
+func sweepIdempotentResults(now time.Time) {
+	for el := idempotentOrder.Front(); el != nil; el = idempotentOrder.Front() {
+		id := el.Value.(string)
+		if now.Before(idempotentRequests[id].expires) {
+			break
+		}
+		forgetIdempotentResult(id)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func resetIdempotency(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		idempotencyMu.Lock()
+		idempotentRequests = make(map[string]*idempotentResult)
+		idempotentOrder = list.New()
+		idempotentBytes = 0
+		idempotencyMu.Unlock()
+		idempotencyWindow = defaultIdempotencyWindow
+		idempotencyMaxBytes = int64(defaultIdempotencyMaxMB) << 20
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// postIdempotentChat is postChat with an Idempotency-Key and a chosen prompt.
+func postIdempotentChat(router http.Handler, apiKey, key, content string) *httptest.ResponseRecorder {
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"` + content + `"}]}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set(idempotencyHeader, key)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotency_Replay(t *testing.T) {
+	resetGlobalState()
+	resetIdempotency(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	first := postIdempotentChat(router, "sk-test", "retry-1", "Hello")
+	if first.Code != http.StatusOK || first.Header().Get(replayedHeader) != "" {
+		t.Fatalf("Expected status 200, got %d: %s", first.Code, first.Body.String())
+	}
+	spent := totalCost
+
+	// A retry is answered with the stored response and not charged again
+	retry := postIdempotentChat(router, "sk-test", "retry-1", "Hello")
+	if retry.Code != http.StatusOK || retry.Header().Get(replayedHeader) != "true" || retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected the first response replayed, got %d: %s", retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Content-Type") != first.Header().Get("Content-Type") {
+		t.Errorf("Expected the content type replayed, got %q", retry.Header().Get("Content-Type"))
+	}
+	if n := api.count("POST /v1/chat/completions"); n != 1 || totalCost != spent {
+		t.Errorf("Expected one upstream call and one charge, got %d calls and $%f", n, totalCost)
+	}
+
+	// The key cannot be reused for another request
+	if w := postIdempotentChat(router, "sk-test", "retry-1", "Goodbye"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status 422, got %d: %s", w.Code, w.Body.String())
+	}
+	// Keys are scoped to the client
+	if w := postIdempotentChat(router, "sk-other", "retry-1", "Hello"); w.Header().Get(replayedHeader) != "" {
+		t.Error("Expected another client's key not to be replayed")
+	}
+	if n := api.count("POST /v1/chat/completions"); n != 2 {
+		t.Errorf("Expected 2 upstream calls, got %d", n)
+	}
+}
+
+func TestIdempotency_FailedRequestNotStored(t *testing.T) {
+	resetGlobalState()
+	resetIdempotency(t)
+	api := newMockOpenAIRoutes(t)
+	router := setupTestRouter()
+
+	if w := postIdempotentChat(router, "sk-test", "retry-2", "Hello"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	w := postIdempotentChat(router, "sk-test", "retry-2", "Hello")
+	if w.Code != http.StatusOK || w.Header().Get(replayedHeader) != "" {
+		t.Errorf("Expected the retry to reach OpenAI, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestIdempotency_ConcurrentDuplicates(t *testing.T) {
+	resetGlobalState()
+	resetIdempotency(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Write([]byte(testChatCompletion))
+	}))
+	defer server.Close()
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() { openAIBaseURL = previous }()
+	router := setupTestRouter()
+
+	const duplicates = 3
+	responses := make([]*httptest.ResponseRecorder, duplicates)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = postIdempotentChat(router, "sk-test", "retry-3", "Hello")
+		}(i)
+	}
+	// Let every duplicate arrive while the first is in flight
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	replayed := 0
+	for _, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != responses[0].Body.String() {
+			t.Errorf("Expected the same response for every duplicate, got %d: %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get(replayedHeader) == "true" {
+			replayed++
+		}
+	}
+	if calls.Load() != 1 || replayed != duplicates-1 {
+		t.Errorf("Expected one upstream call and %d replays, got %d calls and %d replays", duplicates-1, calls.Load(), replayed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := calculateCost(10, 5, "gpt-4o"); totalCost != want {
+		t.Errorf("Expected one charge of $%f, got $%f", want, totalCost)
+	}
+}
+
+func TestIdempotency_Window(t *testing.T) {
+	resetGlobalState()
+	resetIdempotency(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	postIdempotentChat(router, "sk-test", "retry-4", "Hello")
+	idempotencyMu.Lock()
+	for _, result := range idempotentRequests {
+		result.expires = time.Now()
+	}
+	idempotencyMu.Unlock()
+	if w := postIdempotentChat(router, "sk-test", "retry-4", "Hello"); w.Header().Get(replayedHeader) != "" {
+		t.Error("Expected a response past the window not to be replayed")
+	}
+
+	// Without a window the header is ignored
+	idempotencyWindow = 0
+	postIdempotentChat(router, "sk-test", "retry-5", "Hello")
+	if w := postIdempotentChat(router, "sk-test", "retry-5", "Hello"); w.Header().Get(replayedHeader) != "" {
+		t.Error("Expected no replay with idempotency disabled")
+	}
+	if n := api.count("POST /v1/chat/completions"); n != 4 {
+		t.Errorf("Expected 4 upstream calls, got %d", n)
+	}
+}
+
+func TestIdempotency_MaxBytes(t *testing.T) {
+	resetGlobalState()
+	resetIdempotency(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	first := postIdempotentChat(router, "sk-test", "retry-6", "Hello")
+	size := int64(first.Body.Len())
+	// Room for two responses: storing a third evicts the oldest
+	idempotencyMaxBytes = 2*size + size/2
+	for i := 7; i <= 8; i++ {
+		postIdempotentChat(router, "sk-test", fmt.Sprintf("retry-%d", i), "Hello")
+	}
+	idempotencyMu.Lock()
+	stored, used := len(idempotentRequests), idempotentBytes
+	idempotencyMu.Unlock()
+	if stored != 2 || used != 2*size {
+		t.Errorf("Expected 2 responses of %d bytes stored, got %d using %d bytes", size, stored, used)
+	}
+	if w := postIdempotentChat(router, "sk-test", "retry-6", "Hello"); w.Header().Get(replayedHeader) != "" {
+		t.Error("Expected the oldest response to be evicted")
+	}
+	if w := postIdempotentChat(router, "sk-test", "retry-8", "Hello"); w.Header().Get(replayedHeader) != "true" {
+		t.Error("Expected the newest response to be replayed")
+	}
+
+	// A response larger than the limit is returned but not stored
+	idempotencyMaxBytes = size - 1
+	if w := postIdempotentChat(router, "sk-test", "retry-9", "Hello"); w.Code != http.StatusOK || w.Body.Len() != int(size) {
+		t.Errorf("Expected the full response, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postIdempotentChat(router, "sk-test", "retry-9", "Hello"); w.Header().Get(replayedHeader) != "" {
+		t.Error("Expected a response over the limit not to be replayed")
+	}
+	if n := api.count("POST /v1/chat/completions"); n != 6 {
+		t.Errorf("Expected 6 upstream calls, got %d", n)
+	}
+}
+
+func TestIdempotency_StreamNotStored(t *testing.T) {
+	resetGlobalState()
+	resetIdempotency(t)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"type\":\"response.completed\",\"response\":{\"usage\":{\"input_tokens\":10,\"output_tokens\":5}}}\n\n")
+	}))
+	defer server.Close()
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() { openAIBaseURL = previous }()
+	router := setupTestRouter()
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/responses", bytes.NewBufferString(`{"model":"gpt-4o","input":"Hello","stream":true}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-test")
+		req.Header.Set(idempotencyHeader, "stream-1")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get(replayedHeader) != "" {
+			t.Errorf("Expected the stream relayed, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	idempotencyMu.Lock()
+	stored := len(idempotentRequests)
+	idempotencyMu.Unlock()
+	if calls.Load() != 2 || stored != 0 {
+		t.Errorf("Expected streams not to be stored, got %d calls and %d stored", calls.Load(), stored)
+	}
+}
+
+func TestIdempotency_PanicNotStored(t *testing.T) {
+	resetIdempotency(t)
+	calls := 0
+	r := gin.New()
+	r.Use(gin.RecoveryWithWriter(io.Discard))
+	r.POST("/v1/chat/completions", idempotent, func(c *gin.Context) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		c.JSON(http.StatusOK, gin.H{"calls": calls})
+	})
+
+	if w := postIdempotentChat(r, "sk-test", "retry-10", "Hello"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d: %s", w.Code, w.Body.String())
+	}
+	// The failed request is retried rather than replayed as an empty 200
+	w := postIdempotentChat(r, "sk-test", "retry-10", "Hello")
+	if w.Code != http.StatusOK || w.Header().Get(replayedHeader) != "" || calls != 2 {
+		t.Errorf("Expected the retry to run the handler, got %d after %d calls: %s", w.Code, calls, w.Body.String())
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultImageModel is used by OpenAI when an images request names no model.
+const defaultImageModel = "dall-e-2"
+
+// maxImageUpload limits the size of image edit uploads held in memory.
+const maxImageUpload = 64 << 20
+
+// ImageRequest holds the fields of an images request the proxy needs to price
+// it. The request body is forwarded to OpenAI unchanged.
+type ImageRequest struct {
+	Model   string `json:"model"`
+	Prompt  string `json:"prompt"`
+	N       *int   `json:"n,omitempty"`
+	Size    string `json:"size,omitempty"`
+	Quality string `json:"quality,omitempty"`
+	User    string `json:"user,omitempty"`
+}
+
+// ImageUsage is reported for token-priced image models such as gpt-image-1.
+type ImageUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	OutputTokens       int `json:"output_tokens"`
+	InputTokensDetails *struct {
+		TextTokens  int `json:"text_tokens"`
+		ImageTokens int `json:"image_tokens"`
+	} `json:"input_tokens_details,omitempty"`
+}
+
+// imagePrice returns the price of one image. Sizes "" and "auto" are priced as
+// 1024x1024. Without a quality (or with "auto") the size's only price is used,
+// then its "standard" price, then its most expensive one, so that estimates do
+// not fall short.
+func (p ModelPricing) imagePrice(size, quality string) (float64, bool) {
+	if size == "" || size == "auto" {
+		size = "1024x1024"
+	}
+	if quality == "auto" {
+		quality = ""
+	}
+
+	highest, found := 0.0, false
+	var standard *ImagePrice
+	for i, price := range p.ImagePrices {
+		if price.Size != size {
+			continue
+		}
+		if price.Quality == quality {
+			return price.PerImage, true
+		}
+		if price.Quality == "standard" {
+			standard = &p.ImagePrices[i]
+		}
+		if price.PerImage > highest {
+			highest, found = price.PerImage, true
+		}
+	}
+	if quality == "" && standard != nil {
+		return standard.PerImage, true
+	}
+	if quality == "" && found {
+		return highest, true
+	}
+
+	// Unknown size or quality: charge the most expensive image of the model
+	for _, price := range p.ImagePrices {
+		if price.PerImage > highest {
+			highest = price.PerImage
+		}
+	}
+	return highest, false
+}
+
+// estimateImageCost prices the prompt and n images before the request is sent.
+func estimateImageCost(reqData ImageRequest, promptTokens int) float64 {
+	pricing, _ := getPricingForModel(reqData.Model)
+	perImage, found := pricing.imagePrice(reqData.Size, reqData.Quality)
+	if !found {
+		log.Printf("Image price not found for model %s, size %q, quality %q, using $%.4f per image", reqData.Model, reqData.Size, reqData.Quality, perImage)
+	}
+	return float64(imageCount(reqData))*perImage + float64(promptTokens)*(pricing.Input/1000000.0)
+}
+
+func imageCount(reqData ImageRequest) int {
+	if reqData.N != nil && *reqData.N > 0 {
+		return *reqData.N
+	}
+	return 1
+}
+
+// imageResponseCost prices a response: token-priced models report usage,
+// other models are charged per returned image.
+func imageResponseCost(reqData ImageRequest, usage *ImageUsage, images int) (promptTokens, completionTokens int, cost float64) {
+	pricing, _ := getPricingForModel(reqData.Model)
+	if usage != nil && (usage.InputTokens > 0 || usage.OutputTokens > 0) {
+		textTokens, imageTokens := usage.InputTokens, 0
+		if usage.InputTokensDetails != nil {
+			textTokens, imageTokens = usage.InputTokensDetails.TextTokens, usage.InputTokensDetails.ImageTokens
+		}
+		cost = float64(textTokens)*(pricing.Input/1000000.0) +
+			float64(imageTokens)*(pricing.ImageInput/1000000.0) +
+			float64(usage.OutputTokens)*(pricing.Output/1000000.0)
+		return usage.InputTokens, usage.OutputTokens, cost
+	}
+
+	perImage, _ := pricing.imagePrice(reqData.Size, reqData.Quality)
+	return 0, 0, float64(images) * perImage
+}
+
+func imageGenerationsProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var reqData ImageRequest
+	if err == nil {
+		err = json.Unmarshal(body, &reqData)
+	}
+	if err != nil || reqData.Prompt == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+
+	proxyImageRequest(c, proxyKey, upstreamKey, "/v1/images/generations", "application/json", body, reqData)
+}
+
+// imageEditsProxy forwards multipart uploads unchanged after reading the form
+// fields needed for pricing.
+func imageEditsProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImageUpload))
+	if err == nil {
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		err = c.Request.ParseMultipartForm(maxImageUpload)
+	}
+	if err != nil || c.PostForm("prompt") == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Expected multipart form with image and prompt.",
+		})
+		return
+	}
+
+	reqData := ImageRequest{
+		Model:   c.PostForm("model"),
+		Prompt:  c.PostForm("prompt"),
+		Size:    c.PostForm("size"),
+		Quality: c.PostForm("quality"),
+		User:    c.PostForm("user"),
+	}
+	if n := c.PostForm("n"); n != "" {
+		count, err := strconv.Atoi(n)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Invalid n: %q.", n),
+			})
+			return
+		}
+		reqData.N = &count
+	}
+
+	proxyImageRequest(c, proxyKey, upstreamKey, "/v1/images/edits", c.GetHeader("Content-Type"), body, reqData)
+}
+
+func proxyImageRequest(c *gin.Context, proxyKey *ProxyKey, upstreamKey, path, contentType string, body []byte, reqData ImageRequest) {
+	if reqData.Model == "" {
+		reqData.Model = defaultImageModel
+	}
+	if !checkModel(c, proxyKey, reqData.Model) {
+		return
+	}
+	setRequestUser(c, reqData.User)
+
+	promptTokens := countTokens(reqData.Prompt, reqData.Model)
+	estimate := estimateImageCost(reqData, promptTokens)
+
+	reservation, ok := reserveRequest(c, proxyKey, reqData.Model, promptTokens, estimate)
+	if !ok {
+		return
+	}
+
+	respBody, err := postOpenAI(path, contentType, body, upstreamKey)
+	// Decoded loosely so that fields unknown to the proxy are passed through
+	var response map[string]json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err != nil {
+		failRequest(c, reservation, promptTokens, err)
+		return
+	}
+
+	var usage *ImageUsage
+	if raw, ok := response["usage"]; ok {
+		json.Unmarshal(raw, &usage)
+	}
+	var data []json.RawMessage
+	json.Unmarshal(response["data"], &data)
+	// Token-priced models report the size and quality they actually used
+	if raw, ok := response["size"]; ok {
+		json.Unmarshal(raw, &reqData.Size)
+	}
+	if raw, ok := response["quality"]; ok {
+		json.Unmarshal(raw, &reqData.Quality)
+	}
+
+	inputTokens, outputTokens, cost := imageResponseCost(reqData, usage, len(data))
+	proxyUsage := chargeRequest(c, reservation, inputTokens, outputTokens, cost, "")
+	proxyUsage.Images = len(data)
+
+	response["proxy_usage"], _ = json.Marshal(proxyUsage)
+	c.JSON(http.StatusOK, response)
+}
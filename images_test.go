@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testImagePricingCSV = `model,version,input,cached_input,output,service_tier,min_prompt_tokens,image_input,size,quality,per_image
+gpt-image-1,gpt-image-1,5.0,1.25,40.0,,,10.0,,,
+gpt-image-1,gpt-image-1,,,,,,,1024x1024,low,0.011
+gpt-image-1,gpt-image-1,,,,,,,1024x1024,high,0.167
+dall-e-3,dall-e-3,,,,,,,1024x1024,standard,0.04
+dall-e-3,dall-e-3,,,,,,,1024x1024,hd,0.08
+dall-e-3,dall-e-3,,,,,,,1792x1024,hd,0.12
+dall-e-2,dall-e-2,,,,,,,256x256,,0.016
+dall-e-2,dall-e-2,,,,,,,1024x1024,,0.02
+`
+
+func setupImagePricing(t *testing.T) {
+	t.Helper()
+	problems, err := parsePricingCSV(testImagePricingCSV, modelPricing)
+	if err != nil || len(problems) > 0 {
+		t.Fatalf("Failed to parse image pricing: %v %v", err, problems)
+	}
+	generateAllowedPrefixes()
+}
+
+// mockOpenAIRaw serves a fixed JSON body and records the last request.
+func mockOpenAIRaw(t *testing.T, body string) *http.Request {
+	t.Helper()
+	got := &http.Request{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		*got = *r
+		got.Body = io.NopCloser(bytes.NewReader(data))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	t.Cleanup(func() {
+		openAIBaseURL = previous
+		server.Close()
+	})
+	return got
+}
+
+func postImages(router http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/images/generations", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestImagePricingRows(t *testing.T) {
+	resetGlobalState()
+	setupImagePricing(t)
+
+	pricing := modelPricing["gpt-image-1"]
+	if pricing.Input != 5.0 || pricing.ImageInput != 10.0 || pricing.Output != 40.0 || len(pricing.ImagePrices) != 2 {
+		t.Errorf("Unexpected gpt-image-1 pricing: %+v", pricing)
+	}
+
+	tests := []struct {
+		model, size, quality string
+		expected             float64
+		found                bool
+	}{
+		{"dall-e-3", "1024x1024", "hd", 0.08, true},
+		{"dall-e-3", "", "", 0.04, true},          // default size, standard quality
+		{"dall-e-3", "1792x1024", "", 0.12, true}, // only quality offered
+		{"dall-e-2", "256x256", "", 0.016, true},
+		{"gpt-image-1", "auto", "auto", 0.167, true}, // most expensive for the size
+		{"gpt-image-1", "4096x4096", "low", 0.167, false},
+	}
+	for _, tt := range tests {
+		price, found := modelPricing[tt.model].imagePrice(tt.size, tt.quality)
+		if price != tt.expected || found != tt.found {
+			t.Errorf("imagePrice(%s, %q, %q) = %v, %v; expected %v, %v", tt.model, tt.size, tt.quality, price, found, tt.expected, tt.found)
+		}
+	}
+
+	// Per-image rows need a size and a valid price
+	problems, _ := parsePricingCSV(`model,version,input,cached_input,output,size,quality,per_image
+dall-e-2,dall-e-2,,,,,,0.02
+dall-e-2,dall-e-2,,,,256x256,,abc
+`, make(map[string]ModelPricing))
+	if len(problems) != 2 || !strings.Contains(problems[0], "line 2") || !strings.Contains(problems[1], "invalid per_image") {
+		t.Errorf("Unexpected problems: %v", problems)
+	}
+}
+
+func TestImageGenerations_PerImage(t *testing.T) {
+	resetGlobalState()
+	setupImagePricing(t)
+	got := mockOpenAIRaw(t, `{"created":1713833628,"data":[{"url":"https://example.com/1.png"},{"url":"https://example.com/2.png"}]}`)
+	router := setupTestRouter()
+
+	w := postImages(router, `{"model":"dall-e-3","prompt":"A cat","n":2,"size":"1024x1024","quality":"hd","style":"vivid"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got.URL.Path != "/v1/images/generations" {
+		t.Errorf("Unexpected upstream path %s", got.URL.Path)
+	}
+	sent, _ := io.ReadAll(got.Body)
+	if !strings.Contains(string(sent), `"style":"vivid"`) {
+		t.Errorf("Expected request to be forwarded unchanged, got %s", sent)
+	}
+
+	var response struct {
+		Created    int64             `json:"created"`
+		Data       []json.RawMessage `json:"data"`
+		ProxyUsage ProxyUsage        `json:"proxy_usage"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Created != 1713833628 || len(response.Data) != 2 {
+		t.Errorf("Response not passed through: %s", w.Body.String())
+	}
+	if response.ProxyUsage.Images != 2 || response.ProxyUsage.CostUSD != 0.16 {
+		t.Errorf("Unexpected proxy usage: %+v", response.ProxyUsage)
+	}
+	if totalCost != 0.16 {
+		t.Errorf("Expected total cost 0.16, got %f", totalCost)
+	}
+}
+
+func TestImageGenerations_TokenPriced(t *testing.T) {
+	resetGlobalState()
+	setupImagePricing(t)
+	mockOpenAIRaw(t, `{"created":1,"data":[{"b64_json":"aGVsbG8="}],"quality":"low","size":"1024x1024",
+		"usage":{"input_tokens":50,"output_tokens":4160,"total_tokens":4210,"input_tokens_details":{"text_tokens":40,"image_tokens":10}}}`)
+	router := setupTestRouter()
+
+	w := postImages(router, `{"model":"gpt-image-1","prompt":"A cat"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 40 text tokens at $5, 10 image tokens at $10 and 4160 output tokens at $40 per 1M
+	expected := (40*5.0 + 10*10.0 + 4160*40.0) / 1000000
+	var response struct {
+		ProxyUsage ProxyUsage `json:"proxy_usage"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.ProxyUsage.PromptTokens != 50 || response.ProxyUsage.CompletionTokens != 4160 {
+		t.Errorf("Unexpected proxy usage: %+v", response.ProxyUsage)
+	}
+	if diff := totalCost - expected; diff > 1e-12 || diff < -1e-12 {
+		t.Errorf("Expected total cost %f, got %f", expected, totalCost)
+	}
+}
+
+func TestImageGenerations_Rejected(t *testing.T) {
+	resetGlobalState()
+	setupImagePricing(t)
+	router := setupTestRouter()
+
+	if w := postImages(router, `{"model":"dall-e-3"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without prompt, got %d", w.Code)
+	}
+
+	// 10 hd images cost $0.80, more than the remaining quota
+	costLimitUSD = 0.5
+	w := postImages(router, `{"model":"dall-e-3","prompt":"A cat","n":10,"quality":"hd"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestImageEdits_Multipart(t *testing.T) {
+	resetGlobalState()
+	setupImagePricing(t)
+	got := mockOpenAIRaw(t, `{"created":1,"data":[{"url":"https://example.com/1.png"}]}`)
+	router := setupTestRouter()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("prompt", "Add a hat")
+	form.WriteField("size", "256x256")
+	part, _ := form.CreateFormFile("image", "cat.png")
+	part.Write([]byte("\x89PNG fake image data"))
+	form.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/images/edits", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The upload is forwarded byte for byte
+	sent, _ := io.ReadAll(got.Body)
+	if !bytes.Equal(sent, body.Bytes()) || got.Header.Get("Content-Type") != form.FormDataContentType() {
+		t.Error("Multipart body was not forwarded unchanged")
+	}
+	// Without a model the default dall-e-2 price applies
+	if totalCost != 0.016 {
+		t.Errorf("Expected total cost 0.016, got %f", totalCost)
+	}
+}
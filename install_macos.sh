@@ -96,6 +96,14 @@ go mod tidy
 go mod download
 print_status "Dependencies installed"
 
+# Token counting reads bundled encodings and never downloads them at runtime
+print_info "Fetching token encodings..."
+if make encodings; then
+    print_status "Token encodings installed"
+else
+    print_warning "Cannot fetch token encodings, token counts will be approximate"
+fi
+
 # Build the application
 print_info "Building the application..."
 make build
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// proxyKeyPrefix marks secrets issued by the proxy, as opposed to OpenAI keys
+// that are passed through to the upstream API unchanged.
+const proxyKeyPrefix = "sk-proxy-"
+
+var errKeyNotFound = errors.New("not found")
+
+// ProxyKey is an API key issued by the proxy. Only the SHA-256 hash of the
+// secret is stored; the secret itself is shown once, when the key is created.
+type ProxyKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Prefix    string     `json:"prefix"`     // first characters of the secret, for display
+	BudgetUSD float64    `json:"budget_usd"` // 0 means only the global quota applies
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	FrozenAt  *time.Time `json:"frozen_at,omitempty"` // temporarily disabled, see Freeze
+
+	// Moderation overrides the moderation setting for the key when set
+	Moderation *bool `json:"moderation,omitempty"`
+
+	// RateLimit caps the requests and tokens per minute of the key
+	RateLimit
+
+	// MaxConcurrent caps the key's requests in flight; 0 uses key_max_concurrent
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// Priority is the lane of the key's requests, interactive when empty
+	Priority string `json:"priority,omitempty"`
+
+	// Project places the key in the budget tree, e.g. "platform/search";
+	// empty keys are charged to the organisation only
+	Project string `json:"project,omitempty"`
+
+	// Models lists the model patterns the key may use, e.g. "gpt-4o-mini*";
+	// empty allows every model the proxy allows
+	Models []string `json:"models,omitempty"`
+}
+
+func (k ProxyKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+func (k ProxyKey) Frozen() bool {
+	return k.FrozenAt != nil
+}
+
+// KeyStore is a JSON file of proxy keys shared by the server and the CLI.
+// The server reloads the file when it changes on disk.
+type KeyStore struct {
+	path string
+	mu   sync.Mutex
+	keys []ProxyKey
+	info os.FileInfo // file state at the last load, nil if the file did not exist
+}
+
+var keyStore *KeyStore
+
+func loadKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload re-reads the key file if it was modified. A missing file is an empty store.
+// Saves replace the file, so a new inode also counts as a modification.
+func (s *KeyStore) reload() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.keys = nil
+		s.info = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read keys file: %w", err)
+	}
+	if s.info != nil && os.SameFile(s.info, info) && info.ModTime().Equal(s.info.ModTime()) && info.Size() == s.info.Size() {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("cannot read keys file: %w", err)
+	}
+	var keys []ProxyKey
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return fmt.Errorf("invalid keys file %s: %w", s.path, err)
+		}
+	}
+
+	s.keys = keys
+	s.info = info
+	return nil
+}
+
+// save writes the store atomically so a concurrent reader never sees a partial file.
+func (s *KeyStore) save() error {
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".keys-*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot write keys file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("cannot write keys file: %w", err)
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("cannot write keys file: %w", err)
+	}
+
+	if info, err := os.Stat(s.path); err == nil {
+		s.info = info
+	}
+	return nil
+}
+
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create issues a new key and returns its secret together with the stored record.
+func (s *KeyStore) Create(name string, budgetUSD float64) (string, ProxyKey, error) {
+	if name == "" {
+		return "", ProxyKey{}, errors.New("key name must not be empty")
+	}
+	if budgetUSD < 0 {
+		return "", ProxyKey{}, errors.New("key budget must not be negative")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return "", ProxyKey{}, err
+	}
+	for _, k := range s.keys {
+		if k.Name == name && !k.Revoked() {
+			return "", ProxyKey{}, fmt.Errorf("an active key named %q already exists (%s)", name, k.ID)
+		}
+	}
+
+	secretPart, err := randomHex(24)
+	if err != nil {
+		return "", ProxyKey{}, err
+	}
+	idPart, err := randomHex(4)
+	if err != nil {
+		return "", ProxyKey{}, err
+	}
+	secret := proxyKeyPrefix + secretPart
+
+	key := ProxyKey{
+		ID:        "key_" + idPart,
+		Name:      name,
+		Hash:      hashKey(secret),
+		Prefix:    secret[:len(proxyKeyPrefix)+6],
+		BudgetUSD: budgetUSD,
+		CreatedAt: time.Now().UTC(),
+	}
+	s.keys = append(s.keys, key)
+	if err := s.save(); err != nil {
+		s.keys = s.keys[:len(s.keys)-1]
+		return "", ProxyKey{}, err
+	}
+
+	return secret, key, nil
+}
+
+// update applies fn to the key with the given ID or name and saves the store.
+func (s *KeyStore) update(idOrName string, fn func(k *ProxyKey) error) (ProxyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return ProxyKey{}, err
+	}
+
+	index := -1
+	for i, k := range s.keys {
+		if k.ID == idOrName || (k.Name == idOrName && !k.Revoked()) {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return ProxyKey{}, fmt.Errorf("key %q %w", idOrName, errKeyNotFound)
+	}
+
+	previous := s.keys[index]
+	if err := fn(&s.keys[index]); err != nil {
+		return ProxyKey{}, err
+	}
+	if err := s.save(); err != nil {
+		s.keys[index] = previous
+		return ProxyKey{}, err
+	}
+	return s.keys[index], nil
+}
+
+// Revoke disables a key permanently.
+func (s *KeyStore) Revoke(idOrName string) (ProxyKey, error) {
+	return s.update(idOrName, func(k *ProxyKey) error {
+		if k.Revoked() {
+			return fmt.Errorf("key %s is already revoked", k.ID)
+		}
+		now := time.Now().UTC()
+		k.RevokedAt = &now
+		return nil
+	})
+}
+
+// SetBudget replaces the budget of a key. A budget of 0 leaves only the global quota.
+func (s *KeyStore) SetBudget(id string, budgetUSD float64) (ProxyKey, error) {
+	if budgetUSD < 0 {
+		return ProxyKey{}, errors.New("key budget must not be negative")
+	}
+	return s.update(id, func(k *ProxyKey) error {
+		k.BudgetUSD = budgetUSD
+		return nil
+	})
+}
+
+// TopUp adds amountUSD to the budget of a key.
+func (s *KeyStore) TopUp(id string, amountUSD float64) (ProxyKey, error) {
+	if amountUSD <= 0 {
+		return ProxyKey{}, errors.New("top-up amount must be positive")
+	}
+	return s.update(id, func(k *ProxyKey) error {
+		if k.BudgetUSD == 0 {
+			return fmt.Errorf("key %s has no budget of its own to top up", k.ID)
+		}
+		k.BudgetUSD += amountUSD
+		return nil
+	})
+}
+
+// Freeze temporarily rejects requests made with a key until it is unfrozen.
+func (s *KeyStore) Freeze(id string) (ProxyKey, error) {
+	return s.update(id, func(k *ProxyKey) error {
+		if k.Frozen() {
+			return fmt.Errorf("key %s is already frozen", k.ID)
+		}
+		now := time.Now().UTC()
+		k.FrozenAt = &now
+		return nil
+	})
+}
+
+func (s *KeyStore) Unfreeze(id string) (ProxyKey, error) {
+	return s.update(id, func(k *ProxyKey) error {
+		if !k.Frozen() {
+			return fmt.Errorf("key %s is not frozen", k.ID)
+		}
+		k.FrozenAt = nil
+		return nil
+	})
+}
+
+// SetModeration sets whether chat prompts made with a key are moderated; nil
+// follows the moderation setting.
+func (s *KeyStore) SetModeration(id string, moderation *bool) (ProxyKey, error) {
+	return s.update(id, func(k *ProxyKey) error {
+		k.Moderation = moderation
+		return nil
+	})
+}
+
+// SetRateLimit sets the requests and tokens per minute of a key; zero removes
+// a limit.
+func (s *KeyStore) SetRateLimit(id string, limit RateLimit) (ProxyKey, error) {
+	if limit.RPM < 0 || limit.TPM < 0 {
+		return ProxyKey{}, errors.New("rate limits must not be negative")
+	}
+	return s.update(id, func(k *ProxyKey) error {
+		k.RateLimit = limit
+		return nil
+	})
+}
+
+// SetMaxConcurrent sets how many requests of a key may be in flight at once;
+// zero follows the key_max_concurrent setting.
+func (s *KeyStore) SetMaxConcurrent(id string, limit int) (ProxyKey, error) {
+	if limit < 0 {
+		return ProxyKey{}, errors.New("concurrency limit must not be negative")
+	}
+	return s.update(id, func(k *ProxyKey) error {
+		k.MaxConcurrent = limit
+		return nil
+	})
+}
+
+// SetPriority sets the lane of a key's requests; "" makes them interactive.
+func (s *KeyStore) SetPriority(id, priority string) (ProxyKey, error) {
+	if priority != "" && !validPriority(priority) {
+		return ProxyKey{}, fmt.Errorf("priority must be %s or %s", priorityInteractive, priorityBatch)
+	}
+	return s.update(id, func(k *ProxyKey) error {
+		k.Priority = priority
+		return nil
+	})
+}
+
+// SetProject moves a key to a node of the budget tree; "" moves it to the root.
+func (s *KeyStore) SetProject(id, project string) (ProxyKey, error) {
+	project, err := normalizeBudgetPath(project)
+	if err != nil {
+		return ProxyKey{}, err
+	}
+	return s.update(id, func(k *ProxyKey) error {
+		k.Project = project
+		return nil
+	})
+}
+
+// SetModels replaces the model patterns a key may use; none allows every model.
+func (s *KeyStore) SetModels(id string, models []string) (ProxyKey, error) {
+	for _, pattern := range models {
+		if err := validModelPattern(pattern); err != nil {
+			return ProxyKey{}, err
+		}
+	}
+	if len(models) == 0 {
+		models = nil
+	}
+	return s.update(id, func(k *ProxyKey) error {
+		k.Models = models
+		return nil
+	})
+}
+
+// List returns all keys ordered by creation time.
+func (s *KeyStore) List() ([]ProxyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	keys := make([]ProxyKey, len(s.keys))
+	copy(keys, s.keys)
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// Get finds a key by ID, or an active key by name.
+func (s *KeyStore) Get(idOrName string) (ProxyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return ProxyKey{}, err
+	}
+	for _, k := range s.keys {
+		if k.ID == idOrName || (k.Name == idOrName && !k.Revoked()) {
+			return k, nil
+		}
+	}
+	return ProxyKey{}, fmt.Errorf("key %q %w", idOrName, errKeyNotFound)
+}
+
+// Lookup finds the key matching a secret presented by a client.
+func (s *KeyStore) Lookup(secret string) (ProxyKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		// Keep serving with the last good copy of the file
+		log.Printf("Warning: %v", err)
+	}
+	hash := hashKey(secret)
+	for _, k := range s.keys {
+		if k.Hash == hash {
+			return k, true
+		}
+	}
+	return ProxyKey{}, false
+}
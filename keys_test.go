@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupTestKeyStore(t *testing.T) *KeyStore {
+	t.Helper()
+	store, err := loadKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatalf("Failed to load key store: %v", err)
+	}
+	keyStore = store
+	keySpend = make(map[string]float64)
+	t.Cleanup(func() {
+		keyStore = nil
+		upstreamAPIKey = ""
+		keySpend = make(map[string]float64)
+	})
+	return store
+}
+
+// mockOpenAI serves a fixed chat completion and records the Authorization header.
+func mockOpenAI(t *testing.T, response ChatResponse) *string {
+	t.Helper()
+	var gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	t.Cleanup(func() {
+		openAIBaseURL = previous
+		server.Close()
+	})
+	return &gotAuth
+}
+
+func postChat(router http.Handler, apiKey string) *httptest.ResponseRecorder {
+	jsonData, _ := json.Marshal(ChatRequest{
+		Model:    "gpt-4o",
+		Messages: []ChatMessage{{Role: "user", Content: "Hello"}},
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestKeyStore_CreateLookupRevoke(t *testing.T) {
+	store := setupTestKeyStore(t)
+
+	secret, key, err := store.Create("alice", 1.5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(secret, proxyKeyPrefix) || !strings.HasPrefix(secret, key.Prefix) {
+		t.Errorf("Unexpected secret %q for prefix %q", secret, key.Prefix)
+	}
+
+	found, ok := store.Lookup(secret)
+	if !ok || found.ID != key.ID || found.BudgetUSD != 1.5 {
+		t.Errorf("Lookup failed: %+v, %v", found, ok)
+	}
+	if _, ok := store.Lookup("sk-some-openai-key"); ok {
+		t.Error("Unknown key should not be found")
+	}
+
+	// A second store on the same file sees the changes
+	other, err := loadKeyStore(store.path)
+	if err != nil {
+		t.Fatalf("Failed to reload store: %v", err)
+	}
+	if _, err := other.Revoke(key.ID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found, ok = store.Lookup(secret)
+	if !ok || !found.Revoked() {
+		t.Error("Revocation should be picked up from the file")
+	}
+
+	if _, err := store.Revoke(key.ID); err == nil {
+		t.Error("Expected error revoking twice")
+	}
+	if _, _, err := store.Create("", 0); err == nil {
+		t.Error("Expected error for empty name")
+	}
+}
+
+func TestChatCompletionsProxy_ProxyKeys(t *testing.T) {
+	resetGlobalState()
+	store := setupTestKeyStore(t)
+	router := setupTestRouter()
+
+	secret, key, _ := store.Create("alice", 1.0)
+	revokedSecret, revoked, _ := store.Create("bob", 0)
+	store.Revoke(revoked.ID)
+
+	// No upstream key configured
+	if w := postChat(router, secret); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 without upstream key, got %d", w.Code)
+	}
+
+	upstreamAPIKey = "sk-upstream"
+	if w := postChat(router, revokedSecret); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for revoked key, got %d", w.Code)
+	}
+
+	gotAuth := mockOpenAI(t, ChatResponse{
+		Choices: []Choice{{Message: ChatMessage{Role: "assistant", Content: "Hi"}}},
+		Usage:   Usage{PromptTokens: 100000, CompletionTokens: 10000},
+	})
+
+	w := postChat(router, secret)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if *gotAuth != "Bearer sk-upstream" {
+		t.Errorf("Expected upstream key to be used, got %q", *gotAuth)
+	}
+	expectedCost := calculateCost(100000, 10000, "gpt-4o")
+	if keySpend[key.ID] != expectedCost {
+		t.Errorf("Expected key spend %f, got %f", expectedCost, keySpend[key.ID])
+	}
+
+	// Client keys are still passed through unchanged
+	if w := postChat(router, "sk-client"); w.Code != http.StatusOK || *gotAuth != "Bearer sk-client" {
+		t.Errorf("Expected pass-through of client key, got %d with %q", w.Code, *gotAuth)
+	}
+
+	keySpend[key.ID] = 1.0
+	w = postChat(router, secret)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "Key cost limit exceeded") {
+		t.Errorf("Expected key budget error, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChatCompletionsProxy_RecordsLedger(t *testing.T) {
+	resetGlobalState()
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	ledger = l
+	defer func() {
+		ledger = nil
+		l.Close()
+	}()
+
+	mockOpenAI(t, ChatResponse{
+		Choices:     []Choice{{Message: ChatMessage{Role: "assistant", Content: "Hi"}}},
+		Usage:       Usage{PromptTokens: 10, CompletionTokens: 5},
+		ServiceTier: "default",
+	})
+	router := setupTestRouter()
+	if w := postChat(router, "sk-client"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	entries, err := readLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to read ledger: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 ledger entry, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Model != "gpt-4o" || e.PromptTokens != 10 || e.CompletionTokens != 5 || e.KeyID != "" || e.ServiceTier != "" {
+		t.Errorf("Unexpected ledger entry: %+v", e)
+	}
+	if e.CostUSD != calculateCost(10, 5, "gpt-4o") {
+		t.Errorf("Unexpected cost %f", e.CostUSD)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Ledger entry types other than charged requests
+const (
+	ledgerEntryReset      = "reset"      // key or budget node spend reset by an administrator
+	ledgerEntryModeration = "moderation" // free moderation call
+	ledgerEntryCacheHit   = "cache_hit"  // response served from the cache, not charged
+	ledgerEntryFile       = "file"       // file uploaded with a proxy key, recording its owner
+	ledgerEntryBatch      = "batch"      // batch submitted, its estimate reserved until it is settled
+)
+
+// LedgerEntry records one charged request, or an event affecting spend when Type is set.
+type LedgerEntry struct {
+	Time             time.Time         `json:"time"`
+	Type             string            `json:"type,omitempty"`
+	KeyID            string            `json:"key_id,omitempty"`
+	Project          string            `json:"project,omitempty"` // key's node in the budget tree
+	Tags             map[string]string `json:"tags,omitempty"`
+	User             string            `json:"user,omitempty"` // OpenAI's user field
+	Model            string            `json:"model"`
+	PromptTokens     int               `json:"prompt_tokens"`
+	CompletionTokens int               `json:"completion_tokens"`
+	CostUSD          float64           `json:"cost_usd"`
+	ServiceTier      string            `json:"service_tier,omitempty"`
+	Flagged          bool              `json:"flagged,omitempty"`   // moderation result
+	SavedUSD         float64           `json:"saved_usd,omitempty"` // cost of a cache hit had it been fetched
+	FileID           string            `json:"file_id,omitempty"`
+	BatchID          string            `json:"batch_id,omitempty"`     // submitted batch, or the batch a charge settles
+	ReservedUSD      float64           `json:"reserved_usd,omitempty"` // estimate reserved for a submitted batch
+}
+
+// Ledger is an append-only JSON Lines file of charged requests.
+type Ledger struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+var ledger *Ledger
+
+func openLedger(path string) (*Ledger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open ledger: %w", err)
+	}
+	return &Ledger{path: path, file: file}, nil
+}
+
+func (l *Ledger) Append(entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// readLedger returns every entry of a ledger file. A missing file is an empty ledger.
+func readLedger(path string) ([]LedgerEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open ledger: %w", err)
+	}
+	defer file.Close()
+
+	var entries []LedgerEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid ledger entry: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read ledger: %w", err)
+	}
+	return entries, nil
+}
+
+// keySpend holds the spend of each proxy key, restored from the ledger at
+// startup together with nodeSpend, tagSpend, the spend of model caps and the
+// batches still running. Guarded by mu.
+var keySpend = make(map[string]float64)
+
+func restoreKeySpend(entries []LedgerEntry) {
+	now := time.Now()
+	for _, entry := range entries {
+		restoreBatchState(entry)
+		if entry.Type == "" {
+			chargeModelSpendCaps(entry.Model, entry.CostUSD, entry.Time, now)
+			chargeTags(entry.Tags, entry.CostUSD)
+		}
+		if entry.KeyID == "" {
+			// A reset without a key is one of the budget node in Project
+			if entry.Type == ledgerEntryReset && entry.Project != "" {
+				delete(nodeSpend, entry.Project)
+			}
+			continue
+		}
+		switch entry.Type {
+		case "":
+			keySpend[entry.KeyID] += entry.CostUSD
+			chargeNodes(entry.Project, entry.CostUSD)
+		case ledgerEntryReset:
+			keySpend[entry.KeyID] = 0
+			startBudgetPeriod("key:"+entry.KeyID, entry.Time)
+		}
+	}
+}
+
+// recordUsage appends a charged request to the ledger, if one is configured.
+func recordUsage(entry LedgerEntry) {
+	if ledger == nil {
+		return
+	}
+	if err := ledger.Append(entry); err != nil {
+		log.Printf("Warning: cannot write ledger entry: %v", err)
+	}
+}
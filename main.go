@@ -1,22 +1,22 @@
 package main
 
 import (
-	"bytes"
 	_ "embed"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/gin-gonic/gin"
-	"github.com/pkoukk/tiktoken-go"
 )
 
 //go:embed config/model_pricing.csv
@@ -28,14 +28,42 @@ var (
 	modelPricing         = make(map[string]ModelPricing)
 	totalCost            = 0.0
 	mu                   sync.Mutex
+
+	// upstreamAPIKey replaces proxy-issued keys in requests to OpenAI
+	upstreamAPIKey string
+	openAIBaseURL  = "https://api.openai.com"
 )
 
 type ModelPricing struct {
-	Model       string  `json:"model"`
-	Version     string  `json:"version"`
-	Input       float64 `json:"input"`        // price per 1M input tokens
-	CachedInput float64 `json:"cached_input"` // price per 1M cached input tokens
-	Output      float64 `json:"output"`       // price per 1M output tokens
+	Model       string        `json:"model"`
+	Version     string        `json:"version"`
+	Input       float64       `json:"input"`                       // price per 1M input tokens
+	CachedInput float64       `json:"cached_input"`                // price per 1M cached input tokens
+	Output      float64       `json:"output"`                      // price per 1M output tokens
+	ImageInput  float64       `json:"image_input,omitempty"`       // price per 1M image input tokens
+	PerSecond   float64       `json:"per_second,omitempty"`        // price per second of input audio
+	PerMChars   float64       `json:"per_1m_characters,omitempty"` // price per 1M input characters
+	Rules       []PricingRule `json:"rules,omitempty"`
+	ImagePrices []ImagePrice  `json:"image_prices,omitempty"`
+}
+
+// PricingRule overrides the base rates of a model for a service tier
+// (e.g. "batch", "flex", "priority") and/or for prompts of at least
+// MinPromptTokens tokens (long-context pricing).
+type PricingRule struct {
+	ServiceTier     string  `json:"service_tier,omitempty"`
+	MinPromptTokens int     `json:"min_prompt_tokens,omitempty"`
+	Input           float64 `json:"input"`
+	CachedInput     float64 `json:"cached_input"`
+	Output          float64 `json:"output"`
+}
+
+// ImagePrice is the price of one generated image of a size and quality.
+// An empty Quality is the only quality offered for that size.
+type ImagePrice struct {
+	Size     string  `json:"size"`
+	Quality  string  `json:"quality,omitempty"`
+	PerImage float64 `json:"per_image"`
 }
 
 type ChatMessage struct {
@@ -49,12 +77,17 @@ type ChatRequest struct {
 	Messages         []ChatMessage `json:"messages"`
 	Temperature      *float64      `json:"temperature,omitempty"`
 	MaxTokens        *int          `json:"max_tokens,omitempty"`
+	MaxCompletion    *int          `json:"max_completion_tokens,omitempty"`
 	N                *int          `json:"n,omitempty"`
 	Stop             interface{}   `json:"stop,omitempty"`
 	PresencePenalty  *float64      `json:"presence_penalty,omitempty"`
 	FrequencyPenalty *float64      `json:"frequency_penalty,omitempty"`
 	Functions        interface{}   `json:"functions,omitempty"`
 	FunctionCall     interface{}   `json:"function_call,omitempty"`
+	Tools            interface{}   `json:"tools,omitempty"`
+	ToolChoice       interface{}   `json:"tool_choice,omitempty"`
+	ServiceTier      string        `json:"service_tier,omitempty"`
+	User             string        `json:"user,omitempty"`
 }
 
 type Usage struct {
@@ -70,19 +103,27 @@ type Choice struct {
 }
 
 type ChatResponse struct {
-	ID         string      `json:"id"`
-	Object     string      `json:"object"`
-	Created    int64       `json:"created"`
-	Model      string      `json:"model"`
-	Choices    []Choice    `json:"choices"`
-	Usage      Usage       `json:"usage"`
-	ProxyUsage *ProxyUsage `json:"proxy_usage,omitempty"`
+	ID          string      `json:"id"`
+	Object      string      `json:"object"`
+	Created     int64       `json:"created"`
+	Model       string      `json:"model"`
+	Choices     []Choice    `json:"choices"`
+	Usage       Usage       `json:"usage"`
+	ServiceTier string      `json:"service_tier,omitempty"`
+	ProxyUsage  *ProxyUsage `json:"proxy_usage,omitempty"`
 }
 
 type ProxyUsage struct {
 	PromptTokens     int     `json:"prompt_tokens"`
 	CompletionTokens int     `json:"completion_tokens"`
 	CostUSD          float64 `json:"cost_usd"`
+	ServiceTier      string  `json:"service_tier,omitempty"`
+	Images           int     `json:"images,omitempty"`           // images generated, for per-image pricing
+	AudioSeconds     float64 `json:"audio_seconds,omitempty"`    // input audio, for per-second pricing
+	Characters       int     `json:"characters,omitempty"`       // input characters, for per-character pricing
+	CachedTokens     int     `json:"cached_tokens,omitempty"`    // prompt tokens billed at the cached input rate
+	ReasoningTokens  int     `json:"reasoning_tokens,omitempty"` // completion tokens spent on reasoning
+	SavedUSD         float64 `json:"saved_usd,omitempty"`        // cost of the cached response served instead
 }
 
 type ErrorResponse struct {
@@ -91,80 +132,178 @@ type ErrorResponse struct {
 
 func loadModelPricing(filename string) error {
 	var csvData string
-	
-	// Try to use embedded data first, fallback to file if needed
-	if embeddedPricingData != "" {
-		csvData = embeddedPricingData
-	} else {
-		file, err := os.Open(filename)
-		if err != nil {
-			return fmt.Errorf("cannot open pricing file: %w", err)
-		}
-		defer file.Close()
-		
-		data, err := io.ReadAll(file)
-		if err != nil {
-			return fmt.Errorf("error reading file: %w", err)
-		}
+
+	// Prefer the pricing file, fall back to the embedded copy if it cannot be opened
+	data, err := os.ReadFile(filename)
+	switch {
+	case err == nil:
 		csvData = string(data)
+	case embeddedPricingData != "":
+		log.Printf("Cannot open pricing file %s (%v), using embedded pricing", filename, err)
+		csvData = embeddedPricingData
+	default:
+		return fmt.Errorf("cannot open pricing file: %w", err)
+	}
+
+	problems, err := parsePricingCSV(csvData, modelPricing)
+	if err != nil {
+		return err
 	}
+	for _, problem := range problems {
+		log.Print(problem)
+	}
+
+	logInfof("Loaded pricing for %d models", len(modelPricing))
+	
+	// Generate allowed model prefixes from loaded models
+	generateAllowedPrefixes()
+	
+	return nil
+}
+
+// parsePricingCSV adds the models of a pricing CSV to into. Rows that cannot be
+// used are skipped and reported as problems; a malformed file is an error.
+func parsePricingCSV(csvData string, into map[string]ModelPricing) ([]string, error) {
+	var problems []string
 
 	reader := csv.NewReader(strings.NewReader(csvData))
 	records, err := reader.ReadAll()
 	if err != nil {
-		return fmt.Errorf("error reading CSV: %w", err)
+		return nil, fmt.Errorf("error reading CSV: %w", err)
 	}
 
 	if len(records) < 2 {
-		return fmt.Errorf("CSV file must contain at least header and one data row")
+		return nil, fmt.Errorf("CSV file must contain at least header and one data row")
+	}
+
+	// Optional columns are located by name so older 5-column files keep working
+	tierCol, thresholdCol, imageInputCol, sizeCol, qualityCol, perImageCol := -1, -1, -1, -1, -1, -1
+	perSecondCol, perMCharsCol := -1, -1
+	for i, name := range records[0] {
+		switch strings.TrimSpace(name) {
+		case "service_tier":
+			tierCol = i
+		case "min_prompt_tokens":
+			thresholdCol = i
+		case "image_input":
+			imageInputCol = i
+		case "size":
+			sizeCol = i
+		case "quality":
+			qualityCol = i
+		case "per_image":
+			perImageCol = i
+		case "per_second":
+			perSecondCol = i
+		case "per_1m_characters":
+			perMCharsCol = i
+		}
+	}
+	column := func(record []string, col int) string {
+		if col < 0 || col >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[col])
 	}
 
 	// Skip header (first row)
 	for i := 1; i < len(records); i++ {
 		record := records[i]
 		if len(record) < 5 {
-			log.Printf("Skipping incomplete row: %v", record)
+			problems = append(problems, fmt.Sprintf("line %d: skipping incomplete row: %v", i+1, record))
 			continue
 		}
 
 		model := record[0]
 		version := record[1]
 
+		// Per-image price rows only carry size, quality and price
+		if perImage := column(record, perImageCol); perImage != "" {
+			price := ImagePrice{Size: column(record, sizeCol), Quality: strings.ToLower(column(record, qualityCol))}
+			price.PerImage, err = strconv.ParseFloat(perImage, 64)
+			if err != nil || price.PerImage < 0 {
+				problems = append(problems, fmt.Sprintf("line %d: invalid per_image price for model %s: %q", i+1, model, perImage))
+				continue
+			}
+			if price.Size == "" {
+				problems = append(problems, fmt.Sprintf("line %d: per_image price for model %s has no size", i+1, model))
+				continue
+			}
+			pricing, exists := into[model]
+			if !exists {
+				pricing = ModelPricing{Model: model, Version: version}
+			}
+			pricing.ImagePrices = append(pricing.ImagePrices, price)
+			into[model] = pricing
+			if version != "" && version != model {
+				into[version] = pricing
+			}
+			continue
+		}
+
 		input, err := parseFloat(record[2])
 		if err != nil {
-			log.Printf("Invalid input price for model %s: %v", model, err)
+			problems = append(problems, fmt.Sprintf("line %d: invalid input price for model %s: %v", i+1, model, err))
 			continue
 		}
 
-		cachedInput, _ := parseFloat(record[3]) // may be empty
+		cachedInput, err := parseFloat(record[3]) // may be empty
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: invalid cached input price for model %s, using 0: %v", i+1, model, err))
+		}
 
 		output, err := parseFloat(record[4])
 		if err != nil {
-			log.Printf("Invalid output price for model %s: %v", model, err)
+			problems = append(problems, fmt.Sprintf("line %d: invalid output price for model %s: %v", i+1, model, err))
 			continue
 		}
 
-		pricing := ModelPricing{
-			Model:       model,
-			Version:     version,
-			Input:       input,
-			CachedInput: cachedInput,
-			Output:      output,
+		imageInput, err := parseFloat(column(record, imageInputCol))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: invalid image input price for model %s, using 0: %v", i+1, model, err))
+		}
+		perSecond, err := parseFloat(column(record, perSecondCol))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: invalid per_second price for model %s, using 0: %v", i+1, model, err))
+		}
+		perMChars, err := parseFloat(column(record, perMCharsCol))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: invalid per_1m_characters price for model %s, using 0: %v", i+1, model, err))
 		}
 
-		modelPricing[model] = pricing
+		rule := PricingRule{Input: input, CachedInput: cachedInput, Output: output}
+		rule.ServiceTier = normalizeServiceTier(column(record, tierCol))
+		if threshold := column(record, thresholdCol); threshold != "" {
+			rule.MinPromptTokens, err = strconv.Atoi(threshold)
+			if err != nil || rule.MinPromptTokens < 0 {
+				problems = append(problems, fmt.Sprintf("line %d: invalid min_prompt_tokens for model %s: %q", i+1, model, threshold))
+				continue
+			}
+		}
+
+		pricing, exists := into[model]
+		if !exists {
+			pricing = ModelPricing{Model: model, Version: version}
+		}
+		if rule.ServiceTier == "" && rule.MinPromptTokens == 0 {
+			pricing.Input = input
+			pricing.CachedInput = cachedInput
+			pricing.Output = output
+			pricing.ImageInput = imageInput
+			pricing.PerSecond = perSecond
+			pricing.PerMChars = perMChars
+		} else {
+			pricing.Rules = append(pricing.Rules, rule)
+		}
+
+		into[model] = pricing
 		// Also add under full version name if different
 		if version != "" && version != model {
-			modelPricing[version] = pricing
+			into[version] = pricing
 		}
 	}
 
-	log.Printf("Loaded pricing for %d models", len(modelPricing))
-	
-	// Generate allowed model prefixes from loaded models
-	generateAllowedPrefixes()
-	
-	return nil
+	return problems, nil
 }
 
 func generateAllowedPrefixes() {
@@ -196,7 +335,7 @@ func generateAllowedPrefixes() {
 		allowedModelPrefixes = append(allowedModelPrefixes, prefix)
 	}
 	
-	log.Printf("Generated %d allowed model prefixes: %v", len(allowedModelPrefixes), allowedModelPrefixes)
+	logInfof("Generated %d allowed model prefixes: %v", len(allowedModelPrefixes), allowedModelPrefixes)
 }
 
 func parseFloat(s string) (float64, error) {
@@ -227,15 +366,76 @@ func getPricingForModel(model string) (ModelPricing, bool) {
 	}, false
 }
 
+// normalizeServiceTier maps the tier names OpenAI treats as the standard tier
+// ("auto", "default") to the empty string used by base pricing rows.
+func normalizeServiceTier(tier string) string {
+	tier = strings.ToLower(strings.TrimSpace(tier))
+	if tier == "auto" || tier == "default" {
+		return ""
+	}
+	return tier
+}
+
+// ratesFor returns the rates that apply to a request with the given prompt size
+// and service tier. A rule for the requested tier wins over a tier-less rule,
+// and among equally specific rules the one with the highest threshold wins.
+func (p ModelPricing) ratesFor(promptTokens int, serviceTier string) PricingRule {
+	serviceTier = normalizeServiceTier(serviceTier)
+	best := PricingRule{Input: p.Input, CachedInput: p.CachedInput, Output: p.Output}
+	bestTierMatch := false
+
+	for _, rule := range p.Rules {
+		if rule.ServiceTier != "" && rule.ServiceTier != serviceTier {
+			continue
+		}
+		if promptTokens < rule.MinPromptTokens {
+			continue
+		}
+		tierMatch := rule.ServiceTier != ""
+		if bestTierMatch && !tierMatch {
+			continue
+		}
+		if tierMatch == bestTierMatch && rule.MinPromptTokens <= best.MinPromptTokens {
+			continue
+		}
+		best = rule
+		bestTierMatch = tierMatch
+	}
+
+	return best
+}
+
 func calculateCost(promptTokens, completionTokens int, model string) float64 {
+	return calculateCostForTier(promptTokens, completionTokens, model, "")
+}
+
+// calculateCostForTier prices a request using the model's pricing rules for the
+// given service tier and prompt size.
+func calculateCostForTier(promptTokens, completionTokens int, model, serviceTier string) float64 {
+	return calculateCostWithCache(promptTokens, 0, completionTokens, model, serviceTier)
+}
+
+// calculateCostWithCache is calculateCostForTier for prompts of which
+// cachedTokens were read from the prompt cache and are billed at the cached
+// input rate (the input rate if the model has none).
+func calculateCostWithCache(promptTokens, cachedTokens, completionTokens int, model, serviceTier string) float64 {
 	pricing, found := getPricingForModel(model)
 	if !found {
 		log.Printf("Pricing not found for model %s, using defaults", model)
 	}
+	rates := pricing.ratesFor(promptTokens, serviceTier)
+
+	cachedRate := rates.CachedInput
+	if cachedRate == 0 {
+		cachedRate = rates.Input
+	}
+	if cachedTokens > promptTokens {
+		cachedTokens = promptTokens
+	}
 
 	// Prices in CSV are per 1M tokens, so divide by 1,000,000
-	costPrompt := float64(promptTokens) * (pricing.Input / 1000000.0)
-	costCompletion := float64(completionTokens) * (pricing.Output / 1000000.0)
+	costPrompt := float64(promptTokens-cachedTokens)*(rates.Input/1000000.0) + float64(cachedTokens)*(cachedRate/1000000.0)
+	costCompletion := float64(completionTokens) * (rates.Output / 1000000.0)
 
 	return costPrompt + costCompletion
 }
@@ -257,55 +457,73 @@ func isModelAllowed(model string) bool {
 	return false
 }
 
-func countTokens(text, model string) int {
-	enc, err := tiktoken.EncodingForModel(model)
-	if err != nil {
-		enc, _ = tiktoken.GetEncoding("cl100k_base")
+// maxCompletionTokens returns the worst-case completion tokens of a chat
+// request: its output limit for each of the n choices. Without a limit the
+// completion cannot be bounded and 0 is returned.
+func maxCompletionTokens(reqData ChatRequest) int {
+	limit := 0
+	if reqData.MaxTokens != nil {
+		limit = *reqData.MaxTokens
 	}
-
-	tokens := enc.Encode(text, nil, nil)
-	return len(tokens)
+	if reqData.MaxCompletion != nil {
+		limit = *reqData.MaxCompletion
+	}
+	choices := 1
+	if reqData.N != nil && *reqData.N > 1 {
+		choices = *reqData.N
+	}
+	return saturatingMul(max(limit, 0), choices)
 }
 
-func calculateTokensFromMessages(messages []ChatMessage, model string) int {
-	totalTokens := 0
-	for _, msg := range messages {
-		text := msg.Role + msg.Name + msg.Content
-		totalTokens += countTokens(text, model)
+// saturatingMul multiplies non-negative token counts, returning math.MaxInt
+// instead of wrapping around to a negative estimate.
+func saturatingMul(a, b int) int {
+	if a != 0 && b > math.MaxInt/a {
+		return math.MaxInt
 	}
-	return totalTokens + 3*len(messages) + 3
+	return a * b
 }
 
-func callOpenAI(reqData ChatRequest, apiKey string) (*ChatResponse, error) {
-	jsonData, err := json.Marshal(reqData)
-	if err != nil {
-		return nil, err
-	}
+// checkCompletionLimits rejects negative output limits and choice counts,
+// which would make the reserved estimate negative.
+func checkCompletionLimits(c *gin.Context, reqData ChatRequest) bool {
+	return checkNonNegative(c,
+		intField{"max_tokens", reqData.MaxTokens},
+		intField{"max_completion_tokens", reqData.MaxCompletion},
+		intField{"n", reqData.N},
+	)
+}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
-	}
+// intField is an optional integer field of a request.
+type intField struct {
+	name  string
+	value *int
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+// checkNonNegative writes a 400 for the first field that is negative.
+func checkNonNegative(c *gin.Context, fields ...intField) bool {
+	for _, field := range fields {
+		if field.value != nil && *field.value < 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("%s must not be negative.", field.name),
+			})
+			return false
+		}
+	}
+	return true
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func callOpenAI(reqData ChatRequest, apiKey string) (*ChatResponse, error) {
+	jsonData, err := json.Marshal(reqData)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := postOpenAI("/v1/chat/completions", "application/json", jsonData, apiKey)
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("OpenAI API error: %s", string(body))
-	}
-
 	var chatResp ChatResponse
 	if err := json.Unmarshal(body, &chatResp); err != nil {
 		return nil, err
@@ -314,25 +532,50 @@ func callOpenAI(reqData ChatRequest, apiKey string) (*ChatResponse, error) {
 	return &chatResp, nil
 }
 
-func chatCompletionsProxy(c *gin.Context) {
-	mu.Lock()
-	defer mu.Unlock()
+// resolveAPIKey maps the client's bearer token to the key used upstream. Tokens
+// found in the key store are proxy keys and are swapped for the configured
+// OpenAI key; any other token is passed through unchanged. On failure the
+// error response has already been written.
+func resolveAPIKey(c *gin.Context, apiKey string) (*ProxyKey, string, bool) {
+	if keyStore == nil {
+		return nil, apiKey, true
+	}
+	key, found := keyStore.Lookup(apiKey)
+	if !found {
+		return nil, apiKey, true
+	}
 
-	if totalCost >= costLimitUSD {
-		log.Printf("Request blocked: quota limit exceeded, current_cost=$%.6f, limit=$%.6f", totalCost, costLimitUSD)
-		c.JSON(http.StatusTooManyRequests, ErrorResponse{
-			Error: "Global cost limit exceeded.",
+	if key.Revoked() {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{
+			Error: "API key has been revoked.",
 		})
-		return
+		return nil, "", false
+	}
+	if key.Frozen() {
+		c.JSON(http.StatusForbidden, ErrorResponse{
+			Error: "API key is frozen.",
+		})
+		return nil, "", false
 	}
+	if upstreamAPIKey == "" {
+		log.Printf("Request with proxy key %s rejected: no upstream OpenAI API key configured", key.ID)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error: "Proxy is not configured with an OpenAI API key.",
+		})
+		return nil, "", false
+	}
+	return &key, upstreamAPIKey, true
+}
 
-	// Get API key from Authorization header
+// bearerToken returns the API key from the Authorization header. On failure
+// the 401 response has already been written.
+func bearerToken(c *gin.Context) (string, bool) {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
 		c.JSON(http.StatusUnauthorized, ErrorResponse{
 			Error: "Missing Authorization header. Use: Authorization: Bearer your-api-key",
 		})
-		return
+		return "", false
 	}
 
 	// Check Authorization header format
@@ -340,7 +583,7 @@ func chatCompletionsProxy(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, ErrorResponse{
 			Error: "Invalid Authorization header format. Use: Authorization: Bearer your-api-key",
 		})
-		return
+		return "", false
 	}
 
 	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
@@ -348,6 +591,29 @@ func chatCompletionsProxy(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, ErrorResponse{
 			Error: "Empty API key. Use: Authorization: Bearer your-api-key",
 		})
+		return "", false
+	}
+	return apiKey, true
+}
+
+// globalLimitExceeded rejects requests once the global quota is spent.
+func globalLimitExceeded(c *gin.Context) bool {
+	mu.Lock()
+	exceeded := totalCost >= costLimitUSD
+	if exceeded {
+		log.Printf("Request blocked: quota limit exceeded, current_cost=$%.6f, limit=$%.6f", totalCost, costLimitUSD)
+	}
+	mu.Unlock()
+
+	if exceeded {
+		writeBudgetError(c, budgetError("Global cost limit exceeded."))
+	}
+	return exceeded
+}
+
+func chatCompletionsProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
 		return
 	}
 
@@ -359,38 +625,39 @@ func chatCompletionsProxy(c *gin.Context) {
 		return
 	}
 
-	if !isModelAllowed(reqData.Model) {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error: fmt.Sprintf("Model %s is not in the allowed list.", reqData.Model),
-		})
+	if !checkModel(c, proxyKey, reqData.Model) || !checkCompletionLimits(c, reqData) {
 		return
 	}
+	setRequestUser(c, reqData.User)
 
-	// Calculate prompt tokens before API call
-	promptTokens := calculateTokensFromMessages(reqData.Messages, reqData.Model)
-
-	// Check if prompt alone would exceed cost limit
-	promptCost := calculateCost(promptTokens, 0, reqData.Model)
-	if totalCost+promptCost >= costLimitUSD {
-		log.Printf("Request blocked: prompt would exceed quota, prompt_tokens=%d, prompt_cost=$%.6f, current_cost=$%.6f, limit=$%.6f",
-			promptTokens, promptCost, totalCost, costLimitUSD)
-		c.JSON(http.StatusTooManyRequests, ErrorResponse{
-			Error: "Request would exceed global cost limit.",
-		})
+	if moderationRequired(proxyKey) && !moderateMessages(c, proxyKey, upstreamKey, reqData.Messages) {
 		return
 	}
 
-	response, err := callOpenAI(reqData, apiKey)
-	if err != nil {
-		// Even if OpenAI request failed, count tokens for logging
-		costTotalRequest := calculateCost(promptTokens, 0, reqData.Model) // no completion tokens
+	// Deterministic requests seen before are answered from the cache
+	requestKey := ""
+	if cacheable(c, reqData) {
+		requestKey, _ = cacheKey("/v1/chat/completions", reqData)
+		if entry, ok := responseCache.Get(requestKey); ok {
+			serveCached(c, proxyKey, reqData.Model, entry)
+			return
+		}
+		c.Header(cacheHeader, "miss")
+	}
 
-		log.Printf("Failed request: model=%s, prompt_tokens=%d, completion_tokens=0, estimated_cost=$%.6f, total_cost=$%.6f, remaining=$%.6f, error=%v",
-			reqData.Model, promptTokens, costTotalRequest, totalCost, costLimitUSD-totalCost, err)
+	// Calculate prompt tokens before API call
+	promptTokens := countChatTokens(reqData)
+	estimate := calculateCostForTier(promptTokens, maxCompletionTokens(reqData), reqData.Model, reqData.ServiceTier)
 
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error: fmt.Sprintf("OpenAI API call error: %s", err.Error()),
-		})
+	// Check if the request could exceed cost limits and reserve it while the call is in flight
+	reservation, ok := reserveRequest(c, proxyKey, reqData.Model, promptTokens, estimate)
+	if !ok {
+		return
+	}
+
+	response, err := callOpenAI(reqData, upstreamKey)
+	if err != nil {
+		failRequest(c, reservation, promptTokens, err)
 		return
 	}
 
@@ -401,28 +668,26 @@ func chatCompletionsProxy(c *gin.Context) {
 	completionTokens := response.Usage.CompletionTokens
 
 	if promptTokens == 0 || completionTokens == 0 {
-		promptTokens = calculateTokensFromMessages(reqData.Messages, reqData.Model)
+		promptTokens = countChatTokens(reqData)
 
-		completionText := ""
+		// Each choice is a separate completion
+		completionTokens = 0
 		for _, choice := range response.Choices {
-			completionText += choice.Message.Content
+			completionTokens += countTokens(choice.Message.Content, reqData.Model)
 		}
-		completionTokens = countTokens(completionText, reqData.Model)
 	}
 
-	costTotalRequest := calculateCost(promptTokens, completionTokens, reqData.Model)
-
-	totalCost += costTotalRequest
-
-	// Log detailed usage information
-	log.Printf("Request: model=%s, prompt_tokens=%d, completion_tokens=%d, cost=$%.6f, total_cost=$%.6f, remaining=$%.6f",
-		reqData.Model, promptTokens, completionTokens, costTotalRequest, totalCost, costLimitUSD-totalCost)
+	// The response reports the tier that actually served the request
+	serviceTier := reqData.ServiceTier
+	if response.ServiceTier != "" {
+		serviceTier = response.ServiceTier
+	}
 
-	response.ProxyUsage = &ProxyUsage{
-		PromptTokens:     promptTokens,
-		CompletionTokens: completionTokens,
-		CostUSD:          float64(int(costTotalRequest*1000000)) / 1000000, // round to 6 decimal places
+	costTotalRequest := calculateCostForTier(promptTokens, completionTokens, reqData.Model, serviceTier)
+	if requestKey != "" {
+		storeCached(requestKey, response, promptTokens, completionTokens, costTotalRequest, serviceTier)
 	}
+	response.ProxyUsage = chargeRequest(c, reservation, promptTokens, completionTokens, costTotalRequest, serviceTier)
 
 	c.JSON(http.StatusOK, response)
 }
@@ -435,9 +700,19 @@ func info(c *gin.Context) {
 		"info":             "Local OpenAI proxy. Available method: POST.",
 		"cost_limit":       costLimitUSD,
 		"current_cost":     totalCost,
+		"reserved_cost":    reservedCost,
 		"remaining":        costLimitUSD - totalCost,
 		"available_models": getAvailableModels(),
 		"models_count":     len(modelPricing),
+		"moderation": gin.H{
+			"requests": moderationRequests,
+			"flagged":  moderationFlagged,
+		},
+		"queue": gin.H{
+			"in_flight": inFlight,
+			"depth":     queueDepth,
+		},
+		"budgets": budgetTree(nil),
 	})
 }
 
@@ -450,27 +725,138 @@ func pricing(c *gin.Context) {
 	})
 }
 
+// corsMiddleware answers browser requests from the configured origins.
+// With no origins configured it does nothing.
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[origin] = true
+	}
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || (!allowed["*"] && !allowed[origin]) {
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Expose-Headers", "X-Quota-Limit-USD, X-Quota-Remaining-USD, X-Quota-Reset, X-Request-Cost-USD, "+
+			"x-ratelimit-limit-requests, x-ratelimit-remaining-requests, x-ratelimit-reset-requests, "+
+			"x-ratelimit-limit-tokens, x-ratelimit-remaining-tokens, x-ratelimit-reset-tokens, Retry-After, "+cacheHeader+", "+replayedHeader)
+		c.Header("Vary", "Origin")
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Cache-Control, "+idempotencyHeader+", "+priorityHeader+", "+tagsHeader)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerRoutes mounts all endpoints of the proxy.
+func registerRoutes(r *gin.Engine) {
+	// Endpoint health check
+	r.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// Grupa v1 (bez prefiksu /api)
+	v1 := r.Group("/v1", concurrencySlots)
+	{
+		v1.POST("/chat/completions", idempotent, quotaHeaders, chatCompletionsProxy)
+		v1.GET("/chat/completions", info)
+		v1.POST("/embeddings", idempotent, quotaHeaders, embeddingsProxy)
+		v1.POST("/images/generations", idempotent, quotaHeaders, imageGenerationsProxy)
+		v1.POST("/images/edits", idempotent, quotaHeaders, imageEditsProxy)
+		v1.POST("/audio/transcriptions", idempotent, quotaHeaders, audioTranscriptionsProxy)
+		v1.POST("/audio/translations", idempotent, quotaHeaders, audioTranslationsProxy)
+		v1.POST("/audio/speech", idempotent, quotaHeaders, audioSpeechProxy)
+		v1.POST("/responses", idempotent, quotaHeaders, responsesProxy)
+		v1.POST("/completions", idempotent, quotaHeaders, completionsProxy)
+		v1.GET("/models", listModels)
+		v1.GET("/models/:id", retrieveModel)
+		v1.POST("/files", quotaHeaders, filesUpload)
+		v1.GET("/files/:id/content", fileContent)
+		v1.POST("/batches", idempotent, quotaHeaders, batchesCreate)
+		v1.GET("/batches/:id", quotaHeaders, batchesRetrieve)
+		v1.POST("/batches/:id/cancel", quotaHeaders, batchesCancel)
+		v1.POST("/moderations", moderationsProxy)
+		v1.POST("/tokenize", tokenize)
+		v1.POST("/count_tokens", tokenize)
+	}
+
+	// Grupa api/v1 (z prefiksem /api)
+	apiV1 := r.Group("/api/v1", concurrencySlots)
+	{
+		apiV1.POST("/chat/completions", idempotent, quotaHeaders, chatCompletionsProxy)
+		apiV1.GET("/chat/completions", info)
+		apiV1.POST("/embeddings", idempotent, quotaHeaders, embeddingsProxy)
+		apiV1.POST("/images/generations", idempotent, quotaHeaders, imageGenerationsProxy)
+		apiV1.POST("/images/edits", idempotent, quotaHeaders, imageEditsProxy)
+		apiV1.POST("/audio/transcriptions", idempotent, quotaHeaders, audioTranscriptionsProxy)
+		apiV1.POST("/audio/translations", idempotent, quotaHeaders, audioTranslationsProxy)
+		apiV1.POST("/audio/speech", idempotent, quotaHeaders, audioSpeechProxy)
+		apiV1.POST("/responses", idempotent, quotaHeaders, responsesProxy)
+		apiV1.POST("/completions", idempotent, quotaHeaders, completionsProxy)
+		apiV1.GET("/models", listModels)
+		apiV1.GET("/models/:id", retrieveModel)
+		apiV1.POST("/files", quotaHeaders, filesUpload)
+		apiV1.GET("/files/:id/content", fileContent)
+		apiV1.POST("/batches", idempotent, quotaHeaders, batchesCreate)
+		apiV1.GET("/batches/:id", quotaHeaders, batchesRetrieve)
+		apiV1.POST("/batches/:id/cancel", quotaHeaders, batchesCancel)
+		apiV1.POST("/moderations", moderationsProxy)
+		apiV1.POST("/tokenize", tokenize)
+		apiV1.POST("/count_tokens", tokenize)
+	}
+
+	// Endpoint cennika
+	r.GET("/pricing", pricing)
+	r.GET("/api/pricing", pricing)
+
+	registerAdminRoutes(r)
+}
+
 func main() {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			if err := command(args[1:], os.Stdout); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					os.Exit(0)
+				}
+				fmt.Fprintln(os.Stderr, err)
+				if errors.Is(err, errUsage) {
+					os.Exit(2)
+				}
+				os.Exit(1)
+			}
+			return
+		}
+		if args[0] == "serve" {
+			args = args[1:]
+		}
+	}
+
 	// Parse command line arguments
-	var (
-		quota       = flag.Float64("quota", 2.0, "Global cost limit in USD")
-		port        = flag.String("port", "8123", "Port to run server on")
-		pricingFile = flag.String("pricing", "config/model_pricing.csv", "Path to CSV file with model pricing")
-		help        = flag.Bool("help", false, "Show help")
-		h           = flag.Bool("h", false, "Show help (short)")
-	)
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags := registerConfigFlags(fs)
 
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "OpenAI Quota Proxy - proxy server with cost control\n\n")
+	fs.Usage = func() {
+		printCommandsUsage(os.Stderr, os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOpenAI Quota Proxy - proxy server with cost control\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nConfiguration precedence: flags > environment variables > config file > defaults\n")
 		fmt.Fprintf(os.Stderr, "\nAuthorization:\n")
 		fmt.Fprintf(os.Stderr, "  OpenAI API key must be passed in Authorization header of each request:\n")
 		fmt.Fprintf(os.Stderr, "  Authorization: Bearer your-openai-api-key\n")
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  %s -quota 5.0 -port 8080\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s -quota 10.0 -pricing custom_pricing.csv\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s -config config/app.yaml\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nExample request:\n")
 		fmt.Fprintf(os.Stderr, "  curl -X POST http://localhost:8123/v1/chat/completions \\\n")
 		fmt.Fprintf(os.Stderr, "       -H \"Authorization: Bearer your-api-key\" \\\n")
@@ -478,52 +864,136 @@ func main() {
 		fmt.Fprintf(os.Stderr, "       -d '{\"model\":\"gpt-4o\",\"messages\":[{\"role\":\"user\",\"content\":\"Hello\"}]}'\n")
 	}
 
-	flag.Parse()
+	fs.Parse(args)
 
-	if *help || *h {
-		flag.Usage()
+	if flags.help {
+		fs.Usage()
 		os.Exit(0)
 	}
 
+	cfg, err := loadConfig(fs, flags, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logLevel = cfg.LogLevel
+
 	// Wczytaj cennik modeli
-	if err := loadModelPricing(*pricingFile); err != nil {
-		log.Printf("Warning: Cannot load pricing file (%s): %v", *pricingFile, err)
+	if err := loadModelPricing(cfg.PricingFile); err != nil {
+		log.Printf("Warning: Cannot load pricing file (%s): %v", cfg.PricingFile, err)
 		log.Printf("Using default pricing for models")
 	}
 
 	// Ustawienie globalnych zmiennych
-	costLimitUSD = *quota
-
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
-
-	// Endpoint health check
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+	costLimitUSD = cfg.Quota
+	upstreamAPIKey = cfg.OpenAIAPIKey
+	mergeUpstreamModels = cfg.ModelsUpstream
+	moderationEnabled = cfg.Moderation
+	encodingsDir = cfg.EncodingsDir
+	globalRateLimit = cfg.RateLimit
+	maxConcurrent = cfg.MaxConcurrent
+	keyMaxConcurrent = cfg.KeyMaxConcurrent
+	maxQueueWait = cfg.MaxQueueWait
+	maxQueueDepth = cfg.MaxQueueDepth
+	interactiveSlots = cfg.InteractiveSlots
+	interactiveHeadroomPercent = cfg.InteractiveHeadroomPercent
+	webhookURL = cfg.WebhookURL
+	budgetThresholds = cfg.BudgetThresholds
+	if cfg.ModelRateLimits != nil {
+		modelRateLimits = cfg.ModelRateLimits
+	}
+	if cfg.NodeBudgets != nil {
+		nodeBudgets = cfg.NodeBudgets
+	}
+	modelSpendCaps = cfg.ModelSpendCaps
+	if cfg.ModelAllowlists != nil {
+		nodeModels = cfg.ModelAllowlists
+	}
+	if cfg.Cache != "" {
+		if responseCache, err = newResponseCache(cfg.Cache, cfg.CacheDir, cfg.CacheTTL, int64(cfg.CacheMaxMB)<<20); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Response cache: %s, ttl %s, max %d MB", cfg.Cache, cfg.CacheTTL, cfg.CacheMaxMB)
+	}
+	idempotencyWindow = cfg.IdempotencyWindow
+	idempotencyMaxBytes = int64(cfg.IdempotencyMaxMB) << 20
+	tagSchema = cfg.TagSchema
+	requiredTags = cfg.RequiredTags
+	if cfg.TagBudgets != nil {
+		tagBudgets = cfg.TagBudgets
+	}
+	if err := loadEncoders(); err != nil {
+		log.Printf("Warning: token counts fall back to cl100k_base or to approximations; fetch the rank files with make encodings and rebuild")
+	} else {
+		log.Printf("Token encodings: %d loaded from %s", len(encodingSpecs), encodingsSource())
+	}
 
-	// Grupa v1 (bez prefiksu /api)
-	v1 := r.Group("/v1")
-	{
-		v1.POST("/chat/completions", chatCompletionsProxy)
-		v1.GET("/chat/completions", info)
+	if cfg.KeysFile != "" {
+		if keyStore, err = loadKeyStore(cfg.KeysFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Proxy keys enabled: %s", cfg.KeysFile)
+		if upstreamAPIKey == "" {
+			log.Printf("Warning: no OpenAI API key configured, requests with proxy keys will be rejected")
+		}
+	}
+	if cfg.LedgerFile != "" {
+		entries, err := readLedger(cfg.LedgerFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		restoreKeySpend(entries)
+		if ledger, err = openLedger(cfg.LedgerFile); err != nil {
+			log.Fatal(err)
+		}
+		defer ledger.Close()
+		log.Printf("Usage ledger: %s (%d entries)", cfg.LedgerFile, len(entries))
+	}
+	if webhookURL != "" {
+		var keys []ProxyKey
+		if keyStore != nil {
+			if keys, err = keyStore.List(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		armBudgetNotifications(keys)
+		target, _ := url.Parse(webhookURL)
+		log.Printf("Budget notifications at %v%% to %s", budgetThresholds, target.Host)
+	}
+	adminToken = cfg.AdminToken
+	if adminToken != "" {
+		log.Printf("Admin API enabled at /admin")
+	}
+	if cfg.AuditFile != "" {
+		if auditTrail, err = openAuditTrail(cfg.AuditFile); err != nil {
+			log.Fatal(err)
+		}
+		defer auditTrail.Close()
 	}
 
-	// Grupa api/v1 (z prefiksem /api)
-	apiV1 := r.Group("/api/v1")
-	{
-		apiV1.POST("/chat/completions", chatCompletionsProxy)
-		apiV1.GET("/chat/completions", info)
+	var r *gin.Engine
+	switch cfg.LogLevel {
+	case "debug":
+		gin.SetMode(gin.DebugMode)
+		r = gin.Default()
+	case "info":
+		gin.SetMode(gin.ReleaseMode)
+		r = gin.Default()
+	default:
+		gin.SetMode(gin.ReleaseMode)
+		r = gin.New()
+		r.Use(gin.Recovery())
 	}
+	r.Use(corsMiddleware(cfg.AllowedOrigins))
 
-	// Endpoint cennika
-	r.GET("/pricing", pricing)
-	r.GET("/api/pricing", pricing)
+	registerRoutes(r)
+
+	go runBatchPoller()
 
-	log.Printf("Starting server on port %s with quota limit: $%.2f", *port, costLimitUSD)
-	log.Printf("Loaded pricing for models: %v", getAvailableModels())
+	log.Printf("Starting server on port %s with quota limit: $%.2f", cfg.Port, costLimitUSD)
+	logInfof("Loaded pricing for models: %v", getAvailableModels())
 
-	if err := r.Run(":" + *port); err != nil {
+	if err := r.Run(":" + cfg.Port); err != nil {
 		log.Fatal("Failed to start server:", err)
 	}
 }
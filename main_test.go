@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -19,28 +20,7 @@ func setupTestRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	r := gin.New()
 
-	// Endpoint health check
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
-
-	// Grupa v1 (bez prefiksu /api)
-	v1 := r.Group("/v1")
-	{
-		v1.POST("/chat/completions", chatCompletionsProxy)
-		v1.GET("/chat/completions", info)
-	}
-
-	// Grupa api/v1 (z prefiksem /api)
-	apiV1 := r.Group("/api/v1")
-	{
-		apiV1.POST("/chat/completions", chatCompletionsProxy)
-		apiV1.GET("/chat/completions", info)
-	}
-
-	// Endpoint cennika
-	r.GET("/pricing", pricing)
-	r.GET("/api/pricing", pricing)
+	registerRoutes(r)
 
 	return r
 }
@@ -611,6 +591,113 @@ func TestCountTokens(t *testing.T) {
 	}
 }
 
+func TestMaxCompletionTokens(t *testing.T) {
+	intPtr := func(v int) *int { return &v }
+	tests := []struct {
+		name     string
+		req      ChatRequest
+		expected int
+	}{
+		{"no limit", ChatRequest{N: intPtr(3)}, 0},
+		{"max_tokens", ChatRequest{MaxTokens: intPtr(100)}, 100},
+		{"n choices", ChatRequest{MaxTokens: intPtr(100), N: intPtr(3)}, 300},
+		{"max_completion_tokens", ChatRequest{MaxTokens: intPtr(100), MaxCompletion: intPtr(50), N: intPtr(2)}, 100},
+		{"negative limit", ChatRequest{MaxTokens: intPtr(-100), N: intPtr(2)}, 0},
+		{"overflow saturates", ChatRequest{MaxTokens: intPtr(math.MaxInt/2 + 1), N: intPtr(4)}, math.MaxInt},
+	}
+	for _, tt := range tests {
+		if got := maxCompletionTokens(tt.req); got != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestChatCompletionsProxy_MultipleChoicesExceedQuota(t *testing.T) {
+	resetGlobalState()
+	mockOpenAI(t, ChatResponse{Model: "gpt-4o", Usage: Usage{PromptTokens: 10, CompletionTokens: 10}})
+	router := setupTestRouter()
+
+	// 1000 tokens at $10 per 1M fit; 4 choices of 1000 tokens do not
+	costLimitUSD = 0.03
+	post := func(n int) int {
+		maxTokens := 1000
+		jsonData, _ := json.Marshal(ChatRequest{
+			Model:     "gpt-4o",
+			Messages:  []ChatMessage{{Role: "user", Content: "Hello"}},
+			MaxTokens: &maxTokens,
+			N:         &n,
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBuffer(jsonData))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-test-key")
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post(1); code != http.StatusOK {
+		t.Errorf("Expected status 200 for one choice, got %d", code)
+	}
+	if code := post(4); code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for four choices, got %d", code)
+	}
+}
+
+func TestChatCompletionsProxy_NegativeLimits(t *testing.T) {
+	resetGlobalState()
+	mockOpenAI(t, ChatResponse{Model: "gpt-4o", Usage: Usage{PromptTokens: 10, CompletionTokens: 10}})
+	router := setupTestRouter()
+
+	for _, fields := range []string{
+		`"max_tokens":-1000`,
+		`"max_completion_tokens":-1000`,
+		`"max_tokens":1000,"n":-2`,
+	} {
+		body := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}],` + fields + `}`
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-test-key")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d: %s", fields, w.Code, w.Body.String())
+		}
+	}
+	if len(reservations) != 0 || reservedCost != 0 {
+		t.Errorf("Expected nothing reserved, got %f", reservedCost)
+	}
+}
+
+func TestChatCompletionsProxy_FallbackCountsEachChoice(t *testing.T) {
+	resetGlobalState()
+	choices := []string{"Hello there!", "Hi!", "Good morning, how can I help?"}
+	response := ChatResponse{Model: "gpt-4o"} // no usage reported
+	for i, content := range choices {
+		response.Choices = append(response.Choices, Choice{Message: ChatMessage{Role: "assistant", Content: content}, Index: i})
+	}
+	mockOpenAI(t, response)
+	router := setupTestRouter()
+
+	w := postChat(router, "sk-test-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	expectedCompletion := 0
+	for _, content := range choices {
+		expectedCompletion += countTokens(content, "gpt-4o")
+	}
+	var got ChatResponse
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if got.ProxyUsage == nil || got.ProxyUsage.CompletionTokens != expectedCompletion {
+		t.Errorf("Expected %d completion tokens counted per choice, got %+v", expectedCompletion, got.ProxyUsage)
+	}
+	promptTokens := calculateTokensFromMessages([]ChatMessage{{Role: "user", Content: "Hello"}}, "gpt-4o")
+	if expected := calculateCost(promptTokens, expectedCompletion, "gpt-4o"); totalCost != expected {
+		t.Errorf("Expected total cost %f, got %f", expected, totalCost)
+	}
+}
+
 // Integration tests
 func TestFullWorkflow_ValidRequest(t *testing.T) {
 	resetGlobalState()
@@ -689,6 +776,50 @@ func BenchmarkCalculateTokensFromMessages(b *testing.B) {
 	}
 }
 
+// largePrompt is a conversation of about 100 KB.
+func largePrompt() []ChatMessage {
+	paragraph := strings.Repeat("The quick brown fox jumps over the lazy dog, again and again. ", 16)
+	messages := make([]ChatMessage, 0, 100)
+	for i := 0; i < 100; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		messages = append(messages, ChatMessage{Role: role, Content: paragraph})
+	}
+	return messages
+}
+
+func promptBytes(messages []ChatMessage) int64 {
+	var n int64
+	for _, msg := range messages {
+		n += int64(len(msg.Content))
+	}
+	return n
+}
+
+func BenchmarkCalculateTokensFromMessages_LargePrompt(b *testing.B) {
+	messages := largePrompt()
+	b.SetBytes(promptBytes(messages))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		calculateTokensFromMessages(messages, "gpt-4o")
+	}
+}
+
+func BenchmarkCalculateTokensFromMessages_Parallel(b *testing.B) {
+	messages := largePrompt()
+	b.SetBytes(promptBytes(messages))
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			calculateTokensFromMessages(messages, "gpt-4o")
+		}
+	})
+}
+
 func BenchmarkCalculateCost(b *testing.B) {
 	resetGlobalState()
 
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Model policies narrow the global allow list for a key and for the nodes of
+// the budget tree above it, and cap what everyone together spends on a model
+// per day, week or month. Models are matched by patterns such as "o3-pro" or
+// "gpt-4o-mini*", where * matches any characters.
+
+// Model patterns allowed below a node of the budget tree, guarded by mu.
+var nodeModels = make(map[string][]string)
+
+func validModelPattern(pattern string) error {
+	if strings.TrimSpace(pattern) == "" {
+		return fmt.Errorf("model pattern must not be empty")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid model pattern %q", pattern)
+	}
+	return nil
+}
+
+func matchModel(patterns []string, model string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// modelDeniedBy returns who denies a model to requests made with key: the key
+// or a node above it, or "" if the model is permitted. Must hold mu.
+func modelDeniedBy(key *ProxyKey, model string) string {
+	if key == nil {
+		return ""
+	}
+	if len(key.Models) > 0 && !matchModel(key.Models, model) {
+		return "key " + key.Name
+	}
+	for _, node := range budgetAncestors(key.Project) {
+		if patterns, ok := nodeModels[node]; ok && !matchModel(patterns, model) {
+			return node
+		}
+	}
+	return ""
+}
+
+// checkModel rejects a model outside the allow list, or not permitted for the
+// key. On rejection the error response has already been written.
+func checkModel(c *gin.Context, key *ProxyKey, model string) bool {
+	if !isModelAllowed(model) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Model %s is not in the allowed list.", model),
+		})
+		return false
+	}
+	mu.Lock()
+	deniedBy := modelDeniedBy(key, model)
+	mu.Unlock()
+	if deniedBy != "" {
+		log.Printf("Request blocked: model %s is not allowed for %s", model, deniedBy)
+		c.JSON(http.StatusForbidden, ErrorResponse{
+			Error: fmt.Sprintf("Model %s is not allowed for %s.", model, deniedBy),
+		})
+		return false
+	}
+	return true
+}
+
+// ModelSpendCap limits the spend of all clients on the models matching
+// Pattern to LimitUSD per Period.
+type ModelSpendCap struct {
+	Pattern  string
+	LimitUSD float64
+	Period   string // "day", "week" or "month", in UTC
+}
+
+// Configured caps and their spend in the current period by pattern and
+// period, guarded by mu.
+var (
+	modelSpendCaps []ModelSpendCap
+	modelCapSpend  = make(map[string]*capSpend)
+)
+
+type capSpend struct {
+	start time.Time
+	spent float64
+}
+
+// periodStart returns the start of the period containing t.
+func periodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7) // Monday
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// periodEnd returns when a period starting at start ends.
+func periodEnd(period string, start time.Time) time.Time {
+	switch period {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// spendOf returns the spend of a cap in the period containing now, starting
+// from zero in a new period. Must hold mu.
+func (limit ModelSpendCap) spendOf(now time.Time) *capSpend {
+	start := periodStart(limit.Period, now)
+	name := limit.Pattern + "/" + limit.Period
+	spend, ok := modelCapSpend[name]
+	if !ok || !spend.start.Equal(start) {
+		spend = &capSpend{start: start}
+		modelCapSpend[name] = spend
+	}
+	return spend
+}
+
+// reservedForPattern sums the reservations of requests for models matching
+// pattern. Must hold mu.
+func reservedForPattern(pattern string) float64 {
+	reserved := 0.0
+	for _, r := range reservations {
+		if matchModel([]string{pattern}, r.Model) {
+			reserved += r.CostUSD
+		}
+	}
+	return reserved
+}
+
+// checkModelSpendCaps rejects a request for model estimated to cost estimate
+// if it would exceed a cap on the model. Must hold mu.
+func checkModelSpendCaps(model string, estimate float64, now time.Time) error {
+	for _, limit := range modelSpendCaps {
+		if !matchModel([]string{limit.Pattern}, model) {
+			continue
+		}
+		spend := limit.spendOf(now)
+		reserved := reservedForPattern(limit.Pattern)
+		if spend.spent+reserved+estimate >= limit.LimitUSD {
+			log.Printf("Request blocked: prompt would exceed spend cap of %s, prompt_cost=$%.6f, spent=$%.6f, reserved=$%.6f, cap=$%.6f per %s",
+				limit.Pattern, estimate, spend.spent, reserved, limit.LimitUSD, limit.Period)
+			return budgetError(fmt.Sprintf("Spend cap for %s reached: $%.2f per %s, resets at %s.",
+				limit.Pattern, limit.LimitUSD, limit.Period, periodEnd(limit.Period, spend.start).Format(time.RFC3339)))
+		}
+	}
+	return nil
+}
+
+// chargeModelSpendCaps adds the cost of a request for model made at t to the
+// caps on the model, if t is in their current period. Must hold mu.
+func chargeModelSpendCaps(model string, cost float64, t, now time.Time) {
+	for _, limit := range modelSpendCaps {
+		if !matchModel([]string{limit.Pattern}, model) {
+			continue
+		}
+		if spend := limit.spendOf(now); !t.Before(spend.start) {
+			spend.spent += cost
+		}
+	}
+}
+
+// modelCapStatus describes the caps and their spend. Must hold mu.
+func modelCapStatus(now time.Time) []gin.H {
+	status := make([]gin.H, 0, len(modelSpendCaps))
+	for _, limit := range modelSpendCaps {
+		spend := limit.spendOf(now)
+		status = append(status, gin.H{
+			"model":        limit.Pattern,
+			"limit_usd":    limit.LimitUSD,
+			"period":       limit.Period,
+			"spent_usd":    spend.spent,
+			"reserved_usd": reservedForPattern(limit.Pattern),
+			"resets_at":    periodEnd(limit.Period, spend.start),
+		})
+	}
+	return status
+}
+
+// parseModelSpendCaps parses comma-separated pattern=USD/period entries, e.g.
+// "o3-pro*=5/day,gpt-4.5-preview*=50/month".
+func parseModelSpendCaps(value string) ([]ModelSpendCap, error) {
+	var caps []ModelSpendCap
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, limit, ok := strings.Cut(entry, "=")
+		amount, period, ok2 := strings.Cut(limit, "/")
+		pattern, period = strings.TrimSpace(pattern), strings.TrimSpace(period)
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("entry %q must be model=USD/period", entry)
+		}
+		if err := validModelPattern(pattern); err != nil {
+			return nil, fmt.Errorf("entry %q: %w", entry, err)
+		}
+		limitUSD, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if err != nil || math.IsNaN(limitUSD) || math.IsInf(limitUSD, 0) || limitUSD <= 0 {
+			return nil, fmt.Errorf("entry %q: cap must be a positive amount in USD", entry)
+		}
+		if period != "day" && period != "week" && period != "month" {
+			return nil, fmt.Errorf("entry %q: period must be day, week or month", entry)
+		}
+		caps = append(caps, ModelSpendCap{Pattern: pattern, LimitUSD: limitUSD, Period: period})
+	}
+	return caps, nil
+}
+
+// formatModelSpendCaps is the inverse of parseModelSpendCaps.
+func formatModelSpendCaps(caps []ModelSpendCap) []string {
+	entries := make([]string, 0, len(caps))
+	for _, limit := range caps {
+		entries = append(entries, fmt.Sprintf("%s=%s/%s", limit.Pattern, strconv.FormatFloat(limit.LimitUSD, 'f', -1, 64), limit.Period))
+	}
+	return entries
+}
+
+// parseNodeModels parses comma-separated path=pattern|pattern entries, e.g.
+// "interns=gpt-4o-mini*|gpt-4.1-mini*".
+func parseNodeModels(value string) (map[string][]string, error) {
+	allowlists := make(map[string][]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		node, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q must be path=model|model", entry)
+		}
+		node, err := normalizeBudgetPath(node)
+		if err != nil {
+			return nil, err
+		}
+		if node == "" {
+			return nil, fmt.Errorf("entry %q: the organisation's models are the priced models", entry)
+		}
+		var patterns []string
+		for _, pattern := range strings.Split(list, "|") {
+			pattern = strings.TrimSpace(pattern)
+			if err := validModelPattern(pattern); err != nil {
+				return nil, fmt.Errorf("entry %q: %w", entry, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+		allowlists[node] = patterns
+	}
+	return allowlists, nil
+}
+
+// formatNodeModels is the inverse of parseNodeModels, sorted by path.
+func formatNodeModels(allowlists map[string][]string) []string {
+	entries := make([]string, 0, len(allowlists))
+	for node, patterns := range allowlists {
+		entries = append(entries, node+"="+strings.Join(patterns, "|"))
+	}
+	sort.Strings(entries)
+	return entries
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetModelPolicy(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		nodeModels = make(map[string][]string)
+		modelSpendCaps = nil
+		modelCapSpend = make(map[string]*capSpend)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestModelPolicyParsing(t *testing.T) {
+	if !matchModel([]string{"gpt-4o-mini*"}, "gpt-4o-mini-2024-07-18") || matchModel([]string{"gpt-4o-mini*"}, "gpt-4o") {
+		t.Error("Expected * to match any characters")
+	}
+	for _, pattern := range []string{"", " ", "gpt-["} {
+		if err := validModelPattern(pattern); err == nil {
+			t.Errorf("Expected error for %q", pattern)
+		}
+	}
+
+	caps, err := parseModelSpendCaps("o3-pro*=5/day, gpt-4.5-preview=50.5/month")
+	if err != nil || len(caps) != 2 || caps[0] != (ModelSpendCap{Pattern: "o3-pro*", LimitUSD: 5, Period: "day"}) {
+		t.Errorf("Unexpected caps %v: %v", caps, err)
+	}
+	if entries := formatModelSpendCaps(caps); strings.Join(entries, ",") != "o3-pro*=5/day,gpt-4.5-preview=50.5/month" {
+		t.Errorf("Unexpected format: %v", entries)
+	}
+	for _, value := range []string{"o3-pro=5", "o3-pro=0/day", "o3-pro=5/year", "=5/day", "o3-pro=lots/day"} {
+		if _, err := parseModelSpendCaps(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+
+	allowlists, err := parseNodeModels("interns/=gpt-4o-mini*|gpt-4.1-mini*, research=o3*")
+	if err != nil || len(allowlists) != 2 || len(allowlists["interns"]) != 2 {
+		t.Errorf("Unexpected allowlists %v: %v", allowlists, err)
+	}
+	if entries := formatNodeModels(allowlists); strings.Join(entries, ",") != "interns=gpt-4o-mini*|gpt-4.1-mini*,research=o3*" {
+		t.Errorf("Unexpected format: %v", entries)
+	}
+	for _, value := range []string{"interns", "=gpt-4o", "interns=", "interns=gpt-4o||o3"} {
+		if _, err := parseNodeModels(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	now := time.Date(2025, 3, 13, 15, 4, 5, 0, time.UTC) // a Thursday
+	for period, want := range map[string]string{
+		"day":   "2025-03-13 2025-03-14",
+		"week":  "2025-03-10 2025-03-17",
+		"month": "2025-03-01 2025-04-01",
+	} {
+		start := periodStart(period, now)
+		if got := start.Format("2006-01-02") + " " + periodEnd(period, start).Format("2006-01-02"); got != want {
+			t.Errorf("Expected %s period %s, got %s", period, want, got)
+		}
+	}
+}
+
+func TestModelAllowlists(t *testing.T) {
+	resetGlobalState()
+	resetBudgetTree(t)
+	resetModelPolicy(t)
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	internSecret, intern, _ := store.Create("intern", 0)
+	store.SetProject(intern.ID, "interns/summer")
+	nodeModels["interns"] = []string{"gpt-4o-mini*"}
+	ownSecret, own, _ := store.Create("own", 0)
+	store.SetModels(own.ID, []string{"gpt-4o"})
+
+	chat := func(secret, model string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/chat/completions",
+			strings.NewReader(`{"model":"`+model+`","messages":[{"role":"user","content":"Hi"}]}`))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := chat(internSecret, "gpt-4o-mini"); w.Code != http.StatusOK {
+		t.Errorf("Expected the group's model to pass, got %d: %s", w.Code, w.Body.String())
+	}
+	w := chat(internSecret, "gpt-4o")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "Model gpt-4o is not allowed for interns.") {
+		t.Errorf("Expected group rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	w = chat(ownSecret, "gpt-4o-mini")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "not allowed for key own") {
+		t.Errorf("Expected key rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := chat(ownSecret, "gpt-4o"); w.Code != http.StatusOK {
+		t.Errorf("Expected the key's model to pass, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(reservations) != 0 {
+		t.Errorf("Expected rejected requests to leave no reservation, got %d", len(reservations))
+	}
+
+	// The model list shows only what the key may use
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer "+internSecret)
+	router.ServeHTTP(w, req)
+	var list ModelList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) == 0 {
+		t.Fatalf("Unexpected model list %d: %s", w.Code, w.Body.String())
+	}
+	for _, model := range list.Data {
+		if !strings.HasPrefix(model.ID, "gpt-4o-mini") {
+			t.Errorf("Expected only models allowed for interns, got %s", model.ID)
+		}
+	}
+}
+
+func TestModelSpendCaps(t *testing.T) {
+	resetGlobalState()
+	resetModelPolicy(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	modelSpendCaps = []ModelSpendCap{{Pattern: "gpt-4o", LimitUSD: 0.5, Period: "day"}}
+	if w := postChat(router, "sk-test"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	mu.Lock()
+	spend := modelSpendCaps[0].spendOf(time.Now())
+	spent := spend.spent
+	spend.spent = 0.5
+	mu.Unlock()
+	if spent == 0 {
+		t.Error("Expected the request charged to the cap")
+	}
+
+	w := postChat(router, "sk-test")
+	tomorrow := periodStart("day", time.Now()).AddDate(0, 0, 1).Format(time.RFC3339)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "Spend cap for gpt-4o reached: $0.50 per day, resets at "+tomorrow) {
+		t.Errorf("Expected cap rejection, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A new period starts from zero
+	mu.Lock()
+	spend.start = spend.start.AddDate(0, 0, -1)
+	mu.Unlock()
+	if w := postChat(router, "sk-test"); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 in a new period, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestModelSpendCaps_RestoredFromLedger(t *testing.T) {
+	resetModelPolicy(t)
+	keySpend = make(map[string]float64)
+	t.Cleanup(func() { keySpend = make(map[string]float64) })
+
+	now := time.Now().UTC()
+	modelSpendCaps = []ModelSpendCap{{Pattern: "o3-pro*", LimitUSD: 5, Period: "day"}}
+	restoreKeySpend([]LedgerEntry{
+		{Time: now.AddDate(0, 0, -1), Model: "o3-pro", CostUSD: 4},
+		{Time: now, Model: "o3-pro", CostUSD: 1},
+		{Time: now, KeyID: "key_1", Model: "o3-pro-2025-06-10", CostUSD: 2},
+		{Time: now, KeyID: "key_1", Model: "gpt-4o", CostUSD: 8},
+		{Time: now, Type: ledgerEntryReset, KeyID: "key_1"},
+	})
+	// Only today's requests count, and resetting a key does not undo them
+	if spent := modelSpendCaps[0].spendOf(time.Now()).spent; spent != 3 {
+		t.Errorf("Expected $3 spent on o3-pro today, got %v", spent)
+	}
+}
+
+func TestAdminKeyModels(t *testing.T) {
+	resetGlobalState()
+	resetModelPolicy(t)
+	setupTestAdmin(t)
+	store := setupTestKeyStore(t)
+	router := setupTestRouter()
+	_, key, _ := store.Create("intern", 0)
+
+	w := adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/models", `{"models": ["gpt-4o-mini*"]}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"models":["gpt-4o-mini*"]`) {
+		t.Errorf("Expected key models, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, body := range []string{`{}`, `{"models": "gpt-4o"}`, `{"models": ["gpt-["]}`} {
+		if w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/models", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+	w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/models", `{"models": null}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"models":null`) {
+		t.Errorf("Expected models removed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	modelSpendCaps = []ModelSpendCap{{Pattern: "o3-pro*", LimitUSD: 5, Period: "week"}}
+	w = adminRequest(router, "GET", "/admin/budget", "")
+	if !strings.Contains(w.Body.String(), `"model_caps":[{"limit_usd":5,"model":"o3-pro*","period":"week"`) {
+		t.Errorf("Expected model caps in budget status, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mergeUpstreamModels adds the models OpenAI lists for the upstream key to
+// GET /v1/models, as far as the allow policy permits them.
+var mergeUpstreamModels bool
+
+// Model is an entry of the model list in OpenAI's format.
+type Model struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type ModelList struct {
+	Object string  `json:"object"`
+	Data   []Model `json:"data"`
+}
+
+// availableModels lists the models a client with key may use: every priced
+// model, and with mergeUpstreamModels the allowed models OpenAI offers,
+// narrowed by the key's model policy. Entries known upstream keep OpenAI's
+// creation time and owner. The list is sorted by ID.
+func availableModels(upstreamKey string, key *ProxyKey) []Model {
+	mu.Lock()
+	models := make(map[string]Model, len(modelPricing))
+	for _, id := range getAvailableModels() {
+		if isModelAllowed(id) && modelDeniedBy(key, id) == "" {
+			models[id] = Model{ID: id, Object: "model", OwnedBy: "openai"}
+		}
+	}
+	mu.Unlock()
+
+	if mergeUpstreamModels {
+		upstream, err := fetchUpstreamModels(upstreamKey)
+		if err != nil {
+			log.Printf("Cannot fetch OpenAI model list, listing priced models only: %v", err)
+		}
+		mu.Lock()
+		for _, model := range upstream {
+			if isModelAllowed(model.ID) && modelDeniedBy(key, model.ID) == "" {
+				models[model.ID] = model
+			}
+		}
+		mu.Unlock()
+	}
+
+	list := make([]Model, 0, len(models))
+	for _, model := range models {
+		list = append(list, model)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func fetchUpstreamModels(apiKey string) ([]Model, error) {
+	body, _, err := getOpenAI("/v1/models", apiKey)
+	if err != nil {
+		return nil, err
+	}
+	var list ModelList
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+func listModels(c *gin.Context) {
+	// Listing models costs nothing, so the quota is not checked
+	proxyKey, upstreamKey, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, ModelList{
+		Object: "list",
+		Data:   availableModels(upstreamKey, proxyKey),
+	})
+}
+
+func retrieveModel(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	id := c.Param("id")
+	for _, model := range availableModels(upstreamKey, proxyKey) {
+		if model.ID == id {
+			c.JSON(http.StatusOK, model)
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, ErrorResponse{
+		Error: fmt.Sprintf("Model %s is not available.", id),
+	})
+}
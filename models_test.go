@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func getModels(router http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func modelIDs(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var list ModelList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || list.Object != "list" {
+		t.Fatalf("Expected model list, got %s", w.Body.String())
+	}
+	ids := make([]string, 0, len(list.Data))
+	for _, model := range list.Data {
+		ids = append(ids, model.ID)
+	}
+	return ids
+}
+
+func TestListModels(t *testing.T) {
+	resetGlobalState()
+	router := setupTestRouter()
+
+	w := getModels(router, "/v1/models")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	ids := modelIDs(t, w)
+	if len(ids) != len(modelPricing) || !sort.StringsAreSorted(ids) {
+		t.Errorf("Expected the %d priced models sorted by ID, got %v", len(modelPricing), ids)
+	}
+
+	w = getModels(router, "/api/v1/models/gpt-4o")
+	var model Model
+	json.Unmarshal(w.Body.Bytes(), &model)
+	if w.Code != http.StatusOK || model.ID != "gpt-4o" || model.Object != "model" {
+		t.Errorf("Expected gpt-4o, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w = getModels(router, "/v1/models/dall-e-3"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unpriced model, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/models", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without API key, got %d", w.Code)
+	}
+}
+
+func TestListModels_MergeUpstream(t *testing.T) {
+	resetGlobalState()
+	mergeUpstreamModels = true
+	defer func() { mergeUpstreamModels = false }()
+	got := mockOpenAIRaw(t, `{"object":"list","data":[
+		{"id":"gpt-4o","object":"model","created":1715367049,"owned_by":"system"},
+		{"id":"gpt-4o-2024-08-06","object":"model","created":1722814719,"owned_by":"system"},
+		{"id":"dall-e-3","object":"model","created":1698785189,"owned_by":"system"}]}`)
+	router := setupTestRouter()
+
+	w := getModels(router, "/v1/models")
+	if got.Method != "GET" || got.URL.Path != "/v1/models" || got.Header.Get("Authorization") != "Bearer sk-test" {
+		t.Errorf("Unexpected upstream request: %s %s", got.Method, got.URL.Path)
+	}
+
+	// Allowed upstream models are added; dall-e-3 matches no allowed prefix
+	ids := modelIDs(t, w)
+	if len(ids) != len(modelPricing)+1 {
+		t.Errorf("Expected priced models and gpt-4o-2024-08-06, got %v", ids)
+	}
+	w = getModels(router, "/v1/models/gpt-4o")
+	var model Model
+	json.Unmarshal(w.Body.Bytes(), &model)
+	if model.Created != 1715367049 || model.OwnedBy != "system" {
+		t.Errorf("Expected upstream details for gpt-4o, got %+v", model)
+	}
+	if w = getModels(router, "/v1/models/dall-e-3"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for disallowed model, got %d", w.Code)
+	}
+}
+
+func TestListModels_UpstreamUnavailable(t *testing.T) {
+	resetGlobalState()
+	mergeUpstreamModels = true
+	defer func() { mergeUpstreamModels = false }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() {
+		openAIBaseURL = previous
+		server.Close()
+	}()
+	router := setupTestRouter()
+
+	w := getModels(router, "/v1/models")
+	if w.Code != http.StatusOK || len(modelIDs(t, w)) != len(modelPricing) {
+		t.Errorf("Expected priced models when OpenAI is unavailable, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// moderationModel checks chat prompts before they are forwarded.
+const moderationModel = "omni-moderation-latest"
+
+// moderationEnabled runs pre-flight moderation on chat prompts for keys that
+// do not set their own policy.
+var moderationEnabled bool
+
+// Moderation calls are free upstream but are tracked apart from charged
+// requests. Guarded by mu.
+var (
+	moderationRequests int
+	moderationFlagged  int
+)
+
+// APIError is an error in OpenAI's format, for clients that parse it.
+type APIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type ModerationResult struct {
+	Flagged    bool            `json:"flagged"`
+	Categories map[string]bool `json:"categories"`
+}
+
+type ModerationResponse struct {
+	ID      string             `json:"id"`
+	Model   string             `json:"model"`
+	Results []ModerationResult `json:"results"`
+}
+
+// moderationRequired reports whether chat prompts made with key are moderated:
+// the key's own policy when it sets one, the moderation setting otherwise.
+func moderationRequired(key *ProxyKey) bool {
+	if key != nil && key.Moderation != nil {
+		return *key.Moderation
+	}
+	return moderationEnabled
+}
+
+// trackModeration counts a moderation call and records it in the ledger.
+func trackModeration(key *ProxyKey, model string, flagged bool) {
+	mu.Lock()
+	moderationRequests++
+	if flagged {
+		moderationFlagged++
+	}
+	mu.Unlock()
+
+	keyID := ""
+	if key != nil {
+		keyID = key.ID
+	}
+	recordUsage(LedgerEntry{
+		Time:    time.Now().UTC(),
+		Type:    ledgerEntryModeration,
+		KeyID:   keyID,
+		Model:   model,
+		Flagged: flagged,
+	})
+}
+
+// flaggedCategories returns the categories flagged in any result, sorted.
+func flaggedCategories(results []ModerationResult) []string {
+	set := make(map[string]bool)
+	for _, result := range results {
+		for category, flagged := range result.Categories {
+			if flagged {
+				set[category] = true
+			}
+		}
+	}
+	categories := make([]string, 0, len(set))
+	for category := range set {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// moderateMessages checks the messages of a chat request. It returns true if
+// the request may proceed; otherwise the error response has already been
+// written: 400 for flagged prompts, 500 when the check itself fails.
+func moderateMessages(c *gin.Context, key *ProxyKey, upstreamKey string, messages []ChatMessage) bool {
+	texts := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Content != "" {
+			texts = append(texts, msg.Content)
+		}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"model": moderationModel, "input": texts})
+
+	respBody, err := postOpenAI("/v1/moderations", "application/json", body, upstreamKey)
+	var response ModerationResponse
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err != nil {
+		log.Printf("Moderation check failed: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error: fmt.Sprintf("Moderation check failed: %s", err.Error()),
+		})
+		return false
+	}
+
+	categories := flaggedCategories(response.Results)
+	flagged := false
+	for _, result := range response.Results {
+		flagged = flagged || result.Flagged
+	}
+	trackModeration(key, moderationModel, flagged)
+	if !flagged {
+		return true
+	}
+
+	log.Printf("Request blocked: prompt flagged by moderation, categories=%v", categories)
+	c.JSON(http.StatusBadRequest, APIErrorResponse{Error: APIError{
+		Message: fmt.Sprintf("Your request was rejected by the moderation policy (flagged: %s).", strings.Join(categories, ", ")),
+		Type:    "invalid_request_error",
+		Code:    "content_policy_violation",
+	}})
+	return false
+}
+
+// moderationsProxy forwards moderation requests unchanged. They are free, so
+// the quota is not checked, but the rate limits are.
+func moderationsProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authenticateRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var reqData struct {
+		Model string          `json:"model"`
+		Input json.RawMessage `json:"input"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &reqData)
+	}
+	if err != nil || len(reqData.Input) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+	model := reqData.Model
+	if model == "" {
+		model = moderationModel
+	}
+
+	// Moderation is free but still counts against the request rate limits
+	if !limitRequestRate(c, proxyKey, model) {
+		return
+	}
+
+	respBody, contentType, err := sendOpenAI("/v1/moderations", "application/json", body, upstreamKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Error: fmt.Sprintf("OpenAI API call error: %s", err.Error()),
+		})
+		return
+	}
+
+	var response ModerationResponse
+	json.Unmarshal(respBody, &response)
+	flagged := false
+	for _, result := range response.Results {
+		flagged = flagged || result.Flagged
+	}
+	if response.Model != "" {
+		model = response.Model
+	}
+	trackModeration(proxyKey, model, flagged)
+
+	c.Data(http.StatusOK, contentType, respBody)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testModerationClean   = `{"id":"modr-1","model":"omni-moderation-latest","results":[{"flagged":false,"categories":{"violence":false}}]}`
+	testModerationFlagged = `{"id":"modr-2","model":"omni-moderation-latest","results":[{"flagged":true,"categories":{"violence":true,"harassment":true,"hate":false}}]}`
+	testChatCompletion    = `{"id":"chatcmpl-1","choices":[{"message":{"role":"assistant","content":"Hi"},"index":0}],"usage":{"prompt_tokens":10,"completion_tokens":5}}`
+)
+
+func resetModeration() {
+	moderationEnabled = false
+	moderationRequests = 0
+	moderationFlagged = 0
+}
+
+func TestModerationsProxy(t *testing.T) {
+	resetGlobalState()
+	resetModeration()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/moderations", testModerationFlagged)
+	router := setupTestRouter()
+
+	// Moderation is free, so it is allowed after the quota is spent
+	totalCost = costLimitUSD
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/moderations", strings.NewReader(`{"input":"text to check"}`))
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != testModerationFlagged {
+		t.Errorf("Expected response to be passed through, got %d: %s", w.Code, w.Body.String())
+	}
+	if moderationRequests != 1 || moderationFlagged != 1 || totalCost != costLimitUSD {
+		t.Errorf("Expected moderation to be tracked apart from spend, got %d requests, %d flagged", moderationRequests, moderationFlagged)
+	}
+}
+
+func TestPreflightModeration(t *testing.T) {
+	resetGlobalState()
+	resetModeration()
+	defer resetModeration()
+	moderationEnabled = true
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/moderations", testModerationFlagged)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	w := postChat(router, "sk-test")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+	}
+	var response APIErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Error.Code != "content_policy_violation" || response.Error.Type != "invalid_request_error" ||
+		!strings.Contains(response.Error.Message, "harassment, violence") {
+		t.Errorf("Expected OpenAI-style error, got %s", w.Body.String())
+	}
+	if api.count("POST /v1/chat/completions") != 0 || totalCost != 0 || len(reservations) != 0 {
+		t.Error("Expected flagged request not to be forwarded or charged")
+	}
+
+	api.set("POST /v1/moderations", testModerationClean)
+	w = postChat(router, "sk-test")
+	if w.Code != http.StatusOK || api.count("POST /v1/chat/completions") != 1 {
+		t.Errorf("Expected clean request to be forwarded, got %d: %s", w.Code, w.Body.String())
+	}
+	if moderationRequests != 2 || moderationFlagged != 1 {
+		t.Errorf("Expected 2 moderation checks with 1 flagged, got %d and %d", moderationRequests, moderationFlagged)
+	}
+
+	// A failed check blocks the request
+	api.set("POST /v1/moderations", "not json")
+	if w = postChat(router, "sk-test"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 when moderation fails, got %d", w.Code)
+	}
+}
+
+func TestPreflightModeration_PerKey(t *testing.T) {
+	resetGlobalState()
+	resetModeration()
+	defer resetModeration()
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/moderations", testModerationFlagged)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	secret, key, _ := store.Create("moderated", 0)
+
+	// Off by default
+	if w := postChat(router, secret); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 without moderation, got %d", w.Code)
+	}
+
+	enabled := true
+	store.SetModeration(key.ID, &enabled)
+	if w := postChat(router, secret); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected key policy to enable moderation, got %d", w.Code)
+	}
+
+	// The key's policy wins over the setting
+	moderationEnabled = true
+	disabled := false
+	store.SetModeration(key.ID, &disabled)
+	if w := postChat(router, secret); w.Code != http.StatusOK {
+		t.Errorf("Expected key policy to disable moderation, got %d", w.Code)
+	}
+	if api.count("POST /v1/moderations") != 1 {
+		t.Errorf("Expected 1 moderation call, got %d", api.count("POST /v1/moderations"))
+	}
+}
+
+func TestAdminKeyModeration(t *testing.T) {
+	resetGlobalState()
+	resetModeration()
+	setupTestAdmin(t)
+	store := setupTestKeyStore(t)
+	router := setupTestRouter()
+	_, key, _ := store.Create("team", 0)
+
+	w := adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/moderation", `{"moderation": true}`)
+	var status map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusOK || status["moderation"] != true {
+		t.Errorf("Expected moderation enabled, got %d: %s", w.Code, w.Body.String())
+	}
+	if stored, _ := store.Get(key.ID); stored.Moderation == nil || !*stored.Moderation {
+		t.Error("Expected moderation to be stored with the key")
+	}
+
+	// null follows the moderation setting again
+	w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/moderation", `{"moderation": null}`)
+	if stored, _ := store.Get(key.ID); w.Code != http.StatusOK || stored.Moderation != nil {
+		t.Errorf("Expected key policy to be cleared, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, body := range []string{`{}`, `{"moderation": "yes"}`} {
+		if w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/moderation", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
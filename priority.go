@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Priority lanes. Interactive requests are queued ahead of batch requests and
+// may use slots and budget that batch requests may not, so batch traffic is
+// held back and shed first when the proxy is busy or the quota runs low.
+const (
+	priorityInteractive = "interactive"
+	priorityBatch       = "batch"
+)
+
+// priorities lists the lanes in the order their queued requests are started.
+var priorities = []string{priorityInteractive, priorityBatch}
+
+// Capacity kept for interactive requests.
+var (
+	interactiveSlots           int     // slots of max_concurrent batch requests may not use
+	interactiveHeadroomPercent float64 // share of the quota batch requests may not spend
+)
+
+// Header a client sets to choose the lane of a request
+const priorityHeader = "X-Proxy-Priority"
+
+// Context key of the lane of a request
+const contextPriority = "priority"
+
+func validPriority(priority string) bool {
+	return priority == priorityInteractive || priority == priorityBatch
+}
+
+// keyPriority returns the lane of a key's requests; keys without one are
+// interactive.
+func keyPriority(key *ProxyKey) string {
+	if key != nil && key.Priority != "" {
+		return key.Priority
+	}
+	return priorityInteractive
+}
+
+// resolvePriority sets the lane of a request from its key and the
+// X-Proxy-Priority header. The header may move a request to the batch lane
+// but not out of it, so a key marked batch cannot jump the queue. On failure
+// the 400 response has already been written.
+func resolvePriority(c *gin.Context, key *ProxyKey) bool {
+	priority := keyPriority(key)
+	if value := strings.ToLower(strings.TrimSpace(c.GetHeader(priorityHeader))); value != "" {
+		if !validPriority(value) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Invalid %s header %q: must be %s or %s.", priorityHeader, value, priorityInteractive, priorityBatch),
+			})
+			return false
+		}
+		if priority == priorityInteractive {
+			priority = value
+		}
+	}
+	c.Set(contextPriority, priority)
+	return true
+}
+
+// requestPriority returns the lane resolvePriority chose for a request.
+func requestPriority(c *gin.Context) string {
+	if priority := c.GetString(contextPriority); priority != "" {
+		return priority
+	}
+	return priorityInteractive
+}
+
+// batchCostLimit is the part of the global quota batch requests may spend.
+// Must hold mu.
+func batchCostLimit() float64 {
+	return costLimitUSD * (1 - interactiveHeadroomPercent/100)
+}
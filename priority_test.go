@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolvePriority(t *testing.T) {
+	batchKey := &ProxyKey{ID: "ci", Priority: priorityBatch}
+	tests := []struct {
+		name     string
+		key      *ProxyKey
+		header   string
+		expected string
+	}{
+		{"default", nil, "", priorityInteractive},
+		{"header", nil, "Batch", priorityBatch},
+		{"key", batchKey, "", priorityBatch},
+		{"key cannot be raised", batchKey, priorityInteractive, priorityBatch},
+		{"interactive key lowered", &ProxyKey{ID: "tool"}, priorityBatch, priorityBatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := queueContext("a")
+			c.Request.Header.Set(priorityHeader, tt.header)
+			if !resolvePriority(c, tt.key) || requestPriority(c) != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, requestPriority(c))
+			}
+		})
+	}
+
+	c, w := queueContext("a")
+	c.Request.Header.Set(priorityHeader, "urgent")
+	if resolvePriority(c, nil) || w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown priority, got %d", w.Code)
+	}
+}
+
+func TestPriority_BudgetHeadroom(t *testing.T) {
+	resetGlobalState()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+	interactiveHeadroomPercent = 20
+	t.Cleanup(func() { interactiveHeadroomPercent = 0 })
+
+	// Batch requests may spend $1.60 of the $2 quota
+	totalCost = 1.7
+	postPriorityChat := func(priority string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-test")
+		req.Header.Set(priorityHeader, priority)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w := postPriorityChat(priorityBatch)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "batch traffic") {
+		t.Errorf("Expected batch request to be shed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postPriorityChat(priorityInteractive); w.Code != http.StatusOK {
+		t.Errorf("Expected interactive request to use the headroom, got %d: %s", w.Code, w.Body.String())
+	}
+
+	totalCost = 1.0
+	if w := postPriorityChat(priorityBatch); w.Code != http.StatusOK {
+		t.Errorf("Expected batch request below its share to pass, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestQueue_InteractiveFirst(t *testing.T) {
+	resetQueue(t)
+	maxConcurrent, interactiveSlots = 2, 1
+
+	inLane := func(client, priority string) *gin.Context {
+		c, _ := queueContext(client)
+		c.Set(contextPriority, priority)
+		return c
+	}
+
+	// Batch requests leave the last slot to interactive ones
+	batch := inLane("ci", priorityBatch)
+	if !acquireSlot(batch, nil) {
+		t.Fatal("Expected first batch request to run")
+	}
+	started := make(chan string, 2)
+	queued := inLane("ci", priorityBatch)
+	go func() {
+		if acquireSlot(queued, nil) {
+			started <- "batch"
+		}
+	}()
+	waitForDepth(t, 1)
+	interactive := inLane("tool", priorityInteractive)
+	if !acquireSlot(interactive, nil) {
+		t.Fatal("Expected interactive request to take the reserved slot")
+	}
+
+	// Interactive requests queued later start first
+	late := inLane("tool", priorityInteractive)
+	go func() {
+		if acquireSlot(late, nil) {
+			started <- "interactive"
+		}
+	}()
+	waitForDepth(t, 2)
+	releaseSlot(interactive)
+	if first := <-started; first != "interactive" {
+		t.Errorf("Expected interactive request to start first, got %s", first)
+	}
+	// Interactive requests may use every slot, so the batch request waits
+	// until only it would be in flight
+	releaseSlot(batch)
+	if queueDepth != 1 {
+		t.Errorf("Expected batch request to keep waiting, depth %d", queueDepth)
+	}
+	releaseSlot(late)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("Expected batch request to start once a batch slot was free")
+	}
+	releaseSlot(queued)
+}
+
+func TestAdminKeyPriority(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	store := setupTestKeyStore(t)
+	router := setupTestRouter()
+	_, key, _ := store.Create("ci", 0)
+
+	w := adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/priority", `{"priority": "batch"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"priority":"batch"`) {
+		t.Errorf("Expected batch priority, got %d: %s", w.Code, w.Body.String())
+	}
+	if stored, _ := store.Get(key.ID); stored.Priority != priorityBatch {
+		t.Errorf("Expected priority to be stored with the key, got %q", stored.Priority)
+	}
+	w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/priority", `{"priority": null}`)
+	if !strings.Contains(w.Body.String(), `"priority":"interactive"`) {
+		t.Errorf("Expected interactive priority, got %s", w.Body.String())
+	}
+	for _, body := range []string{`{"priority": "urgent"}`, `{}`, `not json`} {
+		if w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/priority", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
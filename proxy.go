@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Steps shared by the proxied endpoints: authorize the client, reserve the
+// estimated cost, call OpenAI, then charge the actual cost.
+
+// authorizeRequest checks the global quota and the client's API key and
+// returns the key to use upstream. On failure the error response has already
+// been written.
+func authorizeRequest(c *gin.Context) (*ProxyKey, string, bool) {
+	if globalLimitExceeded(c) {
+		return nil, "", false
+	}
+	proxyKey, upstreamKey, ok := authenticateRequest(c)
+	if !ok || !resolveTags(c) {
+		return nil, "", false
+	}
+	return proxyKey, upstreamKey, true
+}
+
+// authenticateRequest is authorizeRequest without the quota check, for
+// requests that cost nothing.
+func authenticateRequest(c *gin.Context) (*ProxyKey, string, bool) {
+	// Get API key from Authorization header
+	apiKey, ok := bearerToken(c)
+	if !ok {
+		return nil, "", false
+	}
+
+	// Keys issued by the proxy are replaced with the configured OpenAI key
+	proxyKey, upstreamKey, ok := resolveAPIKey(c, apiKey)
+	if !ok {
+		return nil, "", false
+	}
+	c.Set(contextProxyKey, proxyKey)
+	if proxyKey == nil {
+		c.Set(contextClientID, "openai:"+hashKey(apiKey)[:12])
+	}
+	if !resolvePriority(c, proxyKey) {
+		return nil, "", false
+	}
+	return proxyKey, upstreamKey, true
+}
+
+// reserveRequest waits for a concurrency slot, admits the request under the
+// rate limits and reserves its estimated cost. On rejection the 429 response
+// has already been written.
+func reserveRequest(c *gin.Context, key *ProxyKey, model string, promptTokens int, estimate float64) (*Reservation, bool) {
+	return reserve(c, key, model, promptTokens, estimate, true)
+}
+
+// reserve is reserveRequest; without limitTokens the request counts against
+// the request limits only, as batches do.
+func reserve(c *gin.Context, key *ProxyKey, model string, promptTokens int, estimate float64, limitTokens bool) (*Reservation, bool) {
+	if !acquireSlot(c, key) {
+		return nil, false
+	}
+	rateTokens := 0
+	if limitTokens {
+		rateTokens = promptTokens
+	}
+
+	now := time.Now()
+	mu.Lock()
+	scopes := rateScopes(key, model)
+	var reservation *Reservation
+	err := checkRateLimits(scopes, rateTokens, now)
+	if err == nil {
+		reservation, err = reserveBudget(key, model, requestPriority(c), requestTags(c), promptTokens, estimate)
+	}
+	if err == nil {
+		takeRateLimits(scopes, rateTokens, now)
+		reservation.rateLimited = limitTokens
+		reservation.rateTokens = rateTokens
+		reservation.User = c.GetString(contextUser)
+	}
+	headers := rateLimitHeaders(scopes, now)
+	mu.Unlock()
+
+	headers.write(c)
+	if err != nil {
+		releaseSlot(c)
+	}
+	if rateErr, ok := err.(*rateLimitError); ok {
+		writeRateLimitError(c, rateErr)
+		return nil, false
+	}
+	if err != nil {
+		writeBudgetError(c, err)
+		return nil, false
+	}
+	return reservation, true
+}
+
+// failRequest releases the reservation of a request whose upstream call failed
+// and writes the error response.
+func failRequest(c *gin.Context, reservation *Reservation, promptTokens int, err error) {
+	mu.Lock()
+	releaseReservation(reservation)
+
+	// Even if OpenAI request failed, count tokens for logging
+	log.Printf("Failed request: model=%s, prompt_tokens=%d, completion_tokens=0, estimated_cost=$%.6f, total_cost=$%.6f, remaining=$%.6f, error=%v",
+		reservation.Model, promptTokens, reservation.CostUSD, totalCost, costLimitUSD-totalCost, err)
+	mu.Unlock()
+
+	c.JSON(http.StatusInternalServerError, ErrorResponse{
+		Error: fmt.Sprintf("OpenAI API call error: %s", err.Error()),
+	})
+}
+
+// chargeRequest replaces the reservation with the actual cost of a request,
+// records it in the ledger and returns the usage reported to the client.
+func chargeRequest(c *gin.Context, reservation *Reservation, promptTokens, completionTokens int, cost float64, serviceTier string) *ProxyUsage {
+	proxyUsage := settleUsage(reservation, promptTokens, completionTokens, cost, serviceTier)
+	c.Set(contextRequestCost, cost)
+	return proxyUsage
+}
+
+// settleUsage is chargeRequest for requests settled outside of a client
+// request, such as batches.
+func settleUsage(reservation *Reservation, promptTokens, completionTokens int, cost float64, serviceTier string) *ProxyUsage {
+	mu.Lock()
+	settleReservation(reservation, cost)
+	settleRateTokens(reservation, promptTokens+completionTokens)
+	notifications := budgetNotificationsDue(reservation)
+
+	// Log detailed usage information
+	logInfof("Request: model=%s, prompt_tokens=%d, completion_tokens=%d, cost=$%.6f, total_cost=$%.6f, remaining=$%.6f",
+		reservation.Model, promptTokens, completionTokens, cost, totalCost, costLimitUSD-totalCost)
+	mu.Unlock()
+	sendBudgetNotifications(notifications)
+
+	recordUsage(LedgerEntry{
+		Time:             time.Now().UTC(),
+		KeyID:            reservation.KeyID,
+		Project:          reservation.Project,
+		Tags:             reservation.Tags,
+		User:             reservation.User,
+		Model:            reservation.Model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		CostUSD:          cost,
+		ServiceTier:      normalizeServiceTier(serviceTier),
+		BatchID:          reservation.BatchID,
+	})
+
+	return &ProxyUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		CostUSD:          float64(int(cost*1000000)) / 1000000, // round to 6 decimal places
+		ServiceTier:      normalizeServiceTier(serviceTier),
+	}
+}
+
+// postOpenAI sends a request body of the given content type to an OpenAI
+// endpoint and returns the body of a successful response.
+func postOpenAI(path, contentType string, body []byte, apiKey string) ([]byte, error) {
+	respBody, _, err := sendOpenAI(path, contentType, body, apiKey)
+	return respBody, err
+}
+
+// sendOpenAI is postOpenAI for responses that are not JSON; it also returns
+// the content type of the response.
+func sendOpenAI(path, contentType string, body []byte, apiKey string) ([]byte, string, error) {
+	req, err := http.NewRequest("POST", openAIBaseURL+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return doOpenAI(req, apiKey)
+}
+
+// getOpenAI fetches an OpenAI resource and returns the body and content type
+// of a successful response.
+func getOpenAI(path, apiKey string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", openAIBaseURL+path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return doOpenAI(req, apiKey)
+}
+
+func doOpenAI(req *http.Request, apiKey string) ([]byte, string, error) {
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("OpenAI API error: %s", string(respBody))
+	}
+	return respBody, resp.Header.Get("Content-Type"), nil
+}
+
+// openOpenAIStream sends a JSON request for a streamed response. The request is
+// canceled when ctx is, e.g. when the client disconnects. The caller closes
+// the body of the returned response.
+func openOpenAIStream(ctx context.Context, path string, body []byte, apiKey string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", openAIBaseURL+path, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("OpenAI API error: %s", string(respBody))
+	}
+	return resp, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Concurrency limits on requests in flight upstream. Requests over a limit
+// wait in a queue instead of being rejected; clients take turns, so a burst
+// from one client waits behind the requests of others.
+var (
+	maxConcurrent    int           // across all clients, 0 = no limit
+	keyMaxConcurrent int           // per client without its own cap, 0 = no limit
+	maxQueueWait     time.Duration // 0 rejects instead of queueing
+	maxQueueDepth    int           // 0 = no limit
+)
+
+const (
+	defaultMaxQueueWait  = 30 * time.Second
+	defaultMaxQueueDepth = 100
+)
+
+// Context key of the client a request is scheduled as
+const contextClientID = "clientID"
+
+// slotWaiter is a queued request, granted a slot by closing ready.
+type slotWaiter struct {
+	client   string
+	limit    int
+	priority string
+	ready    chan struct{}
+	granted  bool
+}
+
+// laneQueue holds the queued requests of one priority lane by client.
+type laneQueue struct {
+	clients map[string][]*slotWaiter
+	turns   []string // clients with queued requests, next turn first
+}
+
+func newLaneQueues() map[string]*laneQueue {
+	queues := make(map[string]*laneQueue, len(priorities))
+	for _, priority := range priorities {
+		queues[priority] = &laneQueue{clients: make(map[string][]*slotWaiter)}
+	}
+	return queues
+}
+
+// Scheduler state, guarded by mu.
+var (
+	inFlight       int
+	clientInFlight = make(map[string]int)
+	laneQueues     = newLaneQueues()
+	queueDepth     int
+
+	queueStats QueueStats
+)
+
+// QueueStats are the queue's counters since the proxy started.
+type QueueStats struct {
+	Queued        int64   `json:"queued"`
+	TimedOut      int64   `json:"timed_out"`
+	Rejected      int64   `json:"rejected"`
+	Abandoned     int64   `json:"abandoned"`
+	MaxDepth      int     `json:"max_depth"`
+	TotalWaitSecs float64 `json:"total_wait_seconds"`
+}
+
+// clientID identifies the client a request is scheduled as: its proxy key, or
+// the OpenAI key it passes through.
+func clientID(c *gin.Context, key *ProxyKey) string {
+	if key != nil {
+		return "key:" + key.ID
+	}
+	return c.GetString(contextClientID)
+}
+
+// clientConcurrency returns the cap on in-flight requests of a client. Must
+// hold mu.
+func clientConcurrency(key *ProxyKey) int {
+	if key != nil && key.MaxConcurrent > 0 {
+		return key.MaxConcurrent
+	}
+	return keyMaxConcurrent
+}
+
+// canRun reports whether a client under limit may start a request of the
+// given priority now. Batch requests leave interactiveSlots free. Must hold mu.
+func canRun(client string, limit int, priority string) bool {
+	slots := maxConcurrent
+	if priority == priorityBatch {
+		slots -= interactiveSlots
+	}
+	return (maxConcurrent == 0 || inFlight < slots) &&
+		(limit == 0 || clientInFlight[client] < limit)
+}
+
+func startRequest(client string) {
+	inFlight++
+	clientInFlight[client]++
+}
+
+// dispatchQueue starts queued requests while slots are free, interactive
+// requests first. Must hold mu.
+func dispatchQueue() {
+	for _, priority := range priorities {
+		laneQueues[priority].dispatch()
+	}
+}
+
+// dispatch starts queued requests of the lane while slots are free, giving
+// clients turns in order. Must hold mu.
+func (q *laneQueue) dispatch() {
+	for started := true; started; {
+		started = false
+		for i, client := range q.turns {
+			queue := q.clients[client]
+			if !canRun(client, queue[0].limit, queue[0].priority) {
+				continue
+			}
+			waiter := queue[0]
+			waiter.granted = true
+			close(waiter.ready)
+			startRequest(client)
+			queueDepth--
+
+			// The client's next request waits for everyone else's turn
+			q.turns = append(q.turns[:i:i], q.turns[i+1:]...)
+			if len(queue) > 1 {
+				q.clients[client] = queue[1:]
+				q.turns = append(q.turns, client)
+			} else {
+				delete(q.clients, client)
+			}
+			started = true
+			break
+		}
+	}
+}
+
+// add queues a request behind the client's earlier ones. Must hold mu.
+func (q *laneQueue) add(waiter *slotWaiter) {
+	if len(q.clients[waiter.client]) == 0 {
+		q.turns = append(q.turns, waiter.client)
+	}
+	q.clients[waiter.client] = append(q.clients[waiter.client], waiter)
+	queueDepth++
+}
+
+// remove drops a request that gave up waiting. Must hold mu.
+func (q *laneQueue) remove(waiter *slotWaiter) {
+	queue := q.clients[waiter.client]
+	for i, w := range queue {
+		if w != waiter {
+			continue
+		}
+		queue = append(queue[:i:i], queue[i+1:]...)
+		queueDepth--
+		break
+	}
+	if len(queue) > 0 {
+		q.clients[waiter.client] = queue
+		return
+	}
+	delete(q.clients, waiter.client)
+	for i, client := range q.turns {
+		if client == waiter.client {
+			q.turns = append(q.turns[:i:i], q.turns[i+1:]...)
+			break
+		}
+	}
+}
+
+// acquireSlot waits until the request may be sent upstream. The slot is
+// released by releaseSlot when the handler returns. On rejection the 429
+// response has already been written.
+func acquireSlot(c *gin.Context, key *ProxyKey) bool {
+	client := clientID(c, key)
+	priority := requestPriority(c)
+
+	mu.Lock()
+	limit := clientConcurrency(key)
+	lane := laneQueues[priority]
+	if canRun(client, limit, priority) && len(lane.clients[client]) == 0 {
+		startRequest(client)
+		mu.Unlock()
+		c.Set(contextSlot, client)
+		return true
+	}
+	if maxQueueWait <= 0 || (maxQueueDepth > 0 && queueDepth >= maxQueueDepth) {
+		queueStats.Rejected++
+		mu.Unlock()
+		log.Printf("Request blocked: too many concurrent requests, client=%s, priority=%s", client, priority)
+		writeQueueError(c, "Too many concurrent requests. Please retry shortly.")
+		return false
+	}
+
+	waiter := &slotWaiter{client: client, limit: limit, priority: priority, ready: make(chan struct{})}
+	lane.add(waiter)
+	queueStats.Queued++
+	if queueDepth > queueStats.MaxDepth {
+		queueStats.MaxDepth = queueDepth
+	}
+	mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(maxQueueWait)
+	defer timer.Stop()
+	var timedOut bool
+	select {
+	case <-waiter.ready:
+	case <-timer.C:
+		timedOut = true
+	case <-c.Request.Context().Done():
+	}
+
+	mu.Lock()
+	queueStats.TotalWaitSecs += time.Since(start).Seconds()
+	if waiter.granted {
+		mu.Unlock()
+		c.Set(contextSlot, client)
+		if c.Request.Context().Err() != nil {
+			releaseSlot(c)
+			return false
+		}
+		return true
+	}
+	lane.remove(waiter)
+	if timedOut {
+		queueStats.TimedOut++
+	} else {
+		queueStats.Abandoned++
+	}
+	mu.Unlock()
+
+	if timedOut {
+		log.Printf("Request blocked: waited %s in the queue, client=%s, priority=%s", maxQueueWait, client, priority)
+		writeQueueError(c, fmt.Sprintf("Request waited %s in the queue without a free slot. Please retry later.", maxQueueWait))
+	}
+	return false
+}
+
+// Context key of the client holding a slot for the request
+const contextSlot = "concurrencySlot"
+
+// releaseSlot frees the request's slot, if it holds one, and starts the next
+// queued request.
+func releaseSlot(c *gin.Context) {
+	client, ok := c.Get(contextSlot)
+	if !ok {
+		return
+	}
+	c.Set(contextSlot, nil)
+	if client == nil {
+		return
+	}
+
+	mu.Lock()
+	inFlight--
+	if clientInFlight[client.(string)]--; clientInFlight[client.(string)] <= 0 {
+		delete(clientInFlight, client.(string))
+	}
+	dispatchQueue()
+	mu.Unlock()
+}
+
+// concurrencySlots releases the slot a handler acquired once it returns.
+func concurrencySlots(c *gin.Context) {
+	defer releaseSlot(c)
+	c.Next()
+}
+
+func writeQueueError(c *gin.Context, message string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(maxQueueWait.Seconds())))))
+	c.JSON(http.StatusTooManyRequests, APIErrorResponse{Error: APIError{
+		Message: message,
+		Type:    "requests",
+		Code:    "concurrency_limit_exceeded",
+	}})
+}
+
+// queueStatus describes the requests in flight and waiting. Must hold mu.
+func queueStatus() gin.H {
+	waiting := make(map[string]int)
+	byPriority := make(map[string]int, len(priorities))
+	for priority, lane := range laneQueues {
+		for client, queue := range lane.clients {
+			waiting[client] += len(queue)
+			byPriority[priority] += len(queue)
+		}
+	}
+	running := make(map[string]int, len(clientInFlight))
+	for client, n := range clientInFlight {
+		running[client] = n
+	}
+	averageWait := 0.0
+	if queueStats.Queued > 0 {
+		averageWait = queueStats.TotalWaitSecs / float64(queueStats.Queued)
+	}
+	return gin.H{
+		"max_concurrent":       maxConcurrent,
+		"interactive_slots":    interactiveSlots,
+		"in_flight":            inFlight,
+		"in_flight_by_client":  running,
+		"depth":                queueDepth,
+		"depth_by_client":      waiting,
+		"depth_by_priority":    byPriority,
+		"average_wait_seconds": averageWait,
+		"stats":                queueStats,
+	}
+}
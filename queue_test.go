@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func resetQueue(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		maxConcurrent, keyMaxConcurrent, maxQueueDepth = 0, 0, 0
+		maxQueueWait = defaultMaxQueueWait
+		inFlight, queueDepth = 0, 0
+		clientInFlight = make(map[string]int)
+		laneQueues = newLaneQueues()
+		interactiveSlots = 0
+		queueStats = QueueStats{}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// queueContext is a request of client as seen by a handler.
+func queueContext(client string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	c.Set(contextClientID, client)
+	return c, w
+}
+
+// waitForDepth waits until depth requests are queued.
+func waitForDepth(t *testing.T, depth int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		mu.Lock()
+		current := queueDepth
+		mu.Unlock()
+		if current == depth {
+			return
+		}
+	}
+	t.Fatalf("Expected %d queued requests", depth)
+}
+
+func TestQueue_FairAcrossClients(t *testing.T) {
+	resetQueue(t)
+	maxConcurrent = 1
+
+	running, _ := queueContext("a")
+	if !acquireSlot(running, nil) {
+		t.Fatal("Expected first request to run")
+	}
+
+	// A burst from a is queued before a request of b
+	started := make(chan string, 3)
+	queue := func(client, name string) *gin.Context {
+		c, _ := queueContext(client)
+		go func() {
+			if acquireSlot(c, nil) {
+				started <- name
+			}
+		}()
+		return c
+	}
+	contexts := map[string]*gin.Context{}
+	for i, name := range []string{"a2", "a3", "b1"} {
+		contexts[name] = queue(name[:1], name)
+		waitForDepth(t, i+1)
+	}
+
+	// b takes its turn before the rest of a's burst
+	releaseSlot(running)
+	var order []string
+	for i := 0; i < 3; i++ {
+		name := <-started
+		order = append(order, name)
+		releaseSlot(contexts[name])
+	}
+	if strings.Join(order, ",") != "a2,b1,a3" {
+		t.Errorf("Expected a2,b1,a3, got %v", order)
+	}
+	if inFlight != 0 || queueDepth != 0 || queueStats.Queued != 3 || queueStats.MaxDepth != 3 {
+		t.Errorf("Unexpected state: in flight %d, depth %d, stats %+v", inFlight, queueDepth, queueStats)
+	}
+}
+
+func TestQueue_ClientCap(t *testing.T) {
+	resetQueue(t)
+	keyMaxConcurrent = 1
+
+	first, _ := queueContext("a")
+	acquireSlot(first, nil)
+
+	// Another client is not held up by a's cap
+	other, _ := queueContext("b")
+	if !acquireSlot(other, nil) {
+		t.Fatal("Expected other client to run")
+	}
+
+	done := make(chan bool)
+	second, _ := queueContext("a")
+	go func() { done <- acquireSlot(second, nil) }()
+	waitForDepth(t, 1)
+	releaseSlot(first)
+	if !<-done {
+		t.Error("Expected queued request to run once a's slot was released")
+	}
+}
+
+func TestQueue_TimeoutAndRejection(t *testing.T) {
+	resetQueue(t)
+	maxConcurrent = 1
+	maxQueueWait = 20 * time.Millisecond
+
+	running, _ := queueContext("a")
+	acquireSlot(running, nil)
+
+	c, w := queueContext("b")
+	if acquireSlot(c, nil) {
+		t.Fatal("Expected request to time out")
+	}
+	var response APIErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusTooManyRequests || response.Error.Code != "concurrency_limit_exceeded" || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	if queueDepth != 0 || queueStats.TimedOut != 1 {
+		t.Errorf("Expected timed out request to leave the queue, depth %d, stats %+v", queueDepth, queueStats)
+	}
+
+	// Without queueing, or with a full queue, requests are rejected at once
+	maxQueueWait = 0
+	if c, w = queueContext("b"); acquireSlot(c, nil) || w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected immediate rejection, got %d", w.Code)
+	}
+	maxQueueWait, maxQueueDepth = time.Second, 1
+	queued, _ := queueContext("c")
+	done := make(chan bool)
+	go func() { done <- acquireSlot(queued, nil) }()
+	waitForDepth(t, 1)
+	if c, w = queueContext("b"); acquireSlot(c, nil) || w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected rejection with a full queue, got %d", w.Code)
+	}
+	if queueStats.Rejected != 2 {
+		t.Errorf("Expected 2 rejections, got %d", queueStats.Rejected)
+	}
+	releaseSlot(running)
+	if <-done {
+		releaseSlot(queued)
+	}
+}
+
+func TestQueue_ReleasedByHandler(t *testing.T) {
+	resetGlobalState()
+	resetQueue(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+	maxConcurrent = 1
+
+	// Slots are released after successful and rejected requests alike
+	for _, limit := range []float64{2.0, 1e-12} {
+		costLimitUSD = limit
+		postChat(router, "sk-test")
+		if inFlight != 0 || len(clientInFlight) != 0 {
+			t.Errorf("Expected slot to be released, %d in flight", inFlight)
+		}
+	}
+}
+
+func TestAdminQueue(t *testing.T) {
+	resetGlobalState()
+	resetQueue(t)
+	setupTestAdmin(t)
+	store := setupTestKeyStore(t)
+	router := setupTestRouter()
+	_, key, _ := store.Create("team", 0)
+	keyMaxConcurrent = 4
+
+	w := adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/concurrency", `{"max_concurrent": 2}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"concurrency":2`) {
+		t.Errorf("Expected key concurrency 2, got %d: %s", w.Code, w.Body.String())
+	}
+	w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/concurrency", `{"max_concurrent": 0}`)
+	if !strings.Contains(w.Body.String(), `"concurrency":4`) {
+		t.Errorf("Expected key to follow key_max_concurrent, got %s", w.Body.String())
+	}
+	if w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/concurrency", `{"max_concurrent": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+
+	w = adminRequest(router, "GET", "/admin/queue", "")
+	var status struct {
+		InFlight int        `json:"in_flight"`
+		Depth    int        `json:"depth"`
+		Stats    QueueStats `json:"stats"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || w.Code != http.StatusOK {
+		t.Errorf("Unexpected queue status %d: %s", w.Code, w.Body.String())
+	}
+}
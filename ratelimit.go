@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit caps requests and tokens per minute; zero means no limit.
+type RateLimit struct {
+	RPM int `json:"rpm,omitempty"`
+	TPM int `json:"tpm,omitempty"`
+}
+
+func (l RateLimit) isZero() bool {
+	return l.RPM == 0 && l.TPM == 0
+}
+
+// Configured limits, guarded by mu. Keys set their own in the keys file.
+var (
+	globalRateLimit RateLimit
+	modelRateLimits = make(map[string]RateLimit)
+)
+
+// tokenBucket holds the allowance of one scope and unit. It refills
+// continuously, reaching its limit one minute after it was emptied.
+type tokenBucket struct {
+	limit   float64
+	level   float64
+	updated time.Time
+}
+
+// Buckets by scope and unit, e.g. "key:abc:tokens". Guarded by mu.
+var rateBuckets = make(map[string]*tokenBucket)
+
+// rateBucket returns a bucket refilled up to now, created full. A changed limit
+// applies immediately. Must hold mu.
+func rateBucket(name string, limit int, now time.Time) *tokenBucket {
+	b, ok := rateBuckets[name]
+	if !ok {
+		b = &tokenBucket{level: float64(limit), updated: now}
+		rateBuckets[name] = b
+	}
+	b.limit = float64(limit)
+	b.level = math.Min(b.limit, b.level+now.Sub(b.updated).Minutes()*b.limit)
+	b.updated = now
+	return b
+}
+
+// wait returns how long until the bucket holds n.
+func (b *tokenBucket) wait(n float64) time.Duration {
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.limit * float64(time.Minute))
+}
+
+// rateScope is a set of limits shared by requests, e.g. all requests made with
+// one key.
+type rateScope struct {
+	name   string // shown to clients
+	bucket string // prefix of its bucket names
+	limit  RateLimit
+}
+
+// rateScopes returns the limits that apply to a request for model made with
+// key. Must hold mu.
+func rateScopes(key *ProxyKey, model string) []rateScope {
+	var scopes []rateScope
+	if key != nil && !key.RateLimit.isZero() {
+		scopes = append(scopes, rateScope{name: "key " + key.Name, bucket: "key:" + key.ID, limit: key.RateLimit})
+	}
+	if limit, ok := modelRateLimits[model]; ok {
+		scopes = append(scopes, rateScope{name: "model " + model, bucket: "model:" + model, limit: limit})
+	}
+	if !globalRateLimit.isZero() {
+		scopes = append(scopes, rateScope{name: "the proxy", bucket: "global", limit: globalRateLimit})
+	}
+	return scopes
+}
+
+// rateLimitError rejects a request with 429 in OpenAI's format.
+type rateLimitError struct {
+	message    string
+	unit       string // "requests" or "tokens"
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string { return e.message }
+
+// checkRateLimits returns an error if any scope lacks the allowance for one
+// request of tokens, without taking it. Must hold mu.
+func checkRateLimits(scopes []rateScope, tokens int, now time.Time) error {
+	for _, s := range scopes {
+		if s.limit.RPM > 0 {
+			if b := rateBucket(s.bucket+":requests", s.limit.RPM, now); b.level < 1 {
+				return &rateLimitError{
+					message: fmt.Sprintf("Rate limit reached for requests per minute (RPM) on %s: limit %d. Please try again in %s.",
+						s.name, s.limit.RPM, formatResetDuration(b.wait(1))),
+					unit:       "requests",
+					retryAfter: b.wait(1),
+				}
+			}
+		}
+		if s.limit.TPM > 0 {
+			if tokens > s.limit.TPM {
+				return &rateLimitError{
+					message: fmt.Sprintf("Request too large for tokens per minute (TPM) on %s: limit %d, requested %d.",
+						s.name, s.limit.TPM, tokens),
+					unit: "tokens",
+				}
+			}
+			if b := rateBucket(s.bucket+":tokens", s.limit.TPM, now); b.level < float64(tokens) {
+				return &rateLimitError{
+					message: fmt.Sprintf("Rate limit reached for tokens per minute (TPM) on %s: limit %d, requested %d. Please try again in %s.",
+						s.name, s.limit.TPM, tokens, formatResetDuration(b.wait(float64(tokens)))),
+					unit:       "tokens",
+					retryAfter: b.wait(float64(tokens)),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// takeRateLimits takes one request of tokens from every scope. Must hold mu.
+func takeRateLimits(scopes []rateScope, tokens int, now time.Time) {
+	for _, s := range scopes {
+		if s.limit.RPM > 0 {
+			rateBucket(s.bucket+":requests", s.limit.RPM, now).level--
+		}
+		if s.limit.TPM > 0 {
+			rateBucket(s.bucket+":tokens", s.limit.TPM, now).level -= float64(tokens)
+		}
+	}
+}
+
+// settleRateTokens corrects the tokens taken at admission with the tokens a
+// request actually used. A bucket may go below zero, delaying later requests
+// until the difference has refilled. Must hold mu.
+func settleRateTokens(r *Reservation, tokens int) {
+	if !r.rateLimited {
+		return
+	}
+	difference := float64(tokens - r.rateTokens)
+	for _, name := range []string{"key:" + r.KeyID, "model:" + r.Model, "global"} {
+		if b, ok := rateBuckets[name+":tokens"]; ok {
+			b.level -= difference
+		}
+	}
+}
+
+// rateLimitStatus is the tightest allowance of each unit across the scopes of
+// a request, reported in x-ratelimit-* headers.
+type rateLimitStatus map[string]string
+
+// rateLimitHeaders describes the scope with the least remaining allowance of
+// each unit, as OpenAI does. Must hold mu.
+func rateLimitHeaders(scopes []rateScope, now time.Time) rateLimitStatus {
+	headers := make(rateLimitStatus)
+	for _, unit := range []string{"requests", "tokens"} {
+		var tightest *tokenBucket
+		for _, s := range scopes {
+			limit := s.limit.RPM
+			if unit == "tokens" {
+				limit = s.limit.TPM
+			}
+			if limit == 0 {
+				continue
+			}
+			if b := rateBucket(s.bucket+":"+unit, limit, now); tightest == nil || b.level < tightest.level {
+				tightest = b
+			}
+		}
+		if tightest == nil {
+			continue
+		}
+		headers["x-ratelimit-limit-"+unit] = strconv.Itoa(int(tightest.limit))
+		headers["x-ratelimit-remaining-"+unit] = strconv.Itoa(int(math.Max(math.Floor(tightest.level), 0)))
+		headers["x-ratelimit-reset-"+unit] = formatResetDuration(tightest.wait(tightest.limit))
+	}
+	return headers
+}
+
+func (s rateLimitStatus) write(c *gin.Context) {
+	for name, value := range s {
+		c.Header(name, value)
+	}
+}
+
+// formatResetDuration formats a wait like OpenAI's headers, e.g. "6m0s" or "1.5s".
+func formatResetDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+func writeRateLimitError(c *gin.Context, err *rateLimitError) {
+	log.Printf("Request blocked: %s", err.message)
+	if err.retryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(err.retryAfter.Seconds()))))
+	}
+	c.JSON(http.StatusTooManyRequests, APIErrorResponse{Error: APIError{
+		Message: err.message,
+		Type:    err.unit,
+		Code:    "rate_limit_exceeded",
+	}})
+}
+
+// limitRequestRate counts a request that is not charged, such as a moderation
+// check, against the request limits of its scopes. On rejection the 429
+// response has already been written.
+func limitRequestRate(c *gin.Context, key *ProxyKey, model string) bool {
+	now := time.Now()
+	mu.Lock()
+	scopes := rateScopes(key, model)
+	err := checkRateLimits(scopes, 0, now)
+	if err == nil {
+		takeRateLimits(scopes, 0, now)
+	}
+	headers := rateLimitHeaders(scopes, now)
+	mu.Unlock()
+
+	headers.write(c)
+	if err != nil {
+		writeRateLimitError(c, err.(*rateLimitError))
+		return false
+	}
+	return true
+}
+
+// parseModelRateLimits parses comma-separated model=RPM/TPM entries, where
+// an empty or zero value means no limit, e.g. "gpt-4o=500/30000,o3=/10000".
+func parseModelRateLimits(value string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, values, ok := strings.Cut(entry, "=")
+		rpm, tpm, ok2 := strings.Cut(values, "/")
+		if !ok || !ok2 || strings.TrimSpace(model) == "" {
+			return nil, fmt.Errorf("entry %q must be model=RPM/TPM", entry)
+		}
+		var limit RateLimit
+		for _, field := range []struct {
+			text   string
+			target *int
+		}{{rpm, &limit.RPM}, {tpm, &limit.TPM}} {
+			text := strings.TrimSpace(field.text)
+			if text == "" {
+				continue
+			}
+			n, err := strconv.Atoi(text)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("entry %q: limits must be non-negative integers", entry)
+			}
+			*field.target = n
+		}
+		if !limit.isZero() {
+			limits[strings.TrimSpace(model)] = limit
+		}
+	}
+	return limits, nil
+}
+
+// formatModelRateLimits is the inverse of parseModelRateLimits, sorted by model.
+func formatModelRateLimits(limits map[string]RateLimit) []string {
+	entries := make([]string, 0, len(limits))
+	for model, limit := range limits {
+		entries = append(entries, fmt.Sprintf("%s=%d/%d", model, limit.RPM, limit.TPM))
+	}
+	sort.Strings(entries)
+	return entries
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetRateLimits(t *testing.T) {
+	t.Helper()
+	globalRateLimit = RateLimit{}
+	modelRateLimits = make(map[string]RateLimit)
+	rateBuckets = make(map[string]*tokenBucket)
+	t.Cleanup(func() {
+		globalRateLimit = RateLimit{}
+		modelRateLimits = make(map[string]RateLimit)
+		rateBuckets = make(map[string]*tokenBucket)
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	resetRateLimits(t)
+	start := time.Now()
+
+	b := rateBucket("test", 60, start)
+	if b.level != 60 {
+		t.Fatalf("Expected a full bucket, got %f", b.level)
+	}
+	b.level = 0
+	if wait := b.wait(6); wait != 6*time.Second {
+		t.Errorf("Expected 6s wait, got %v", wait)
+	}
+
+	// Refills continuously, up to the limit
+	if b = rateBucket("test", 60, start.Add(30*time.Second)); math.Abs(b.level-30) > 1e-9 {
+		t.Errorf("Expected 30 after half a minute, got %f", b.level)
+	}
+	if b = rateBucket("test", 60, start.Add(5*time.Minute)); b.level != 60 {
+		t.Errorf("Expected bucket capped at its limit, got %f", b.level)
+	}
+	// A lower limit applies immediately
+	if b = rateBucket("test", 10, start.Add(5*time.Minute)); b.level != 10 {
+		t.Errorf("Expected level lowered to the new limit, got %f", b.level)
+	}
+}
+
+func TestParseModelRateLimits(t *testing.T) {
+	limits, err := parseModelRateLimits("gpt-4o=500/30000, o3=/10000,gpt-4o-mini=0/0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(limits) != 2 || limits["gpt-4o"] != (RateLimit{RPM: 500, TPM: 30000}) || limits["o3"] != (RateLimit{TPM: 10000}) {
+		t.Errorf("Unexpected limits: %v", limits)
+	}
+	if entries := formatModelRateLimits(limits); strings.Join(entries, ",") != "gpt-4o=500/30000,o3=0/10000" {
+		t.Errorf("Unexpected format: %v", entries)
+	}
+
+	for _, value := range []string{"gpt-4o", "gpt-4o=500", "=1/1", "gpt-4o=-1/0", "gpt-4o=a/b"} {
+		if _, err := parseModelRateLimits(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestRateLimit_KeyRequests(t *testing.T) {
+	resetGlobalState()
+	resetRateLimits(t)
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	secret, key, _ := store.Create("script", 0)
+	store.SetRateLimit(key.ID, RateLimit{RPM: 2})
+
+	for i := 0; i < 2; i++ {
+		if w := postChat(router, secret); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to pass, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	w := postChat(router, secret)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+	var response APIErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Error.Code != "rate_limit_exceeded" || response.Error.Type != "requests" || !strings.Contains(response.Error.Message, "key script") {
+		t.Errorf("Unexpected error: %s", w.Body.String())
+	}
+	if w.Header().Get("x-ratelimit-limit-requests") != "2" || w.Header().Get("x-ratelimit-remaining-requests") != "0" ||
+		w.Header().Get("x-ratelimit-reset-requests") == "" || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("Unexpected headers: %v", w.Header())
+	}
+	if api.count("POST /v1/chat/completions") != 2 || len(reservations) != 0 {
+		t.Error("Expected limited request not to be forwarded or reserved")
+	}
+
+	// Other clients are not limited by the key
+	if w := postChat(router, "sk-other"); w.Code != http.StatusOK || w.Header().Get("x-ratelimit-limit-requests") != "" {
+		t.Errorf("Expected unlimited request without headers, got %d: %v", w.Code, w.Header())
+	}
+}
+
+func TestRateLimit_ModelTokens(t *testing.T) {
+	resetGlobalState()
+	resetRateLimits(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion) // 10 prompt + 5 completion tokens
+	router := setupTestRouter()
+
+	modelRateLimits["gpt-4o"] = RateLimit{TPM: 40}
+	promptTokens := calculateTokensFromMessages([]ChatMessage{{Role: "user", Content: "Hello"}}, "gpt-4o")
+
+	w := postChat(router, "sk-test")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if remaining := w.Header().Get("x-ratelimit-remaining-tokens"); remaining != strconv.Itoa(40-promptTokens) {
+		t.Errorf("Expected %d remaining tokens after admission, got %s", 40-promptTokens, remaining)
+	}
+
+	// Settlement replaces the estimate with the 15 tokens used
+	mu.Lock()
+	level := rateBuckets["model:gpt-4o:tokens"].level
+	mu.Unlock()
+	if math.Abs(level-25) > 0.1 {
+		t.Errorf("Expected 25 tokens left after settlement, got %f", level)
+	}
+
+	// Requests larger than the limit can never pass
+	modelRateLimits["gpt-4o"] = RateLimit{TPM: 1}
+	w = postChat(router, "sk-test")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "Request too large") || w.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected request too large, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Other models are not limited
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model":"gpt-4o-mini","messages":[{"role":"user","content":"Hello"}]}`))
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected other model to pass, got %d", w.Code)
+	}
+}
+
+func TestRateLimit_BudgetRejectionTakesNothing(t *testing.T) {
+	resetGlobalState()
+	resetRateLimits(t)
+	router := setupTestRouter()
+
+	globalRateLimit = RateLimit{RPM: 5}
+	costLimitUSD = 1e-12 // any estimate exceeds the quota
+	if w := postChat(router, "sk-test"); w.Code != http.StatusTooManyRequests || strings.Contains(w.Body.String(), "rate_limit_exceeded") {
+		t.Fatalf("Expected budget rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	mu.Lock()
+	level := rateBuckets["global:requests"].level
+	mu.Unlock()
+	if level < 5-1e-6 {
+		t.Errorf("Expected rejected request not to take a request, got %f left", level)
+	}
+}
+
+func TestRateLimit_Moderations(t *testing.T) {
+	resetGlobalState()
+	resetRateLimits(t)
+	resetModeration()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/moderations", testModerationClean)
+	router := setupTestRouter()
+
+	globalRateLimit = RateLimit{RPM: 1}
+	postModeration := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/moderations", strings.NewReader(`{"input":"text"}`))
+		req.Header.Set("Authorization", "Bearer sk-test")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := postModeration(); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if w := postModeration(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected moderation to count against the request limit, got %d", w.Code)
+	}
+	if api.count("POST /v1/moderations") != 1 {
+		t.Errorf("Expected 1 moderation call, got %d", api.count("POST /v1/moderations"))
+	}
+}
+
+func TestAdminKeyRateLimit(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	store := setupTestKeyStore(t)
+	router := setupTestRouter()
+	_, key, _ := store.Create("team", 0)
+
+	w := adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/rate-limit", `{"rpm": 60, "tpm": 100000}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"rate_limit":{"rpm":60,"tpm":100000}`) {
+		t.Errorf("Expected rate limit in key status, got %d: %s", w.Code, w.Body.String())
+	}
+	if stored, _ := store.Get(key.ID); stored.RateLimit != (RateLimit{RPM: 60, TPM: 100000}) {
+		t.Errorf("Expected limits to be stored with the key, got %+v", stored.RateLimit)
+	}
+
+	for _, body := range []string{`{"rpm": -1}`, `{"tpm": "many"}`, `not json`} {
+		if w = adminRequest(router, "PUT", "/admin/keys/"+key.ID+"/rate-limit", body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ResponsesRequest holds the fields of a Responses API request the proxy needs.
+// The request body is forwarded to OpenAI unchanged.
+type ResponsesRequest struct {
+	Model           string          `json:"model"`
+	Input           json.RawMessage `json:"input"`
+	Instructions    string          `json:"instructions,omitempty"`
+	MaxOutputTokens *int            `json:"max_output_tokens,omitempty"`
+	Stream          bool            `json:"stream,omitempty"`
+	ServiceTier     string          `json:"service_tier,omitempty"`
+	User            string          `json:"user,omitempty"`
+}
+
+type ResponsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+}
+
+// responseItem is an input or output item; messages carry their text in
+// content, either as a string or as an array of parts.
+type responseItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// responseEvent is a server-sent event of a streamed response.
+type responseEvent struct {
+	Type     string `json:"type"`
+	Delta    string `json:"delta"`
+	Response *struct {
+		ServiceTier string          `json:"service_tier"`
+		Usage       *ResponsesUsage `json:"usage"`
+	} `json:"response"`
+}
+
+// itemText returns the text of a message's content.
+func itemText(content json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(content, &text); err == nil {
+		return text
+	}
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(content, &parts)
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString(part.Text)
+	}
+	return b.String()
+}
+
+// countResponsesInputTokens estimates the prompt tokens of a Responses request.
+// Messages are counted like chat messages; other items (function call outputs,
+// ...) by their JSON.
+func countResponsesInputTokens(reqData ResponsesRequest) (int, error) {
+	var messages []ChatMessage
+	if reqData.Instructions != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: reqData.Instructions})
+	}
+
+	var text string
+	var items []json.RawMessage
+	if err := json.Unmarshal(reqData.Input, &text); err == nil {
+		messages = append(messages, ChatMessage{Role: "user", Content: text})
+	} else if err := json.Unmarshal(reqData.Input, &items); err != nil {
+		return 0, fmt.Errorf("input must be a string or an array of items")
+	}
+
+	other := 0
+	for _, raw := range items {
+		var item responseItem
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return 0, fmt.Errorf("invalid input item: %s", raw)
+		}
+		if item.Type == "message" || (item.Type == "" && item.Role != "") {
+			messages = append(messages, ChatMessage{Role: item.Role, Content: itemText(item.Content)})
+		} else {
+			other += countTokens(string(raw), reqData.Model)
+		}
+	}
+	return calculateTokensFromMessages(messages, reqData.Model) + other, nil
+}
+
+// responseOutputText returns the text of the output items of a response.
+func responseOutputText(output json.RawMessage) string {
+	var items []responseItem
+	json.Unmarshal(output, &items)
+	var b strings.Builder
+	for _, item := range items {
+		if item.Type == "message" {
+			b.WriteString(itemText(item.Content))
+		}
+	}
+	return b.String()
+}
+
+func responsesProxy(c *gin.Context) {
+	proxyKey, upstreamKey, ok := authorizeRequest(c)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	var reqData ResponsesRequest
+	if err == nil {
+		err = json.Unmarshal(body, &reqData)
+	}
+	if err != nil || len(reqData.Input) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+
+	if !checkModel(c, proxyKey, reqData.Model) {
+		return
+	}
+	setRequestUser(c, reqData.User)
+
+	promptTokens, err := countResponsesInputTokens(reqData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Invalid input: %v.", err),
+		})
+		return
+	}
+	if reqData.MaxOutputTokens != nil && *reqData.MaxOutputTokens < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "max_output_tokens must not be negative.",
+		})
+		return
+	}
+	// The output limit covers reasoning tokens too, so it bounds the whole
+	// completion; without one only the input can be estimated
+	outputTokens := 0
+	if reqData.MaxOutputTokens != nil {
+		outputTokens = *reqData.MaxOutputTokens
+	}
+	estimate := calculateCostForTier(promptTokens, outputTokens, reqData.Model, reqData.ServiceTier)
+
+	reservation, ok := reserveRequest(c, proxyKey, reqData.Model, promptTokens, estimate)
+	if !ok {
+		return
+	}
+
+	if reqData.Stream {
+		streamResponse(c, reservation, reqData, body, upstreamKey, promptTokens)
+		return
+	}
+
+	respBody, err := postOpenAI("/v1/responses", "application/json", body, upstreamKey)
+	// Decoded loosely so that fields unknown to the proxy are passed through
+	var response map[string]json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(respBody, &response)
+	}
+	if err != nil {
+		failRequest(c, reservation, promptTokens, err)
+		return
+	}
+
+	var usage *ResponsesUsage
+	json.Unmarshal(response["usage"], &usage)
+	var serviceTier string
+	json.Unmarshal(response["service_tier"], &serviceTier)
+
+	proxyUsage := chargeResponse(c, reservation, reqData, promptTokens, usage, serviceTier, responseOutputText(response["output"]))
+	response["proxy_usage"], _ = json.Marshal(proxyUsage)
+	c.JSON(http.StatusOK, response)
+}
+
+// streamResponse relays server-sent events as they arrive and charges the
+// request from the usage of the final event. The cost is sent in trailers.
+func streamResponse(c *gin.Context, reservation *Reservation, reqData ResponsesRequest, body []byte, upstreamKey string, promptTokens int) {
+	resp, err := openOpenAIStream(c.Request.Context(), "/v1/responses", body, upstreamKey)
+	if err != nil {
+		failRequest(c, reservation, promptTokens, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var (
+		usage       *ResponsesUsage
+		serviceTier string
+		outputText  strings.Builder
+	)
+	relayStream(c, resp, reqData.Model, func(data []byte) {
+		var event responseEvent
+		if json.Unmarshal(data, &event) != nil {
+			return
+		}
+		switch {
+		case event.Type == "response.output_text.delta":
+			outputText.WriteString(event.Delta)
+		case event.Response != nil && event.Response.Usage != nil:
+			usage = event.Response.Usage
+			serviceTier = event.Response.ServiceTier
+		}
+	})
+
+	chargeResponse(c, reservation, reqData, promptTokens, usage, serviceTier, outputText.String())
+	writeQuotaTrailers(c)
+}
+
+// relayStream copies server-sent events to the client as they arrive, passing
+// the data of each event to handle. The quota trailers are declared so the
+// caller can write them once the stream has been charged.
+func relayStream(c *gin.Context, resp *http.Response, model string, handle func(data []byte)) {
+	declareQuotaTrailers(c)
+	c.Header("Content-Type", resp.Header.Get("Content-Type"))
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			c.Writer.Write(line)
+			if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+				handle(bytes.TrimSpace(data))
+			}
+			// Events end with a blank line
+			if len(bytes.TrimSpace(line)) == 0 {
+				c.Writer.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Stream interrupted: model=%s, error=%v", model, err)
+			}
+			break
+		}
+	}
+	c.Writer.Flush()
+}
+
+// chargeResponse charges a response from its usage, or from the counted
+// prompt and output text when OpenAI reported none.
+func chargeResponse(c *gin.Context, reservation *Reservation, reqData ResponsesRequest, promptTokens int, usage *ResponsesUsage, serviceTier, outputText string) *ProxyUsage {
+	var cachedTokens, completionTokens, reasoningTokens int
+	if usage != nil && (usage.InputTokens > 0 || usage.OutputTokens > 0) {
+		promptTokens = usage.InputTokens
+		cachedTokens = usage.InputTokensDetails.CachedTokens
+		completionTokens = usage.OutputTokens
+		reasoningTokens = usage.OutputTokensDetails.ReasoningTokens
+	} else {
+		completionTokens = countTokens(outputText, reqData.Model)
+	}
+
+	// The response reports the tier that actually served the request
+	if serviceTier == "" {
+		serviceTier = reqData.ServiceTier
+	}
+
+	cost := calculateCostWithCache(promptTokens, cachedTokens, completionTokens, reqData.Model, serviceTier)
+	proxyUsage := chargeRequest(c, reservation, promptTokens, completionTokens, cost, serviceTier)
+	proxyUsage.CachedTokens = cachedTokens
+	proxyUsage.ReasoningTokens = reasoningTokens
+	return proxyUsage
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postResponses(router http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/responses", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCountResponsesInputTokens(t *testing.T) {
+	resetGlobalState()
+	model := "gpt-4o"
+	single := calculateTokensFromMessages([]ChatMessage{{Role: "user", Content: "Hello there"}}, model)
+
+	// A string input counts like one user message
+	tokens, err := countResponsesInputTokens(ResponsesRequest{Model: model, Input: json.RawMessage(`"Hello there"`)})
+	if err != nil || tokens != single {
+		t.Errorf("Expected %d tokens for string input, got %d (%v)", single, tokens, err)
+	}
+
+	// Messages with content parts count like the same chat messages
+	tokens, err = countResponsesInputTokens(ResponsesRequest{
+		Model:        model,
+		Instructions: "Be brief",
+		Input:        json.RawMessage(`[{"role":"user","content":[{"type":"input_text","text":"Hello "},{"type":"input_text","text":"there"}]}]`),
+	})
+	expected := calculateTokensFromMessages([]ChatMessage{{Role: "system", Content: "Be brief"}, {Role: "user", Content: "Hello there"}}, model)
+	if err != nil || tokens != expected {
+		t.Errorf("Expected %d tokens for item input, got %d (%v)", expected, tokens, err)
+	}
+
+	// Other items are counted by their JSON
+	output := `{"type":"function_call_output","call_id":"call_1","output":"42"}`
+	tokens, _ = countResponsesInputTokens(ResponsesRequest{Model: model, Input: json.RawMessage("[" + output + "]")})
+	if tokens != calculateTokensFromMessages(nil, model)+countTokens(output, model) {
+		t.Errorf("Unexpected token count for function call output: %d", tokens)
+	}
+
+	if _, err := countResponsesInputTokens(ResponsesRequest{Model: model, Input: json.RawMessage(`42`)}); err == nil {
+		t.Error("Expected error for numeric input")
+	}
+}
+
+func TestResponsesProxy(t *testing.T) {
+	resetGlobalState()
+	modelPricing["gpt-4o"] = ModelPricing{Model: "gpt-4o", Input: 2.5, CachedInput: 1.25, Output: 10.0}
+	mockOpenAIRaw(t, `{"id":"resp_1","object":"response","status":"completed","output":[{"type":"message","role":"assistant","content":[{"type":"output_text","text":"Hi!"}]}],
+		"usage":{"input_tokens":1000,"input_tokens_details":{"cached_tokens":400},"output_tokens":300,"output_tokens_details":{"reasoning_tokens":200},"total_tokens":1300}}`)
+	router := setupTestRouter()
+
+	w := postResponses(router, `{"model":"gpt-4o","input":"Hello","store":false}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		ID         string     `json:"id"`
+		Status     string     `json:"status"`
+		ProxyUsage ProxyUsage `json:"proxy_usage"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.ID != "resp_1" || response.Status != "completed" {
+		t.Errorf("Response not passed through: %s", w.Body.String())
+	}
+
+	// 600 uncached tokens at $2.5, 400 cached at $1.25 and 300 output at $10 per 1M
+	expected := (600*2.5 + 400*1.25 + 300*10.0) / 1000000
+	pu := response.ProxyUsage
+	if pu.PromptTokens != 1000 || pu.CompletionTokens != 300 || pu.CachedTokens != 400 || pu.ReasoningTokens != 200 {
+		t.Errorf("Unexpected proxy usage: %+v", pu)
+	}
+	if pu.CostUSD != expected || totalCost != expected {
+		t.Errorf("Expected cost %f, got %f (total %f)", expected, pu.CostUSD, totalCost)
+	}
+}
+
+func TestResponsesProxy_OutputLimitEstimate(t *testing.T) {
+	resetGlobalState()
+	mockOpenAIRaw(t, `{"id":"resp_1","object":"response","status":"completed","output":[],"usage":{"input_tokens":10,"output_tokens":5}}`)
+	router := setupTestRouter()
+
+	// $10 per 1M output tokens: the worst case is over the $2 limit
+	w := postResponses(router, `{"model":"gpt-4o","input":"Hello","max_output_tokens":1000000}`)
+	if w.Code != http.StatusTooManyRequests || totalCost != 0 {
+		t.Errorf("Expected status 429 without a charge, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postResponses(router, `{"model":"gpt-4o","input":"Hello","max_output_tokens":-1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a negative limit, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postResponses(router, `{"model":"gpt-4o","input":"Hello","max_output_tokens":1000}`); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestResponsesProxy_Streaming(t *testing.T) {
+	resetGlobalState()
+	events := []string{
+		`{"type":"response.created","response":{"id":"resp_1","status":"in_progress"}}`,
+		`{"type":"response.output_text.delta","delta":"Hi"}`,
+		`{"type":"response.output_text.delta","delta":"!"}`,
+		`{"type":"response.completed","response":{"id":"resp_1","status":"completed","service_tier":"default","usage":{"input_tokens":1000,"output_tokens":500}}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"stream":true`) {
+			t.Errorf("Expected stream request, got %s", body)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			var e struct{ Type string }
+			json.Unmarshal([]byte(event), &e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() {
+		openAIBaseURL = previous
+		server.Close()
+	}()
+	router := setupTestRouter()
+
+	w := postResponses(router, `{"model":"gpt-4o","input":"Hello","stream":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/event-stream" || strings.Count(w.Body.String(), "data: ") != len(events) {
+		t.Errorf("Expected events to be relayed, got:\n%s", w.Body.String())
+	}
+
+	// 1000 input tokens at $2.5 and 500 output tokens at $10 per 1M
+	expected := 0.0075
+	if totalCost != expected {
+		t.Errorf("Expected total cost %f, got %f", expected, totalCost)
+	}
+	// The cost is known only at the end of the stream and is sent as a trailer
+	result := w.Result()
+	if result.Trailer.Get("X-Request-Cost-USD") != "0.007500" {
+		t.Errorf("Unexpected X-Request-Cost-USD trailer: %q", result.Trailer.Get("X-Request-Cost-USD"))
+	}
+	if result.Header.Get("X-Quota-Limit-USD") == "" {
+		t.Error("Expected quota headers at the start of the stream")
+	}
+}
+
+func TestResponsesProxy_StreamWithoutUsage(t *testing.T) {
+	resetGlobalState()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"type\":\"response.output_text.delta\",\"delta\":\"Hello world\"}\n\n")
+	}))
+	previous := openAIBaseURL
+	openAIBaseURL = server.URL
+	defer func() {
+		openAIBaseURL = previous
+		server.Close()
+	}()
+	router := setupTestRouter()
+
+	w := postResponses(router, `{"model":"gpt-4o","input":"Hello","stream":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	// Without usage the prompt and the streamed text are counted
+	promptTokens := calculateTokensFromMessages([]ChatMessage{{Role: "user", Content: "Hello"}}, "gpt-4o")
+	expected := calculateCost(promptTokens, countTokens("Hello world", "gpt-4o"), "gpt-4o")
+	if totalCost != expected {
+		t.Errorf("Expected total cost %f, got %f", expected, totalCost)
+	}
+	if len(reservations) != 0 {
+		t.Errorf("Expected reservation to be settled, got %d", len(reservations))
+	}
+}
@@ -185,7 +185,7 @@ fi
 log_and_display "${PURPLE}=== 10. INTEGRATION TESTS ===${NC}"
 
 # Test if we can start the server briefly
-run_and_capture "timeout 5s go run main.go -quota 1.0 -port 0 || true" "Server startup test"
+run_and_capture "timeout 5s go run . -quota 1.0 -port 0 || true" "Server startup test"
 
 # 11. Final Summary
 log_and_display "${PURPLE}=== 11. FINAL SUMMARY ===${NC}"
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tags attribute the cost of a request to projects, features or environments
+// for chargeback. Clients send them as name=value pairs in the X-Proxy-Tags
+// header; together with OpenAI's user field they are recorded with the
+// request in the ledger, and tags can have budgets of their own.
+
+// Header a client sets to tag a request, e.g. "project=search,env=staging"
+const tagsHeader = "X-Proxy-Tags"
+
+// Context keys of the attribution of a request
+const (
+	contextTags = "tags"
+	contextUser = "user"
+)
+
+const (
+	maxTags           = 16
+	maxTagValueLength = 128
+)
+
+var tagNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// The tag schema: allowed values by tag name, where "*" allows any value, and
+// the tags every charged request must carry. Without a schema any well-formed
+// tag is accepted.
+var (
+	tagSchema    map[string][]string
+	requiredTags []string
+)
+
+// Tag budgets by "name:value", and the spend of every tag restored from the
+// ledger at startup, guarded by mu.
+var (
+	tagBudgets = make(map[string]float64)
+	tagSpend   = make(map[string]float64)
+)
+
+func tagKey(name, value string) string {
+	return name + ":" + value
+}
+
+// parseTags parses the X-Proxy-Tags header.
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, tagValue, ok := strings.Cut(pair, "=")
+		name, tagValue = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(tagValue)
+		if !ok || !tagNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%q must be name=value with a lowercase name", pair)
+		}
+		if tagValue == "" || len(tagValue) > maxTagValueLength || strings.ContainsAny(tagValue, "=:") {
+			return nil, fmt.Errorf("tag %s must have a value of at most %d characters without = or :", name, maxTagValueLength)
+		}
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("tag %s is given twice", name)
+		}
+		tags[name] = tagValue
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return tags, nil
+}
+
+// checkTagSchema checks tags against the schema and the required tags.
+func checkTagSchema(tags map[string]string) error {
+	for _, name := range requiredTags {
+		if _, ok := tags[name]; !ok {
+			return fmt.Errorf("tag %s is required", name)
+		}
+	}
+	if len(tagSchema) == 0 {
+		return nil
+	}
+	for name, value := range tags {
+		allowed, ok := tagSchema[name]
+		if !ok {
+			return fmt.Errorf("unknown tag %s", name)
+		}
+		if !slices.Contains(allowed, "*") && !slices.Contains(allowed, value) {
+			return fmt.Errorf("tag %s must be one of %s", name, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// resolveTags sets the tags of a charged request from the X-Proxy-Tags
+// header. On failure the 400 response has already been written.
+func resolveTags(c *gin.Context) bool {
+	tags, err := parseTags(c.GetHeader(tagsHeader))
+	if err == nil {
+		err = checkTagSchema(tags)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Invalid %s header: %s.", tagsHeader, err),
+		})
+		return false
+	}
+	if len(tags) > 0 {
+		c.Set(contextTags, tags)
+	}
+	return true
+}
+
+// requestTags returns the tags resolveTags set for a request, or nil.
+func requestTags(c *gin.Context) map[string]string {
+	tags, _ := c.Get(contextTags)
+	t, _ := tags.(map[string]string)
+	return t
+}
+
+// setRequestUser records OpenAI's user field of a request for attribution.
+func setRequestUser(c *gin.Context, user string) {
+	if user != "" {
+		c.Set(contextUser, user)
+	}
+}
+
+// hasTags reports whether tags include every tag of filter.
+func hasTags(tags, filter map[string]string) bool {
+	for name, value := range filter {
+		if v, ok := tags[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// tagReservedCost sums the reservations of requests with a tag. Must hold mu.
+func tagReservedCost(name, value string) float64 {
+	reserved := 0.0
+	for _, r := range reservations {
+		if v, ok := r.Tags[name]; ok && v == value {
+			reserved += r.CostUSD
+		}
+	}
+	return reserved
+}
+
+// checkTagBudgets rejects a request with tags estimated to cost estimate if
+// any of its tags lacks the headroom. Must hold mu.
+func checkTagBudgets(tags map[string]string, estimate float64) error {
+	for name, value := range tags {
+		tag := tagKey(name, value)
+		budget := tagBudgets[tag]
+		if budget <= 0 {
+			continue
+		}
+		if tagSpend[tag] >= budget {
+			log.Printf("Request blocked: budget of tag %s exceeded, spent=$%.6f, budget=$%.6f", tag, tagSpend[tag], budget)
+			return budgetError(fmt.Sprintf("Cost limit of tag %s exceeded.", tag))
+		}
+		reserved := tagReservedCost(name, value)
+		if tagSpend[tag]+reserved+estimate >= budget {
+			log.Printf("Request blocked: prompt would exceed budget of tag %s, prompt_cost=$%.6f, spent=$%.6f, reserved=$%.6f, budget=$%.6f",
+				tag, estimate, tagSpend[tag], reserved, budget)
+			return budgetError(fmt.Sprintf("Request would exceed cost limit of tag %s.", tag))
+		}
+	}
+	return nil
+}
+
+// chargeTags adds the cost of a request to each of its tags. Must hold mu.
+func chargeTags(tags map[string]string, cost float64) {
+	for name, value := range tags {
+		tagSpend[tagKey(name, value)] += cost
+	}
+}
+
+// tagBudgetStatus describes the tag budgets, sorted by tag. Must hold mu.
+func tagBudgetStatus() []gin.H {
+	tags := make([]string, 0, len(tagBudgets))
+	for tag := range tagBudgets {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	status := make([]gin.H, 0, len(tags))
+	for _, tag := range tags {
+		name, value, _ := strings.Cut(tag, ":")
+		status = append(status, gin.H{
+			"tag":          tag,
+			"budget_usd":   tagBudgets[tag],
+			"spent_usd":    tagSpend[tag],
+			"reserved_usd": tagReservedCost(name, value),
+		})
+	}
+	return status
+}
+
+// parseTagSchema parses comma-separated name=value|value entries, e.g.
+// "project=*,env=staging|production"; a name alone allows any value.
+func parseTagSchema(value string) (map[string][]string, error) {
+	schema := make(map[string][]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, list, ok := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !tagNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("entry %q: invalid tag name %q", entry, name)
+		}
+		values := []string{"*"}
+		if ok {
+			values = nil
+			for _, v := range strings.Split(list, "|") {
+				if v = strings.TrimSpace(v); v == "" || strings.ContainsAny(v, "=:") {
+					return nil, fmt.Errorf("entry %q must be name=value|value", entry)
+				}
+				values = append(values, v)
+			}
+		}
+		schema[name] = values
+	}
+	return schema, nil
+}
+
+// formatTagSchema is the inverse of parseTagSchema, sorted by name.
+func formatTagSchema(schema map[string][]string) []string {
+	entries := make([]string, 0, len(schema))
+	for name, values := range schema {
+		entries = append(entries, name+"="+strings.Join(values, "|"))
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// parseTagNames parses comma-separated tag names.
+func parseTagNames(value string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !tagNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid tag name %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// parseTagBudgets parses comma-separated name:value=USD entries, e.g.
+// "env:staging=20,project:search=100".
+func parseTagBudgets(value string) (map[string]float64, error) {
+	budgets := make(map[string]float64)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tag, amount, ok := strings.Cut(entry, "=")
+		name, tagValue, ok2 := strings.Cut(strings.TrimSpace(tag), ":")
+		name, tagValue = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(tagValue)
+		if !ok || !ok2 || !tagNamePattern.MatchString(name) || tagValue == "" {
+			return nil, fmt.Errorf("entry %q must be name:value=USD", entry)
+		}
+		budget, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if err != nil || math.IsNaN(budget) || math.IsInf(budget, 0) || budget < 0 {
+			return nil, fmt.Errorf("entry %q: budget must be a non-negative amount in USD", entry)
+		}
+		budgets[tagKey(name, tagValue)] = budget
+	}
+	return budgets, nil
+}
+
+// formatTagBudgets is the inverse of parseTagBudgets, sorted by tag.
+func formatTagBudgets(budgets map[string]float64) []string {
+	entries := make([]string, 0, len(budgets))
+	for tag, budget := range budgets {
+		entries = append(entries, tag+"="+strconv.FormatFloat(budget, 'f', -1, 64))
+	}
+	sort.Strings(entries)
+	return entries
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetTags(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		tagSchema = nil
+		requiredTags = nil
+		tagBudgets = make(map[string]float64)
+		tagSpend = make(map[string]float64)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// postTaggedChat is postChat with the X-Proxy-Tags header and a user field.
+func postTaggedChat(router http.Handler, apiKey, tags, user string) *httptest.ResponseRecorder {
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}],"user":"` + user + `"}`
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set(tagsHeader, tags)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestTagParsing(t *testing.T) {
+	tags, err := parseTags(" Project=search, env = staging ,")
+	if err != nil || len(tags) != 2 || tags["project"] != "search" || tags["env"] != "staging" {
+		t.Errorf("Unexpected tags %v: %v", tags, err)
+	}
+	for _, value := range []string{"project", "=search", "project=", "project=a=b", "project=a,project=b", "-x=1"} {
+		if _, err := parseTags(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+
+	schema, err := parseTagSchema("project, env=staging|production")
+	if err != nil || len(schema) != 2 || schema["project"][0] != "*" || len(schema["env"]) != 2 {
+		t.Errorf("Unexpected schema %v: %v", schema, err)
+	}
+	if entries := formatTagSchema(schema); strings.Join(entries, ",") != "env=staging|production,project=*" {
+		t.Errorf("Unexpected format: %v", entries)
+	}
+	if _, err := parseTagSchema("env=staging||production"); err == nil {
+		t.Error("Expected error for an empty value")
+	}
+
+	budgets, err := parseTagBudgets("env:staging=20, Project:search=100")
+	if err != nil || budgets["env:staging"] != 20 || budgets["project:search"] != 100 {
+		t.Errorf("Unexpected budgets %v: %v", budgets, err)
+	}
+	if entries := formatTagBudgets(budgets); strings.Join(entries, ",") != "env:staging=20,project:search=100" {
+		t.Errorf("Unexpected format: %v", entries)
+	}
+	for _, value := range []string{"env=20", "env:=20", "env:staging=-1", "env:staging"} {
+		if _, err := parseTagBudgets(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestTagSchema(t *testing.T) {
+	resetGlobalState()
+	resetTags(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	tagSchema = map[string][]string{"project": {"*"}, "env": {"staging", "production"}}
+	requiredTags = []string{"project"}
+
+	for tags, want := range map[string]string{
+		"env=staging":                  "tag project is required",
+		"project=search,env=dev":       "tag env must be one of staging, production",
+		"project=search,team=platform": "unknown tag team",
+		"project=search;env=staging":   "without = or :",
+	} {
+		w := postTaggedChat(router, "sk-test", tags, "")
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected %q for %q, got %d: %s", want, tags, w.Code, w.Body.String())
+		}
+	}
+	if w := postTaggedChat(router, "sk-test", "project=search,env=staging", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Requests that cost nothing need no tags
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer sk-test")
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected untagged free request to pass, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTags_RecordedInLedger(t *testing.T) {
+	resetGlobalState()
+	resetTags(t)
+	ledgerFile := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(ledgerFile)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	ledger = l
+	defer func() {
+		ledger = nil
+		l.Close()
+	}()
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	if w := postTaggedChat(router, "sk-test", "project=search,env=staging", "user-42"); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	entries, err := readLedger(ledgerFile)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 ledger entry, got %d: %v", len(entries), err)
+	}
+	if e := entries[0]; e.Tags["project"] != "search" || e.Tags["env"] != "staging" || e.User != "user-42" {
+		t.Errorf("Unexpected ledger entry: %+v", e)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if tagSpend["env:staging"] != entries[0].CostUSD || tagSpend["project:search"] != entries[0].CostUSD {
+		t.Errorf("Expected the cost charged to each tag, got %v", tagSpend)
+	}
+}
+
+func TestTagBudgets(t *testing.T) {
+	resetGlobalState()
+	resetTags(t)
+	setupTestAdmin(t)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	tagBudgets["env:staging"] = 0.5
+	mu.Lock()
+	tagSpend["env:staging"] = 0.5
+	mu.Unlock()
+
+	w := postTaggedChat(router, "sk-test", "env=staging", "")
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "Cost limit of tag env:staging exceeded.") {
+		t.Errorf("Expected tag budget rejection, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := postTaggedChat(router, "sk-test", "env=production", ""); w.Code != http.StatusOK {
+		t.Errorf("Expected other tag values to pass, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = adminRequest(router, "GET", "/admin/budget", "")
+	if !strings.Contains(w.Body.String(), `"tag_budgets":[{"budget_usd":0.5,"reserved_usd":0,"spent_usd":0.5,"tag":"env:staging"}]`) {
+		t.Errorf("Expected tag budgets in budget status, got %s", w.Body.String())
+	}
+}
+
+func TestTagSpend_RestoredFromLedger(t *testing.T) {
+	resetTags(t)
+	keySpend = make(map[string]float64)
+	t.Cleanup(func() { keySpend = make(map[string]float64) })
+
+	now := time.Now().UTC()
+	restoreKeySpend([]LedgerEntry{
+		{Time: now, Model: "gpt-4o", CostUSD: 1, Tags: map[string]string{"env": "staging"}},
+		{Time: now, KeyID: "key_1", Model: "gpt-4o", CostUSD: 2, Tags: map[string]string{"env": "staging", "project": "search"}},
+		{Time: now, Type: ledgerEntryReset, KeyID: "key_1"},
+	})
+	if tagSpend["env:staging"] != 3 || tagSpend["project:search"] != 2 {
+		t.Errorf("Unexpected tag spend: %v", tagSpend)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// Encodings are loaded from rank files embedded in the binary, named as
+// published by OpenAI, so the proxy never downloads them at runtime. make build
+// fetches them into encodings/ (make encodings) before compiling.
+const (
+	encodingsURL = "https://openaipublic.blob.core.windows.net/encodings/"
+	o200kBase    = "o200k_base"
+)
+
+//go:embed encodings
+var bundledEncodings embed.FS
+
+// encodingsDir, when set, holds rank files (<encoding>.tiktoken) read instead
+// of the embedded ones.
+var encodingsDir string
+
+// encodingSpec describes how an encoding splits and ranks text.
+type encodingSpec struct {
+	file          string
+	pattern       string
+	specialTokens map[string]int
+}
+
+const (
+	gpt2Pattern   = `'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+`
+	cl100kPattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+	o200kPattern  = `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+(?!\S)|\s+`
+)
+
+var encodingSpecs = map[string]encodingSpec{
+	o200kBase: {file: "o200k_base.tiktoken", pattern: o200kPattern,
+		specialTokens: map[string]int{tiktoken.ENDOFTEXT: 199999, tiktoken.ENDOFPROMPT: 200018}},
+	tiktoken.MODEL_CL100K_BASE: {file: "cl100k_base.tiktoken", pattern: cl100kPattern,
+		specialTokens: map[string]int{tiktoken.ENDOFTEXT: 100257, tiktoken.FIM_PREFIX: 100258, tiktoken.FIM_MIDDLE: 100259, tiktoken.FIM_SUFFIX: 100260, tiktoken.ENDOFPROMPT: 100276}},
+	tiktoken.MODEL_P50K_BASE: {file: "p50k_base.tiktoken", pattern: gpt2Pattern,
+		specialTokens: map[string]int{tiktoken.ENDOFTEXT: 50256}},
+	tiktoken.MODEL_P50K_EDIT: {file: "p50k_base.tiktoken", pattern: gpt2Pattern,
+		specialTokens: map[string]int{tiktoken.ENDOFTEXT: 50256, tiktoken.FIM_PREFIX: 50281, tiktoken.FIM_MIDDLE: 50282, tiktoken.FIM_SUFFIX: 50283}},
+	tiktoken.MODEL_R50K_BASE: {file: "r50k_base.tiktoken", pattern: gpt2Pattern,
+		specialTokens: map[string]int{tiktoken.ENDOFTEXT: 50256}},
+}
+
+// o200kModelPrefixes are the model families that use o200k_base, which
+// tiktoken-go does not map yet.
+var o200kModelPrefixes = []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "chatgpt-4o", "o1", "o3", "o4", "gpt-image", "omni-moderation"}
+
+// bundledBpeLoader reads rank files by the file name of their published URL,
+// from encodingsDir when set and from the embedded files otherwise.
+type bundledBpeLoader struct{}
+
+func (bundledBpeLoader) LoadTiktokenBpe(url string) (map[string]int, error) {
+	if encodingsDir != "" {
+		data, err := os.ReadFile(filepath.Join(encodingsDir, path.Base(url)))
+		if err != nil {
+			return nil, err
+		}
+		return parseBpeRanks(data)
+	}
+	data, err := bundledEncodings.ReadFile("encodings/" + path.Base(url))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s is not bundled; fetch it with \"make encodings\" and rebuild", path.Base(url))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseBpeRanks(data)
+}
+
+// encodingsSource describes where rank files are read from, for logs.
+func encodingsSource() string {
+	if encodingsDir != "" {
+		return encodingsDir
+	}
+	return "the binary"
+}
+
+// parseBpeRanks parses a .tiktoken file: a base64 token and its rank per line.
+func parseBpeRanks(data []byte) (map[string]int, error) {
+	ranks := make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(line, " ")
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		value, rankErr := strconv.Atoi(rank)
+		if !ok || err != nil || rankErr != nil {
+			return nil, fmt.Errorf("line %d: expected a base64 token and a rank", i+1)
+		}
+		ranks[string(decoded)] = value
+	}
+	return ranks, nil
+}
+
+// bpeLoader loads the ranks of every encoding.
+var bpeLoader tiktoken.BpeLoader = bundledBpeLoader{}
+
+// Encoders are built once per encoding and shared by all requests; a failed
+// load is cached too, so it is reported once and not retried per request.
+type cachedEncoder struct {
+	enc *tiktoken.Tiktoken
+	err error
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = make(map[string]cachedEncoder)
+)
+
+// encodingName returns the name of the encoding a model tokenizes with;
+// unknown models are counted with cl100k_base.
+func encodingName(model string) string {
+	for _, prefix := range o200kModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return o200kBase
+		}
+	}
+	if name, ok := tiktoken.MODEL_TO_ENCODING[model]; ok {
+		return name
+	}
+	for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if strings.HasPrefix(model, prefix) {
+			return name
+		}
+	}
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+func loadEncoder(name string) (*tiktoken.Tiktoken, error) {
+	spec, ok := encodingSpecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %s", name)
+	}
+	ranks, err := bpeLoader.LoadTiktokenBpe(encodingsURL + spec.file)
+	if err != nil {
+		return nil, err
+	}
+	bpe, err := tiktoken.NewCoreBPE(ranks, spec.specialTokens, spec.pattern)
+	if err != nil {
+		return nil, err
+	}
+	specialTokens := make(map[string]any, len(spec.specialTokens))
+	for token := range spec.specialTokens {
+		specialTokens[token] = true
+	}
+	encoding := &tiktoken.Encoding{Name: name, PatStr: spec.pattern, MergeableRanks: ranks, SpecialTokens: spec.specialTokens}
+	return tiktoken.NewTiktoken(bpe, encoding, specialTokens), nil
+}
+
+// encoderFor returns the cached encoder of an encoding, loading it on first
+// use.
+func encoderFor(name string) (*tiktoken.Tiktoken, error) {
+	encodersMu.RLock()
+	cached, ok := encoders[name]
+	encodersMu.RUnlock()
+	if ok {
+		return cached.enc, cached.err
+	}
+
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	if cached, ok := encoders[name]; ok {
+		return cached.enc, cached.err
+	}
+	enc, err := loadEncoder(name)
+	if err != nil {
+		log.Printf("Warning: cannot load %s encoding from %s: %v", name, encodingsSource(), err)
+	}
+	encoders[name] = cachedEncoder{enc: enc, err: err}
+	return enc, err
+}
+
+// loadEncoders loads every encoding at startup, so the first requests are not
+// slowed down and missing rank files are reported early. The error joins the
+// failure of each encoding that could not be loaded.
+func loadEncoders() error {
+	names := make([]string, 0, len(encodingSpecs))
+	for name := range encodingSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if _, err := encoderFor(name); err != nil {
+			errs = append(errs, fmt.Errorf("cannot load %s encoding from %s: %w", name, encodingsSource(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// countTokens counts text with the model's encoding, falling back to
+// cl100k_base and then to approximateTokens when rank files are missing.
+// It takes no lock shared with request accounting.
+func countTokens(text, model string) int {
+	enc, err := encoderFor(encodingName(model))
+	if err != nil {
+		enc, err = encoderFor(tiktoken.MODEL_CL100K_BASE)
+	}
+	if err != nil {
+		return approximateTokens(text)
+	}
+	return len(enc.Encode(text, nil, nil))
+}
+
+// approximateTokens estimates text at about 4 bytes per token, OpenAI's rule
+// of thumb for English.
+func approximateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// chatFormat describes how a model family renders chat requests into prompt
+// tokens.
+type chatFormat struct {
+	prefix           string
+	tokensPerMessage int // wrapping every message
+	tokensPerName    int // added when a message has a name
+	functionInit     int // opening every tool definition
+}
+
+// Every request ends with tokens priming the assistant's reply.
+const replyPrimingTokens = 3
+
+// Tool definitions are rendered as a namespace of typed functions; these are
+// the overheads shared by all model families.
+const (
+	toolPropertiesInit = 3
+	toolPropertyKey    = 3
+	toolEnumInit       = -3
+	toolEnumItem       = 3
+	toolsEnd           = 12
+)
+
+// chatFormats by model prefix; the longest matching prefix applies and other
+// models use defaultChatFormat.
+var chatFormats = []chatFormat{
+	{prefix: "gpt-3.5-turbo-0301", tokensPerMessage: 4, tokensPerName: -1, functionInit: 10},
+	{prefix: "gpt-3.5-turbo", tokensPerMessage: 3, tokensPerName: 1, functionInit: 10},
+	{prefix: "gpt-4", tokensPerMessage: 3, tokensPerName: 1, functionInit: 10},
+	{prefix: "gpt-4o", tokensPerMessage: 3, tokensPerName: 1, functionInit: 7},
+	{prefix: "gpt-4.1", tokensPerMessage: 3, tokensPerName: 1, functionInit: 7},
+	{prefix: "gpt-4.5", tokensPerMessage: 3, tokensPerName: 1, functionInit: 7},
+}
+
+var defaultChatFormat = chatFormat{tokensPerMessage: 3, tokensPerName: 1, functionInit: 7}
+
+func chatFormatFor(model string) chatFormat {
+	format := defaultChatFormat
+	for _, f := range chatFormats {
+		if strings.HasPrefix(model, f.prefix) && len(f.prefix) > len(format.prefix) {
+			format = f
+		}
+	}
+	return format
+}
+
+func calculateTokensFromMessages(messages []ChatMessage, model string) int {
+	format := chatFormatFor(model)
+	totalTokens := 0
+	for _, msg := range messages {
+		totalTokens += format.tokensPerMessage + countTokens(msg.Role, model) + countTokens(msg.Content, model)
+		if msg.Name != "" {
+			totalTokens += countTokens(msg.Name, model) + format.tokensPerName
+		}
+	}
+	return totalTokens + replyPrimingTokens
+}
+
+// functionDefinition holds the parts of a tool definition that are rendered
+// into the prompt.
+type functionDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  struct {
+		Properties map[string]struct {
+			Type        interface{}   `json:"type"`
+			Description string        `json:"description"`
+			Enum        []interface{} `json:"enum"`
+		} `json:"properties"`
+	} `json:"parameters"`
+}
+
+// countFunctionTokens estimates the prompt tokens of the tool definitions of a
+// chat request, in tools or in the legacy functions field.
+func countFunctionTokens(tools, functions interface{}, model string) int {
+	var toolDefs []struct {
+		Function *functionDefinition `json:"function"`
+	}
+	if data, err := json.Marshal(tools); err == nil {
+		json.Unmarshal(data, &toolDefs)
+	}
+	var defs []functionDefinition
+	if data, err := json.Marshal(functions); err == nil {
+		json.Unmarshal(data, &defs)
+	}
+	for _, tool := range toolDefs {
+		if tool.Function != nil {
+			defs = append(defs, *tool.Function)
+		}
+	}
+	if len(defs) == 0 {
+		return 0
+	}
+
+	format := chatFormatFor(model)
+	total := 0
+	for _, f := range defs {
+		total += format.functionInit + countTokens(f.Name+":"+strings.TrimSuffix(f.Description, "."), model)
+		if len(f.Parameters.Properties) == 0 {
+			continue
+		}
+		total += toolPropertiesInit
+		for name, property := range f.Parameters.Properties {
+			total += toolPropertyKey
+			if property.Enum != nil {
+				total += toolEnumInit
+				for _, item := range property.Enum {
+					total += toolEnumItem + countTokens(fmt.Sprint(item), model)
+				}
+			}
+			propertyType, ok := property.Type.(string)
+			if !ok {
+				data, _ := json.Marshal(property.Type)
+				propertyType = string(data)
+			}
+			total += countTokens(name+":"+propertyType+":"+strings.TrimSuffix(property.Description, "."), model)
+		}
+	}
+	return total + toolsEnd
+}
+
+// countChatTokens estimates the prompt tokens of a chat request: its messages
+// and tool definitions.
+func countChatTokens(reqData ChatRequest) int {
+	return calculateTokensFromMessages(reqData.Messages, reqData.Model) +
+		countFunctionTokens(reqData.Tools, reqData.Functions, reqData.Model)
+}
+
+// TokenizeRequest is a chat request to estimate, or text in input counted
+// like embeddings input.
+type TokenizeRequest struct {
+	ChatRequest
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+type TokenizeResponse struct {
+	Model               string  `json:"model"`
+	Encoding            string  `json:"encoding"`
+	PromptTokens        int     `json:"prompt_tokens"`
+	MaxCompletionTokens int     `json:"max_completion_tokens"`
+	EstimatedCostUSD    float64 `json:"estimated_cost_usd"`
+}
+
+// tokenize returns the estimate the proxy reserves for a request, without
+// sending it. It calls nothing upstream, so no API key is needed.
+func tokenize(c *gin.Context) {
+	var reqData TokenizeRequest
+	if err := c.ShouldBindJSON(&reqData); err != nil || reqData.Model == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: "Missing JSON data in request.",
+		})
+		return
+	}
+
+	promptTokens := 0
+	if len(reqData.Input) > 0 {
+		var err error
+		if promptTokens, err = countEmbeddingInputTokens(reqData.Input, reqData.Model); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{
+				Error: fmt.Sprintf("Invalid input: %v.", err),
+			})
+			return
+		}
+	} else {
+		promptTokens = countChatTokens(reqData.ChatRequest)
+	}
+	completionTokens := maxCompletionTokens(reqData.ChatRequest)
+
+	c.JSON(http.StatusOK, TokenizeResponse{
+		Model:               reqData.Model,
+		Encoding:            encodingName(reqData.Model),
+		PromptTokens:        promptTokens,
+		MaxCompletionTokens: completionTokens,
+		EstimatedCostUSD:    calculateCostForTier(promptTokens, completionTokens, reqData.Model, reqData.ServiceTier),
+	})
+}
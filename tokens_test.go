@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// byteBpeLoader ranks the 256 single bytes, so every byte is a token, and
+// counts the loads.
+type byteBpeLoader struct {
+	mu    sync.Mutex
+	loads int
+	err   error
+}
+
+func (l *byteBpeLoader) LoadTiktokenBpe(string) (map[string]int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loads++
+	if l.err != nil {
+		return nil, l.err
+	}
+	ranks := make(map[string]int, 256)
+	for i := 0; i < 256; i++ {
+		ranks[string([]byte{byte(i)})] = i
+	}
+	return ranks, nil
+}
+
+// withBpeLoader replaces the loader and starts with no cached encoders for the
+// rest of the test.
+func withBpeLoader(t *testing.T, loader tiktoken.BpeLoader) {
+	t.Helper()
+	previousLoader, previousEncoders := bpeLoader, encoders
+	bpeLoader, encoders = loader, make(map[string]cachedEncoder)
+	t.Cleanup(func() {
+		bpeLoader, encoders = previousLoader, previousEncoders
+	})
+}
+
+func TestEncodingName(t *testing.T) {
+	for model, expected := range map[string]string{
+		"gpt-4o-mini-2024-07-18": "o200k_base",
+		"gpt-4.1":                "o200k_base",
+		"o3-mini":                "o200k_base",
+		"gpt-4":                  "cl100k_base",
+		"gpt-4-0613":             "cl100k_base",
+		"gpt-3.5-turbo":          "cl100k_base",
+		"text-davinci-003":       "p50k_base",
+		"unknown-model":          "cl100k_base",
+	} {
+		if name := encodingName(model); name != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, model, name)
+		}
+	}
+}
+
+func TestBundledBpeLoader(t *testing.T) {
+	previous := encodingsDir
+	encodingsDir = t.TempDir()
+	defer func() { encodingsDir = previous }()
+
+	content := fmt.Sprintf("%s 0\n%s 1\n", base64.StdEncoding.EncodeToString([]byte("a")), base64.StdEncoding.EncodeToString([]byte("ab")))
+	os.WriteFile(filepath.Join(encodingsDir, "cl100k_base.tiktoken"), []byte(content), 0o644)
+	ranks, err := bundledBpeLoader{}.LoadTiktokenBpe(encodingsURL + "cl100k_base.tiktoken")
+	if err != nil || len(ranks) != 2 || ranks["ab"] != 1 {
+		t.Errorf("Unexpected ranks %v (%v)", ranks, err)
+	}
+
+	// Files are never downloaded
+	if _, err := (bundledBpeLoader{}).LoadTiktokenBpe(encodingsURL + "o200k_base.tiktoken"); err == nil {
+		t.Error("Expected error for missing rank file")
+	}
+
+	// Without a directory the files are read from the binary
+	encodingsDir = ""
+	if _, err := (bundledBpeLoader{}).LoadTiktokenBpe(encodingsURL + "x50k_base.tiktoken"); err == nil || !strings.Contains(err.Error(), "make encodings") {
+		t.Errorf("Expected error for a file not bundled, got %v", err)
+	}
+	if _, err := parseBpeRanks([]byte("YQ== one\n")); err == nil {
+		t.Error("Expected error for invalid rank")
+	}
+}
+
+func TestEncoderFor_Cached(t *testing.T) {
+	loader := &byteBpeLoader{}
+	withBpeLoader(t, loader)
+
+	first, err := encoderFor(o200kBase)
+	second, _ := encoderFor(o200kBase)
+	if err != nil || first != second || loader.loads != 1 {
+		t.Errorf("Expected one shared encoder, got %d loads (%v)", loader.loads, err)
+	}
+	if tokens := countTokens("hello", "gpt-4o"); tokens != 5 {
+		t.Errorf("Expected 5 tokens, got %d", tokens)
+	}
+}
+
+func TestCountTokens_MissingEncodings(t *testing.T) {
+	loader := &byteBpeLoader{err: errors.New("no such file")}
+	withBpeLoader(t, loader)
+
+	// Without rank files text is counted at about 4 bytes per token
+	if tokens := countTokens("twelve bytes", "gpt-4o"); tokens != 3 {
+		t.Errorf("Expected 3 approximate tokens, got %d", tokens)
+	}
+	// Failures are cached: o200k_base and the cl100k_base fallback are tried once
+	countTokens("again", "gpt-4o")
+	if loader.loads != 2 {
+		t.Errorf("Expected 2 load attempts, got %d", loader.loads)
+	}
+}
+
+func TestLoadEncoders(t *testing.T) {
+	withBpeLoader(t, &byteBpeLoader{})
+	if err := loadEncoders(); err != nil {
+		t.Errorf("Expected every encoding to load, got %v", err)
+	}
+
+	// Every encoding that cannot be loaded is reported
+	withBpeLoader(t, &byteBpeLoader{err: errors.New("no such file")})
+	if err := loadEncoders(); err == nil || strings.Count(err.Error(), "no such file") != len(encodingSpecs) {
+		t.Errorf("Expected an error for each missing rank file, got %v", err)
+	}
+}
+
+// withBundledEncodings loads the rank files embedded in the binary, which
+// make build and make test fetch first (make encodings), and fails the test
+// without them.
+func withBundledEncodings(t *testing.T) {
+	t.Helper()
+	withBpeLoader(t, bundledBpeLoader{})
+	previous := encodingsDir
+	encodingsDir = ""
+	t.Cleanup(func() { encodingsDir = previous })
+
+	if err := loadEncoders(); err != nil {
+		t.Fatalf("Rank files are not embedded: %v", err)
+	}
+}
+
+func TestBundledEncodings(t *testing.T) {
+	withBundledEncodings(t)
+	for _, model := range []string{"gpt-4o", "gpt-4", "text-davinci-003", "davinci"} {
+		if tokens := countTokens("hello world", model); tokens != 2 {
+			t.Errorf("Expected 2 tokens for %s, got %d", model, tokens)
+		}
+	}
+}
+
+func TestChatFormatFor(t *testing.T) {
+	for model, expected := range map[string]int{
+		"gpt-3.5-turbo-0301": 10,
+		"gpt-3.5-turbo-0613": 10,
+		"gpt-4-0613":         10,
+		"gpt-4o-2024-08-06":  7,
+		"gpt-4.1-mini":       7,
+		"o1":                 7,
+		"unknown-model":      7,
+	} {
+		if format := chatFormatFor(model); format.functionInit != expected {
+			t.Errorf("Expected function init %d for %s, got %d", expected, model, format.functionInit)
+		}
+	}
+	if format := chatFormatFor("gpt-3.5-turbo-0301"); format.tokensPerMessage != 4 || format.tokensPerName != -1 {
+		t.Errorf("Unexpected format for gpt-3.5-turbo-0301: %+v", format)
+	}
+}
+
+func TestCalculateTokensFromMessages_Names(t *testing.T) {
+	messages := []ChatMessage{{Role: "system", Name: "example_user", Content: "Hello"}}
+	text := countTokens("system", "gpt-4") + countTokens("Hello", "gpt-4") + countTokens("example_user", "gpt-4")
+
+	// Each message is wrapped and the reply is primed with 3 tokens
+	if tokens := calculateTokensFromMessages(messages, "gpt-4"); tokens != text+3+1+3 {
+		t.Errorf("Expected %d tokens, got %d", text+3+1+3, tokens)
+	}
+	// gpt-3.5-turbo-0301 wraps messages in 4 tokens and a name replaces the role
+	if tokens := calculateTokensFromMessages(messages, "gpt-3.5-turbo-0301"); tokens != text+4-1+3 {
+		t.Errorf("Expected %d tokens, got %d", text+4-1+3, tokens)
+	}
+}
+
+func TestCountFunctionTokens(t *testing.T) {
+	var tools interface{}
+	json.Unmarshal([]byte(`[{"type":"function","function":{"name":"lookup","description":"Find a word.",
+		"parameters":{"type":"object","properties":{"mode":{"type":"string","description":"How","enum":["exact","fuzzy"]}}}}}]`), &tools)
+
+	count := func(text string) int { return countTokens(text, "gpt-4o") }
+	expected := 7 + count("lookup:Find a word") + // trailing period is dropped
+		3 + 3 + count("mode:string:How") +
+		-3 + 3 + count("exact") + 3 + count("fuzzy") +
+		12
+	if tokens := countFunctionTokens(tools, nil, "gpt-4o"); tokens != expected {
+		t.Errorf("Expected %d tokens, got %d", expected, tokens)
+	}
+
+	// Legacy functions are counted the same way
+	var functions interface{}
+	json.Unmarshal([]byte(`[{"name":"lookup","description":"Find a word.",
+		"parameters":{"type":"object","properties":{"mode":{"type":"string","description":"How","enum":["exact","fuzzy"]}}}}]`), &functions)
+	if tokens := countFunctionTokens(nil, functions, "gpt-4o"); tokens != expected {
+		t.Errorf("Expected %d tokens for functions, got %d", expected, tokens)
+	}
+
+	if tokens := countFunctionTokens(nil, nil, "gpt-4o"); tokens != 0 {
+		t.Errorf("Expected no tokens without tools, got %d", tokens)
+	}
+}
+
+// TestTokenCalibration checks the estimates against prompt_tokens reported by
+// OpenAI for the same requests, counted with the embedded rank files.
+func TestTokenCalibration(t *testing.T) {
+	withBundledEncodings(t)
+
+	data, err := os.ReadFile("testdata/token_calibration.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []struct {
+		Name         string         `json:"name"`
+		Request      ChatRequest    `json:"request"`
+		PromptTokens map[string]int `json:"prompt_tokens"`
+	}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fixture := range fixtures {
+		for model, expected := range fixture.PromptTokens {
+			request := fixture.Request
+			request.Model = model
+			if tokens := countChatTokens(request); tokens != expected {
+				t.Errorf("%s with %s: expected %d prompt tokens, got %d", fixture.Name, model, expected, tokens)
+			}
+		}
+	}
+}
+
+func postTokenize(router http.Handler, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/tokenize", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestTokenize(t *testing.T) {
+	resetGlobalState()
+	router := setupTestRouter()
+
+	w := postTokenize(router, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}],"max_tokens":100,"n":2}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response TokenizeResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	promptTokens := calculateTokensFromMessages([]ChatMessage{{Role: "user", Content: "Hello"}}, "gpt-4o")
+	if response.Encoding != "o200k_base" || response.PromptTokens != promptTokens || response.MaxCompletionTokens != 200 {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+	if expected := calculateCost(promptTokens, 200, "gpt-4o"); math.Abs(response.EstimatedCostUSD-expected) > 1e-12 {
+		t.Errorf("Expected cost %f, got %f", expected, response.EstimatedCostUSD)
+	}
+
+	// Text is counted like embeddings input
+	w = postTokenize(router, `{"model":"text-embedding-3-small","input":["a","b"]}`)
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || response.PromptTokens != 2 || response.MaxCompletionTokens != 0 {
+		t.Errorf("Unexpected response for input: %s", w.Body.String())
+	}
+
+	for _, body := range []string{`{"messages":[]}`, `not json`, `{"model":"gpt-4o","input":{}}`} {
+		if w = postTokenize(router, body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %s, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Budget thresholds are soft limits: when spend first reaches a percentage of
+// the global quota or of a key's budget, a JSON notification is posted to the
+// configured webhook. Requests are not affected.
+var (
+	webhookURL       string
+	budgetThresholds []float64 // percentages, ascending
+)
+
+var defaultBudgetThresholds = []float64{50, 80, 95}
+
+// Delivery is retried with exponential backoff on errors and non-2xx responses.
+var (
+	webhookAttempts   = 4
+	webhookRetryDelay = time.Second
+	webhookClient     = &http.Client{Timeout: 10 * time.Second}
+)
+
+// BudgetNotification is the payload posted when spend reaches a threshold.
+type BudgetNotification struct {
+	ID               string    `json:"id"` // the same for every delivery attempt
+	Event            string    `json:"event"`
+	Time             time.Time `json:"time"`
+	Budget           string    `json:"budget"` // "global" or "key"
+	KeyID            string    `json:"key_id,omitempty"`
+	KeyName          string    `json:"key_name,omitempty"`
+	BudgetUSD        float64   `json:"budget_usd"`
+	SpentUSD         float64   `json:"spent_usd"`
+	ThresholdPercent float64   `json:"threshold_percent"`
+	PeriodStart      time.Time `json:"period_start"`
+}
+
+// Notification state by budget, "global" or "key:<id>", guarded by mu. A
+// threshold is notified once per period; resetting a budget's spend starts a
+// new one.
+var (
+	notifiedThresholds = make(map[string]map[float64]bool)
+	budgetPeriods      = map[string]time.Time{"global": time.Now().UTC()}
+)
+
+// budgetPeriod returns when the current period of a budget started: its last
+// reset, or else when the key was created or the proxy started. Must hold mu.
+func budgetPeriod(budget string, created time.Time) time.Time {
+	if start, ok := budgetPeriods[budget]; ok {
+		return start
+	}
+	return created.UTC()
+}
+
+// startBudgetPeriod forgets the thresholds notified for a budget whose spend
+// was reset. Must hold mu.
+func startBudgetPeriod(budget string, start time.Time) {
+	budgetPeriods[budget] = start.UTC()
+	delete(notifiedThresholds, budget)
+}
+
+// reachedThresholds returns the thresholds spend has reached and that have not
+// been notified in the current period, and marks them notified. Must hold mu.
+func reachedThresholds(budget string, spent, limit float64) []float64 {
+	if limit <= 0 {
+		return nil
+	}
+	var reached []float64
+	for _, threshold := range budgetThresholds {
+		if spent < limit*threshold/100 || notifiedThresholds[budget][threshold] {
+			continue
+		}
+		if notifiedThresholds[budget] == nil {
+			notifiedThresholds[budget] = make(map[float64]bool)
+		}
+		notifiedThresholds[budget][threshold] = true
+		reached = append(reached, threshold)
+	}
+	return reached
+}
+
+// budgetNotificationsDue returns the notifications due after a reservation was
+// settled. Must hold mu.
+func budgetNotificationsDue(r *Reservation) []BudgetNotification {
+	if webhookURL == "" {
+		return nil
+	}
+	now := time.Now().UTC()
+	var due []BudgetNotification
+	notify := func(n BudgetNotification, budget string, created time.Time) {
+		n.Event = "budget.threshold"
+		n.Time = now
+		n.PeriodStart = budgetPeriod(budget, created)
+		for _, threshold := range reachedThresholds(budget, n.SpentUSD, n.BudgetUSD) {
+			n.ThresholdPercent = threshold
+			n.ID = fmt.Sprintf("%s:%s:%s", budget, formatThreshold(threshold), n.PeriodStart.Format(time.RFC3339Nano))
+			due = append(due, n)
+		}
+	}
+	notify(BudgetNotification{Budget: "global", BudgetUSD: costLimitUSD, SpentUSD: totalCost}, "global", time.Time{})
+	if r.KeyID != "" && r.keyBudget > 0 {
+		notify(BudgetNotification{
+			Budget:    "key",
+			KeyID:     r.KeyID,
+			KeyName:   r.keyName,
+			BudgetUSD: r.keyBudget,
+			SpentUSD:  keySpend[r.KeyID],
+		}, "key:"+r.KeyID, r.keyCreated)
+	}
+	return due
+}
+
+// armBudgetNotifications marks the thresholds spend restored at startup has
+// already reached as notified, so restarting does not repeat them. Must hold mu.
+func armBudgetNotifications(keys []ProxyKey) {
+	for _, k := range keys {
+		if !k.Revoked() && k.BudgetUSD > 0 {
+			reachedThresholds("key:"+k.ID, keySpend[k.ID], k.BudgetUSD)
+		}
+	}
+}
+
+// sendBudgetNotifications posts notifications in the background.
+func sendBudgetNotifications(notifications []BudgetNotification) {
+	for _, n := range notifications {
+		log.Printf("Budget threshold reached: %s %s spent $%.6f of $%.6f (%s%%)",
+			n.Budget, n.KeyID, n.SpentUSD, n.BudgetUSD, formatThreshold(n.ThresholdPercent))
+		go deliverWebhook(webhookURL, n)
+	}
+}
+
+// deliverWebhook posts a notification, retrying failed attempts. Receivers
+// deduplicate retried deliveries by the notification's ID.
+func deliverWebhook(url string, n BudgetNotification) {
+	body, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("Warning: cannot encode notification %s: %v", n.ID, err)
+		return
+	}
+	delay := webhookRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(url, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Warning: webhook notification %s not delivered after %d attempts: %v", n.ID, attempt, err)
+			return
+		}
+		log.Printf("Webhook notification %s failed (attempt %d), retrying in %s: %v", n.ID, attempt, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhook(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// parseBudgetThresholds parses comma-separated percentages of a budget, e.g.
+// "50,80,95", sorted and without duplicates.
+func parseBudgetThresholds(value string) ([]float64, error) {
+	var thresholds []float64
+	seen := make(map[float64]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(entry), "%"))
+		if entry == "" {
+			continue
+		}
+		threshold, err := strconv.ParseFloat(entry, 64)
+		if err != nil || !(threshold > 0 && threshold <= 100) {
+			return nil, fmt.Errorf("threshold %q must be a percentage above 0 and at most 100", entry)
+		}
+		if !seen[threshold] {
+			seen[threshold] = true
+			thresholds = append(thresholds, threshold)
+		}
+	}
+	sort.Float64s(thresholds)
+	return thresholds, nil
+}
+
+func formatThreshold(threshold float64) string {
+	return strconv.FormatFloat(threshold, 'f', -1, 64)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver stands in for the service receiving notifications. It
+// fails the given number of deliveries first and records the rest.
+type webhookReceiver struct {
+	*httptest.Server
+	mu         sync.Mutex
+	failures   int
+	deliveries int
+	received   chan BudgetNotification
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	receiver := &webhookReceiver{failures: failures, received: make(chan BudgetNotification, 10)}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiver.mu.Lock()
+		receiver.deliveries++
+		fail := receiver.deliveries <= receiver.failures
+		receiver.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var n BudgetNotification
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&n) != nil {
+			t.Errorf("Unexpected notification request")
+		}
+		receiver.received <- n
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+// next waits for the next notification received.
+func (r *webhookReceiver) next(t *testing.T) BudgetNotification {
+	t.Helper()
+	select {
+	case n := <-r.received:
+		return n
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a notification")
+		return BudgetNotification{}
+	}
+}
+
+func resetWebhooks(t *testing.T, url string) {
+	t.Helper()
+	reset := func(url string, delay time.Duration) {
+		webhookURL = url
+		budgetThresholds = defaultBudgetThresholds
+		webhookRetryDelay = delay
+		notifiedThresholds = make(map[string]map[float64]bool)
+		budgetPeriods = map[string]time.Time{"global": time.Now().UTC()}
+	}
+	reset(url, time.Millisecond)
+	t.Cleanup(func() { reset("", time.Second) })
+}
+
+func TestParseBudgetThresholds(t *testing.T) {
+	thresholds, err := parseBudgetThresholds("95, 50%,80,50")
+	if err != nil || len(thresholds) != 3 || thresholds[0] != 50 || thresholds[2] != 95 {
+		t.Errorf("Unexpected thresholds %v: %v", thresholds, err)
+	}
+	for _, value := range []string{"0", "101", "half", "-5"} {
+		if _, err := parseBudgetThresholds(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
+
+func TestBudgetNotifications_Global(t *testing.T) {
+	resetGlobalState()
+	setupTestAdmin(t)
+	receiver := newWebhookReceiver(t, 0)
+	resetWebhooks(t, receiver.URL)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	totalCost = 0.99999
+	postChat(router, "sk-test")
+	n := receiver.next(t)
+	if n.Event != "budget.threshold" || n.Budget != "global" || n.ThresholdPercent != 50 || n.BudgetUSD != 2 || n.SpentUSD < 1 {
+		t.Errorf("Unexpected notification: %+v", n)
+	}
+	firstID := n.ID
+
+	// Each threshold is notified once per period
+	postChat(router, "sk-test")
+	totalCost = 1.9
+	postChat(router, "sk-test")
+	if first, second := receiver.next(t), receiver.next(t); first.ThresholdPercent+second.ThresholdPercent != 175 {
+		t.Errorf("Expected the 80%% and 95%% thresholds, got %v and %v", first.ThresholdPercent, second.ThresholdPercent)
+	}
+	select {
+	case n := <-receiver.received:
+		t.Errorf("Expected no repeated notification, got %+v", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Resetting the spend starts a new period
+	adminRequest(router, "POST", "/admin/budget/reset", "")
+	totalCost = 1.0
+	postChat(router, "sk-test")
+	if n = receiver.next(t); n.ThresholdPercent != 50 || n.ID == firstID || !n.PeriodStart.After(n.Time.Add(-time.Second)) {
+		t.Errorf("Expected a notification for the new period, got %+v", n)
+	}
+}
+
+func TestBudgetNotifications_KeyWithRetry(t *testing.T) {
+	resetGlobalState()
+	store := setupTestKeyStore(t)
+	upstreamAPIKey = "sk-upstream"
+	receiver := newWebhookReceiver(t, 2)
+	resetWebhooks(t, receiver.URL)
+	api := newMockOpenAIRoutes(t)
+	api.set("POST /v1/chat/completions", testChatCompletion)
+	router := setupTestRouter()
+
+	budgetThresholds = []float64{80}
+	secret, key, _ := store.Create("ci", 0.001)
+	mu.Lock()
+	keySpend[key.ID] = 0.0008
+	mu.Unlock()
+	postChat(router, secret)
+
+	// Delivered on the third attempt
+	n := receiver.next(t)
+	if n.Budget != "key" || n.KeyID != key.ID || n.KeyName != "ci" || n.ThresholdPercent != 80 || !n.PeriodStart.Equal(key.CreatedAt) {
+		t.Errorf("Unexpected notification: %+v", n)
+	}
+	if !strings.HasPrefix(n.ID, "key:"+key.ID+":80:") {
+		t.Errorf("Unexpected notification ID %q", n.ID)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.deliveries != 3 {
+		t.Errorf("Expected 3 delivery attempts, got %d", receiver.deliveries)
+	}
+}
+
+func TestArmBudgetNotifications(t *testing.T) {
+	resetWebhooks(t, "http://localhost/hook")
+	mu.Lock()
+	defer mu.Unlock()
+	keySpend["restored"] = 0.9
+	t.Cleanup(func() { delete(keySpend, "restored") })
+
+	armBudgetNotifications([]ProxyKey{{ID: "restored", BudgetUSD: 1}})
+	if reached := reachedThresholds("key:restored", 0.96, 1); len(reached) != 1 || reached[0] != 95 {
+		t.Errorf("Expected only the 95%% threshold to be due after a restart, got %v", reached)
+	}
+}